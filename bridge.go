@@ -0,0 +1,146 @@
+package main
+
+/*
+ * bridge.go
+ * Relay join and leave notices to a second mesh
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* bridgeMsgPrefix starts the user messages we send to the bridged mesh, to
+tell them apart from anything else which might turn up someday. */
+const bridgeMsgPrefix = "meshmembers-bridge\x00"
+
+/* bridgeableEvents are the kinds of events which may be forwarded to the
+bridged mesh.  Notices, including the ones we get from the bridged mesh, are
+never forwarded, which prevents loops between bridges. */
+const bridgeableEvents = eventJoin | eventUpdate | eventLeave
+
+var (
+	/* bridge is our node in the bridged mesh, or nil if we're not
+	bridging. */
+	bridge  *memberlist.Memberlist
+	bridgeL sync.Mutex
+
+	/* bridgeEvents are the kinds of events forwarded to the bridged
+	mesh. */
+	bridgeEvents = eventMask(eventJoin | eventLeave)
+)
+
+// StartBridge joins a second mesh, via the peers in the comma-separated list
+// peers, to which join and leave notices from our own mesh will be forwarded.
+// Nodes from the second mesh aren't added to our mesh or vice-versa; the
+// second mesh only gets informational notices.  The bridge node's name is
+// name with -bridge appended.
+func StartBridge(
+	newConfig func() *memberlist.Config,
+	name string,
+	listen string,
+	secret string,
+	label string,
+	peers string,
+	debug bool,
+) error {
+	b, err := newSideMesh(
+		newConfig,
+		name+"-bridge",
+		"bridge",
+		listen,
+		secret,
+		label,
+		debug,
+	)
+	if nil != err {
+		return fmt.Errorf("creating bridge node: %w", err)
+	}
+	log.Printf("Bridge node: %s", FormatNode(b.LocalNode()))
+
+	/* Join the other mesh */
+	n, err := connectToPeers(b, peers)
+	if nil != err {
+		b.Shutdown()
+		return fmt.Errorf("joining bridged mesh: %w", err)
+	}
+	log.Printf("Bridged to mesh with %d initial peers", n)
+
+	bridgeL.Lock()
+	defer bridgeL.Unlock()
+	bridge = b
+	return nil
+}
+
+/* forwardToBridge sends the message made from f and a to every node in the
+bridged mesh, if we have one and events of kind k are to be forwarded. */
+func forwardToBridge(k eventKind, f string, a ...interface{}) {
+	if 0 == k&bridgeableEvents || !bridgeEvents.Has(k) {
+		return
+	}
+	bridgeL.Lock()
+	b := bridge
+	bridgeL.Unlock()
+	if nil == b {
+		return
+	}
+
+	msg := []byte(
+		bridgeMsgPrefix + b.LocalNode().Name + "\x00" +
+			fmt.Sprintf(f, a...),
+	)
+	for _, n := range b.Members() {
+		if n.Name == b.LocalNode().Name {
+			continue
+		}
+		go sendToBridged(b, n, msg)
+	}
+}
+
+/* sendToBridged sends msg to n in the bridged mesh via b. */
+func sendToBridged(b *memberlist.Memberlist, n *memberlist.Node, msg []byte) {
+	if err := b.SendReliable(n, msg); nil != err {
+		log.Printf(
+			"Error forwarding to bridged node %s: %v",
+			n.Name,
+			err,
+		)
+	}
+}
+
+/* handleBridgeMsg tells clients about a notice forwarded from another mesh by
+a bridge.  Anything which doesn't look like a forwarded notice is ignored. */
+func handleBridgeMsg(b []byte) {
+	s, ok := strings.CutPrefix(string(b), bridgeMsgPrefix)
+	if !ok {
+		return
+	}
+	from, msg, ok := strings.Cut(s, "\x00")
+	if !ok || strings.ContainsAny(msg, "\r\n\x00") {
+		return
+	}
+	broadcastAndLogf(eventNotice, nil, "[Bridged via %s] %s", from, msg)
+}
+
+/* leaveBridge gracefully leaves the bridged mesh, if we're in one. */
+func leaveBridge() {
+	bridgeL.Lock()
+	defer bridgeL.Unlock()
+	if nil == bridge {
+		return
+	}
+	if err := bridge.Leave(leaveTimeout); nil != err {
+		log.Printf("Error leaving bridged mesh: %v", err)
+	}
+	if err := bridge.Shutdown(); nil != err {
+		log.Printf("Error shutting down bridge listeners: %v", err)
+	}
+	bridge = nil
+}
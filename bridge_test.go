@@ -0,0 +1,75 @@
+package main
+
+/*
+ * bridge_test.go
+ * Tests for bridge.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestBridge makes sure join and leave notices are forwarded to the bridged
+mesh, but notices aren't, and that the meshes don't merge. */
+func TestBridge(t *testing.T) {
+	ours := newTestMesh(t, nil, "a1", "a2")
+	mn := new(memberlist.MockNetwork)
+	theirs := newTestMeshOn(t, mn, nil, "b1", "b2")
+	tc := newTestClient(t, ours[0], false)
+
+	if err := StartBridge(
+		func() *memberlist.Config {
+			conf := memberlist.DefaultLocalConfig()
+			conf.Transport = mn.NewTransport("a1-bridge")
+			return conf
+		},
+		"a1",
+		"127.0.0.1:0",
+		"test-secret",
+		"",
+		theirs[0].LocalNode().Address(),
+		false,
+	); nil != err {
+		t.Fatalf("Starting bridge: %v", err)
+	}
+	t.Cleanup(leaveBridge)
+	waitFor(t, "bridge to join", func() bool {
+		for _, m := range theirs {
+			if 3 != m.NumMembers() {
+				return false
+			}
+		}
+		return true
+	})
+
+	/* Notices stay here, joins go there, too */
+	broadcastAndLogf(eventNotice, nil, "[Notice] stays")
+	broadcastAndLogf(eventJoin, nil, "[Join] kittens")
+	want := []string{
+		/* Both of the other mesh's nodes tell us */
+		"[Bridged via a1-bridge] [Join] kittens",
+		"[Bridged via a1-bridge] [Join] kittens",
+		"[Join] kittens",
+		"[Notice] stays",
+	}
+	if got := sortedLines(tc, len(want)); !slices.Equal(want, got) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+	Broadcastf("done")
+	if l := tc.readLine(); "done" != l {
+		t.Fatalf("Got extra message %q", l)
+	}
+
+	/* The meshes stay apart */
+	for _, m := range ours {
+		if n := m.NumMembers(); 2 != n {
+			t.Fatalf("%s sees %d members", m.LocalNode().Name, n)
+		}
+	}
+}
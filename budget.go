@@ -0,0 +1,160 @@
+package main
+
+/*
+ * budget.go
+ * Limit the memory used by events waiting to be sent to clients
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+var (
+	/* clientMemBudget is the most bytes of events which may be waiting
+	to be sent to all clients put together, or 0 for no limit. */
+	clientMemBudget int64
+
+	/* clientMemDisconnect is set if the client with the most waiting
+	bytes is disconnected when the budget's exceeded, rather than events
+	being dropped. */
+	clientMemDisconnect bool
+
+	/* clientMemUsed is the number of bytes of events waiting to be sent
+	to clients. */
+	clientMemUsed atomic.Int64
+
+	/* clientMemOver is set once we've logged that the budget's been
+	exceeded, and cleared when usage falls back below half the budget,
+	so we don't log for every event. */
+	clientMemOver atomic.Bool
+)
+
+/* reserveClientMem counts n bytes about to be sent to l against the budget.
+If there's not enough room, it drops the oldest events queued for the client
+with the most queued or disconnects the client with the most waiting bytes,
+according to clientMemDisconnect.  It returns false if the event shouldn't be
+sent to l, because there's still not enough room or l's been disconnected.
+This must be called with clientsL held. */
+func reserveClientMem(l *localClient, n int) bool {
+	if l.memEvicted {
+		return false
+	}
+	if 0 == clientMemBudget || clientMemFits(n) {
+		l.buffered.Add(int64(n))
+		clientMemUsed.Add(int64(n))
+		return true
+	}
+	if clientMemOver.CompareAndSwap(false, true) {
+		what := "dropping events"
+		if clientMemDisconnect {
+			what = "disconnecting slow clients"
+		}
+		log.Printf(
+			"Over client memory budget of %d bytes, %s",
+			clientMemBudget,
+			what,
+		)
+	}
+
+	/* Make room, if the event can fit at all */
+	if int64(n) > clientMemBudget {
+		return false
+	}
+	if clientMemDisconnect {
+		evictSlowestClient(l)
+	} else {
+		dropOldestEvents(l, n)
+	}
+	if l.memEvicted || !clientMemFits(n) {
+		return false
+	}
+	l.buffered.Add(int64(n))
+	clientMemUsed.Add(int64(n))
+	return true
+}
+
+/* clientMemFits returns true if n more bytes fit in the budget. */
+func clientMemFits(n int) bool {
+	return clientMemUsed.Load()+int64(n) <= clientMemBudget
+}
+
+/* slowestClient returns whichever of l and the clients in the list has the
+most bytes waiting, leaving out clients being disconnected and, if queued is
+true, clients with no events queued.  It returns nil if there's no such
+client.  It must be called with clientsL held. */
+func slowestClient(l *localClient, queued bool) *localClient {
+	var slowest *localClient
+	for _, c := range append([]*localClient{l}, clients...) {
+		if nil == c || nil == c.queue || c.memEvicted ||
+			(queued && 0 == len(c.queue)) {
+			continue
+		}
+		if nil == slowest ||
+			slowest.buffered.Load() < c.buffered.Load() {
+			slowest = c
+		}
+	}
+	return slowest
+}
+
+/* evictSlowestClient disconnects the client with the most bytes waiting, which
+may be l, and gives its bytes back to the budget.  It must be called with
+clientsL held. */
+func evictSlowestClient(l *localClient) {
+	slowest := slowestClient(l, false)
+	if nil == slowest || 0 == slowest.buffered.Load() {
+		return
+	}
+	slowest.memEvicted = true
+	freed := slowest.buffered.Swap(0)
+	giveBackClientMem(freed)
+	log.Printf(
+		"[%s] Disconnecting to free %d bytes of client memory",
+		slowest.tag,
+		freed,
+	)
+	slowest.c.Close()
+}
+
+/* dropOldestEvents drops the oldest events queued for whichever of l and the
+other clients has the most bytes waiting, until there's room for n more bytes
+or nothing left queued.  It must be called with clientsL held. */
+func dropOldestEvents(l *localClient, n int) {
+	for !clientMemFits(n) {
+		slowest := slowestClient(l, true)
+		if nil == slowest {
+			return
+		}
+		select {
+		case old := <-slowest.queue:
+			releaseClientMem(slowest, len(old.msg))
+		default:
+			/* Its writer got there first */
+		}
+	}
+}
+
+/* releaseClientMem gives back n bytes reserved with reserveClientMem, once
+they've been sent to l or dropped.  Bytes given back when l was disconnected
+by evictSlowestClient aren't given back again. */
+func releaseClientMem(l *localClient, n int) {
+	for {
+		b := l.buffered.Load()
+		r := min(int64(n), b)
+		if l.buffered.CompareAndSwap(b, b-r) {
+			giveBackClientMem(r)
+			return
+		}
+	}
+}
+
+/* giveBackClientMem gives back n bytes to the budget */
+func giveBackClientMem(n int64) {
+	if clientMemUsed.Add(-n) < clientMemBudget/2 {
+		clientMemOver.Store(false)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+/*
+ * budget_test.go
+ * Tests for budget.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+/* setClientMemBudget sets the client memory budget and eviction policy until
+t is finished. */
+func setClientMemBudget(t *testing.T, budget int64, disconnect bool) {
+	clientMemBudget, clientMemDisconnect = budget, disconnect
+	clientMemUsed.Store(0)
+	clientMemOver.Store(false)
+	t.Cleanup(func() {
+		clientMemBudget, clientMemDisconnect = 0, false
+		clientMemUsed.Store(0)
+		clientMemOver.Store(false)
+	})
+}
+
+/* budgetEvent reserves room for an n-byte event for l and queues it if
+there's room, as broadcastEvent would.  It returns whether the event was
+queued. */
+func budgetEvent(l *localClient, n int) bool {
+	clientsL.Lock()
+	defer clientsL.Unlock()
+	if !reserveClientMem(l, n) {
+		return false
+	}
+	l.queue <- &clientEvent{msg: make([]byte, n)}
+	return true
+}
+
+/* TestClientMemBudgetDrop makes sure going over -client-mem-budget drops a
+client's oldest events. */
+func TestClientMemBudgetDrop(t *testing.T) {
+	setClientMemBudget(t, 10, false)
+	sb := captureLog(t)
+	l := &localClient{tag: "budget", queue: make(chan *clientEvent, 10)}
+
+	for i := range 3 {
+		if !budgetEvent(l, 4) {
+			t.Fatalf("Event %d not queued", i)
+		}
+	}
+	if n := len(l.queue); 2 != n {
+		t.Fatalf("%d events queued, expected 2", n)
+	}
+	if n := clientMemUsed.Load(); 8 != n {
+		t.Fatalf("Using %d bytes, expected 8", n)
+	}
+	if n := l.buffered.Load(); 8 != n {
+		t.Fatalf("Client has %d bytes buffered, expected 8", n)
+	}
+	want := "Over client memory budget of 10 bytes, dropping events"
+	if s := sb.String(); 1 != strings.Count(s, want) {
+		t.Fatalf("Log has %q", s)
+	}
+
+	/* Too big even once the queue's empty */
+	if budgetEvent(l, 11) {
+		t.Fatalf("Queued event bigger than the budget")
+	}
+
+	/* Sending everything frees it all up */
+	for 0 != len(l.queue) {
+		releaseClientMem(l, len((<-l.queue).msg))
+	}
+	if n := clientMemUsed.Load(); 0 != n {
+		t.Fatalf("Using %d bytes after sending everything", n)
+	}
+	if clientMemOver.Load() {
+		t.Fatalf("Still over budget after sending everything")
+	}
+}
+
+/* TestClientMemBudgetDropSlowest makes sure going over -client-mem-budget
+drops the oldest events of the client with the most waiting, not just the
+client getting the new event. */
+func TestClientMemBudgetDropSlowest(t *testing.T) {
+	setClientMemBudget(t, 10, false)
+	captureLog(t)
+	var (
+		slow = &localClient{
+			tag:   "slow",
+			queue: make(chan *clientEvent, 10),
+		}
+		fast = &localClient{
+			tag:   "fast",
+			queue: make(chan *clientEvent, 10),
+		}
+	)
+	putBudgetClients(t, slow)
+
+	for i := range 3 {
+		if !budgetEvent(slow, 3) {
+			t.Fatalf("Slow client's event %d not queued", i)
+		}
+	}
+	if !budgetEvent(fast, 1) {
+		t.Fatalf("Fast client's event not queued")
+	}
+
+	/* Going over drops the slow client's oldest events */
+	if !budgetEvent(fast, 4) {
+		t.Fatalf("Fast client's event not queued over budget")
+	}
+	if n := len(slow.queue); 1 != n {
+		t.Fatalf("Slow client has %d events queued, expected 1", n)
+	}
+	if n := len(fast.queue); 2 != n {
+		t.Fatalf("Fast client has %d events queued, expected 2", n)
+	}
+	if n := clientMemUsed.Load(); 8 != n {
+		t.Fatalf("Using %d bytes, expected 8", n)
+	}
+}
+
+/* putBudgetClients puts cs in the list of clients until t is finished, for
+finding the slowest. */
+func putBudgetClients(t *testing.T, cs ...*localClient) {
+	var slots []int
+	clientsL.Lock()
+	for i, c := range clients {
+		if len(slots) == len(cs) {
+			break
+		}
+		if nil == c {
+			clients[i] = cs[len(slots)]
+			slots = append(slots, i)
+		}
+	}
+	clientsL.Unlock()
+	t.Cleanup(func() {
+		clientsL.Lock()
+		defer clientsL.Unlock()
+		for _, i := range slots {
+			clients[i] = nil
+		}
+	})
+}
+
+/* TestClientMemBudgetDisconnect makes sure going over -client-mem-budget
+with -client-mem-policy disconnect disconnects the slowest client. */
+func TestClientMemBudgetDisconnect(t *testing.T) {
+	setClientMemBudget(t, 10, true)
+	sb := captureLog(t)
+	var (
+		slowC = new(fakeConn)
+		fastC = new(fakeConn)
+		slow  = &localClient{
+			tag:   "slow",
+			c:     slowC,
+			queue: make(chan *clientEvent, 10),
+		}
+		fast = &localClient{
+			tag:   "fast",
+			c:     fastC,
+			queue: make(chan *clientEvent, 10),
+		}
+	)
+
+	putBudgetClients(t, slow, fast)
+
+	for i := range 2 {
+		if !budgetEvent(slow, 4) {
+			t.Fatalf("Slow client's event %d not queued", i)
+		}
+	}
+	if !budgetEvent(fast, 2) {
+		t.Fatalf("Fast client's event not queued")
+	}
+	if slowC.closed.Load() || fastC.closed.Load() {
+		t.Fatalf("Client disconnected under budget")
+	}
+
+	/* Going over kicks off the slow client, but not the fast one */
+	if !budgetEvent(fast, 2) {
+		t.Fatalf("Fast client's event not queued over budget")
+	}
+	if !slowC.closed.Load() {
+		t.Fatalf("Slow client not disconnected")
+	}
+	if fastC.closed.Load() {
+		t.Fatalf("Fast client disconnected")
+	}
+	for _, want := range []string{
+		"Over client memory budget of 10 bytes, disconnecting slow " +
+			"clients",
+		"[slow] Disconnecting to free 8 bytes of client memory",
+	} {
+		if s := sb.String(); !strings.Contains(s, want) {
+			t.Fatalf("Log missing %q: %q", want, s)
+		}
+	}
+
+	if n := clientMemUsed.Load(); 4 != n {
+		t.Fatalf("Using %d bytes after disconnect, expected 4", n)
+	}
+
+	/* A disconnected client doesn't get any more, and its bytes aren't
+	given back twice. */
+	if budgetEvent(slow, 4) {
+		t.Fatalf("Disconnected slow client's event queued")
+	}
+	for 0 != len(slow.queue) {
+		releaseClientMem(slow, len((<-slow.queue).msg))
+	}
+	if n := clientMemUsed.Load(); 4 != n {
+		t.Fatalf("Using %d bytes after slow client's writes, "+
+			"expected 4", n)
+	}
+
+	/* If disconnecting doesn't make enough room, the event's dropped, and
+	the disconnected slow client isn't disconnected again. */
+	other := &localClient{
+		tag:   "other",
+		c:     new(fakeConn),
+		queue: make(chan *clientEvent, 10),
+	}
+	putBudgetClients(t, other)
+	if !budgetEvent(other, 3) {
+		t.Fatalf("Other client's event not queued")
+	}
+	if budgetEvent(other, 9) {
+		t.Fatalf("Event queued without enough room")
+	}
+	if !fastC.closed.Load() {
+		t.Fatalf("Fast client not disconnected")
+	}
+	if n := clientMemUsed.Load(); 3 != n {
+		t.Fatalf("Using %d bytes after second disconnect, "+
+			"expected 3", n)
+	}
+	s := sb.String()
+	if n := strings.Count(s, "Disconnecting to free"); 2 != n {
+		t.Fatalf("Disconnected %d times, expected 2: %q", n, s)
+	}
+	want := "[fast] Disconnecting to free 4 bytes of client memory"
+	if !strings.Contains(s, want) {
+		t.Fatalf("Log missing %q: %q", want, s)
+	}
+}
@@ -5,19 +5,26 @@ package main
  * Handle local clients
  * By J. Stuart McMurray
  * Created 20200417
- * Last Modified 20200418
+ * Last Modified 20261014
  */
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -31,15 +38,192 @@ const (
 	non-disconnectworthy read error */
 	readWait = time.Second
 
+	/* readDeadline is how long a read from a client may block before
+	it's retried with a new deadline */
+	readDeadline = time.Minute
+
 	/* maxClients is the maximum number of simultaneous clients we allow,
 	though nofiles ulimit might be lower. */
 	maxClients = 1024
+
+	/* defaultMaxCommandSize is the default maximum length of a command
+	line from a client */
+	defaultMaxCommandSize = 4096
+
+	/* defaultSnapshotTimeout is the default amount of time we'll spend
+	trying to send a client the initial member list */
+	defaultSnapshotTimeout = 10 * time.Second
+
+	/* snapshotRetryWait is the initial wait after a temporary error
+	sending the initial member list.  It doubles after each error. */
+	snapshotRetryWait = 10 * time.Millisecond
+
+	/* defaultProtoVersion is the protocol version clients get if they
+	don't ask for another with PROTO, and maxProtoVersion is the newest
+	we speak. */
+	defaultProtoVersion = 1
+	maxProtoVersion     = 1
+
+	/* defaultFullMessage is what we tell clients when there's too many
+	clients by default */
+	defaultFullMessage = "Too many connected clients, sorry"
+
+	/* fullQueueWait is how long a client will wait for room in the list
+	of clients with -full-policy queue, and fullRetryWait is how often
+	it checks */
+	fullQueueWait = 5 * time.Second
+	fullRetryWait = 100 * time.Millisecond
+
+	/* eventQueueLen is the number of events we'll queue for a client
+	when coalescing before deciding it's too slow */
+	eventQueueLen = 1024
+
+	/* maxCoalesced is the most we'll buffer for a client before sending
+	even if the coalescing window hasn't passed */
+	maxCoalesced = 64 * 1024
 )
 
+/* clientOpts controls how we treat clients connecting to a listener */
+type clientOpts struct {
+	admin     bool /* Client may use admin commands */
+	snapshot  bool /* Send the member list on connect */
+	negotiate bool /* Read an encoding byte before anything else */
+
+	/* format is the format in which clients are sent events, unless
+	they negotiate another.  If it's formatText, eventFormat is used. */
+	format clientFormat
+
+	/* allow, if not empty, are the only networks from which clients
+	may connect */
+	allow []netip.Prefix
+}
+
 /* localClient holds a local client's conn and tag */
 type localClient struct {
-	tag string
-	c   *net.UnixConn
+	/* tag identifies the client in logs.  It may be changed by HELLO,
+	and is protected by clientsL; use Tag outside of clientsL. */
+	tag   string
+	c     net.Conn
+	admin bool /* Connected to the admin socket */
+
+	/* watch, if set, is the name of the only node about which the client
+	wants to hear.  It is protected by clientsL. */
+	watch string
+
+	/* regions, if not empty, are the only networks containing nodes
+	about which the client wants to hear.  It is protected by clientsL. */
+	regions []netip.Prefix
+
+	/* paused is set while the client doesn't want events, which are
+	dropped rather than queued.  It is protected by clientsL. */
+	paused bool
+
+	/* proto is the client protocol version negotiated with PROTO.  It is
+	protected by clientsL. */
+	proto int
+
+	/* format is the format in which the client receives events.  It is
+	protected by clientsL. */
+	format clientFormat
+
+	/* queue is where events are sent to be formatted and written by
+	writeEvents, which is the only thing which writes to c once the
+	client's added to the list of clients.  It's set to nil when the
+	client's gone, and is protected by clientsL. */
+	queue chan *clientEvent
+
+	/* replies is where command output is sent to be written by
+	writeEvents, in between events. */
+	replies chan clientReply
+
+	/* writerDone is closed when the client's writer has finished, after
+	queue is closed. */
+	writerDone chan struct{}
+
+	/* pw, if not nil, is the client's state in the write pool started
+	by LimitWriteConcurrency, which takes the place of writeEvents. */
+	pw *pooledWriter
+
+	/* buffered is the number of bytes of events waiting to be sent to
+	the client, counted against clientMemBudget. */
+	buffered atomic.Int64
+
+	/* memEvicted is set when the client's been disconnected to stay
+	under clientMemBudget.  It is protected by clientsL. */
+	memEvicted bool
+
+	/* ranCommand is set once the client's sent a command, as HELLO must
+	be first.  It's only used by the client's command goroutine. */
+	ranCommand bool
+
+	/* echo holds the round-trip times of lines sent by ECHO and echoed
+	back.  It's only used by the client's command goroutine. */
+	echo echoStats
+}
+
+/* clientReply is command output waiting to be written by writeEvents.  The
+result of the write is sent to sent. */
+type clientReply struct {
+	b    []byte
+	sent chan<- error
+}
+
+/* startWriter starts a goroutine which writes events sent to lc.queue and
+replies sent with lc.reply to lc, one at a time, or adds lc to writePool if
+there is one.  It must be called with clientsL held, before lc is added to the
+list of clients. */
+func (lc *localClient) startWriter() {
+	lc.queue = make(chan *clientEvent, eventQueueLen)
+	lc.replies = make(chan clientReply, 1)
+	lc.writerDone = make(chan struct{})
+	if nil != writePool {
+		lc.pw = &pooledWriter{
+			lc:      lc,
+			pool:    writePool,
+			q:       lc.queue,
+			replies: lc.replies,
+			done:    lc.writerDone,
+		}
+		return
+	}
+	go writeEvents(lc, lc.queue, lc.replies, lc.writerDone)
+}
+
+/* reply sends b to lc via lc's writer, after any events already being sent,
+and waits for it to be written.  It must only be called by lc's command
+goroutine. */
+func (lc *localClient) reply(b []byte) error {
+	ch := make(chan error, 1)
+	lc.replies <- clientReply{b: b, sent: ch}
+	lc.wake(0)
+	return <-ch
+}
+
+/* stopWriter closes lc's queue, after which lc's writer finishes writing
+whatever's queued and closes lc.writerDone.  It must be called with clientsL
+held. */
+func (lc *localClient) stopWriter() {
+	close(lc.queue)
+	lc.queue = nil
+	if nil != lc.pw {
+		lc.pw.closing.Store(true)
+		lc.pw.wake(0)
+	}
+}
+
+/* wake tells lc's write pool, if lc's written to by one, that lc has
+something to write.  It's written after delay, to let events coalesce. */
+func (lc *localClient) wake(delay time.Duration) {
+	if nil != lc.pw {
+		lc.pw.wake(delay)
+	}
+}
+
+/* Tag returns lc's tag.  It must not be called with clientsL held. */
+func (lc *localClient) Tag() string {
+	clientsL.Lock()
+	defer clientsL.Unlock()
+	return lc.tag
 }
 
 var (
@@ -50,24 +234,145 @@ var (
 	/* clientCount counts the number of local clients we've had */
 	clientCount  uint64
 	clientCountL sync.Mutex
+
+	/* stdoutQueue, if not nil, is where broadcasts are sent to be
+	written to stdout by writeStdout, as well as to clients.
+	stdoutDropped is the number of events dropped since stdoutQueue was
+	last full.  Both are protected by clientsL. */
+	stdoutQueue   chan *clientEvent
+	stdoutDropped int
+
+	/* maxCommandSize is the maximum length of a line a client may send,
+	including the newline */
+	maxCommandSize = defaultMaxCommandSize
+
+	/* snapshotTimeout is how long we'll try to send a client the
+	initial member list before giving up */
+	snapshotTimeout = defaultSnapshotTimeout
+
+	/* clientCoalesceMS is the number of milliseconds for which events
+	are buffered before being sent to clients, or 0 to send them
+	immediately */
+	clientCoalesceMS int
+
+	/* fullMessage is what we tell clients when there's too many
+	clients */
+	fullMessage = defaultFullMessage
+
+	/* queueWhenFull causes clients to wait for a bit for room when
+	there's too many clients, rather than being disconnected right
+	away */
+	queueWhenFull bool
+
+	/* writePool, if not nil, writes to clients in place of a writer for
+	each client.  It is protected by clientsL. */
+	writePool *clientWritePool
+
+	/* excludeSelfInSnapshot causes our own node to be left out of the
+	member list sent to new clients */
+	excludeSelfInSnapshot bool
+
+	/* broadcastIncludeSeq causes a number, which increases by one with
+	every event from the mesh, to be added to those events when they're
+	sent to clients.  The numbers are assigned by HandleEvents. */
+	broadcastIncludeSeq bool
+
+	/* sizeMesh, if not nil, is the mesh whose size is added to every
+	event sent to clients */
+	sizeMesh  *memberlist.Memberlist
+	sizeMeshL sync.Mutex
+
+	/* socketFailureContinue is set if we keep going without a client
+	listener which fails, rather than leaving the mesh and exiting */
+	socketFailureContinue bool
+
+	/* listeners holds the client listeners, so they can be closed before
+	we exit */
+	listeners  []net.Listener
+	listenersL sync.Mutex
 )
 
 // ListenForClients listens for and handles local clients.  If rm is true the
-// path will be removed before listening.  On return clients can connect.
-// ListenForClients terminates the program on error.
-func ListenForClients(path string, rm bool, m *memberlist.Memberlist) {
+// path will be removed before listening.  Clients are handled according to
+// opts.  On return clients can connect.  ListenForClients terminates the
+// program on error.
+func ListenForClients(
+	path string,
+	rm bool,
+	opts clientOpts,
+	m *memberlist.Memberlist,
+) {
 	/* Listen on the unix socket */
 	if rm {
 		if err := os.RemoveAll(path); nil != err {
-			log.Fatalf("Error removing %s: %v", path, err)
+			fatalf(exitSocket, "Error removing %s: %v", path, err)
 		}
 	}
 	ul, err := ListenUnix(path)
 	if nil != err {
-		log.Fatalf("Unable to listen on %s: %s", path, err)
+		fatalf(exitSocket, "Unable to listen on %s: %s", path, err)
+	}
+	switch {
+	case opts.admin:
+		log.Printf("Listening for admin clients on %s", ul.Addr())
+	case !opts.snapshot:
+		log.Printf("Listening for event clients on %s", ul.Addr())
+	default:
+		log.Printf("Listening for local clients on %s", ul.Addr())
+	}
+	serveClients(ul, opts, m)
+}
+
+/* serveClients accepts and handles clients on l, according to opts.  The
+listener is closed by CloseListeners. */
+func serveClients(l net.Listener, opts clientOpts, m *memberlist.Memberlist) {
+	listenersL.Lock()
+	listeners = append(listeners, l)
+	listenersL.Unlock()
+	go handleClients(l, opts, m)
+}
+
+// CloseListeners stops listening for new clients and removes the sockets.
+// Already-connected clients are unaffected.
+func CloseListeners() {
+	listenersL.Lock()
+	defer listenersL.Unlock()
+	for _, l := range listeners {
+		if err := l.Close(); nil != err {
+			log.Printf("Error closing %s: %v", l.Addr(), err)
+		}
 	}
-	log.Printf("Listening for local clients on %s", ul.Addr())
-	go handleClients(ul, m)
+	listeners = nil
+}
+
+/* closeListener closes l and removes it from listeners, for when we stop
+listening before CloseListeners. */
+func closeListener(l net.Listener) {
+	listenersL.Lock()
+	defer listenersL.Unlock()
+	for i, ol := range listeners {
+		if ol == l {
+			listeners = append(listeners[:i], listeners[i+1:]...)
+			break
+		}
+	}
+	if err := l.Close(); nil != err {
+		log.Printf("Error closing %s: %v", l.Addr(), err)
+	}
+}
+
+// ExpandSocketPath replaces {name}, {pid}, and {port} in path with the node
+// name, process ID, and mesh port.  The expanded path must be absolute.
+func ExpandSocketPath(path, name string, pid, port int) (string, error) {
+	p := strings.NewReplacer(
+		"{name}", name,
+		"{pid}", strconv.Itoa(pid),
+		"{port}", strconv.Itoa(port),
+	).Replace(path)
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("socket path %q is not absolute", p)
+	}
+	return p, nil
 }
 
 // ListenUnix listens on a unix Socket
@@ -88,27 +393,58 @@ func ListenUnix(path string) (*net.UnixListener, error) {
 	return l, nil
 }
 
-/* handleClients accepts and handles clients */
-func handleClients(ul *net.UnixListener, m *memberlist.Memberlist) {
+/* handleClients accepts and handles clients according to opts */
+func handleClients(
+	l net.Listener,
+	opts clientOpts,
+	m *memberlist.Memberlist,
+) {
 	for {
 		/* Get a client */
-		c, err := ul.AcceptUnix()
-		if nil != err && !IsTemporary(err) {
-			LeaveMeshAndExitWithError(fmt.Errorf(
-				"acceping local client: %w",
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			/* Someone closed the listener on purpose */
+			return
+		} else if IsTemporary(err) {
+			time.Sleep(acceptWait)
+			continue
+		} else if nil != err && socketFailureContinue {
+			log.Printf(
+				"Error accepting clients on %s, no longer "+
+					"listening: %v",
+				l.Addr(),
+				err,
+			)
+			closeListener(l)
+			return
+		} else if nil != err {
+			LeaveMeshAndExitWithError(m, exitSocket, fmt.Errorf(
+				"accepting local client: %w",
 				err,
 			))
 		}
 
+		/* Make sure it's from somewhere we like */
+		if !clientAllowed(c, opts.allow) {
+			log.Printf(
+				"Rejected client from disallowed address %s",
+				c.RemoteAddr(),
+			)
+			c.Close()
+			continue
+		}
+
 		/* Add it to the list */
-		go handleClient(c, m)
+		go handleClient(c, opts, m)
 	}
 }
 
-/* handleClient sends the current state to the client and adds it to the list
-to receive updates.  If there's no space in the list the client is told and
-disconnected. */
-func handleClient(c *net.UnixConn, m *memberlist.Memberlist) {
+/* handleClient sends the current state to the client, if opts.snapshot is
+set, and adds it to the list to receive updates.  If there's no space in the
+list the client is told and disconnected. */
+func handleClient(c net.Conn, opts clientOpts, m *memberlist.Memberlist) {
+	m = liveMesh(m)
+
 	/* Get the client's number */
 	clientCountL.Lock()
 	tag := fmt.Sprintf("client-%d", clientCount)
@@ -116,20 +452,53 @@ func handleClient(c *net.UnixConn, m *memberlist.Memberlist) {
 	clientCountL.Unlock()
 	log.Printf("[%s] Connected", tag)
 
-	/* Roll a message with the state */
+	/* Work out how the client wants to talk, if we're meant to */
+	format := eventFormat
+	if formatText != opts.format {
+		format = opts.format
+	}
+	if opts.negotiate {
+		nc, f, err := negotiateEncoding(c)
+		if nil != err {
+			log.Printf("[%s] Negotiation failed: %v", tag, err)
+			c.Close()
+			return
+		}
+		c, format = nc, f
+	}
+
+	/* Roll a message with our protocol version and maybe the state */
 	var b bytes.Buffer
-	ns := m.Members()
-	fmt.Fprintf(&b, "Current nodes in mesh: %d\n", len(ns))
-	for _, n := range ns {
-		fmt.Fprintf(&b, "%s\n", FormatNode(n))
+	fmt.Fprintf(&b, "MESHMEMBERS %d\n", maxProtoVersion)
+	if opts.snapshot {
+		writeSnapshot(&b, m, format)
 	}
-	if _, err := c.Write(b.Bytes()); nil != err {
+	if err := writeWithTimeout(c, b.Bytes(), snapshotTimeout); nil != err {
 		log.Printf("[%s] Error sending member list: %v", tag, err)
 		c.Close()
 		return
 	}
 
-	/* Add to list of clients, for broadcasting */
+	/* Add to list of clients, for broadcasting, maybe waiting for room */
+	lc := &localClient{
+		tag:    tag,
+		c:      c,
+		admin:  opts.admin,
+		proto:  defaultProtoVersion,
+		format: format,
+	}
+	for start := time.Now(); !addClient(lc, m); time.Sleep(fullRetryWait) {
+		if !queueWhenFull || fullQueueWait <= time.Since(start) {
+			fmt.Fprintf(c, "%s\n", fullMessage)
+			c.Close()
+			return
+		}
+	}
+}
+
+/* addClient adds lc to the list of clients and starts waiting for it to
+disconnect.  It returns false if there's no room in the list. */
+func addClient(lc *localClient, m *memberlist.Memberlist) bool {
 	clientsL.Lock()
 	defer clientsL.Unlock()
 
@@ -137,108 +506,537 @@ func handleClient(c *net.UnixConn, m *memberlist.Memberlist) {
 	for i, p := range clients {
 		if nil == p {
 			/* Found a spot */
-			clients[i] = &localClient{tag: tag, c: c}
+			lc.startWriter()
+			clients[i] = lc
 			/* Wait for the client to disconnect, and remove it
 			from the list when it does. */
-			go waitForDisconnect(tag, i, c)
-			return
+			go waitForDisconnect(lc, i, m)
+			return true
 		}
 	}
+	return false
+}
 
-	/* No empty space */
-	fmt.Fprintf(c, "Too many connected clients, sorry\n")
-	c.Close()
+/* writeSnapshot writes the member list sent to new clients to w, leaving out
+our own node if excludeSelfInSnapshot is set.  If f is formatCompact, the list
+is written on a single line. */
+func writeSnapshot(w io.Writer, m *memberlist.Memberlist, f clientFormat) {
+	var ns []*memberlist.Node
+	for _, n := range m.Members() {
+		if excludeSelfInSnapshot && n.Name == m.LocalNode().Name {
+			continue
+		}
+		ns = append(ns, n)
+	}
+	if formatCompact == f {
+		writeCompactSnapshot(w, ns)
+		return
+	}
+	fmt.Fprintf(w, "Current nodes in mesh: %d\n", len(ns))
+	for _, n := range ns {
+		fmt.Fprintf(w, "%s\n", FormatNode(n))
+	}
+	if 0 < tombstoneTTL {
+		writeTombstones(w)
+	}
 }
 
-// LeaveMeshAndExitWithError tries to gracefully leave the mesh.  Either way,
-// the program is terminated after printing the error.
-func LeaveMeshAndExitWithError(err error) {
-	/* TODO: Finish this */
-	log.Fatalf("Fatal error: %s", err)
+/* writeCompactSnapshot writes ns, sorted by name, and any tombstones to w on
+a single line, as count=N nodes=name@addr,... departed=name@addr,... */
+func writeCompactSnapshot(w io.Writer, ns []*memberlist.Node) {
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Name < ns[j].Name })
+	ss := make([]string, len(ns))
+	for i, n := range ns {
+		ss[i] = n.Name + "@" + nodeAddr(n)
+	}
+	fmt.Fprintf(w, "count=%d nodes=%s", len(ns), strings.Join(ss, ","))
+	if 0 < tombstoneTTL {
+		ts := Tombstones()
+		ss = make([]string, len(ts))
+		for i, t := range ts {
+			ss[i] = t.Node.Name + "@" + nodeAddr(t.Node)
+		}
+		fmt.Fprintf(w, " departed=%s", strings.Join(ss, ","))
+	}
+	fmt.Fprintf(w, "\n")
 }
 
-/* waitForDisconnect waits for the client to disconnect or have an error.  It
-also reads and ignores bytes the client sends */
-func waitForDisconnect(tag string, ci int, c net.Conn) {
-	var (
-		b     = make([]byte, 1)
-		toErr interface{ Timeout() bool }
-		n     int
-		err   error
-	)
-	for {
-		/* Block on read */
-		n, err = c.Read(b)
+/* writeTombstones writes the list of recently-departed nodes to w */
+func writeTombstones(w io.Writer) {
+	ts := Tombstones()
+	fmt.Fprintf(w, "Recently departed nodes: %d\n", len(ts))
+	for _, t := range ts {
+		fmt.Fprintf(
+			w,
+			"%s (left %s ago)\n",
+			FormatNode(t.Node),
+			time.Since(t.Left).Round(time.Second),
+		)
+	}
+}
 
-		/* Ignore anything we're sent */
-		if 0 != n {
-			continue
+/* countClients returns the number of connected clients */
+func countClients() int {
+	clientsL.Lock()
+	defer clientsL.Unlock()
+	var n int
+	for _, c := range clients {
+		if nil != c {
+			n++
 		}
+	}
+	return n
+}
 
-		/* If there's no real error, just wait and read again */
-		if nil == err || IsTemporary(err) ||
-			(errors.As(err, &toErr) && toErr.Timeout()) {
-			time.Sleep(readWait)
-			continue
-		}
+// LeaveMeshAndExitWithError prints the error and tries to gracefully leave
+// the mesh.  Either way, the program is terminated with the given exit code.
+func LeaveMeshAndExitWithError(m *memberlist.Memberlist, code int, err error) {
+	log.Printf("Fatal error: %s", err)
+	LeaveMesh(m)
+	os.Exit(code)
+}
 
-		/* Looks like there's an error */
-		break
+/* waitForDisconnect waits for the client to disconnect or have an error.  It
+also reads and runs commands the client sends, one per line. */
+func waitForDisconnect(lc *localClient, ci int, m *memberlist.Memberlist) {
+	/* Handle commands until the client goes away */
+	sc := bufio.NewScanner(patientReader{lc.c})
+	sc.Buffer(make([]byte, 0, maxCommandSize), maxCommandSize)
+	for sc.Scan() {
+		runCommand(lc, m, sc.Text())
+	}
+	err := sc.Err()
+
+	/* Tell the client if it sent too much */
+	if errors.Is(err, bufio.ErrTooLong) {
+		lc.reply(fmt.Appendf(
+			nil,
+			"Command too long, maximum length is %d bytes\n",
+			maxCommandSize,
+		))
 	}
 
-	/* Client caused some sort of error, forget about and remove it */
-	clients[ci].c.Close()
+	/* Client caused some sort of error, forget about it and remove it
+	once its writer's done with it */
+	lc.c.Close()
+	clientsL.Lock()
+	lc.stopWriter()
+	clientsL.Unlock()
+	<-lc.writerDone
 	clientsL.Lock()
 	clients[ci] = nil
 	clientsL.Unlock()
 
 	/* Some errors aren't worth printing */
-	if errors.Is(err, io.EOF) {
-		log.Printf("[%s] Disconnected", tag)
+	if nil == err {
+		log.Printf("[%s] Disconnected", lc.Tag())
 		return
 	}
 
 	/* If we read on a closed connection (i.e. a write failed and we closed
 	it elsewhere), don't log as it'll already be logged */
 	/* TODO: Do above */
-	log.Printf("[%s] Disconnected (%T): %v", tag, err, err)
+	log.Printf("[%s] Disconnected (%T): %v", lc.Tag(), err, err)
+}
+
+/* patientReader wraps a net.Conn, retrying reads which return nothing or a
+temporary error after waiting readWait, rather than giving up or spinning.
+Each read has a deadline of readDeadline, renewed and retried right away when
+it passes, so idle clients just block. */
+type patientReader struct{ c net.Conn }
+
+/* Read reads from pr's Conn into b.  It only returns when it's read something
+or there's a permanent error. */
+func (pr patientReader) Read(b []byte) (int, error) {
+	var toErr interface{ Timeout() bool }
+	for {
+		/* If this fails, so will the read, and it'll say why */
+		pr.c.SetReadDeadline(time.Now().Add(readDeadline))
+		n, err := pr.c.Read(b)
+		switch {
+		case 0 != n, 0 == len(b):
+			return n, err
+		case nil == err:
+			/* Nothing read, but no error either */
+		case errors.As(err, &toErr) && toErr.Timeout():
+			/* Idle client, keep waiting */
+			continue
+		case IsTemporary(err):
+			/* Let whatever's wrong settle down */
+		default:
+			return n, err
+		}
+		time.Sleep(readWait)
+	}
+}
+
+/* inRegions returns true if n's address is in one of regions, or if regions
+is empty. */
+func inRegions(n *memberlist.Node, regions []netip.Prefix) bool {
+	if 0 == len(regions) {
+		return true
+	}
+	a, ok := netip.AddrFromSlice(normalizeIP(n.Addr))
+	if !ok {
+		return false
+	}
+	for _, r := range regions {
+		if r.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// IncludeSizeInBroadcasts causes the number of members in m to be added to
+// every event sent to clients, as [size=N].
+func IncludeSizeInBroadcasts(m *memberlist.Memberlist) {
+	sizeMeshL.Lock()
+	defer sizeMeshL.Unlock()
+	sizeMesh = m
 }
 
 // Broadcastf is like fmt.Printf but wraps Broadcast.  It makes sure the
 // message ends in a newline */
 func Broadcastf(f string, a ...interface{}) {
-	m := fmt.Sprintf(f, a...)
-	if !strings.HasSuffix(m, "\n") {
-		m += "\n"
-	}
-	Broadcast([]byte(m))
+	BroadcastNodef(nil, f, a...)
 }
 
-// Broadcast sends b to all clients
-func Broadcast(b []byte) {
-	clientsL.Lock()
-	defer clientsL.Unlock()
+// BroadcastNodef is like Broadcastf, but for messages about the node n.
+func BroadcastNodef(n *memberlist.Node, f string, a ...interface{}) {
+	broadcastKindf(eventOther, n, 0, f, a...)
+}
 
+/* broadcastKindf is like BroadcastNodef, but also takes the kind of event
+being broadcast and, if it's not 0, the event's number. */
+func broadcastKindf(
+	k eventKind,
+	n *memberlist.Node,
+	seq uint64,
+	f string,
+	a ...interface{},
+) {
+	m := strings.TrimSuffix(fmt.Sprintf(f, a...), "\n")
+	sizeMeshL.Lock()
+	if nil != sizeMesh {
+		m += fmt.Sprintf(" [size=%d]", sizeMesh.NumMembers())
+	}
+	sizeMeshL.Unlock()
+	if 0 != seq {
+		m += fmt.Sprintf(" [seq=%d]", seq)
+	}
+	m += "\n"
+	broadcastEvent(&clientEvent{
+		kind: k,
+		node: n,
+		msg:  []byte(m),
+		when: time.Now(),
+	})
+}
+
+// Broadcast sends b to all clients.  If b is about a particular node, n should
+// be that node, so clients watching a different node won't receive b.
+func Broadcast(n *memberlist.Node, b []byte) {
 	/* Can't trust b won't change */
 	wb := make([]byte, len(b))
 	copy(wb, b)
+	broadcastEvent(&clientEvent{
+		kind: eventOther,
+		node: n,
+		msg:  wb,
+		when: time.Now(),
+	})
+}
+
+/* broadcastEvent sends ev to all clients interested in it */
+func broadcastEvent(ev *clientEvent) {
+	clientsL.Lock()
+	defer clientsL.Unlock()
 
-	/* Send in parallel to everybody */
+	/* Remember it for HISTORY */
+	recordEvent(ev)
+
+	/* Send to stdout if we're meant to */
+	if nil != stdoutQueue {
+		queueStdout(ev)
+	}
+
+	/* Queue for everybody's writers */
+	n := ev.node
+	window := time.Duration(clientCoalesceMS) * time.Millisecond
 	for _, c := range clients {
-		if nil == c {
+		if nil == c || nil == c.queue || c.paused {
+			continue
+		}
+		if nil != n && "" != c.watch && n.Name != c.watch {
+			continue
+		}
+		if nil != n && !inRegions(n, c.regions) {
 			continue
 		}
-		go func(l *localClient) {
-			/* Send this client the data */
-			_, err := l.c.Write(wb)
-			if nil == err {
+		if !reserveClientMem(c, len(ev.msg)) {
+			continue
+		}
+		select {
+		case c.queue <- ev:
+			c.wake(window)
+		default:
+			log.Printf("[%s] Too many queued events", c.tag)
+			releaseClientMem(c, len(ev.msg))
+			c.c.Close()
+		}
+	}
+}
+
+// StartStdoutEvents causes broadcasts to be written to w as well as to
+// clients, in the default event format.  Events are written by their own
+// goroutine, so a slow reader of w doesn't hold up clients; if too many
+// events are waiting to be written, new ones are dropped until there's room.
+// The returned function stops sending events to w and waits for those already
+// queued to be written.
+func StartStdoutEvents(w io.Writer) (stop func()) {
+	clientsL.Lock()
+	defer clientsL.Unlock()
+	var (
+		q    = make(chan *clientEvent, eventQueueLen)
+		done = make(chan struct{})
+	)
+	stdoutQueue = q
+	stdoutDropped = 0
+	go writeStdout(w, eventFormat, q, done)
+	return func() {
+		clientsL.Lock()
+		close(q)
+		stdoutQueue = nil
+		clientsL.Unlock()
+		<-done
+	}
+}
+
+/* queueStdout queues ev to be written to stdout by writeStdout.  If the queue
+is full, ev is dropped.  It must be called with clientsL held. */
+func queueStdout(ev *clientEvent) {
+	select {
+	case stdoutQueue <- ev:
+		if 0 != stdoutDropped {
+			log.Printf(
+				"Dropped %d events waiting for stdout",
+				stdoutDropped,
+			)
+			stdoutDropped = 0
+		}
+	default:
+		if 0 == stdoutDropped {
+			log.Printf(
+				"Too many events queued for stdout, " +
+					"dropping",
+			)
+		}
+		stdoutDropped++
+	}
+}
+
+/* writeStdout writes the events received on q to w in format f, until q is
+closed, then closes done. */
+func writeStdout(
+	w io.Writer,
+	f clientFormat,
+	q <-chan *clientEvent,
+	done chan<- struct{},
+) {
+	defer close(done)
+	var (
+		buf []byte
+		seq uint64
+	)
+	for ev := range q {
+		seq++
+		buf = f.append(buf[:0], ev, seq)
+		if err := writeAll(w, buf); nil != err {
+			log.Printf("Error writing event to stdout: %v", err)
+		}
+	}
+}
+
+/* writeEvents formats the events received on q and sends them to l, as well
+as command output received on replies, until q is closed.  Events received
+within clientCoalesceMS of the first unsent event are sent together.  As the
+only writer to l.c, it keeps events and command output from being
+interleaved. */
+func writeEvents(
+	l *localClient,
+	q <-chan *clientEvent,
+	replies <-chan clientReply,
+	done chan<- struct{},
+) {
+	defer close(done)
+
+	var (
+		window = time.Duration(clientCoalesceMS) * time.Millisecond
+		buf    []byte
+		seq    uint64
+		n      int /* Bytes to give back to the memory budget */
+	)
+	add := func(ev *clientEvent) {
+		seq++
+		buf = formatEvent(l, buf, ev, seq)
+		n += len(ev.msg)
+	}
+	for {
+		var ev *clientEvent
+		select {
+		case r := <-replies:
+			r.sent <- sendReply(l, r.b)
+			continue
+		case e, ok := <-q:
+			if !ok {
 				return
 			}
-			log.Printf("[%s] Write error: %v", l.tag, err)
-			/* Something went wrong, lose the client */
-			l.c.Close()
-		}(c)
+			ev = e
+		}
+
+		/* Collect events until the window passes */
+		buf = buf[:0]
+		n = 0
+		add(ev)
+		t := time.NewTimer(window)
+	collect:
+		for 0 < window && len(buf) < maxCoalesced {
+			select {
+			case ev, ok := <-q:
+				if !ok {
+					break collect
+				}
+				add(ev)
+			case <-t.C:
+				break collect
+			}
+		}
+		t.Stop()
+		sendEvent(l, buf)
+		releaseClientMem(l, n)
+	}
+}
+
+/* formatEvent appends ev to b in l's format, as the seq'th event sent to l */
+func formatEvent(l *localClient, b []byte, ev *clientEvent, seq uint64) []byte {
+	clientsL.Lock()
+	f := l.format
+	clientsL.Unlock()
+	return f.append(b, ev, seq)
+}
+
+/* sendReply sends command output to l.  If the write fails, l's connection
+is closed. */
+func sendReply(l *localClient, b []byte) error {
+	err := writeWithTimeout(l.c, b, snapshotTimeout)
+	if nil != err {
+		l.c.Close()
+	}
+	return err
+}
+
+/* sendEvent sends an event to l.  If the write fails because the client's
+gone or misbehaving, l's connection is closed. */
+func sendEvent(l *localClient, b []byte) {
+	err := writeAll(l.c, b)
+	switch {
+	case nil == err:
+		return
+	case isLocalWriteError(err):
+		/* Our problem, not the client's */
+		log.Printf(
+			"[%s] Local error sending event, keeping client: %v",
+			l.Tag(),
+			err,
+		)
+		return
+	case isClientGone(err):
+		log.Printf("[%s] Disconnected while sending event", l.Tag())
+	default:
+		log.Printf("[%s] Write error: %v", l.Tag(), err)
+	}
+	/* Something went wrong, lose the client */
+	l.c.Close()
+}
+
+/* isLocalWriteError returns true if err, from a write to a client, indicates
+a problem on our end, i.e. running out of buffers or memory, rather than a
+problem with the client.  Filesystem errors such as ENOSPC don't happen on
+socket writes, even to Unix sockets on a full filesystem, so aren't counted. */
+func isLocalWriteError(err error) bool {
+	for _, e := range []error{
+		syscall.ENOBUFS,
+		syscall.ENOMEM,
+	} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+/* isClientGone returns true if err, from a write to a client, indicates the
+client's disconnected. */
+func isClientGone(err error) bool {
+	for _, e := range []error{
+		syscall.EPIPE,
+		syscall.ECONNRESET,
+		net.ErrClosed,
+	} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+/* writeAll writes all of b to w, continuing after short writes which don't
+return an error.  A write which makes no progress and returns no error is
+treated as an io.ErrShortWrite. */
+func writeAll(w io.Writer, b []byte) error {
+	for 0 != len(b) {
+		n, err := w.Write(b)
+		if nil != err {
+			return err
+		}
+		if 0 == n {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+/* writeWithTimeout writes b to c, continuing after short writes and retrying
+with backoff after temporary errors, until all of b is written or timeout has
+elapsed. */
+func writeWithTimeout(c net.Conn, b []byte, timeout time.Duration) error {
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); nil != err {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+	defer c.SetWriteDeadline(time.Time{})
+
+	var (
+		wait  = snapshotRetryWait
+		toErr interface{ Timeout() bool }
+	)
+	for 0 != len(b) {
+		n, err := c.Write(b)
+		b = b[n:]
+		switch {
+		case nil == err:
+			continue
+		case errors.As(err, &toErr) && toErr.Timeout():
+			return err
+		case IsTemporary(err):
+			time.Sleep(wait)
+			wait *= 2
+		default:
+			return err
+		}
 	}
+	return nil
 }
 
 // IsTemporary returns true if the error has a Temporary method which returns
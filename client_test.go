@@ -0,0 +1,905 @@
+package main
+
+/*
+ * client_test.go
+ * Tests for client.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestWriteEventsOrdered makes sure events are sent to a client in the order
+in which they're broadcast, with command output sent whole in between. */
+func TestWriteEventsOrdered(t *testing.T) {
+	const nEvent = 500
+	tc := newTestClient(t, nil, false)
+
+	/* Send events and commands at the same time */
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < nEvent; i++ {
+			Broadcastf("event %d", i)
+		}
+		Broadcastf("done")
+	}()
+	const nCommand = 10
+	go func() {
+		for i := 0; i < nCommand; i++ {
+			fmt.Fprintf(tc.c, "LAG\n")
+		}
+	}()
+
+	/* Make sure everything comes out whole and in order */
+	var next, nLag int
+	for _, l := range tc.readUntil("done") {
+		switch {
+		case strings.HasPrefix(l, "last="):
+			nLag++
+		case "done" == l:
+		case strings.HasPrefix(l, "event "):
+			if want := fmt.Sprintf("event %d", next); want != l {
+				t.Fatalf("Got %q, expected %q", l, want)
+			}
+			next++
+		default:
+			t.Fatalf("Unexpected line %q", l)
+		}
+	}
+	wg.Wait()
+	if nEvent != next {
+		t.Fatalf("Got %d events, expected %d", next, nEvent)
+	}
+	for ; nLag < nCommand; nLag++ {
+		if l := tc.readLine(); !strings.HasPrefix(l, "last=") {
+			t.Fatalf("Unexpected line %q", l)
+		}
+	}
+}
+
+/* shortWriter writes at most max bytes at a time to b */
+type shortWriter struct {
+	b   bytes.Buffer
+	max int
+}
+
+/* Write writes up to sw.max bytes of p to sw.b */
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if sw.max < len(p) {
+		p = p[:sw.max]
+	}
+	return sw.b.Write(p)
+}
+
+/* TestWriteAll makes sure writeAll copes with short writes */
+func TestWriteAll(t *testing.T) {
+	want := []byte("kittens and moose\n")
+	sw := shortWriter{max: 3}
+	if err := writeAll(&sw, want); nil != err {
+		t.Fatalf("Error: %v", err)
+	}
+	if got := sw.b.Bytes(); !bytes.Equal(want, got) {
+		t.Fatalf("Wrote %q, expected %q", got, want)
+	}
+
+	/* A writer which gives up shouldn't spin forever */
+	sw = shortWriter{max: 0}
+	if err := writeAll(&sw, want); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("Got error %v, expected %v", err, io.ErrShortWrite)
+	}
+}
+
+/* TestStdoutEvents makes sure events go to stdout with -stdout-events, even
+without any clients. */
+func TestStdoutEvents(t *testing.T) {
+	var b bytes.Buffer
+	stop := StartStdoutEvents(&b)
+	Broadcastf("kittens")
+	Broadcastf("moose")
+	stop()
+	if want := "kittens\nmoose\n"; want != b.String() {
+		t.Fatalf("Got %q, expected %q", b.String(), want)
+	}
+}
+
+/* TestStalledStdout makes sure clients still get events while nobody's
+reading stdout. */
+func TestStalledStdout(t *testing.T) {
+	r, w := net.Pipe()
+	defer r.Close()
+	stop := StartStdoutEvents(w)
+	t.Cleanup(func() {
+		w.Close()
+		stop()
+	})
+	sb := captureLog(t)
+	tc := newTestClient(t, nil, false)
+
+	/* Enough to fill stdout's queue, each of which the client should
+	still get */
+	for i := range eventQueueLen + 10 {
+		Broadcastf("event-%d", i)
+		want := fmt.Sprintf("event-%d", i)
+		if got := tc.readLine(); want != got {
+			t.Fatalf("Got %q, expected %q", got, want)
+		}
+	}
+	if !strings.Contains(sb.String(), "queued for stdout") {
+		t.Fatalf("Dropped stdout events not logged:\n%s", sb)
+	}
+}
+
+/* TestCommandTooLong makes sure clients which send over-long lines are told
+and disconnected. */
+func TestCommandTooLong(t *testing.T) {
+	maxCommandSize = 16
+	t.Cleanup(func() { maxCommandSize = defaultMaxCommandSize })
+	tc := newTestClient(t, nil, false)
+
+	go fmt.Fprintf(tc.c, "%s\n", strings.Repeat("A", 100))
+	want := "Command too long, maximum length is 16 bytes"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+	tc.c.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := tc.r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Client not disconnected, read error %v", err)
+	}
+}
+
+/* TestExpandSocketPath makes sure socket path templates are expanded */
+func TestExpandSocketPath(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"/run/mm-{name}.sock", "/run/mm-node1.sock", true},
+		{"/run/{name}/{pid}-{port}", "/run/node1/123-7946", true},
+		{"/run/mm.sock", "/run/mm.sock", true},
+		{"{name}.sock", "", false},
+	} {
+		got, err := ExpandSocketPath(c.path, "node1", 123, 7946)
+		if c.ok != (nil == err) {
+			t.Errorf("%s: error %v", c.path, err)
+			continue
+		}
+		if c.want != got {
+			t.Errorf("%s: got %q, expected %q", c.path, got, c.want)
+		}
+	}
+}
+
+/* fakeConn is a net.Conn whose reads and writes are handled by read and
+write.  Methods other than Read, Write, Close, and the deadline setters
+panic. */
+type fakeConn struct {
+	net.Conn
+	read   func([]byte) (int, error)
+	write  func([]byte) (int, error)
+	closed atomic.Bool
+
+	/* readDeadlines counts calls to SetReadDeadline */
+	readDeadlines atomic.Int64
+}
+
+/* Read calls fc.read */
+func (fc *fakeConn) Read(b []byte) (int, error) { return fc.read(b) }
+
+/* Write calls fc.write */
+func (fc *fakeConn) Write(b []byte) (int, error) { return fc.write(b) }
+
+/* Close notes fc's been closed */
+func (fc *fakeConn) Close() error {
+	fc.closed.Store(true)
+	return nil
+}
+
+/* SetWriteDeadline is a no-op */
+func (fc *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+/* SetReadDeadline counts calls in fc.readDeadlines */
+func (fc *fakeConn) SetReadDeadline(time.Time) error {
+	fc.readDeadlines.Add(1)
+	return nil
+}
+
+/* temporaryError is a temporary error */
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "try again" }
+func (temporaryError) Temporary() bool { return true }
+
+/* TestWriteWithTimeoutSlow makes sure writeWithTimeout keeps going with a
+slow writer which eventually takes everything, and gives up on one which
+never does. */
+func TestWriteWithTimeoutSlow(t *testing.T) {
+	/* Short writes and the odd temporary error */
+	var (
+		got   bytes.Buffer
+		calls int
+	)
+	fc := &fakeConn{write: func(b []byte) (int, error) {
+		calls++
+		if 2 == calls {
+			return 0, temporaryError{}
+		}
+		n := min(len(b), 5)
+		return got.Write(b[:n])
+	}}
+	want := bytes.Repeat([]byte("slow but steady\n"), 10)
+	if err := writeWithTimeout(fc, want, time.Minute); nil != err {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(want, got.Bytes()) {
+		t.Fatalf("Wrote %q, expected %q", got.Bytes(), want)
+	}
+
+	/* A reader which reads slowly */
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go func(c net.Conn) {
+		b := make([]byte, 3)
+		for {
+			time.Sleep(time.Millisecond)
+			if _, err := c.Read(b); nil != err {
+				return
+			}
+		}
+	}(theirs)
+	if err := writeWithTimeout(ours, want, time.Minute); nil != err {
+		t.Fatalf("Error with slow reader: %v", err)
+	}
+	theirs.Close()
+
+	/* A reader which never reads */
+	ours, theirs = net.Pipe()
+	defer theirs.Close()
+	defer ours.Close()
+	var toErr interface{ Timeout() bool }
+	if err := writeWithTimeout(
+		ours,
+		want,
+		10*time.Millisecond,
+	); !errors.As(err, &toErr) || !toErr.Timeout() {
+		t.Fatalf("Got %v, expected a timeout", err)
+	}
+}
+
+/* TestEventsOnlyClient makes sure clients of an events-only socket don't get
+a snapshot, but do get events. */
+func TestEventsOnlyClient(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	for _, snapshot := range []bool{true, false} {
+		tc := connectTestClient(
+			t,
+			ms[0],
+			clientOpts{snapshot: snapshot},
+		)
+		if l := tc.readLine(); "MESHMEMBERS 1" != l {
+			t.Fatalf("Got banner %q", l)
+		}
+		waitFor(t, "client to be added", func() bool {
+			return 0 != countClients()
+		})
+		Broadcastf("kittens")
+		ls := tc.readUntil("kittens")
+		if snapshot && 4 != len(ls) {
+			t.Fatalf("Expected snapshot and event, got %q", ls)
+		} else if !snapshot && 1 != len(ls) {
+			t.Fatalf("Expected just an event, got %q", ls)
+		}
+		tc.c.Close()
+		waitFor(t, "client removal", func() bool {
+			return 0 == countClients()
+		})
+	}
+}
+
+/* TestSendEventErrors makes sure clients are kept when writes fail because
+of a problem on our end, and dropped otherwise. */
+func TestSendEventErrors(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		keep bool
+	}{
+		{nil, true},
+		{syscall.ENOBUFS, true},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError(
+			"write",
+			syscall.ENOMEM,
+		)}, true},
+		{syscall.EPIPE, false},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError(
+			"write",
+			syscall.ECONNRESET,
+		)}, false},
+		{net.ErrClosed, false},
+		{syscall.ENOSPC, false},
+		{errors.New("something else"), false},
+	} {
+		fc := &fakeConn{write: func(b []byte) (int, error) {
+			if nil != c.err {
+				return 0, c.err
+			}
+			return len(b), nil
+		}}
+		sendEvent(&localClient{tag: "test", c: fc}, []byte("event\n"))
+		if c.keep == fc.closed.Load() {
+			t.Errorf(
+				"Error %v: kept client %t, expected %t",
+				c.err,
+				!fc.closed.Load(),
+				c.keep,
+			)
+		}
+	}
+}
+
+/* writeCountingConn counts the writes made to it */
+type writeCountingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+/* Write counts the write and passes it to cc.Conn */
+func (cc *writeCountingConn) Write(b []byte) (int, error) {
+	cc.writes.Add(1)
+	return cc.Conn.Write(b)
+}
+
+/* BenchmarkCoalesce compares the number of writes, i.e. syscalls, needed to
+send a burst of events with and without -client-coalesce-ms. */
+func BenchmarkCoalesce(b *testing.B) {
+	const burst = 100
+	for _, ms := range []int{0, 1, 5} {
+		b.Run(fmt.Sprintf("coalesce-ms=%d", ms), func(b *testing.B) {
+			clientCoalesceMS = ms
+			b.Cleanup(func() { clientCoalesceMS = 0 })
+			ours, theirs := net.Pipe()
+			cc := &writeCountingConn{Conn: ours}
+			lc := &localClient{
+				tag:    "bench",
+				c:      cc,
+				format: formatText,
+			}
+			if !addClient(lc, nil) {
+				b.Fatalf("No room for client")
+			}
+			b.Cleanup(func() { theirs.Close() })
+
+			/* Read everything, noting when each burst is done */
+			done := make(chan struct{})
+			go func() {
+				sc := bufio.NewScanner(theirs)
+				for sc.Scan() {
+					if "done" == sc.Text() {
+						done <- struct{}{}
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < burst; j++ {
+					Broadcastf("event %d", j)
+				}
+				Broadcastf("done")
+				<-done
+			}
+			b.StopTimer()
+			b.ReportMetric(
+				float64(cc.writes.Load())/float64(b.N),
+				"writes/op",
+			)
+		})
+	}
+}
+
+/* TestPatientReaderNoSpin makes sure patientReader waits between reads which
+return nothing or a temporary error, rather than spinning, but retries
+timeouts right away. */
+func TestPatientReaderNoSpin(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+	}{
+		{"empty read", nil},
+		{"temporary error", temporaryError{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			var reads, done atomic.Int64
+			fc := &fakeConn{read: func(b []byte) (int, error) {
+				reads.Add(1)
+				if 0 != done.Load() {
+					b[0] = 'x'
+					return 1, nil
+				}
+				return 0, c.err
+			}}
+			ch := make(chan error, 1)
+			go func() {
+				b := make([]byte, 1)
+				_, err := patientReader{fc}.Read(b)
+				ch <- err
+			}()
+			time.Sleep(readWait / 4)
+			if n := reads.Load(); 1 != n {
+				t.Fatalf("Read %d times in %s", n, readWait/4)
+			}
+			done.Store(1)
+			select {
+			case err := <-ch:
+				if nil != err {
+					t.Fatalf("Error: %v", err)
+				}
+			case <-time.After(testTimeout):
+				t.Fatalf("Read didn't return")
+			}
+		})
+	}
+
+	/* Timeouts are retried right away, with a new deadline */
+	var timeouts int
+	fc := &fakeConn{read: func(b []byte) (int, error) {
+		if 3 > timeouts {
+			timeouts++
+			return 0, os.ErrDeadlineExceeded
+		}
+		b[0] = 'x'
+		return 1, nil
+	}}
+	start := time.Now()
+	if n, err := (patientReader{fc}).Read(make([]byte, 1)); nil != err {
+		t.Fatalf("Read after timeouts returned %v", err)
+	} else if 1 != n {
+		t.Fatalf("Read after timeouts read %d bytes", n)
+	}
+	if d := time.Since(start); readWait <= d {
+		t.Fatalf("Timeouts took %s", d)
+	}
+	if n := fc.readDeadlines.Load(); 4 != n {
+		t.Fatalf("Set read deadline %d times, expected 4", n)
+	}
+}
+
+/* TestExcludeSelfInSnapshot makes sure -exclude-self-in-snapshot leaves our
+own node out of the snapshot and its count. */
+func TestExcludeSelfInSnapshot(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b", "c")
+	t.Cleanup(func() { excludeSelfInSnapshot = false })
+	for _, c := range []struct {
+		exclude bool
+		want    []string
+	}{
+		{false, []string{"Current nodes in mesh: 3", "a", "b", "c"}},
+		{true, []string{"Current nodes in mesh: 2", "b", "c"}},
+	} {
+		excludeSelfInSnapshot = c.exclude
+		var b bytes.Buffer
+		writeSnapshot(&b, ms[0], formatText)
+		got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		for i, l := range got[1:] {
+			got[i+1], _, _ = strings.Cut(l, " ")
+		}
+		slices.Sort(got[1:])
+		if !slices.Equal(c.want, got) {
+			t.Errorf(
+				"Exclude %t: got %q, expected %q",
+				c.exclude,
+				got,
+				c.want,
+			)
+		}
+	}
+}
+
+/* TestCompactSnapshot makes sure compact clients get the member list on one
+line, sorted by name. */
+func TestCompactSnapshot(t *testing.T) {
+	n := func(name, ip string) *memberlist.Node {
+		return &memberlist.Node{
+			Name: name,
+			Addr: net.ParseIP(ip),
+			Port: 7887,
+		}
+	}
+	ns := []*memberlist.Node{
+		n("c", "192.0.2.3"),
+		n("a", "::ffff:192.0.2.1"),
+		n("b", "2001:db8::2"),
+	}
+	var b bytes.Buffer
+	writeCompactSnapshot(&b, ns)
+	want := "count=3 nodes=a@192.0.2.1:7887,b@[2001:db8::2]:7887," +
+		"c@192.0.2.3:7887\n"
+	if got := b.String(); want != got {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+
+	/* Departed nodes are only listed with -tombstone-ttl */
+	tombstoneTTL = time.Minute
+	t.Cleanup(func() {
+		tombstoneTTL = 0
+		forgetNode("d")
+	})
+	trackTombstone(memberlist.NodeEvent{
+		Event: memberlist.NodeLeave,
+		Node:  n("d", "192.0.2.4"),
+	})
+	b.Reset()
+	writeCompactSnapshot(&b, ns[:1]) /* Sorted, so just a */
+	want = "count=1 nodes=a@192.0.2.1:7887 departed=d@192.0.2.4:7887\n"
+	if got := b.String(); want != got {
+		t.Fatalf("Got %q with a tombstone, expected %q", got, want)
+	}
+	tombstoneTTL = 0
+
+	/* REFRESH uses the client's format */
+	ms := newTestMesh(t, nil, "a", "b")
+	tc := newTestClient(t, ms[0], false)
+	tc.send("FORMAT compact")
+	if l := tc.readLine(); "FORMAT compact" != l {
+		t.Fatalf("Got %q", l)
+	}
+	tc.send("REFRESH")
+	want = fmt.Sprintf(
+		"count=2 nodes=a@%s,b@%s",
+		nodeAddr(ms[0].LocalNode()),
+		nodeAddr(ms[1].LocalNode()),
+	)
+	if l := tc.readLine(); want != l {
+		t.Fatalf("REFRESH got %q, expected %q", l, want)
+	}
+}
+
+/* TestIncludeSizeInBroadcasts makes sure the mesh's size is tacked on to
+broadcasts with -broadcast-include-size, and only then. */
+func TestIncludeSizeInBroadcasts(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b", "c")
+	tc := newTestClient(t, ms[0], false)
+	t.Cleanup(func() { IncludeSizeInBroadcasts(nil) })
+
+	Broadcastf("no size")
+	if l := tc.readLine(); "no size" != l {
+		t.Fatalf("Got %q without a size", l)
+	}
+	IncludeSizeInBroadcasts(ms[0])
+	Broadcastf("size\n")
+	if l := tc.readLine(); "size [size=3]" != l {
+		t.Fatalf("Got %q with a size", l)
+	}
+}
+
+/* TestFullPolicy makes sure clients connecting when there's no room are
+rejected or queued, according to -full-policy. */
+func TestFullPolicy(t *testing.T) {
+	fullMessage = "Full up"
+	t.Cleanup(func() {
+		fullMessage = defaultFullMessage
+		queueWhenFull = false
+	})
+
+	/* Fill the list of clients with placeholders */
+	filler := new(localClient)
+	var free []int
+	clientsL.Lock()
+	for i, p := range clients {
+		if nil == p {
+			clients[i] = filler
+			free = append(free, i)
+		}
+	}
+	clientsL.Unlock()
+	t.Cleanup(func() {
+		clientsL.Lock()
+		defer clientsL.Unlock()
+		for _, i := range free {
+			if filler == clients[i] {
+				clients[i] = nil
+			}
+		}
+	})
+	connect := func() *testClient {
+		ours, theirs := net.Pipe()
+		t.Cleanup(func() { theirs.Close() })
+		go handleClient(ours, clientOpts{}, nil)
+		tc := &testClient{t: t, c: theirs, r: bufio.NewReader(theirs)}
+		if l := tc.readLine(); "MESHMEMBERS 1" != l {
+			t.Fatalf("Got greeting %q", l)
+		}
+		return tc
+	}
+
+	/* By default, no room means no client */
+	tc := connect()
+	if l := tc.readLine(); fullMessage != l {
+		t.Fatalf("Rejected client got %q", l)
+	}
+	if _, err := tc.r.ReadString('\n'); !errors.Is(err, io.EOF) {
+		t.Fatalf("Rejected client not disconnected: %v", err)
+	}
+
+	/* With -full-policy queue, we wait for another client to leave */
+	queueWhenFull = true
+	tc = connect()
+	time.Sleep(2 * fullRetryWait)
+	clientsL.Lock()
+	slot := free[0]
+	clients[slot] = nil
+	clientsL.Unlock()
+	waitFor(t, "queued client", func() bool {
+		clientsL.Lock()
+		defer clientsL.Unlock()
+		return nil != clients[slot] && filler != clients[slot]
+	})
+	tc.send("FORMAT")
+	if l := tc.readLine(); "FORMAT text" != l {
+		t.Fatalf("Queued client got %q", l)
+	}
+	tc.c.Close()
+	waitFor(t, "queued client removal", func() bool {
+		clientsL.Lock()
+		defer clientsL.Unlock()
+		return nil == clients[slot]
+	})
+}
+
+/* concurrencyConn notes how many goroutines are writing to it at once, and
+the most there's been. */
+type concurrencyConn struct {
+	net.Conn
+	cur *atomic.Int64
+	max *atomic.Int64
+}
+
+/* Write notes another writer, passes b to cc.Conn, and un-notes the writer */
+func (cc concurrencyConn) Write(b []byte) (int, error) {
+	n := cc.cur.Add(1)
+	defer cc.cur.Add(-1)
+	for m := cc.max.Load(); m < n && !cc.max.CompareAndSwap(m, n); {
+		m = cc.max.Load()
+	}
+	return cc.Conn.Write(b)
+}
+
+/* addConcurrencyClients adds n clients whose writes are counted in cur and
+max.  Each line each client receives is passed to f, along with the client's
+index.  The clients are removed when tb finishes. */
+func addConcurrencyClients(
+	tb testing.TB,
+	n int,
+	cur *atomic.Int64,
+	max *atomic.Int64,
+	f func(i int, l string),
+) {
+	before := countClients()
+	tb.Cleanup(func() {
+		waitFor(tb, "client removal", func() bool {
+			return before == countClients()
+		})
+	})
+	for i := range n {
+		ours, theirs := net.Pipe()
+		lc := &localClient{
+			tag:    fmt.Sprintf("concurrency-%d", i),
+			c:      concurrencyConn{Conn: ours, cur: cur, max: max},
+			format: formatText,
+		}
+		if !addClient(lc, nil) {
+			tb.Fatalf("No room for client %d", i)
+		}
+		tb.Cleanup(func() { theirs.Close() })
+		go func() {
+			sc := bufio.NewScanner(theirs)
+			for sc.Scan() {
+				f(i, sc.Text())
+			}
+		}()
+	}
+}
+
+/* TestWriteConcurrency makes sure -write-concurrency limits how many clients
+are written to at once, and that each client still gets events in order, as
+well as command output. */
+func TestWriteConcurrency(t *testing.T) {
+	const (
+		limit   = 2
+		nClient = 10
+		nEvent  = 100
+	)
+	t.Cleanup(LimitWriteConcurrency(limit))
+	startGoroutines := runtime.NumGoroutine()
+
+	var (
+		cur, max atomic.Int64
+		nexts    = make([]int, nClient)
+		errs     = make(chan error, nClient)
+	)
+	addConcurrencyClients(t, nClient, &cur, &max, func(i int, l string) {
+		if want := fmt.Sprintf("event %d", nexts[i]); want != l {
+			errs <- fmt.Errorf(
+				"client %d got %q, expected %q",
+				i,
+				l,
+				want,
+			)
+			return
+		}
+		if nexts[i]++; nEvent == nexts[i] {
+			errs <- nil
+		}
+	})
+	for i := range nEvent {
+		Broadcastf("event %d", i)
+	}
+	for range nClient {
+		select {
+		case err := <-errs:
+			if nil != err {
+				t.Fatalf("%v", err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("Timed out waiting for events")
+		}
+	}
+	if n := max.Load(); limit < n {
+		t.Fatalf("%d clients written to at once", n)
+	}
+
+	/* Writers aren't per-client goroutines.  Each client still has a
+	goroutine reading its commands and one in the test reading events,
+	and we allow a few for whatever else is running. */
+	n := runtime.NumGoroutine() - startGoroutines
+	if most := 2*nClient + nClient/2; most < n {
+		t.Errorf("%d more goroutines for %d clients", n, nClient)
+	}
+
+	/* Command output still needs to get through */
+	tc := newTestClient(t, nil, false)
+	tc.send("PROTO")
+	if l := tc.readLine(); "PROTO 1" != l {
+		t.Fatalf("Got %q", l)
+	}
+	Broadcastf("after")
+	if l := tc.readLine(); "after" != l {
+		t.Fatalf("Got %q", l)
+	}
+}
+
+/* BenchmarkWriteConcurrency broadcasts to lots of clients with different
+-write-concurrency limits, and reports the most clients written to at once. */
+func BenchmarkWriteConcurrency(b *testing.B) {
+	const (
+		nClient = 200
+		burst   = 10
+	)
+	for _, limit := range []int{0, 1, 8, 64} {
+		b.Run(fmt.Sprintf("write-concurrency=%d", limit), func(
+			b *testing.B,
+		) {
+			captureLog(b)
+			if 0 != limit {
+				b.Cleanup(LimitWriteConcurrency(limit))
+			}
+			var (
+				cur, max atomic.Int64
+				done     sync.WaitGroup
+			)
+			addConcurrencyClients(
+				b,
+				nClient,
+				&cur,
+				&max,
+				func(_ int, l string) {
+					if "done" == l {
+						done.Done()
+					}
+				},
+			)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				done.Add(nClient)
+				for j := 0; j < burst; j++ {
+					Broadcastf("event %d", j)
+				}
+				Broadcastf("done")
+				done.Wait()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(max.Load()), "max-writers")
+		})
+	}
+}
+
+/* brokenListener is a net.Listener whose Accept always fails */
+type brokenListener struct {
+	closed atomic.Bool
+}
+
+/* Accept returns an error which isn't temporary */
+func (bl *brokenListener) Accept() (net.Conn, error) {
+	return nil, errors.New("broken")
+}
+
+/* Close notes bl's been closed */
+func (bl *brokenListener) Close() error {
+	bl.closed.Store(true)
+	return nil
+}
+
+/* Addr returns a made-up address */
+func (bl *brokenListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "/broken", Net: "unix"}
+}
+
+/* TestSocketFailureContinue makes sure that with -socket-failure-policy
+continue, a broken socket is closed but the mesh and other clients carry on. */
+func TestSocketFailureContinue(t *testing.T) {
+	socketFailureContinue = true
+	t.Cleanup(func() { socketFailureContinue = false })
+	ms := newTestMesh(t, nil, "a", "b")
+	sb := captureLog(t)
+	tc := newTestClient(t, ms[0], false)
+
+	bl := new(brokenListener)
+	done := make(chan struct{})
+	listenersL.Lock()
+	listeners = append(listeners, bl)
+	listenersL.Unlock()
+	go func() {
+		defer close(done)
+		handleClients(bl, clientOpts{}, ms[0])
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("Still accepting after an error")
+	}
+	if !bl.closed.Load() {
+		t.Fatalf("Broken listener not closed")
+	}
+	listenersL.Lock()
+	found := slices.Contains(listeners, net.Listener(bl))
+	listenersL.Unlock()
+	if found {
+		t.Fatalf("Broken listener still in the list of listeners")
+	}
+	want := "Error accepting clients on /broken, no longer listening: " +
+		"broken"
+	if !strings.Contains(sb.String(), want) {
+		t.Fatalf("Log missing %q: %q", want, sb.String())
+	}
+
+	/* Life goes on */
+	if n := ms[0].NumMembers(); 2 != n {
+		t.Fatalf("%d members after socket failure", n)
+	}
+	Broadcastf("still here")
+	if l := tc.readLine(); "still here" != l {
+		t.Fatalf("Got %q after socket failure", l)
+	}
+}
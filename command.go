@@ -0,0 +1,1277 @@
+package main
+
+/*
+ * command.go
+ * Handle commands from local clients
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* commandFunc handles a command from a client.  The command's argument, if
+any, is in arg.  Output written to w is sent to the client. */
+type commandFunc func(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error
+
+var (
+	/* knownGOOS and knownGOARCH are the platforms Go knows about, for
+	picking platforms out of node names */
+	knownGOOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true,
+		"dragonfly": true, "freebsd": true, "illumos": true,
+		"ios": true, "js": true, "linux": true, "netbsd": true,
+		"openbsd": true, "plan9": true, "solaris": true,
+		"wasip1": true, "windows": true,
+	}
+	knownGOARCH = map[string]bool{
+		"386": true, "amd64": true, "arm": true, "arm64": true,
+		"loong64": true, "mips": true, "mips64": true,
+		"mips64le": true, "mipsle": true, "ppc64": true,
+		"ppc64le": true, "riscv64": true, "s390x": true,
+		"wasm": true,
+	}
+)
+
+const (
+	/* gossipTimeout is how long GOSSIP waits for our state to be
+	pushed */
+	gossipTimeout = 10 * time.Second
+
+	/* maxHelloLabelLen is the longest label a client may send with
+	HELLO */
+	maxHelloLabelLen = 32
+
+	/* defaultIPv6SubnetLen is the prefix length SUBNETS uses for IPv6
+	addresses if the client doesn't give one */
+	defaultIPv6SubnetLen = 64
+
+	/* maxHostnameLen is the longest hostname HOSTS will send */
+	maxHostnameLen = 253
+
+	/* maxEchoLines is the most lines ECHO will send at once */
+	maxEchoLines = 10000
+)
+
+/* command is a command clients may send */
+type command struct {
+	f     commandFunc
+	admin bool /* Only for admin clients */
+}
+
+/* commands maps command names to their handlers */
+var commands = map[string]command{
+	"AGES":            {f: agesCommand},
+	"CLIENTS":         {f: clientsCommand, admin: true},
+	"CONFIG":          {f: configCommand, admin: true},
+	"CONVERGENCE":     {f: convergenceCommand},
+	"CSV":             {f: csvCommand},
+	"DOT":             {f: dotCommand},
+	"DRAIN":           {f: drainCommand, admin: true},
+	"DROP-OLD-SECRET": {f: dropOldSecretCommand, admin: true},
+	"ECHO":            {f: echoCommand, admin: true},
+	"ECHOED":          {f: echoedCommand},
+	"FINGERPRINT":     {f: fingerprintCommand},
+	"FORGET":          {f: forgetCommand, admin: true},
+	"FORMAT":          {f: formatCommand},
+	"GOSSIP":          {f: gossipCommand, admin: true},
+	"HELLO":           {f: helloCommand},
+	"HISTORY":         {f: historyCommand},
+	"HOSTS":           {f: hostsCommand},
+	"LAG":             {f: lagCommand},
+	"LASTEVENT":       {f: lastEventCommand},
+	"LEADER":          {f: leaderCommand},
+	"NETSTATS":        {f: netStatsCommand},
+	"PAUSE":           {f: pauseCommand},
+	"PLATFORMS":       {f: platformsCommand},
+	"PROBE":           {f: probeCommand, admin: true},
+	"PROTO":           {f: protoCommand},
+	"RAW":             {f: rawCommand, admin: true},
+	"REFRESH":         {f: refreshCommand},
+	"REGION":          {f: regionCommand},
+	"REMOVE-KEY":      {f: removeKeyCommand, admin: true},
+	"RESUME":          {f: resumeCommand},
+	"ROLE":            {f: roleCommand},
+	"ROTATE-KEY":      {f: rotateKeyCommand, admin: true},
+	"SAVE-PEERS":      {f: savePeersCommand, admin: true},
+	"SET-SECRET":      {f: rotateKeyCommand, admin: true},
+	"SINCE":           {f: sinceCommand},
+	"SUBNETS":         {f: subnetsCommand},
+	"TOP":             {f: topCommand},
+	"WATCH":           {f: watchCommand},
+}
+
+/* runCommand runs the command in line on behalf of lc and sends lc the
+output. */
+func runCommand(lc *localClient, m *memberlist.Memberlist, line string) {
+	m = liveMesh(m)
+
+	/* Work out which command we've got */
+	line = strings.TrimSpace(line)
+	if "" == line {
+		return
+	}
+	name, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); -1 != i {
+		name, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	name = strings.ToUpper(name)
+
+	/* Run it */
+	var b bytes.Buffer
+	if c, ok := commands[name]; !ok {
+		fmt.Fprintf(&b, "Unknown command %q\n", name)
+	} else if c.admin && !lc.admin {
+		fmt.Fprintf(&b, "%s is only available to admin clients\n", name)
+	} else if err := c.f(&b, lc, m, arg); nil != err {
+		fmt.Fprintf(&b, "Error: %v\n", err)
+	}
+	lc.ranCommand = true
+	if err := lc.reply(b.Bytes()); nil != err {
+		log.Printf(
+			"[%s] Error sending %s output: %v",
+			lc.Tag(),
+			name,
+			err,
+		)
+	}
+}
+
+/* formatCommand sets the format in which lc receives events to the one named
+in arg.  Without a format, it sends the current format. */
+func formatCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	clientsL.Lock()
+	defer clientsL.Unlock()
+
+	/* Just asking? */
+	if "" == arg {
+		fmt.Fprintf(w, "FORMAT %s\n", lc.format)
+		return nil
+	}
+
+	/* Switch formats */
+	f, err := parseClientFormat(arg)
+	if nil != err {
+		return err
+	}
+	lc.format = f
+	fmt.Fprintf(w, "FORMAT %s\n", f)
+	return nil
+}
+
+/* helloCommand adds the label in arg to lc's tag, to make it easier to tell
+clients apart in the logs.  It must be the client's first command. */
+func helloCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* Make sure the label's sensible */
+	if lc.ranCommand {
+		return errors.New("HELLO must be the first command")
+	}
+	if "" == arg {
+		return errors.New("need a label")
+	}
+	if maxHelloLabelLen < len(arg) {
+		return fmt.Errorf(
+			"label too long, maximum length is %d bytes",
+			maxHelloLabelLen,
+		)
+	}
+	if strings.ContainsFunc(arg, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) {
+		return errors.New("label contains unusable characters")
+	}
+
+	/* Tag the client */
+	clientsL.Lock()
+	old := lc.tag
+	lc.tag = fmt.Sprintf("%s(%s)", old, arg)
+	nt := lc.tag
+	clientsL.Unlock()
+	log.Printf("[%s] Now known as %s", old, nt)
+	fmt.Fprintf(w, "Hello, %s\n", nt)
+	return nil
+}
+
+/* protoCommand sets lc's protocol version to the one in arg.  Without a
+version, it sends lc's current protocol version. */
+func protoCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* Just asking? */
+	if "" == arg {
+		clientsL.Lock()
+		v := lc.proto
+		clientsL.Unlock()
+		fmt.Fprintf(w, "PROTO %d\n", v)
+		return nil
+	}
+
+	/* Make sure we speak the version */
+	v, err := strconv.Atoi(arg)
+	if nil != err {
+		return fmt.Errorf("invalid version %q", arg)
+	}
+	if v < 1 || maxProtoVersion < v {
+		return fmt.Errorf(
+			"unsupported version %d, maximum is %d",
+			v,
+			maxProtoVersion,
+		)
+	}
+	clientsL.Lock()
+	lc.proto = v
+	clientsL.Unlock()
+	fmt.Fprintf(w, "PROTO %d\n", v)
+	return nil
+}
+
+/* watchCommand limits the events lc receives to those about a single node,
+named in arg.  If arg is empty, lc receives all events. */
+func watchCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	clientsL.Lock()
+	lc.watch = arg
+	clientsL.Unlock()
+
+	/* Unwatching is easy */
+	if "" == arg {
+		fmt.Fprintf(w, "Watching all nodes\n")
+		return nil
+	}
+
+	/* Tell the client what the node looks like right now */
+	fmt.Fprintf(w, "Watching %s\n", arg)
+	if n := findMember(m, arg); nil != n {
+		fmt.Fprintf(w, "%s\n", FormatNode(n))
+	} else {
+		fmt.Fprintf(w, "%s is not currently in the mesh\n", arg)
+	}
+	return nil
+}
+
+/* regionCommand limits the events lc receives to those about nodes in the
+CIDR ranges in arg, separated by commas or whitespace.  If arg is empty, lc
+receives events about all nodes. */
+func regionCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	rs, err := parseCIDRList(arg)
+	if nil != err {
+		return err
+	}
+	clientsL.Lock()
+	lc.regions = rs
+	clientsL.Unlock()
+
+	if 0 == len(rs) {
+		fmt.Fprintf(w, "Receiving events about all nodes\n")
+		return nil
+	}
+	ss := make([]string, len(rs))
+	for i, r := range rs {
+		ss[i] = r.String()
+	}
+	fmt.Fprintf(
+		w,
+		"Receiving events about nodes in %s\n",
+		strings.Join(ss, ", "),
+	)
+	return nil
+}
+
+/* pauseCommand stops events being sent to lc until it sends RESUME.  Events
+in the meantime are dropped. */
+func pauseCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	clientsL.Lock()
+	lc.paused = true
+	clientsL.Unlock()
+	fmt.Fprintf(w, "Paused, events will be dropped until RESUME\n")
+	return nil
+}
+
+/* resumeCommand undoes pauseCommand. */
+func resumeCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	clientsL.Lock()
+	lc.paused = false
+	clientsL.Unlock()
+	fmt.Fprintf(w, "Resumed\n")
+	return nil
+}
+
+/* refreshCommand sends lc the member list, as sent to new clients. */
+func refreshCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	clientsL.Lock()
+	f := lc.format
+	clientsL.Unlock()
+	writeSnapshot(w, m, f)
+	return nil
+}
+
+/* historyCommand sends the recent events in the history, oldest first, in
+the client's format.  JSON events are sent with a sequence number of 0, as
+they're not numbered with the events the client's been sent. */
+func historyCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	clientsL.Lock()
+	f := lc.format
+	clientsL.Unlock()
+	var b []byte
+	for _, ev := range recentEvents() {
+		b = f.append(b, ev, 0)
+	}
+	w.Write(b)
+	return nil
+}
+
+/* clientsCommand lists the connected clients, one per line, as
+tag remote_addr format subscriptions */
+func clientsCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	clientsL.Lock()
+	defer clientsL.Unlock()
+	for _, c := range clients {
+		if nil == c {
+			continue
+		}
+		ra := "-"
+		if a := c.c.RemoteAddr(); nil != a && "" != a.String() {
+			ra = a.String()
+		}
+		fmt.Fprintf(
+			w,
+			"%s %s %s %s\n",
+			c.tag,
+			ra,
+			c.format,
+			clientSubscriptions(c),
+		)
+	}
+	return nil
+}
+
+/* clientSubscriptions describes which events c receives, as a
+comma-separated list of watch=NAME, regions=CIDR+CIDR... and paused, or all if
+c receives everything.  It must be called with clientsL held. */
+func clientSubscriptions(c *localClient) string {
+	var subs []string
+	if "" != c.watch {
+		subs = append(subs, "watch="+c.watch)
+	}
+	if 0 != len(c.regions) {
+		rs := make([]string, len(c.regions))
+		for i, r := range c.regions {
+			rs[i] = r.String()
+		}
+		subs = append(subs, "regions="+strings.Join(rs, "+"))
+	}
+	if c.paused {
+		subs = append(subs, "paused")
+	}
+	if 0 == len(subs) {
+		return "all"
+	}
+	return strings.Join(subs, ",")
+}
+
+/* dotCommand sends the members of the mesh as a Graphviz DOT graph */
+func dotCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	fmt.Fprintf(w, "digraph meshmembers {\n")
+	for _, n := range sortedMembers(m) {
+		fmt.Fprintf(
+			w,
+			"\t%s [label=%s];\n",
+			dotQuote(n.Name),
+			dotQuote(FormatNode(n)),
+		)
+	}
+	fmt.Fprintf(w, "}\n")
+	return nil
+}
+
+/* dotQuote quotes s for use as a DOT ID */
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+	).Replace(s) + `"`
+}
+
+/* sortedMembers returns the members of the mesh, sorted by name */
+func sortedMembers(m *memberlist.Memberlist) []*memberlist.Node {
+	ns := m.Members()
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Name < ns[j].Name })
+	return ns
+}
+
+/* rawCommand sends memberlist's view of the node named in arg, as JSON */
+func rawCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	if "" == arg {
+		return errors.New("need a node name")
+	}
+	n := findMember(m, arg)
+	if nil == n {
+		return fmt.Errorf("no node named %q", arg)
+	}
+	b, err := json.MarshalIndent(n, "", "\t")
+	if nil != err {
+		return fmt.Errorf("encoding node: %w", err)
+	}
+	fmt.Fprintf(w, "%s\n", b)
+	return nil
+}
+
+/* findMember returns the member of the mesh with the given name, or nil if
+there is no such member */
+func findMember(m *memberlist.Memberlist, name string) *memberlist.Node {
+	for _, n := range m.Members() {
+		if name == n.Name {
+			return n
+		}
+	}
+	return nil
+}
+
+/* agesCommand lists the members of the mesh along with when we first saw them
+and how long ago that was, as name first_seen age */
+func agesCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	for _, n := range sortedMembers(m) {
+		t, ok := FirstSeen(n.Name)
+		if !ok {
+			fmt.Fprintf(w, "%s unknown unknown\n", n.Name)
+			continue
+		}
+		fmt.Fprintf(
+			w,
+			"%s %s %s\n",
+			n.Name,
+			t.Format(time.RFC3339),
+			time.Since(t).Round(time.Second),
+		)
+	}
+	return nil
+}
+
+/* platformsCommand sends the number of nodes on each platform, as found in
+the nodes' names, all on one line. */
+func platformsCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* Count ALL the platforms */
+	counts := make(map[string]int)
+	for _, n := range m.Members() {
+		counts[nodePlatform(n.Name)]++
+	}
+
+	/* Send them back */
+	fmt.Fprintf(w, "%s\n", formatCounts(counts))
+	return nil
+}
+
+/* nodePlatform returns the first GOOS-GOARCH pair found in name, or unknown
+if there isn't one. */
+func nodePlatform(name string) string {
+	parts := strings.Split(name, "-")
+	for i := 0; i < len(parts)-1; i++ {
+		if knownGOOS[parts[i]] && knownGOARCH[parts[i+1]] {
+			return parts[i] + "-" + parts[i+1]
+		}
+	}
+	return "unknown"
+}
+
+/* formatCounts formats counts as name: count pairs, all on one line, largest
+count first. */
+func formatCounts(counts map[string]int) string {
+	ns := make([]string, 0, len(counts))
+	for n := range counts {
+		ns = append(ns, n)
+	}
+	sort.Slice(ns, func(i, j int) bool {
+		if counts[ns[i]] != counts[ns[j]] {
+			return counts[ns[i]] > counts[ns[j]]
+		}
+		return ns[i] < ns[j]
+	})
+	ss := make([]string, len(ns))
+	for i, n := range ns {
+		ss[i] = fmt.Sprintf("%s: %d", n, counts[n])
+	}
+	return strings.Join(ss, ", ")
+}
+
+/* roleCounts counts the members of the mesh with each role */
+func roleCounts(m *memberlist.Memberlist) map[string]int {
+	counts := make(map[string]int)
+	for _, n := range m.Members() {
+		counts[nodeRole(n)]++
+	}
+	return counts
+}
+
+/* roleCommand lists the nodes with the role in arg.  Without a role, it
+sends the number of nodes with each role. */
+func roleCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* Without a role, just count */
+	if "" == arg {
+		fmt.Fprintf(w, "%s\n", formatCounts(roleCounts(m)))
+		return nil
+	}
+
+	/* List the nodes doing the role */
+	var ns []*memberlist.Node
+	for _, n := range sortedMembers(m) {
+		if nodeRole(n) == arg {
+			ns = append(ns, n)
+		}
+	}
+	fmt.Fprintf(w, "Nodes with role %s: %d\n", arg, len(ns))
+	for _, n := range ns {
+		fmt.Fprintf(w, "%s\n", FormatNode(n))
+	}
+	return nil
+}
+
+/* gossipCommand bumps our incarnation number and tells the mesh about us,
+which has the effect of gossiping our state immediately rather than waiting
+for the next gossip interval.  Our metadata doesn't change. */
+func gossipCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	start := time.Now()
+	if err := m.UpdateNode(gossipTimeout); nil != err {
+		return fmt.Errorf("pushing state: %w", err)
+	}
+	fmt.Fprintf(
+		w,
+		"Pushed our state to the mesh in %s\n",
+		time.Since(start).Round(time.Millisecond),
+	)
+	return nil
+}
+
+/* rotateKeyCommand makes the key derived from the secret in arg the primary
+gossip key.  It's also SET-SECRET, for use with DROP-OLD-SECRET. */
+func rotateKeyCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	if "" == arg {
+		return errors.New("need a secret")
+	}
+	if err := RotateKey(arg); nil != err {
+		return err
+	}
+	fmt.Fprintf(w, "Rotated to new primary key\n")
+	return nil
+}
+
+/* removeKeyCommand removes the key derived from the secret in arg from the
+keyring. */
+func removeKeyCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	if "" == arg {
+		return errors.New("need a secret")
+	}
+	if err := RemoveKey(arg); nil != err {
+		return err
+	}
+	fmt.Fprintf(w, "Removed key\n")
+	return nil
+}
+
+/* dropOldSecretCommand removes every key but the primary key from the
+keyring. */
+func dropOldSecretCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	n, err := DropOldKeys()
+	if nil != err {
+		return err
+	}
+	log.Printf("[%s] Dropped %d old secrets", lc.Tag(), n)
+	fmt.Fprintf(w, "Dropped %d old secrets\n", n)
+	return nil
+}
+
+/* hostsCommand sends the members of the mesh in /etc/hosts format.  Names
+which aren't valid hostnames are sanitized, with the original name in a
+comment. */
+func hostsCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	for _, n := range sortedMembers(m) {
+		h := hostsName(n.Name)
+		if "" == h {
+			log.Printf(
+				"[%s] Skipping %q in hosts list: "+
+					"no usable characters",
+				lc.Tag(),
+				n.Name,
+			)
+			continue
+		}
+		fmt.Fprintf(w, "%s %s", normalizeIP(n.Addr), h)
+		if h != n.Name {
+			fmt.Fprintf(w, " # %s", n.Name)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return nil
+}
+
+/* configCommand sends the configuration with which our node is running, less
+any secrets, as key=value lines. */
+func configCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	writeConfig(w)
+	return nil
+}
+
+/* csvCommand sends the members of the mesh as CSV, with a header row.  The
+metadata column holds each member's metadata as sent by the member, which is
+normally JSON. */
+func csvCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "addr", "port", "meta"})
+	for _, n := range sortedMembers(m) {
+		cw.Write([]string{
+			n.Name,
+			normalizeIP(n.Addr).String(),
+			strconv.Itoa(int(n.Port)),
+			string(n.Meta),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+/* forgetCommand removes what we've noted about the node named in arg, such
+as when we first saw it and its tombstone.  This is local-only; memberlist
+has no way to remove a node, so a node which is still in the mesh stays in the
+member list and will be noted again when we next hear about it. */
+func forgetCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	if "" == arg {
+		return errors.New("need a name")
+	}
+	if !forgetNode(arg) {
+		return fmt.Errorf("not found: %s", arg)
+	}
+	broadcastAndLogf(
+		eventNotice,
+		nil,
+		"[Forgotten] %s, by %s",
+		arg,
+		lc.Tag(),
+	)
+	for _, n := range m.Members() {
+		if n.Name == arg {
+			fmt.Fprintf(
+				w,
+				"Forgot %s, which is still in the mesh\n",
+				arg,
+			)
+			return nil
+		}
+	}
+	fmt.Fprintf(w, "Forgot %s\n", arg)
+	return nil
+}
+
+/* hostsName turns name into something usable as a hostname in a hosts file.
+Characters other than letters, digits, hyphens, and dots are replaced with
+hyphens and leading and trailing hyphens and dots are removed.  If nothing's
+left, hostsName returns the empty string. */
+func hostsName(name string) string {
+	h := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z',
+			'0' <= r && r <= '9', '.' == r, '-' == r:
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+	h = strings.Trim(h, "-.")
+	if maxHostnameLen < len(h) {
+		h = strings.TrimRight(h[:maxHostnameLen], "-.")
+	}
+	return h
+}
+
+/* probeCommand tries to make TCP connections to the address or member named
+in arg, or to every other member without an argument, and reports which could
+be reached.  This helps to find one-way firewalls. */
+func probeCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* Work out what to probe */
+	var ps []probe
+	switch n := findMember(m, arg); {
+	case "" == arg:
+		ps = memberProbes(m)
+	case nil != n:
+		ps = []probe{{name: n.Name, addr: nodeAddr(n)}}
+	default:
+		if _, _, err := net.SplitHostPort(arg); nil != err {
+			return fmt.Errorf("%q is not a member or address", arg)
+		}
+		ps = []probe{{addr: arg}}
+	}
+	if 0 == len(ps) {
+		fmt.Fprintf(w, "No peers to probe\n")
+		return nil
+	}
+
+	/* Probe ALL the things */
+	runProbes(ps)
+	for _, p := range ps {
+		log.Printf("[%s] Probe: %s", lc.Tag(), p)
+		fmt.Fprintf(w, "%s\n", p)
+	}
+	return nil
+}
+
+/* drainCommand starts draining, after which we leave the mesh and exit */
+func drainCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	if draining.Load() {
+		return errors.New("already draining")
+	}
+	go Drain(m, "Asked to drain by "+lc.Tag(), 0)
+	fmt.Fprintf(w, "Draining\n")
+	return nil
+}
+
+/* lagCommand sends how long the most recent event took to handle, from when
+memberlist gave it to us, and the average and maximum of recent events. */
+func lagCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	last, avg, max, n := eventLag()
+	fmt.Fprintf(
+		w,
+		"last=%s avg=%s max=%s samples=%d\n",
+		last,
+		avg,
+		max,
+		n,
+	)
+	return nil
+}
+
+/* lastEventCommand sends the type of the most recent event we got from
+memberlist and when we got it, as
+last_event=TYPE at 2006-01-02T15:04:05Z (12s ago) */
+func lastEventCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	et, at := LastEvent()
+	if at.IsZero() {
+		fmt.Fprintf(w, "last_event=NONE\n")
+		return nil
+	}
+	var t string
+	switch et {
+	case memberlist.NodeJoin:
+		t = "JOIN"
+	case memberlist.NodeLeave:
+		t = "LEAVE"
+	case memberlist.NodeUpdate:
+		t = "UPDATE"
+	default:
+		t = "UNKNOWN"
+	}
+	fmt.Fprintf(
+		w,
+		"last_event=%s at %s (%s ago)\n",
+		t,
+		at.UTC().Format(time.RFC3339),
+		time.Since(at).Round(time.Second),
+	)
+	return nil
+}
+
+/* subnetsCommand counts the members of the mesh in each subnet.  The arg
+should be the IPv4 prefix length, optionally followed by the IPv6 prefix
+length, which defaults to defaultIPv6SubnetLen. */
+func subnetsCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* Work out the prefix lengths */
+	parts := strings.Fields(arg)
+	if 1 > len(parts) || 2 < len(parts) {
+		return errors.New("need one or two prefix lengths")
+	}
+	v4len, err := parsePrefixLen(parts[0], 32)
+	if nil != err {
+		return fmt.Errorf("invalid IPv4 prefix length: %w", err)
+	}
+	v6len := defaultIPv6SubnetLen
+	if 2 == len(parts) {
+		if v6len, err = parsePrefixLen(parts[1], 128); nil != err {
+			return fmt.Errorf("invalid IPv6 prefix length: %w", err)
+		}
+	}
+
+	fmt.Fprintf(
+		w,
+		"%s\n",
+		formatCounts(countSubnets(m.Members(), v4len, v6len)),
+	)
+	return nil
+}
+
+/* countSubnets counts the nodes in ns in each subnet with the given IPv4 and
+IPv6 prefix lengths. */
+func countSubnets(ns []*memberlist.Node, v4len, v6len int) map[string]int {
+	counts := make(map[string]int)
+	for _, n := range ns {
+		a, ok := netip.AddrFromSlice(normalizeIP(n.Addr))
+		if !ok {
+			counts["unknown"]++
+			continue
+		}
+		a = a.Unmap()
+		l := v6len
+		if a.Is4() {
+			l = v4len
+		}
+		p, err := a.Prefix(l)
+		if nil != err {
+			counts["unknown"]++
+			continue
+		}
+		counts[p.String()]++
+	}
+	return counts
+}
+
+/* parsePrefixLen parses s as a prefix length between 0 and max */
+func parsePrefixLen(s string, max int) (int, error) {
+	l, err := strconv.Atoi(strings.TrimPrefix(s, "/"))
+	if nil != err {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if 0 > l || max < l {
+		return 0, fmt.Errorf("%d is not between 0 and %d", l, max)
+	}
+	return l, nil
+}
+
+/* leaderCommand sends the name of the member with the lexicographically
+smallest name and whether it's us, as leader=NAME self=BOOL.  As members come
+and go, different nodes may briefly disagree. */
+func leaderCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	var leader string
+	for _, n := range m.Members() {
+		if "" == leader || n.Name < leader {
+			leader = n.Name
+		}
+	}
+	fmt.Fprintf(
+		w,
+		"leader=%s self=%t\n",
+		leader,
+		leader == m.LocalNode().Name,
+	)
+	return nil
+}
+
+/* fingerprintCommand sends a SHA-256 hash of the sorted names and addresses
+of the members of the mesh and the number of members, as
+fingerprint=HEX members=N.  Nodes with the same view of the mesh send the same
+fingerprint. */
+func fingerprintCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	ns := sortedMembers(m)
+	h := sha256.New()
+	for _, n := range ns {
+		fmt.Fprintf(h, "%s %s\n", n.Name, nodeAddr(n))
+	}
+	fmt.Fprintf(w, "fingerprint=%x members=%d\n", h.Sum(nil), len(ns))
+	return nil
+}
+
+/* sinceCommand lists the members of the mesh which joined or were updated
+after the RFC3339 time in arg, along with when, as name (addr) changed.  Only
+changes this node's seen are counted. */
+func sinceCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	since, err := time.Parse(time.RFC3339, arg)
+	if nil != err {
+		return fmt.Errorf("invalid RFC3339 time %q", arg)
+	}
+	if since.After(time.Now()) {
+		return fmt.Errorf("%s is in the future", arg)
+	}
+	for _, n := range sortedMembers(m) {
+		t, ok := LastChanged(n.Name)
+		if !ok || !t.After(since) {
+			continue
+		}
+		fmt.Fprintf(
+			w,
+			"%s %s\n",
+			FormatNode(n),
+			t.UTC().Format(time.RFC3339),
+		)
+	}
+	return nil
+}
+
+/* convergenceCommand sends how long it's been since the last membership
+change, whether that's long enough to call the mesh converged, and the spread
+of when we first saw the current members join, as a rough idea of how long the
+mesh took to form. */
+func convergenceCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* How long have things been quiet? */
+	quiet := "NONE"
+	converged := false
+	if _, at := LastEvent(); !at.IsZero() {
+		d := time.Since(at)
+		quiet = d.Round(time.Second).String()
+		converged = convergeQuiet <= d
+	}
+
+	/* How long did the current members take to turn up? */
+	var first, last time.Time
+	ns := m.Members()
+	for _, n := range ns {
+		t, ok := FirstSeen(n.Name)
+		if !ok {
+			continue
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if last.IsZero() || t.After(last) {
+			last = t
+		}
+	}
+
+	fmt.Fprintf(
+		w,
+		"last_change=%s converged=%t formation=%s members=%d\n",
+		quiet,
+		converged,
+		last.Sub(first).Round(time.Millisecond),
+		len(ns),
+	)
+	return nil
+}
+
+/* netStatsCommand sends the number of bytes and packets of mesh traffic
+we've sent and received. */
+func netStatsCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	fmt.Fprintf(
+		w,
+		"tx_bytes=%d\nrx_bytes=%d\ntx_packets=%d\nrx_packets=%d\n",
+		netStats.txBytes.Load(),
+		netStats.rxBytes.Load(),
+		netStats.txPackets.Load(),
+		netStats.rxPackets.Load(),
+	)
+	return nil
+}
+
+/* topCommand sends the k highest-weighted members, where k is in arg,
+highest first.  Members with the same weight are sorted by name. */
+func topCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	k, err := strconv.Atoi(arg)
+	if nil != err || 1 > k {
+		return fmt.Errorf("need a positive number, not %q", arg)
+	}
+	ns := sortedMembers(m)
+	ws := make(map[string]int, len(ns))
+	for _, n := range ns {
+		ws[n.Name] = ParseMeta(n.Meta).Weight
+	}
+	sort.SliceStable(ns, func(i, j int) bool {
+		return ws[ns[i].Name] > ws[ns[j].Name]
+	})
+	if k < len(ns) {
+		ns = ns[:k]
+	}
+	for _, n := range ns {
+		fmt.Fprintf(w, "%s\n", FormatNode(n))
+	}
+	return nil
+}
+
+/* savePeersCommand saves the other members' addresses to the peers cache and
+sends how many were saved. */
+func savePeersCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	n, err := SavePeers(m)
+	if nil != err {
+		return err
+	}
+	fmt.Fprintf(w, "Saved %d peers to %s\n", n, peersCache)
+	return nil
+}
+
+/* echoStats are the round-trip times of lines sent by ECHO and echoed back
+by the client. */
+type echoStats struct {
+	sent     int /* Lines sent by the last ECHO */
+	got      int /* Lines echoed back */
+	min, max time.Duration
+	total    time.Duration
+}
+
+/* echoCommand sends the client n test lines, where n is in arg, as fast as
+it can, and then how long that took.  Each line is an ECHOED command holding
+the time it was sent; if the client sends them back, echoedCommand works out
+the round-trip times.  The lines are sent by lc's writer, so other clients
+aren't held up and lc's events aren't interleaved with them. */
+func echoCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	n, err := strconv.Atoi(arg)
+	if nil != err || 1 > n || maxEchoLines < n {
+		return fmt.Errorf(
+			"need a number between 1 and %d, not %q",
+			maxEchoLines,
+			arg,
+		)
+	}
+	lc.echo = echoStats{sent: n}
+
+	/* Send the lines all in one go */
+	var b []byte
+	start := time.Now()
+	for i := 1; i <= n; i++ {
+		b = fmt.Appendf(b, "ECHOED %d %d\n", i, time.Now().UnixNano())
+	}
+	if err := lc.reply(b); nil != err {
+		return fmt.Errorf("sending lines: %w", err)
+	}
+	d := time.Since(start)
+
+	fmt.Fprintf(
+		w,
+		"ECHO sent=%d bytes=%d elapsed=%s rate=%.0f/s\n",
+		n,
+		len(b),
+		d,
+		float64(n)/d.Seconds(),
+	)
+	return nil
+}
+
+/* echoedCommand handles a line sent by ECHO and echoed back by the client.
+Once all of the lines from the last ECHO are back, it sends the round-trip
+times. */
+func echoedCommand(
+	w io.Writer,
+	lc *localClient,
+	m *memberlist.Memberlist,
+	arg string,
+) error {
+	/* Work out how long the line took */
+	_, ts, ok := strings.Cut(arg, " ")
+	if !ok {
+		return fmt.Errorf("need a line sent by ECHO, not %q", arg)
+	}
+	ns, err := strconv.ParseInt(ts, 10, 64)
+	if nil != err {
+		return fmt.Errorf("parsing send time %q: %w", ts, err)
+	}
+	if lc.echo.got >= lc.echo.sent {
+		return nil /* Extra or late line */
+	}
+	rtt := time.Since(time.Unix(0, ns))
+
+	/* Note it, and if we've got them all, tell the client */
+	es := &lc.echo
+	if 0 == es.got || rtt < es.min {
+		es.min = rtt
+	}
+	if rtt > es.max {
+		es.max = rtt
+	}
+	es.total += rtt
+	es.got++
+	if es.got < es.sent {
+		return nil
+	}
+	fmt.Fprintf(
+		w,
+		"ECHO received=%d min=%s avg=%s max=%s\n",
+		es.got,
+		es.min,
+		es.total/time.Duration(es.got),
+		es.max,
+	)
+	return nil
+}
@@ -0,0 +1,735 @@
+package main
+
+/*
+ * command_test.go
+ * Tests for command.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestWatchCommand makes sure WATCH limits events to the watched node */
+func TestWatchCommand(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	tc := newTestClient(t, ms[0], false)
+
+	tc.send("WATCH b")
+	if l := tc.readLine(); "Watching b" != l {
+		t.Fatalf("Got %q", l)
+	}
+	if l := tc.readLine(); !strings.HasPrefix(l, "b (") {
+		t.Fatalf("Current node not sent, got %q", l)
+	}
+
+	BroadcastNodef(ms[0].LocalNode(), "about a")
+	BroadcastNodef(ms[1].LocalNode(), "about b")
+	Broadcastf("done")
+	got := tc.readUntil("done")
+	if want := []string{"about b", "done"}; !slices.Equal(want, got) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+
+	/* And back to everything */
+	tc.send("WATCH")
+	if l := tc.readLine(); "Watching all nodes" != l {
+		t.Fatalf("Got %q", l)
+	}
+	BroadcastNodef(ms[0].LocalNode(), "about a")
+	if l := tc.readLine(); "about a" != l {
+		t.Fatalf("Got %q after unwatching", l)
+	}
+}
+
+/* TestClientsCommand makes sure CLIENTS lists every client and what it's
+subscribed to. */
+func TestClientsCommand(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	admin := newTestClient(t, ms[0], true)
+	other := newTestClient(t, ms[0], false)
+
+	/* Only admins get to see clients */
+	other.send("CLIENTS")
+	if l := other.readLine(); !strings.Contains(l, "only available") {
+		t.Fatalf("Non-admin CLIENTS got %q", l)
+	}
+
+	admin.send("CLIENTS")
+	want := []string{
+		admin.lc.tag + " pipe text all",
+		other.lc.tag + " pipe text all",
+	}
+	slices.Sort(want)
+	if got := sortedLines(admin, len(want)); !slices.Equal(want, got) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+
+	/* Subscriptions should all show up */
+	other.send("WATCH b")
+	other.readUntil("b (")
+	other.send("REGION 10.0.0.0/8, 192.0.2.0/24")
+	other.readUntil("Receiving")
+	other.send("PAUSE")
+	other.readUntil("Paused")
+	admin.send("CLIENTS")
+	want = []string{admin.lc.tag + " pipe text all", other.lc.tag +
+		" pipe text watch=b,regions=10.0.0.0/8+192.0.2.0/24,paused"}
+	slices.Sort(want)
+	if got := sortedLines(admin, len(want)); !slices.Equal(want, got) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+}
+
+/* sortedLines reads n lines from tc and sorts them */
+func sortedLines(tc *testClient, n int) []string {
+	ls := make([]string, n)
+	for i := range ls {
+		ls[i] = tc.readLine()
+	}
+	slices.Sort(ls)
+	return ls
+}
+
+/* TestDotCommand makes sure DOT sends a plausible Graphviz graph */
+func TestDotCommand(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	tc := newTestClient(t, ms[0], false)
+	tc.send("DOT")
+	ls := tc.readUntil("}")
+	if "digraph meshmembers {" != ls[0] {
+		t.Fatalf("Graph starts with %q", ls[0])
+	}
+	if "}" != ls[len(ls)-1] || 4 != len(ls) {
+		t.Fatalf("Unexpected graph %q", ls)
+	}
+	for i, name := range []string{"a", "b"} {
+		if !strings.HasPrefix(
+			ls[i+1],
+			"\t\""+name+"\" [label=\""+name+" (",
+		) {
+			t.Fatalf("Bad vertex %q", ls[i+1])
+		}
+	}
+
+	/* Names with quotes shouldn't break the graph */
+	if got, want := dotQuote("a\"b\\c\nd"), `"a\"b\\c\nd"`; want != got {
+		t.Fatalf("Quoted as %s, expected %s", got, want)
+	}
+}
+
+/* TestRawCommand makes sure RAW sends a node as readable JSON */
+func TestRawCommand(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	tc := newTestClient(t, ms[0], true)
+
+	tc.send("RAW b")
+	var ls []string
+	for l := ""; "}" != l; {
+		l = tc.readLine()
+		ls = append(ls, l)
+	}
+	var n struct {
+		Name string
+		Addr string
+		Port uint16
+		PMax uint8
+	}
+	if err := json.Unmarshal(
+		[]byte(strings.Join(ls, "\n")),
+		&n,
+	); nil != err {
+		t.Fatalf("Unmarshalling %q: %v", ls, err)
+	}
+	want := ms[1].LocalNode()
+	if "b" != n.Name ||
+		!want.Addr.Equal(net.ParseIP(n.Addr)) ||
+		want.Port != n.Port ||
+		want.PMax != n.PMax {
+		t.Fatalf("Got %+v, expected %+v", n, want)
+	}
+
+	/* Unknown nodes aren't */
+	tc.send("RAW moose")
+	if l := tc.readLine(); `Error: no node named "moose"` != l {
+		t.Fatalf("Got %q", l)
+	}
+}
+
+/* TestPlatformsCommand makes sure PLATFORMS counts nodes' platforms, even
+with extra bits in their names. */
+func TestPlatformsCommand(t *testing.T) {
+	ms := newTestMesh(
+		t,
+		nil,
+		"linux-amd64-02:00:00:00:00:01-x",
+		"web-linux-amd64-unknown-y",
+		"darwin-arm64-z",
+		"moose",
+	)
+	tc := newTestClient(t, ms[0], false)
+	tc.send("PLATFORMS")
+	want := "linux-amd64: 2, darwin-arm64: 1, unknown: 1"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+}
+
+/* TestRoleCommand makes sure ROLE finds nodes by role */
+func TestRoleCommand(t *testing.T) {
+	roles := map[string]string{
+		"a": "gateway",
+		"b": "worker",
+		"c": "gateway",
+		"d": "",
+	}
+	ms := newTestMesh(t, func(conf *memberlist.Config) {
+		conf.Delegate = NewDelegate(NodeMeta{Role: roles[conf.Name]})
+	}, "a", "b", "c", "d")
+	tc := newTestClient(t, ms[0], false)
+
+	tc.send("ROLE gateway")
+	for _, want := range []string{
+		"Nodes with role gateway: 2",
+		"a (",
+		"c (",
+	} {
+		if l := tc.readLine(); !strings.HasPrefix(l, want) {
+			t.Fatalf("Got %q, expected %q...", l, want)
+		}
+	}
+
+	tc.send("ROLE")
+	want := "gateway: 2, none: 1, worker: 1"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+}
+
+/* TestProtoCommand makes sure clients get a banner and can pick a protocol
+version. */
+func TestProtoCommand(t *testing.T) {
+	ms := newTestMesh(t, nil, "a")
+	tc := connectTestClient(t, ms[0], clientOpts{snapshot: true})
+	if l := tc.readLine(); "MESHMEMBERS 1" != l {
+		t.Fatalf("Got banner %q", l)
+	}
+	tc.readUntil("a (")
+
+	for _, c := range [][2]string{
+		{"PROTO", "PROTO 1"},
+		{"PROTO 1", "PROTO 1"},
+		{"PROTO 2", "Error: unsupported version 2, maximum is 1"},
+		{"PROTO 0", "Error: unsupported version 0, maximum is 1"},
+		{"PROTO x", `Error: invalid version "x"`},
+		{"PROTO", "PROTO 1"},
+	} {
+		tc.send("%s", c[0])
+		if l := tc.readLine(); c[1] != l {
+			t.Fatalf("%s: got %q, expected %q", c[0], l, c[1])
+		}
+	}
+}
+
+/* TestGossipCommand makes sure GOSSIP tells the mesh about changes to our
+metadata without waiting for a push/pull. */
+func TestGossipCommand(t *testing.T) {
+	var da *Delegate
+	ms := newTestMesh(t, func(conf *memberlist.Config) {
+		conf.PushPullInterval = time.Hour
+		if "a" == conf.Name {
+			da = conf.Delegate.(*Delegate)
+		}
+	}, "a", "b")
+	tc := newTestClient(t, ms[0], true)
+	draining := func() bool {
+		n := findMember(ms[1], "a")
+		return nil != n && ParseMeta(n.Meta).Draining
+	}
+
+	/* Without GOSSIP, b doesn't hear about it */
+	da.SetDraining(true)
+	time.Sleep(200 * time.Millisecond)
+	if draining() {
+		t.Fatalf("Metadata change spread without GOSSIP")
+	}
+
+	/* With GOSSIP, it does */
+	tc.send("GOSSIP")
+	if l := tc.readLine(); !strings.HasPrefix(l, "Pushed our state") {
+		t.Fatalf("Got %q", l)
+	}
+	waitFor(t, "metadata change to spread", draining)
+}
+
+/* TestHostsCommand makes sure HOSTS sends valid hosts file lines */
+func TestHostsCommand(t *testing.T) {
+	ms := newTestMesh(
+		t,
+		nil,
+		"a.example",
+		"linux-amd64-02:fc:00:00:00:01-x",
+		"!!!",
+	)
+	tc := newTestClient(t, ms[0], false)
+	tc.send("HOSTS")
+	got := []string{tc.readLine(), tc.readLine(), "(end)"}
+	tc.send("LAG") /* Make sure nothing else was sent */
+	if l := tc.readLine(); !strings.HasPrefix(l, "last=") {
+		got = append(got, l)
+	}
+	want := []string{
+		"127.0.0.1 a.example",
+		"127.0.0.1 linux-amd64-02-fc-00-00-00-01-x " +
+			"# linux-amd64-02:fc:00:00:00:01-x",
+		"(end)",
+	}
+	if !slices.Equal(want, got) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+
+	/* Long names get shortened */
+	if h := hostsName(strings.Repeat("a", 300)); maxHostnameLen != len(h) {
+		t.Fatalf("Long name shortened to %d characters", len(h))
+	}
+}
+
+/* TestHelloCommand makes sure HELLO labels the client's tag, and only if it's
+sensible and first. */
+func TestHelloCommand(t *testing.T) {
+	for _, c := range []struct{ label, want string }{
+		{"bad\tlabel", "Error: label contains unusable characters"},
+		{
+			strings.Repeat("x", maxHelloLabelLen+1),
+			fmt.Sprintf(
+				"Error: label too long, maximum length is "+
+					"%d bytes",
+				maxHelloLabelLen,
+			),
+		},
+	} {
+		tc := newTestClient(t, nil, false)
+		tc.send("HELLO %s", c.label)
+		if l := tc.readLine(); c.want != l {
+			t.Fatalf("HELLO %q got %q", c.label, l)
+		}
+	}
+
+	tc := newTestClient(t, nil, false)
+	tag := tc.lc.Tag()
+	tc.send("HELLO prometheus")
+	want := tag + "(prometheus)"
+	if l := tc.readLine(); "Hello, "+want != l {
+		t.Fatalf("Got %q", l)
+	}
+	if got := tc.lc.Tag(); want != got {
+		t.Fatalf("Tag is %q, expected %q", got, want)
+	}
+
+	/* Once is enough */
+	tc.send("HELLO again")
+	if l := tc.readLine(); "Error: HELLO must be the first command" != l {
+		t.Fatalf("Second HELLO got %q", l)
+	}
+}
+
+/* TestSubnetsCommand makes sure SUBNETS groups members by subnet and only
+takes sensible prefix lengths. */
+func TestSubnetsCommand(t *testing.T) {
+	var ns []*memberlist.Node
+	for _, a := range []string{
+		"10.0.1.1",
+		"10.0.1.2",
+		"::ffff:10.0.1.3",
+		"10.0.2.1",
+		"192.0.2.1",
+		"2001:db8:0:1::1",
+		"2001:db8:0:1::2",
+		"2001:db8:0:2::1",
+	} {
+		ns = append(ns, &memberlist.Node{Addr: net.ParseIP(a)})
+	}
+	ns = append(ns, &memberlist.Node{})
+	for _, c := range []struct {
+		v4, v6 int
+		want   string
+	}{
+		{24, 64, "10.0.1.0/24: 3, 2001:db8:0:1::/64: 2, " +
+			"10.0.2.0/24: 1, 192.0.2.0/24: 1, " +
+			"2001:db8:0:2::/64: 1, unknown: 1"},
+		{8, 32, "10.0.0.0/8: 4, 2001:db8::/32: 3, " +
+			"192.0.0.0/8: 1, unknown: 1"},
+	} {
+		got := formatCounts(countSubnets(ns, c.v4, c.v6))
+		if c.want != got {
+			t.Errorf("/%d /%d: got %q", c.v4, c.v6, got)
+		}
+	}
+
+	ms := newTestMesh(t, nil, "a", "b")
+	tc := newTestClient(t, ms[0], false)
+	for _, c := range [][2]string{
+		{"SUBNETS 24", "127.0.0.0/24: 2"},
+		{"SUBNETS /16 48", "127.0.0.0/16: 2"},
+		{"SUBNETS", "Error: need one or two prefix lengths"},
+		{"SUBNETS 33", "Error: invalid IPv4 prefix length: " +
+			"33 is not between 0 and 32"},
+		{"SUBNETS 24 129", "Error: invalid IPv6 prefix length: " +
+			"129 is not between 0 and 128"},
+		{"SUBNETS x", `Error: invalid IPv4 prefix length: ` +
+			`"x" is not a number`},
+	} {
+		tc.send("%s", c[0])
+		if l := tc.readLine(); c[1] != l {
+			t.Errorf("%s: got %q, expected %q", c[0], l, c[1])
+		}
+	}
+}
+
+/* TestLeaderCommand makes sure every node agrees on the leader and only the
+leader thinks it's the leader. */
+func TestLeaderCommand(t *testing.T) {
+	ms := newTestMesh(t, nil, "c", "a", "d", "b")
+	for _, m := range ms {
+		tc := newTestClient(t, m, false)
+		tc.send("LEADER")
+		want := fmt.Sprintf(
+			"leader=a self=%t",
+			"a" == m.LocalNode().Name,
+		)
+		if l := tc.readLine(); want != l {
+			t.Errorf(
+				"%s: got %q, expected %q",
+				m.LocalNode().Name,
+				l,
+				want,
+			)
+		}
+	}
+}
+
+/* TestFingerprintCommand makes sure nodes with the same view of the mesh send
+the same fingerprint, and that it changes when the mesh does. */
+func TestFingerprintCommand(t *testing.T) {
+	fingerprint := func(m *memberlist.Memberlist) string {
+		t.Helper()
+		tc := newTestClient(t, m, false)
+		tc.send("FINGERPRINT")
+		return tc.readLine()
+	}
+
+	/* Mock networks give out the same addresses, so identical meshes
+	should have identical fingerprints. */
+	ms := newTestMesh(t, nil, "a", "b", "c")
+	others := newTestMesh(t, nil, "a", "b", "c")
+	want := fingerprint(ms[0])
+	if !strings.HasSuffix(want, " members=3") {
+		t.Fatalf("Got %q", want)
+	}
+	for _, m := range append(ms[1:], others...) {
+		if got := fingerprint(m); want != got {
+			t.Fatalf("Got %q, expected %q", got, want)
+		}
+	}
+
+	/* A different mesh is different */
+	if err := ms[2].Leave(time.Second); nil != err {
+		t.Fatalf("Leaving: %v", err)
+	}
+	ms[2].Shutdown()
+	waitFor(t, "node to leave", func() bool {
+		return 2 == ms[0].NumMembers()
+	})
+	got := fingerprint(ms[0])
+	if !strings.HasSuffix(got, " members=2") ||
+		strings.Fields(want)[0] == strings.Fields(got)[0] {
+		t.Fatalf("Got %q after leaving, had %q", got, want)
+	}
+}
+
+/* TestPauseCommand makes sure a paused client gets no events until it
+resumes, and that events sent while it's paused are dropped, not queued. */
+func TestPauseCommand(t *testing.T) {
+	tc := newTestClient(t, nil, false)
+	tc.send("PAUSE")
+	if l := tc.readLine(); !strings.HasPrefix(l, "Paused") {
+		t.Fatalf("Got %q", l)
+	}
+	Broadcastf("dropped")
+	tc.send("RESUME")
+	if l := tc.readLine(); "Resumed" != l {
+		t.Fatalf("Got %q", l)
+	}
+	Broadcastf("sent")
+	if l := tc.readLine(); "sent" != l {
+		t.Fatalf("Got %q after resuming", l)
+	}
+}
+
+/* TestRegionCommand makes sure REGION limits events to those about nodes in
+the client's ranges. */
+func TestRegionCommand(t *testing.T) {
+	tc := newTestClient(t, nil, false)
+	for _, c := range []struct {
+		cmd  string
+		want string
+	}{
+		{"REGION moose", `Error: invalid CIDR range "moose"`},
+		{
+			"REGION 192.0.2.7/24, 2001:db8::/32",
+			"Receiving events about nodes in 192.0.2.0/24, " +
+				"2001:db8::/32",
+		},
+	} {
+		tc.send("%s", c.cmd)
+		if l := tc.readLine(); c.want != l {
+			t.Fatalf("%s: got %q, expected %q", c.cmd, l, c.want)
+		}
+	}
+
+	/* Only nodes in range, and events not about a node, get through */
+	for _, ip := range []string{
+		"198.51.100.1",
+		"192.0.2.1",
+		"2001:db9::1",
+		"::ffff:192.0.2.2",
+		"2001:db8::1",
+	} {
+		BroadcastNodef(
+			&memberlist.Node{Name: ip, Addr: net.ParseIP(ip)},
+			"about %s",
+			ip,
+		)
+	}
+	Broadcastf("about nobody")
+	for _, want := range []string{
+		"about 192.0.2.1",
+		"about ::ffff:192.0.2.2",
+		"about 2001:db8::1",
+		"about nobody",
+	} {
+		if l := tc.readLine(); want != l {
+			t.Fatalf("Got %q, expected %q", l, want)
+		}
+	}
+
+	/* No ranges, no filter */
+	tc.send("REGION")
+	if l := tc.readLine(); "Receiving events about all nodes" != l {
+		t.Fatalf("Got %q after clearing ranges", l)
+	}
+	BroadcastNodef(
+		&memberlist.Node{Name: "x", Addr: net.ParseIP("198.51.100.1")},
+		"out of range",
+	)
+	if l := tc.readLine(); "out of range" != l {
+		t.Fatalf("Got %q without ranges", l)
+	}
+}
+
+/* TestTopCommand makes sure TOP sends the highest-weighted nodes, highest
+first, with ties broken by name. */
+func TestTopCommand(t *testing.T) {
+	weights := map[string]int{"a": 1, "b": 5, "c": 3, "d": 5}
+	ms := newTestMesh(t, func(conf *memberlist.Config) {
+		conf.Delegate = NewDelegate(NodeMeta{
+			ID:     "id-" + conf.Name,
+			Weight: weights[conf.Name],
+		})
+	}, "a", "b", "c", "d")
+	tc := newTestClient(t, ms[0], false)
+
+	for _, c := range []struct {
+		k    string
+		want []string
+	}{
+		{"3", []string{"b", "d", "c"}},
+		{"10", []string{"b", "d", "c", "a"}},
+		{"1", []string{"b"}},
+	} {
+		tc.send("TOP %s", c.k)
+		var got []string
+		for range c.want {
+			l := tc.readLine()
+			name, _, _ := strings.Cut(l, " ")
+			if want := fmt.Sprintf(
+				" [w=%d]",
+				weights[name],
+			); !strings.HasSuffix(l, want) {
+				t.Errorf("TOP %s: %q has no weight", c.k, l)
+			}
+			got = append(got, name)
+		}
+		if !slices.Equal(c.want, got) {
+			t.Errorf(
+				"TOP %s: got %q, expected %q",
+				c.k,
+				got,
+				c.want,
+			)
+		}
+	}
+
+	for _, k := range []string{"0", "-1", "moose", ""} {
+		tc.send("TOP %s", k)
+		want := fmt.Sprintf(
+			"Error: need a positive number, not %q",
+			k,
+		)
+		if l := tc.readLine(); want != l {
+			t.Errorf("TOP %s: got %q, expected %q", k, l, want)
+		}
+	}
+}
+
+/* TestEchoCommand makes sure ECHO sends the requested number of lines, is only
+for admin clients, and sends round-trip times once the lines come back. */
+func TestEchoCommand(t *testing.T) {
+	const n = 5
+	tc := newTestClient(t, nil, false)
+	tc.send("ECHO %d", n)
+	if l := tc.readLine(); "ECHO is only available to admin clients" != l {
+		t.Fatalf("Non-admin client got %q", l)
+	}
+	tc = newTestClient(t, nil, true)
+
+	/* Too many or too few lines */
+	for _, arg := range []string{"0", fmt.Sprint(maxEchoLines + 1), "x"} {
+		tc.send("ECHO %s", arg)
+		if l := tc.readLine(); !strings.HasPrefix(l, "Error: ") {
+			t.Fatalf("ECHO %s got %q", arg, l)
+		}
+	}
+
+	/* Just right */
+	tc.send("ECHO %d", n)
+	var got []string
+	for i := 1; i <= n; i++ {
+		l := tc.readLine()
+		if want := fmt.Sprintf("ECHOED %d ", i); !strings.HasPrefix(
+			l,
+			want,
+		) {
+			t.Fatalf("Line %d is %q", i, l)
+		}
+		got = append(got, l)
+	}
+	want := fmt.Sprintf("ECHO sent=%d ", n)
+	if l := tc.readLine(); !strings.HasPrefix(l, want) {
+		t.Fatalf("Got summary %q", l)
+	}
+
+	/* Send it all back */
+	for _, l := range got {
+		tc.send("%s", l)
+	}
+	want = fmt.Sprintf("ECHO received=%d min=", n)
+	if l := tc.readLine(); !strings.HasPrefix(l, want) {
+		t.Fatalf("Got round-trip times %q", l)
+	}
+}
+
+/* TestCSVCommand makes sure CSV sends valid CSV, even for members with names
+which need quoting. */
+func TestCSVCommand(t *testing.T) {
+	names := []string{"a", "b,c", `d"e`}
+	ms := newTestMesh(t, func(conf *memberlist.Config) {
+		conf.Delegate = NewDelegate(NodeMeta{ID: "id-" + conf.Name})
+	}, names...)
+	tc := newTestClient(t, ms[0], false)
+
+	tc.send("CSV")
+	var b strings.Builder
+	for range 1 + len(names) {
+		b.WriteString(tc.readLine() + "\n")
+	}
+	recs, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if nil != err {
+		t.Fatalf("Parsing %q: %v", b.String(), err)
+	}
+	if want := []string{"name", "addr", "port", "meta"}; !slices.Equal(
+		want,
+		recs[0],
+	) {
+		t.Fatalf("Got header %q, expected %q", recs[0], want)
+	}
+	for i, rec := range recs[1:] {
+		n := ms[i].LocalNode()
+		want := []string{
+			n.Name,
+			normalizeIP(n.Addr).String(),
+			fmt.Sprint(n.Port),
+			string(n.Meta),
+		}
+		if !slices.Equal(want, rec) {
+			t.Errorf("Got row %q, expected %q", rec, want)
+		}
+		if id := ParseMeta([]byte(rec[3])).ID; "id-"+n.Name != id {
+			t.Errorf("Row %q has ID %q", rec, id)
+		}
+	}
+}
+
+/* TestForgetCommand makes sure FORGET removes what we've noted about a node,
+and says when the node's still in the mesh. */
+func TestForgetCommand(t *testing.T) {
+	tombstoneTTL = time.Hour
+	t.Cleanup(func() {
+		tombstoneTTL = 0
+		forgetNode("b")
+		forgetNode("ghost")
+	})
+	captureLog(t)
+	ms := newTestMesh(t, nil, "a", "b")
+	tc := newTestClient(t, ms[0], true)
+	trackEvent(memberlist.NodeEvent{
+		Event: memberlist.NodeJoin,
+		Node:  ms[1].LocalNode(),
+	})
+	trackEvent(memberlist.NodeEvent{
+		Event: memberlist.NodeLeave,
+		Node:  &memberlist.Node{Name: "ghost"},
+	})
+	hasTombstone := func(name string) bool {
+		for _, ts := range Tombstones() {
+			if name == ts.Node.Name {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasTombstone("ghost") {
+		t.Fatalf("No tombstone for ghost")
+	}
+
+	for _, c := range []struct {
+		name string
+		want string
+	}{
+		{"ghost", "Forgot ghost"},
+		{"b", "Forgot b, which is still in the mesh"},
+		{"ghost", "Error: not found: ghost"},
+	} {
+		tc.send("FORGET %s", c.name)
+		if got := tc.readUntil(c.want); c.want != got[len(got)-1] {
+			t.Fatalf("FORGET %s got %q", c.name, got)
+		}
+	}
+	if hasTombstone("ghost") {
+		t.Fatalf("Ghost's tombstone not forgotten")
+	}
+	if _, ok := FirstSeen("b"); ok {
+		t.Fatalf("Still know when b was first seen")
+	}
+}
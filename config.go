@@ -0,0 +1,111 @@
+package main
+
+/*
+ * config.go
+ * Remember our configuration, for CONFIG
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* nodeConfig is the configuration with which our node is running, as worked
+out from flags and our surroundings.  Secrets are deliberately left out. */
+type nodeConfig struct {
+	Name           string
+	Listen         string
+	Advertise      net.IP
+	Port           uint16
+	Profile        string
+	ReportInterval time.Duration
+	Encryption     bool
+	DefaultSecret  bool
+	Compression    bool
+	Label          string
+	Role           string
+	Weight         int
+	Observer       bool
+	UDPBuffer      int
+}
+
+/* runningConfig is our node's configuration.  It's set once the node's
+started, before any clients connect, and its name and address are changed if
+we replace our node, e.g. to rejoin with a new name after name conflicts.
+runningConfigL protects it. */
+var (
+	runningConfig  nodeConfig
+	runningConfigL sync.Mutex
+)
+
+/* noteConfig gathers the configuration from conf and the rest of our node
+into runningConfig.  Anything not in conf is in nc. */
+func noteConfig(
+	m *memberlist.Memberlist,
+	conf *memberlist.Config,
+	nc nodeConfig,
+) {
+	ln := m.LocalNode()
+	nc.Name = ln.Name
+	nc.Listen = conf.BindAddr
+	nc.Advertise = normalizeIP(ln.Addr)
+	nc.Port = ln.Port
+	nc.Encryption = nil != conf.Keyring &&
+		0 != len(conf.Keyring.GetKeys())
+	nc.Compression = conf.EnableCompression
+	nc.Label = conf.Label
+	nc.UDPBuffer = conf.UDPBufferSize
+	nm := ParseMeta(localDelegate.NodeMeta(memberlist.MetaMaxSize))
+	nc.Role = nm.Role
+	nc.Weight = nm.Weight
+	nc.Observer = nm.Observer
+	runningConfigL.Lock()
+	defer runningConfigL.Unlock()
+	runningConfig = nc
+}
+
+/* noteNewNode changes the name, advertised address, and port in
+runningConfig to n's, after we've replaced our node with n. */
+func noteNewNode(n *memberlist.Node) {
+	runningConfigL.Lock()
+	defer runningConfigL.Unlock()
+	runningConfig.Name = n.Name
+	runningConfig.Advertise = normalizeIP(n.Addr)
+	runningConfig.Port = n.Port
+}
+
+/* writeConfig writes runningConfig to w, as key=value lines. */
+func writeConfig(w io.Writer) {
+	runningConfigL.Lock()
+	c := runningConfig
+	runningConfigL.Unlock()
+	for _, kv := range []struct {
+		k string
+		v interface{}
+	}{
+		{"name", c.Name},
+		{"listen", c.Listen},
+		{"advertise", c.Advertise},
+		{"port", c.Port},
+		{"profile", c.Profile},
+		{"report_interval", c.ReportInterval},
+		{"encryption", c.Encryption},
+		{"default_secret", c.DefaultSecret},
+		{"compression", c.Compression},
+		{"label", c.Label},
+		{"role", c.Role},
+		{"weight", c.Weight},
+		{"observer", c.Observer},
+		{"udp_buffer", c.UDPBuffer},
+	} {
+		fmt.Fprintf(w, "%s=%v\n", kv.k, kv.v)
+	}
+}
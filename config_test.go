@@ -0,0 +1,91 @@
+package main
+
+/*
+ * config_test.go
+ * Tests for config.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestConfigCommand makes sure CONFIG sends the configuration we're running
+with, to admin clients only, and never the secret. */
+func TestConfigCommand(t *testing.T) {
+	const secret = "test-secret"
+	rc := runningConfig
+	t.Cleanup(func() {
+		runningConfig = rc
+		localDelegate = nil
+	})
+	var conf *memberlist.Config
+	ms := newTestMesh(t, func(c *memberlist.Config) {
+		localDelegate = NewDelegate(NodeMeta{Role: "gateway"})
+		c.Delegate = localDelegate
+		c.Label = "lbl"
+		conf = c
+	}, "a")
+	noteConfig(ms[0], conf, nodeConfig{
+		Profile:        "local",
+		ReportInterval: time.Minute,
+	})
+
+	tc := newTestClient(t, ms[0], false)
+	tc.send("CONFIG")
+	want := "CONFIG is only available to admin clients"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Non-admin client got %q", l)
+	}
+
+	tc = newTestClient(t, ms[0], true)
+	tc.send("CONFIG")
+	got := make(map[string]string)
+	for _, l := range tc.readUntil("udp_buffer=") {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			t.Fatalf("Invalid config line %q", l)
+		}
+		got[k] = v
+	}
+	for _, k := range []string{"listen", "advertise", "port", "weight"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("No %s", k)
+		}
+	}
+	for k, v := range map[string]string{
+		"name":            "a",
+		"profile":         "local",
+		"report_interval": "1m0s",
+		"encryption":      "true",
+		"default_secret":  "false",
+		"label":           "lbl",
+		"role":            "gateway",
+	} {
+		if g, ok := got[k]; !ok {
+			t.Errorf("No %s", k)
+		} else if v != g {
+			t.Errorf("Got %s=%s, expected %s", k, g, v)
+		}
+	}
+	key := DeriveKey(secret)
+	for k, v := range got {
+		for _, s := range []string{
+			secret,
+			hex.EncodeToString(key),
+			base64.StdEncoding.EncodeToString(key),
+		} {
+			if strings.Contains(v, s) {
+				t.Errorf("Secret sent in %s=%s", k, v)
+			}
+		}
+	}
+}
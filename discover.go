@@ -0,0 +1,295 @@
+package main
+
+/*
+ * discover.go
+ * Find peers on the LAN
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	/* discoverInterval is how often we announce ourselves on the LAN */
+	discoverInterval = 10 * time.Second
+
+	/* discoverPrefix starts every LAN announcement */
+	discoverPrefix = "meshmembers-discover"
+
+	/* discoverBufSize is the size of the buffer into which we read LAN
+	announcements, which is much bigger than any legit announcement */
+	discoverBufSize = 1024
+
+	/* discoverMaxAge is how far an announcement's timestamp may be from
+	our clock before it's rejected as stale, allowing for a bit of clock
+	skew */
+	discoverMaxAge = 3 * discoverInterval
+
+	/* discoverNonceLen is the number of random bytes in an announcement's
+	nonce */
+	discoverNonceLen = 16
+
+	/* discoverWarnInterval is the least time between log messages about
+	bad LAN announcements, so anybody on the LAN can't flood our logs */
+	discoverWarnInterval = time.Minute
+)
+
+// DiscoverLAN periodically announces our address to the multicast group and
+// joins nodes which announce theirs.  Announcements are authenticated with an
+// HMAC using kr's primary key, checked against every key in kr, so discovery
+// keeps working as keys are rotated.  Stale and replayed announcements are
+// ignored.  Announcements will only be seen by nodes in the same broadcast
+// domain.
+func DiscoverLAN(
+	m *memberlist.Memberlist,
+	group string,
+	kr *memberlist.Keyring,
+) error {
+	ga, err := net.ResolveUDPAddr("udp", group)
+	if nil != err {
+		return fmt.Errorf("resolving %s: %w", group, err)
+	}
+	lc, err := net.ListenMulticastUDP("udp", nil, ga)
+	if nil != err {
+		return fmt.Errorf("listening on %s: %w", ga, err)
+	}
+	sc, err := net.DialUDP("udp", nil, ga)
+	if nil != err {
+		lc.Close()
+		return fmt.Errorf("preparing to send to %s: %w", ga, err)
+	}
+	log.Printf("Discovering peers via %s", ga)
+
+	go listenForAnnouncements(m, lc, kr)
+	go announce(m, sc, kr)
+
+	return nil
+}
+
+/* announce sends our address to the multicast group every discoverInterval */
+func announce(
+	m *memberlist.Memberlist,
+	c *net.UDPConn,
+	kr *memberlist.Keyring,
+) {
+	for {
+		if err := sendAnnouncement(
+			c,
+			localAddr(liveMesh(m)),
+			kr.GetPrimaryKey(),
+		); nil != err {
+			log.Printf("Error sending LAN announcement: %v", err)
+		}
+		time.Sleep(discoverInterval)
+	}
+}
+
+/* sendAnnouncement sends an announcement for addr to c, with a new nonce */
+func sendAnnouncement(c *net.UDPConn, addr string, key []byte) error {
+	nonce := make([]byte, discoverNonceLen)
+	if _, err := rand.Read(nonce); nil != err {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+	_, err := c.Write(announcement(
+		addr,
+		time.Now(),
+		hex.EncodeToString(nonce),
+		key,
+	))
+	return err
+}
+
+/* listenForAnnouncements joins nodes which send us valid announcements and
+which we don't already know */
+func listenForAnnouncements(
+	m *memberlist.Memberlist,
+	c *net.UDPConn,
+	kr *memberlist.Keyring,
+) {
+	var (
+		buf   = make([]byte, discoverBufSize)
+		guard = newReplayGuard()
+		bad   badAnnouncements
+	)
+	for {
+		n, from, err := c.ReadFromUDP(buf)
+		if nil != err {
+			if IsTemporary(err) {
+				continue
+			}
+			log.Printf("Error receiving LAN announcements: %v", err)
+			return
+		}
+
+		/* Make sure it's from someone we want, and not old */
+		a, ok := parseAnnouncement(buf[:n], kr.GetKeys())
+		if !ok {
+			bad.note(time.Now(), from, "invalid")
+			continue
+		}
+		if err := guard.check(a, time.Now()); nil != err {
+			bad.note(time.Now(), from, err.Error())
+			continue
+		}
+		m := liveMesh(m)
+		if a.addr == localAddr(m) || isMemberAddr(m, a.addr) {
+			continue
+		}
+
+		/* New node, say hi */
+		log.Printf("Discovered %s on the LAN", a.addr)
+		if _, err := m.Join([]string{a.addr}); nil != err {
+			log.Printf("Error joining %s: %v", a.addr, err)
+		}
+	}
+}
+
+/* lanAnnouncement is a parsed LAN announcement */
+type lanAnnouncement struct {
+	addr  string
+	sent  time.Time
+	nonce string
+}
+
+/* announcement makes an announcement for addr, sent at when with the given
+nonce, authenticated with key */
+func announcement(
+	addr string,
+	when time.Time,
+	nonce string,
+	key []byte,
+) []byte {
+	msg := fmt.Sprintf(
+		"%s %s %d %s",
+		discoverPrefix,
+		addr,
+		when.UnixNano(),
+		nonce,
+	)
+	mac := announcementMAC(msg, key)
+	return []byte(msg + " " + hex.EncodeToString(mac))
+}
+
+/* parseAnnouncement parses the announcement in b if b's HMAC is correct for
+any of keys. */
+func parseAnnouncement(b []byte, keys [][]byte) (lanAnnouncement, bool) {
+	parts := strings.Fields(string(b))
+	if 5 != len(parts) || discoverPrefix != parts[0] {
+		return lanAnnouncement{}, false
+	}
+	mac, err := hex.DecodeString(parts[4])
+	if nil != err {
+		return lanAnnouncement{}, false
+	}
+	msg := strings.Join(parts[:4], " ")
+	if !slices.ContainsFunc(keys, func(k []byte) bool {
+		return hmac.Equal(mac, announcementMAC(msg, k))
+	}) {
+		return lanAnnouncement{}, false
+	}
+	ns, err := strconv.ParseInt(parts[2], 10, 64)
+	if nil != err || "" == parts[3] {
+		return lanAnnouncement{}, false
+	}
+	return lanAnnouncement{
+		addr:  parts[1],
+		sent:  time.Unix(0, ns),
+		nonce: parts[3],
+	}, true
+}
+
+/* announcementMAC returns the HMAC of msg using key */
+func announcementMAC(msg string, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+/* replayGuard rejects stale and replayed announcements.  It is not safe for
+concurrent use. */
+type replayGuard struct {
+	/* seen maps the nonces of announcements we've accepted to when
+	they'd be stale anyway and can be forgotten */
+	seen map[string]time.Time
+}
+
+/* newReplayGuard returns a new, empty, replayGuard */
+func newReplayGuard() *replayGuard {
+	return &replayGuard{seen: make(map[string]time.Time)}
+}
+
+/* check returns an error if a was sent more than discoverMaxAge from now or
+if we've already seen its nonce. */
+func (g *replayGuard) check(a lanAnnouncement, now time.Time) error {
+	/* Forget nonces which would be stale by now */
+	for nonce, expires := range g.seen {
+		if now.After(expires) {
+			delete(g.seen, nonce)
+		}
+	}
+
+	if d := now.Sub(a.sent).Abs(); discoverMaxAge < d {
+		return fmt.Errorf("sent %s from now", d.Round(time.Second))
+	}
+	if _, ok := g.seen[a.nonce]; ok {
+		return fmt.Errorf("replayed")
+	}
+	g.seen[a.nonce] = a.sent.Add(discoverMaxAge)
+	return nil
+}
+
+/* badAnnouncements counts bad LAN announcements and logs them at most once
+every discoverWarnInterval.  It is not safe for concurrent use. */
+type badAnnouncements struct {
+	n    int       /* Bad announcements since we last logged */
+	last time.Time /* When we last logged */
+}
+
+/* note notes a bad announcement from from, received at now, and logs it and
+the number of bad announcements since we last logged if we've not logged in
+the last discoverWarnInterval. */
+func (b *badAnnouncements) note(now time.Time, from net.Addr, why string) {
+	b.n++
+	if now.Sub(b.last) < discoverWarnInterval {
+		return
+	}
+	log.Printf(
+		"Ignored %d bad LAN announcement(s), most recently "+
+			"from %s: %s",
+		b.n,
+		from,
+		why,
+	)
+	b.n = 0
+	b.last = now
+}
+
+/* localAddr returns the address and port the local node advertises */
+func localAddr(m *memberlist.Memberlist) string {
+	return nodeAddr(m.LocalNode())
+}
+
+/* isMemberAddr returns true if a member of the mesh advertises addr */
+func isMemberAddr(m *memberlist.Memberlist, addr string) bool {
+	for _, n := range m.Members() {
+		if nodeAddr(n) == addr {
+			return true
+		}
+	}
+	return false
+}
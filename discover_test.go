@@ -0,0 +1,164 @@
+package main
+
+/*
+ * discover_test.go
+ * Tests for discover.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestAnnouncementKeys makes sure announcements are accepted with any key in
+the keyring, and only with a key in the keyring. */
+func TestAnnouncementKeys(t *testing.T) {
+	var (
+		oldKey = DeriveKey("old")
+		newKey = DeriveKey("new")
+		when   = time.Now()
+	)
+	kr, err := memberlist.NewKeyring([][]byte{oldKey}, newKey)
+	if nil != err {
+		t.Fatalf("Making keyring: %v", err)
+	}
+	for _, key := range [][]byte{oldKey, newKey} {
+		a, ok := parseAnnouncement(
+			announcement("192.0.2.1:7946", when, "abc", key),
+			kr.GetKeys(),
+		)
+		if !ok {
+			t.Fatalf("Valid announcement rejected")
+		}
+		want := lanAnnouncement{
+			addr:  "192.0.2.1:7946",
+			sent:  time.Unix(0, when.UnixNano()),
+			nonce: "abc",
+		}
+		if !a.sent.Equal(want.sent) ||
+			a.addr != want.addr ||
+			a.nonce != want.nonce {
+			t.Fatalf("Parsed %+v, expected %+v", a, want)
+		}
+	}
+
+	/* Someone else's key, or a tweaked announcement, is no good */
+	b := announcement("192.0.2.1:7946", when, "abc", DeriveKey("other"))
+	if _, ok := parseAnnouncement(b, kr.GetKeys()); ok {
+		t.Fatalf("Announcement with unknown key accepted")
+	}
+	b = announcement("192.0.2.1:7946", when, "abc", newKey)
+	b[len(discoverPrefix)+1] = '8'
+	if _, ok := parseAnnouncement(b, kr.GetKeys()); ok {
+		t.Fatalf("Modified announcement accepted")
+	}
+}
+
+/* TestReplayGuard makes sure stale and replayed announcements are rejected */
+func TestReplayGuard(t *testing.T) {
+	var (
+		g   = newReplayGuard()
+		now = time.Now()
+	)
+	for _, c := range []struct {
+		a  lanAnnouncement
+		ok bool
+	}{
+		{lanAnnouncement{sent: now, nonce: "a"}, true},
+		{lanAnnouncement{sent: now, nonce: "a"}, false},
+		{lanAnnouncement{
+			sent:  now.Add(-time.Second),
+			nonce: "b",
+		}, true},
+		{lanAnnouncement{
+			sent:  now.Add(-discoverMaxAge - time.Second),
+			nonce: "c",
+		}, false},
+		{lanAnnouncement{
+			sent:  now.Add(discoverMaxAge + time.Second),
+			nonce: "d",
+		}, false},
+	} {
+		if err := g.check(c.a, now); c.ok != (nil == err) {
+			t.Fatalf("Check of %+v returned %v", c.a, err)
+		}
+	}
+
+	/* Old nonces are forgotten once they'd be stale anyway */
+	if err := g.check(
+		lanAnnouncement{sent: now.Add(2 * discoverMaxAge), nonce: "e"},
+		now.Add(2*discoverMaxAge),
+	); nil != err {
+		t.Fatalf("Check after a while returned %v", err)
+	}
+	if 1 != len(g.seen) {
+		t.Fatalf("Remembered %d nonces, expected 1", len(g.seen))
+	}
+}
+
+/* TestBadAnnouncements makes sure bad announcements don't flood the log */
+func TestBadAnnouncements(t *testing.T) {
+	var (
+		sb   = captureLog(t)
+		b    badAnnouncements
+		now  = time.Now()
+		from = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	)
+	for range 100 {
+		b.note(now, from, "invalid")
+	}
+	if got := strings.Count(sb.String(), "\n"); 1 != got {
+		t.Fatalf("Logged %d lines, expected 1:\n%s", got, sb.String())
+	}
+
+	/* After a while we should hear about the ones we didn't log */
+	b.note(now.Add(discoverWarnInterval), from, "replayed")
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if 2 != len(lines) {
+		t.Fatalf("Logged %d lines, expected 2:\n%s", len(lines), sb)
+	}
+	if want := "Ignored 100 bad LAN announcement(s), most recently " +
+		"from 192.0.2.1:1: replayed"; !strings.HasSuffix(
+		lines[1],
+		want,
+	) {
+		t.Fatalf("Second log line %q missing %q", lines[1], want)
+	}
+}
+
+/* TestDiscoverLAN makes sure two nodes find each other via loopback
+multicast, if the host supports it. */
+func TestDiscoverLAN(t *testing.T) {
+	const group = "239.255.77.77:47946"
+	var (
+		mn    = new(memberlist.MockNetwork)
+		nodes []*memberlist.Memberlist
+	)
+	for _, name := range []string{"a", "b"} {
+		conf := newTestConfig(mn, name, "test-secret")
+		kr, err := memberlist.NewKeyring(nil, conf.SecretKey)
+		if nil != err {
+			t.Fatalf("Making keyring: %v", err)
+		}
+		conf.Keyring = kr
+		m, err := memberlist.Create(conf)
+		if nil != err {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		if err := DiscoverLAN(m, group, kr); nil != err {
+			t.Skipf("Multicast unavailable: %v", err)
+		}
+		nodes = append(nodes, m)
+	}
+	waitFor(t, "discovery", func() bool {
+		return 2 == nodes[0].NumMembers() && 2 == nodes[1].NumMembers()
+	})
+}
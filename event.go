@@ -5,50 +5,259 @@ package main
  * Handle events from the mesh
  * By J. Stuart McMurray
  * Created 20200417
- * Last Modified 20200418
+ * Last Modified 20261014
  */
 
 import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/memberlist"
 )
 
+/* eventKind is a kind of event, used to decide where events go */
+type eventKind uint
+
+/* Kinds of events */
+const (
+	eventJoin     eventKind = 1 << iota /* Node joined */
+	eventUpdate                         /* Node updated */
+	eventLeave                          /* Node left */
+	eventConflict                       /* Name conflict */
+	eventNotice                         /* Something we did */
+	eventOther                          /* Unknown memberlist event */
+
+	eventAll = eventJoin | eventUpdate | eventLeave | eventConflict |
+		eventNotice | eventOther
+)
+
+/* eventKindNames maps names usable in event masks to event kinds */
+var eventKindNames = map[string]eventKind{
+	"join":     eventJoin,
+	"update":   eventUpdate,
+	"leave":    eventLeave,
+	"conflict": eventConflict,
+	"notice":   eventNotice,
+	"other":    eventOther,
+}
+
+/* String returns k's name, as in eventKindNames */
+func (k eventKind) String() string {
+	for n, v := range eventKindNames {
+		if v == k {
+			return n
+		}
+	}
+	return "unknown"
+}
+
+/* eventMask is a set of kinds of events.  It implements flag.Value. */
+type eventMask eventKind
+
+/* Has returns true if k is in the mask */
+func (em eventMask) Has(k eventKind) bool { return 0 != eventKind(em)&k }
+
+/* String returns the names of the kinds of events in the mask, separated by
+commas. */
+func (em eventMask) String() string {
+	switch eventKind(em) {
+	case eventAll:
+		return "all"
+	case 0:
+		return "none"
+	}
+	var ns []string
+	for n, k := range eventKindNames {
+		if em.Has(k) {
+			ns = append(ns, n)
+		}
+	}
+	sort.Strings(ns)
+	return strings.Join(ns, ",")
+}
+
+/* Set parses a comma-separated list of kinds of events, which may also be
+all or none. */
+func (em *eventMask) Set(s string) error {
+	var k eventKind
+	for _, n := range strings.Split(s, ",") {
+		n = strings.ToLower(strings.TrimSpace(n))
+		switch n {
+		case "all":
+			k |= eventAll
+		case "none", "":
+		default:
+			nk, ok := eventKindNames[n]
+			if !ok {
+				return fmt.Errorf("unknown event kind %q", n)
+			}
+			k |= nk
+		}
+	}
+	*em = eventMask(k)
+	return nil
+}
+
+var (
+	/* showNodeID causes FormatNode to add the start of the node's ID */
+	showNodeID bool
+
+	/* showProtocol causes FormatNode to add the node's memberlist
+	protocol versions */
+	showProtocol bool
+
+	/* conflictGuidance, if set, is added to name conflict messages,
+	along with what memberlist does about the conflict, to tell whoever
+	reads it what to do */
+	conflictGuidance string
+
+	/* logEvents and broadcastEvents control which kinds of events are
+	logged and sent to clients, respectively */
+	logEvents       = eventMask(eventAll)
+	broadcastEvents = eventMask(eventAll)
+
+	/* eventBuffer is the size of the buffer for events from memberlist,
+	which lets memberlist carry on gossiping if we're slow */
+	eventBuffer = defaultEventBuffer
+
+	/* eventBacklog is the number of events from memberlist waiting to be
+	handled, as of the last one we took */
+	eventBacklog atomic.Int64
+)
+
+const (
+	/* defaultEventBuffer is the default size of the buffer for events
+	from memberlist */
+	defaultEventBuffer = 256
+
+	/* eventBacklogWarn is how full, as a fraction, the buffer of events
+	from memberlist may get before we warn that we're falling behind */
+	eventBacklogWarn = 0.75
+)
+
 // ConflictHandler handles notifications that peer names conflict.  It
 // implements memberlist.ConflictDelegate
-type ConflictHandler struct{}
+type ConflictHandler struct {
+	/* ourName is our node's name, to spot conflicts with us */
+	ourName string
+}
 
 // NotifyConflict sends a message to clients that a new node has joined with
-// the same name as an existing node.
+// the same name as an existing node.  If conflictGuidance is set, it's added
+// to the message.  Conflicts with our own name are counted for
+// -conflict-rejoin-after.  This is called by memberlist with its node lock
+// held, so the message is sent from another goroutine, as adding the mesh's
+// size needs the lock.
 func (c ConflictHandler) NotifyConflict(existing, other *memberlist.Node) {
-	Broadcastf("[Name Conflict] Existing: %s New: %s", existing, other)
+	if c.ourName == existing.Name {
+		defer noteSelfConflict(c.ourName)
+	}
+	if "" == conflictGuidance {
+		go broadcastAndLogf(
+			eventConflict,
+			existing,
+			"[Name Conflict] Existing: %s New: %s",
+			existing,
+			other,
+		)
+		return
+	}
+	go broadcastAndLogf(
+		eventConflict,
+		existing,
+		"[Name Conflict] Existing: %s New: %s (existing node kept, "+
+			"new node ignored; %s)",
+		existing,
+		other,
+		conflictGuidance,
+	)
 }
 
-// HandleEvents handles events from the channel
-func HandleEvents(ourName string, nech <-chan memberlist.NodeEvent) {
-	for ne := range nech {
-		go handleEvent(ourName, ne)
+// HandleEvents handles events from the channel, one at a time and in the
+// order memberlist sent them, so clients hear about them in order.  If the
+// channel's buffer is getting full, a warning is logged, once until it's
+// emptied out a bit.  The time between memberlist giving us each event and it
+// being handled is noted, for LAG.  With -broadcast-include-seq, each event
+// is numbered as it's taken off the channel, so the numbers are in the same
+// order as the events.
+func HandleEvents(ourName string, nech <-chan timedEvent) {
+	var (
+		warned  bool
+		lastSeq uint64
+	)
+	for te := range nech {
+		n := len(nech)
+		eventBacklog.Store(int64(n))
+		switch full := float64(n) / float64(cap(nech)); {
+		case !warned && eventBacklogWarn <= full:
+			log.Printf(
+				"Falling behind handling events, %d/%d "+
+					"buffered",
+				n,
+				cap(nech),
+			)
+			warned = true
+		case warned && full < eventBacklogWarn/2:
+			warned = false
+		}
+		var seq uint64
+		if broadcastIncludeSeq {
+			lastSeq++
+			seq = lastSeq
+		}
+		trackEvent(te.NodeEvent)
+		noteMembersChanged()
+		handleEvent(ourName, te.NodeEvent, seq)
+		recordLag(time.Since(te.at))
 	}
 }
 
-/* handleEvent handles an event from the mesh */
-func handleEvent(ourName string, ne memberlist.NodeEvent) {
+/* handleEvent handles an event from the mesh.  If seq isn't 0, it's added to
+what's sent to clients. */
+func handleEvent(ourName string, ne memberlist.NodeEvent, seq uint64) {
 	switch ne.Event {
 	case memberlist.NodeJoin:
-		/* Don't bother telling people we've joined */
-		if ourName == ne.Node.Name {
+		/* Don't bother telling people we've joined, even under a
+		new name */
+		if ourName == ne.Node.Name || renamedName() == ne.Node.Name {
 			return
 		}
-		broadcastAndLogf("[Join] %s", FormatNode(ne.Node))
+		checkNodeSize(ne.Node)
+		broadcastAndLogSeqf(
+			seq,
+			eventJoin,
+			ne.Node,
+			"[Join] %s",
+			FormatNode(ne.Node),
+		)
 	case memberlist.NodeUpdate:
-		broadcastAndLogf("[News] %s", FormatNode(ne.Node))
+		checkNodeSize(ne.Node)
+		broadcastAndLogSeqf(
+			seq,
+			eventUpdate,
+			ne.Node,
+			"[News] %s",
+			FormatNode(ne.Node),
+		)
 	case memberlist.NodeLeave:
-		broadcastAndLogf("[Part] %s", FormatNode(ne.Node))
+		broadcastAndLogSeqf(
+			seq,
+			eventLeave,
+			ne.Node,
+			"[Part] %s",
+			FormatNode(ne.Node),
+		)
 	default:
-		broadcastAndLogf(
+		broadcastAndLogSeqf(
+			seq,
+			eventOther,
+			ne.Node,
 			"[Unknown event %v] %ss",
 			ne.Event,
 			FormatNode(ne.Node),
@@ -56,17 +265,94 @@ func handleEvent(ourName string, ne memberlist.NodeEvent) {
 	}
 }
 
-/* broadcastAndLogf logs and message and logs it as well */
-func broadcastAndLogf(f string, a ...interface{}) {
-	go Broadcastf(f, a...)
-	log.Printf(f, a...)
+/* broadcastAndLogf logs and message and logs it as well, subject to
+broadcastEvents and logEvents.  The message is about the node n. */
+func broadcastAndLogf(
+	k eventKind,
+	n *memberlist.Node,
+	f string,
+	a ...interface{},
+) {
+	broadcastAndLogSeqf(0, k, n, f, a...)
 }
 
-// FormatNode formats a node as name (address:port)
+/* broadcastAndLogSeqf is like broadcastAndLogf, but if seq isn't 0, it's added
+to the message sent to clients, for -broadcast-include-seq. */
+func broadcastAndLogSeqf(
+	seq uint64,
+	k eventKind,
+	n *memberlist.Node,
+	f string,
+	a ...interface{},
+) {
+	if broadcastEvents.Has(k) {
+		broadcastKindf(k, n, seq, f, a...)
+	}
+	if logEvents.Has(k) {
+		logEventf(k, n, f, a...)
+	}
+	forwardToBridge(k, f, a...)
+}
+
+/* logEventf logs an event of kind k about the node n.  If eventFormat is
+formatCEF, the event is logged as CEF, otherwise as text. */
+func logEventf(k eventKind, n *memberlist.Node, f string, a ...interface{}) {
+	if formatCEF != eventFormat {
+		log.Printf(f, a...)
+		return
+	}
+	log.Printf("%s", appendCEF(nil, &clientEvent{
+		kind: k,
+		node: n,
+		msg:  fmt.Appendf(nil, f, a...),
+		when: time.Now(),
+	}))
+}
+
+// FormatNode formats a node as name (address:port), followed by (observer) if
+// it's an observer, (draining) if it's draining, its weight, if it has one,
+// e.g. [w=10], and optionally the start of the node's ID, e.g. [id=0123abcd],
+// and its memberlist protocol versions, e.g. [proto=5(1-5)].
 func FormatNode(n *memberlist.Node) string {
-	return fmt.Sprintf(
-		"%s (%s)",
-		n.Name,
-		net.JoinHostPort(n.Addr.String(), strconv.Itoa(int(n.Port))),
+	s := fmt.Sprintf("%s (%s)", n.Name, nodeAddr(n))
+	nm := ParseMeta(n.Meta)
+	if nm.Observer {
+		s += " (observer)"
+	}
+	if nm.Draining {
+		s += " (draining)"
+	}
+	if 0 != nm.Weight {
+		s += fmt.Sprintf(" [w=%d]", nm.Weight)
+	}
+	if showNodeID {
+		if id := nm.ID; "" != id {
+			if len(id) > shortIDLen {
+				id = id[:shortIDLen]
+			}
+			s += fmt.Sprintf(" [id=%s]", id)
+		}
+	}
+	if showProtocol {
+		s += fmt.Sprintf(" [proto=%d(%d-%d)]", n.PCur, n.PMin, n.PMax)
+	}
+	return s
+}
+
+/* nodeAddr returns n's address and port.  IPv4-mapped IPv6 addresses are
+returned in dotted-quad form. */
+func nodeAddr(n *memberlist.Node) string {
+	return net.JoinHostPort(
+		normalizeIP(n.Addr).String(),
+		strconv.Itoa(int(n.Port)),
 	)
 }
+
+/* normalizeIP returns the four-byte form of ip if ip is an IPv4 or
+IPv4-mapped IPv6 address, or ip itself otherwise. */
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); nil != v4 {
+		return v4
+	}
+	return ip
+}
@@ -0,0 +1,351 @@
+package main
+
+/*
+ * event_test.go
+ * Tests for event.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestFormatNodeMappedIPv6 makes sure IPv4-mapped IPv6 addresses are shown
+as plain IPv4 addresses. */
+func TestFormatNodeMappedIPv6(t *testing.T) {
+	for _, c := range []struct {
+		ip   net.IP
+		want string
+	}{
+		{net.ParseIP("::ffff:192.0.2.1"), "n (192.0.2.1:7946)"},
+		{net.ParseIP("192.0.2.1").To16(), "n (192.0.2.1:7946)"},
+		{net.ParseIP("192.0.2.1").To4(), "n (192.0.2.1:7946)"},
+		{net.ParseIP("2001:db8::1"), "n ([2001:db8::1]:7946)"},
+	} {
+		n := &memberlist.Node{Name: "n", Addr: c.ip, Port: 7946}
+		if got := FormatNode(n); c.want != got {
+			t.Errorf("%s: got %q, expected %q", c.ip, got, c.want)
+		}
+	}
+}
+
+/* TestEventMaskSet makes sure event masks parse */
+func TestEventMaskSet(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want eventMask
+		str  string
+		ok   bool
+	}{
+		{"all", eventMask(eventAll), "all", true},
+		{"none", 0, "none", true},
+		{"", 0, "none", true},
+		{"join", eventMask(eventJoin), "join", true},
+		{
+			" Leave, JOIN ,,",
+			eventMask(eventJoin | eventLeave),
+			"join,leave",
+			true,
+		},
+		{"join,all", eventMask(eventAll), "all", true},
+		{"join,moose", 0, "", false},
+	} {
+		var em eventMask
+		err := em.Set(c.in)
+		if c.ok != (nil == err) {
+			t.Errorf("%q: error %v", c.in, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if c.want != em {
+			t.Errorf("%q: got %b, expected %b", c.in, em, c.want)
+		}
+		if s := em.String(); c.str != s {
+			t.Errorf(
+				"%q: String returned %q, expected %q",
+				c.in,
+				s,
+				c.str,
+			)
+		}
+	}
+}
+
+/* TestBroadcastAndLogfMasks makes sure logEvents and broadcastEvents are
+independent. */
+func TestBroadcastAndLogfMasks(t *testing.T) {
+	logEvents = eventMask(eventJoin)
+	broadcastEvents = eventMask(eventLeave)
+	t.Cleanup(func() {
+		logEvents = eventMask(eventAll)
+		broadcastEvents = eventMask(eventAll)
+	})
+	sb := captureLog(t)
+	tc := newTestClient(t, nil, false)
+
+	broadcastAndLogf(eventJoin, nil, "[Join] logged")
+	broadcastAndLogf(eventLeave, nil, "[Part] broadcast")
+	if l := tc.readLine(); "[Part] broadcast" != l {
+		t.Fatalf("Client got %q", l)
+	}
+	if l := sb.String(); !strings.Contains(l, "[Join] logged") ||
+		strings.Contains(l, "[Part] broadcast") {
+		t.Fatalf("Log has %q", l)
+	}
+}
+
+/* TestLogEventfCEF makes sure events are logged as CEF with -event-format
+cef, and as text otherwise. */
+func TestLogEventfCEF(t *testing.T) {
+	t.Cleanup(func() { eventFormat = formatText })
+	sb := captureLog(t)
+	n := &memberlist.Node{
+		Name: "a",
+		Addr: net.ParseIP("192.0.2.1"),
+		Port: 7946,
+	}
+
+	logEventf(eventJoin, n, "[Join] %s", "text")
+	eventFormat = formatCEF
+	logEventf(eventJoin, n, "[Join] %s", "cef")
+	ls := strings.Split(strings.TrimSuffix(sb.String(), "\n"), "\n")
+	if 2 != len(ls) {
+		t.Fatalf("Logged %d lines, expected 2:\n%s", len(ls), sb)
+	}
+	if !strings.HasSuffix(ls[0], " [Join] text") {
+		t.Errorf("Text event logged as %q", ls[0])
+	}
+	var (
+		start = "CEF:0|magisterquis|meshmembers|1|join|Node joined|3|"
+		end   = " src=192.0.2.1 spt=7946 cs1Label=node cs1=a " +
+			"msg=[Join] cef"
+	)
+	if !strings.Contains(ls[1], start) || !strings.HasSuffix(ls[1], end) {
+		t.Errorf("CEF event logged as %q", ls[1])
+	}
+}
+
+/* gateWriter is an io.Writer which blocks until open is closed. */
+type gateWriter struct {
+	open chan struct{}
+	syncBuffer
+}
+
+/* Write waits for gw.open to be closed and writes b to gw's buffer. */
+func (gw *gateWriter) Write(b []byte) (int, error) {
+	<-gw.open
+	return gw.syncBuffer.Write(b)
+}
+
+/* TestHandleEventsBacklog makes sure memberlist can keep sending events
+while we're stuck handling one, and that once we're unstuck they're handled in
+order. */
+func TestHandleEventsBacklog(t *testing.T) {
+	const nEvent = 200
+	gw := &gateWriter{open: make(chan struct{})}
+	w := log.Writer()
+	log.SetOutput(gw)
+	t.Cleanup(func() { log.SetOutput(w) })
+	nech := make(chan timedEvent, nEvent+1)
+	defer close(nech)
+	go HandleEvents("us", nech)
+
+	/* Logging's stuck, which shouldn't stop events being taken */
+	ed := TimedEventDelegate{Ch: nech}
+	sent := make(chan struct{})
+	t.Cleanup(func() {
+		for i := range nEvent {
+			forgetNode(fmt.Sprintf("n%d", i))
+		}
+	})
+	go func() {
+		defer close(sent)
+		for i := range nEvent {
+			ed.NotifyJoin(&memberlist.Node{
+				Name: fmt.Sprintf("n%d", i),
+			})
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(testTimeout):
+		t.Fatalf("Sending events blocked")
+	}
+	waitFor(t, "backlog", func() bool { return nEvent-1 == len(nech) })
+
+	/* Unstick, and make sure everything was handled in order */
+	close(gw.open)
+	waitFor(t, "backlog to clear", func() bool {
+		return strings.Contains(
+			gw.String(),
+			fmt.Sprintf("[Join] n%d ", nEvent-1),
+		)
+	})
+	var got []string
+	for _, l := range strings.Split(gw.String(), "\n") {
+		if _, j, ok := strings.Cut(l, "[Join] "); ok {
+			got = append(got, strings.Fields(j)[0])
+		}
+	}
+	if nEvent != len(got) {
+		t.Fatalf("Handled %d/%d events", len(got), nEvent)
+	}
+	for i, name := range got {
+		if want := fmt.Sprintf("n%d", i); want != name {
+			t.Fatalf(
+				"Event %d was about %s, expected %s",
+				i,
+				name,
+				want,
+			)
+		}
+	}
+}
+
+/* TestBroadcastIncludeSeq makes sure -broadcast-include-seq numbers events
+from the mesh, one after another, and leaves everything else alone. */
+func TestBroadcastIncludeSeq(t *testing.T) {
+	const nEvent = 5
+	broadcastIncludeSeq = true
+	t.Cleanup(func() {
+		broadcastIncludeSeq = false
+		for i := range nEvent {
+			forgetNode(fmt.Sprintf("n%d", i))
+		}
+	})
+	captureLog(t)
+	tc := newTestClient(t, nil, false)
+	nech := make(chan timedEvent)
+	defer close(nech)
+	go HandleEvents("us", nech)
+	ed := TimedEventDelegate{Ch: nech}
+
+	seq := func() uint64 {
+		t.Helper()
+		l := tc.readLine()
+		_, s, ok := strings.Cut(l, " [seq=")
+		if !ok {
+			t.Fatalf("No sequence number in %q", l)
+		}
+		var n uint64
+		if _, err := fmt.Sscanf(s, "%d]", &n); nil != err {
+			t.Fatalf("Parsing sequence number in %q: %v", l, err)
+		}
+		return n
+	}
+
+	/* Events are numbered one after another */
+	var last uint64
+	for i := range nEvent {
+		ed.NotifyJoin(&memberlist.Node{Name: fmt.Sprintf("n%d", i)})
+		n := seq()
+		if 0 != i && last+1 != n {
+			t.Fatalf("Event %d has number %d, after %d", i, n, last)
+		}
+		last = n
+	}
+
+	/* Notices aren't, and don't use up a number */
+	Broadcastf("[Notice] not numbered")
+	if l := tc.readLine(); "[Notice] not numbered" != l {
+		t.Fatalf("Notice sent as %q", l)
+	}
+
+	/* Unsent events still take a number */
+	ed.NotifyJoin(&memberlist.Node{Name: "us"})
+	ed.NotifyLeave(&memberlist.Node{Name: "n0"})
+	if n := seq(); last+2 != n {
+		t.Fatalf("Leave has number %d, after %d", n, last)
+	}
+}
+
+/* TestShowProtocol makes sure -show-protocol adds nodes' protocol versions,
+and only then. */
+func TestShowProtocol(t *testing.T) {
+	t.Cleanup(func() { showProtocol = false })
+	ns := []*memberlist.Node{
+		{
+			Name: "old",
+			Addr: net.ParseIP("192.0.2.1"),
+			Port: 7946,
+			PMin: 1,
+			PMax: 2,
+			PCur: 2,
+		},
+		{
+			Name: "new",
+			Addr: net.ParseIP("192.0.2.2"),
+			Port: 7946,
+			PMin: 1,
+			PMax: 5,
+			PCur: 5,
+		},
+	}
+	for _, c := range []struct {
+		show bool
+		want []string
+	}{
+		{false, []string{
+			"old (192.0.2.1:7946)",
+			"new (192.0.2.2:7946)",
+		}},
+		{true, []string{
+			"old (192.0.2.1:7946) [proto=2(1-2)]",
+			"new (192.0.2.2:7946) [proto=5(1-5)]",
+		}},
+	} {
+		showProtocol = c.show
+		for i, n := range ns {
+			if got := FormatNode(n); c.want[i] != got {
+				t.Errorf(
+					"Show %t: got %q, expected %q",
+					c.show,
+					got,
+					c.want[i],
+				)
+			}
+		}
+	}
+}
+
+/* TestConflictGuidance makes sure -conflict-guidance is added to name
+conflict messages, and only when it's set. */
+func TestConflictGuidance(t *testing.T) {
+	t.Cleanup(func() { conflictGuidance = "" })
+	captureLog(t)
+	tc := newTestClient(t, nil, false)
+	existing := &memberlist.Node{
+		Name: "n",
+		Addr: net.ParseIP("192.0.2.1"),
+		Port: 7946,
+	}
+	other := &memberlist.Node{
+		Name: "n",
+		Addr: net.ParseIP("192.0.2.2"),
+		Port: 7946,
+	}
+
+	ConflictHandler{}.NotifyConflict(existing, other)
+	if l := tc.readLine(); "[Name Conflict] Existing: n New: n" != l {
+		t.Fatalf("Got %q without guidance", l)
+	}
+
+	conflictGuidance = "set -name to disambiguate"
+	ConflictHandler{}.NotifyConflict(existing, other)
+	want := "[Name Conflict] Existing: n New: n (existing node kept, " +
+		"new node ignored; set -name to disambiguate)"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+}
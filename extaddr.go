@@ -0,0 +1,175 @@
+package main
+
+/*
+ * extaddr.go
+ * Find our external address
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* lookupExternalAddr gets our external address by querying extAddrURL.  If
+cache isn't empty, a cached address younger than ttl is used instead, and
+addresses we get are saved to the cache.  If the query fails, a stale cached
+address is better than nothing. */
+func lookupExternalAddr(cache string, ttl time.Duration) (string, error) {
+	/* Try the cache first */
+	var cached string
+	if "" != cache {
+		a, age, err := readExtAddrCache(cache)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			/* No cache yet, not a problem */
+		case nil != err:
+			log.Printf("Error reading %s: %v", cache, err)
+		case age < ttl:
+			log.Printf(
+				"Using cached external address from %s",
+				cache,
+			)
+			return a, nil
+		default:
+			cached = a
+		}
+	}
+
+	/* Ask the internet */
+	a, err := queryExternalAddr()
+	if nil != err {
+		if "" != cached {
+			log.Printf("Using stale cached external address")
+			return cached, nil
+		}
+		return "", err
+	}
+
+	/* Save it for next time */
+	saveExtAddrCache(cache, a)
+	return a, nil
+}
+
+/* saveExtAddrCache saves a to the cache file at path, if neither is empty. */
+func saveExtAddrCache(path, a string) {
+	if "" == path || "" == a {
+		return
+	}
+	if err := writeFileAtomic(path, []byte(a+"\n"), 0644); nil != err {
+		log.Printf("Error caching external address: %v", err)
+	}
+}
+
+/* watchExternalAddr queries our external address every interval.  Started
+is the address we got from the query at startup, if any.  If the address
+changes, it's cached and we start advertising it with advertiseNewAddr. */
+func watchExternalAddr(interval time.Duration, cache string, started string) {
+	for {
+		from, to := waitForAddrChange(interval, started)
+		saveExtAddrCache(cache, to)
+		advertiseNewAddr(from, to)
+		started = to
+	}
+}
+
+/* advertiseNewAddr tells clients our external address has changed from from
+to to, and replaces our node with one advertising to, as memberlist can't
+change a running node's address. */
+func advertiseNewAddr(from, to string) {
+	broadcastAndLogf(
+		eventNotice,
+		nil,
+		"[AddrChange] External address changed from %s to %s, "+
+			"rejoining to advertise the new address",
+		from,
+		to,
+	)
+	replaceMesh(func(nc *memberlist.Config) { nc.AdvertiseAddr = to })
+}
+
+/* waitForAddrChange queries our external address every interval until it
+differs from prev, and returns the old and new addresses.  If prev is empty,
+the first address we get is used instead.  An address of a different IP
+version than prev, e.g. from a query which went out over IPv6 instead of IPv4,
+isn't a change. */
+func waitForAddrChange(
+	interval time.Duration,
+	prev string,
+) (from, to string) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		<-t.C
+		a, err := queryExternalAddr()
+		switch {
+		case nil != err || "" == a:
+			/* queryExternalAddr logged why */
+		case "" == prev:
+			prev = a
+		case isIPv4(a) != isIPv4(prev), a == prev:
+			/* Not a change */
+		default:
+			return prev, a
+		}
+	}
+}
+
+/* isIPv4 returns true if a is an IPv4 address. */
+func isIPv4(a string) bool {
+	ip := net.ParseIP(a)
+	return nil != ip && nil != ip.To4()
+}
+
+/* readExtAddrCache reads an address from the cache file at path, and returns
+it and the cache's age. */
+func readExtAddrCache(path string) (string, time.Duration, error) {
+	b, err := os.ReadFile(path)
+	if nil != err {
+		return "", 0, err
+	}
+	fi, err := os.Stat(path)
+	if nil != err {
+		return "", 0, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if nil == ip {
+		return "", 0, errors.New("cache does not contain an IP address")
+	}
+	return ip.String(), time.Since(fi.ModTime()), nil
+}
+
+/* queryExternalAddr queries extAddrURL for our external address.  If the
+reply isn't an IP address, queryExternalAddr returns the empty string. */
+func queryExternalAddr() (string, error) {
+	res, err := http.Get(extAddrURL)
+	if nil != err {
+		/* We tried */
+		log.Printf("Error querying %q: %v", extAddrURL, err)
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if nil != err {
+		log.Printf("Error reading reply from %q: %v", extAddrURL, err)
+		return "", err
+	}
+
+	/* Got an answer, maybe it's an address? */
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if nil == ip {
+		log.Printf("Unable to parse reply %q from %q", b, extAddrURL)
+		return "", nil
+	}
+	return ip.String(), nil
+}
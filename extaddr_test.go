@@ -0,0 +1,248 @@
+package main
+
+/*
+ * extaddr_test.go
+ * Tests for extaddr.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* testExtAddrServer points extAddrURL at a server which returns addr, until
+the test finishes.  The returned counter counts queries. */
+func testExtAddrServer(t testing.TB, addr string) *atomic.Int64 {
+	var n atomic.Int64
+	s := httptest.NewServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		n.Add(1)
+		fmt.Fprintf(w, "%s\n", addr)
+	}))
+	old := extAddrURL
+	extAddrURL = s.URL
+	t.Cleanup(func() {
+		extAddrURL = old
+		s.Close()
+	})
+	return &n
+}
+
+/* TestExtAddrCache makes sure a fresh cache saves a query and a stale one
+doesn't. */
+func TestExtAddrCache(t *testing.T) {
+	queries := testExtAddrServer(t, "192.0.2.2")
+	cache := filepath.Join(t.TempDir(), "extaddr")
+	if err := os.WriteFile(cache, []byte("192.0.2.1\n"), 0644); nil != err {
+		t.Fatalf("Writing cache: %v", err)
+	}
+
+	/* Fresh cache */
+	a, err := lookupExternalAddr(cache, time.Hour)
+	if nil != err {
+		t.Fatalf("Error with fresh cache: %v", err)
+	}
+	if "192.0.2.1" != a || 0 != queries.Load() {
+		t.Fatalf("Got %s after %d queries", a, queries.Load())
+	}
+
+	/* Stale cache */
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(cache, old, old); nil != err {
+		t.Fatalf("Aging cache: %v", err)
+	}
+	a, err = lookupExternalAddr(cache, time.Hour)
+	if nil != err {
+		t.Fatalf("Error with stale cache: %v", err)
+	}
+	if "192.0.2.2" != a || 1 != queries.Load() {
+		t.Fatalf("Got %s after %d queries", a, queries.Load())
+	}
+	if got, _, err := readExtAddrCache(cache); nil != err ||
+		"192.0.2.2" != got {
+		t.Fatalf("Cache has %s (error %v)", got, err)
+	}
+
+	/* A stale cache is better than nothing */
+	if err := os.Chtimes(cache, old, old); nil != err {
+		t.Fatalf("Aging cache: %v", err)
+	}
+	extAddrURL = "http://127.0.0.1:1"
+	a, err = lookupExternalAddr(cache, time.Hour)
+	if nil != err || "192.0.2.2" != a {
+		t.Fatalf("Got %s with a failed query (error %v)", a, err)
+	}
+}
+
+/* TestWaitForAddrChange makes sure only a real change in the address we get
+from the query counts. */
+func TestWaitForAddrChange(t *testing.T) {
+	var (
+		addrs = make(chan string)
+		s     = httptest.NewServer(http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			fmt.Fprintf(w, "%s\n", <-addrs)
+		}))
+		old = extAddrURL
+	)
+	extAddrURL = s.URL
+	t.Cleanup(func() {
+		extAddrURL = old
+		s.Close()
+	})
+	captureLog(t)
+
+	for _, c := range []struct {
+		started string
+		replies []string
+		from    string
+		to      string
+	}{{
+		started: "192.0.2.1",
+		replies: []string{"192.0.2.1", "2001:db8::1", "x", "192.0.2.2"},
+		from:    "192.0.2.1",
+		to:      "192.0.2.2",
+	}, {
+		started: "2001:db8::1",
+		replies: []string{"192.0.2.1", "2001:db8::2"},
+		from:    "2001:db8::1",
+		to:      "2001:db8::2",
+	}, {
+		/* Nothing from the query at startup */
+		started: "",
+		replies: []string{"192.0.2.1", "192.0.2.1", "192.0.2.3"},
+		from:    "192.0.2.1",
+		to:      "192.0.2.3",
+	}} {
+		type change struct{ from, to string }
+		ch := make(chan change, 1)
+		go func() {
+			from, to := waitForAddrChange(
+				time.Millisecond,
+				c.started,
+			)
+			ch <- change{from, to}
+		}()
+		for _, a := range c.replies {
+			select {
+			case addrs <- a:
+			case got := <-ch:
+				t.Fatalf(
+					"Started with %q: early change from "+
+						"%s to %s",
+					c.started,
+					got.from,
+					got.to,
+				)
+			}
+		}
+		select {
+		case got := <-ch:
+			if c.from != got.from || c.to != got.to {
+				t.Errorf(
+					"Started with %q: got change from "+
+						"%s to %s, expected %s to %s",
+					c.started,
+					got.from,
+					got.to,
+					c.from,
+					c.to,
+				)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("Started with %q: no change", c.started)
+		}
+	}
+}
+
+/* advertisingTransport is a MockTransport which advertises the address it's
+asked to, rather than its own. */
+type advertisingTransport struct{ *memberlist.MockTransport }
+
+/* FinalAdvertiseAddr returns ip, if it's set, and the port of the underlying
+MockTransport. */
+func (t advertisingTransport) FinalAdvertiseAddr(
+	ip string,
+	port int,
+) (net.IP, int, error) {
+	mip, mport, err := t.MockTransport.FinalAdvertiseAddr(ip, port)
+	if nil != err || "" == ip {
+		return mip, mport, err
+	}
+	return net.ParseIP(ip), mport, nil
+}
+
+/* TestAdvertiseNewAddr makes sure we rejoin advertising our new address when
+it changes, without losing our clients. */
+func TestAdvertiseNewAddr(t *testing.T) {
+	rc := runningConfig
+	t.Cleanup(func() {
+		conflictL.Lock()
+		defer conflictL.Unlock()
+		conflictMesh = nil
+		conflictConf = nil
+		conflictCreate = nil
+		runningConfig = rc
+	})
+	captureLog(t)
+
+	mn := new(memberlist.MockNetwork)
+	nt := mn.NewTransport("readvertised") /* Can't add them once running */
+	var aConf *memberlist.Config
+	ms := newTestMeshOn(t, mn, func(conf *memberlist.Config) {
+		if "a" == conf.Name {
+			aConf = conf
+		}
+	}, "a", "b")
+	RejoinOnConflicts(ms[0], aConf, func(
+		conf *memberlist.Config,
+	) (*memberlist.Memberlist, error) {
+		conf.Transport = advertisingTransport{nt}
+		m, err := memberlist.Create(conf)
+		if nil == err {
+			t.Cleanup(func() { m.Shutdown() })
+		}
+		return m, err
+	})
+	tc := newTestClient(t, ms[0], false)
+
+	advertiseNewAddr("192.0.2.1", "192.0.2.2")
+	tc.readUntil("[AddrChange] External address changed from 192.0.2.1 " +
+		"to 192.0.2.2")
+	nm := liveMesh(ms[0])
+	if ms[0] == nm {
+		t.Fatalf("Node not replaced")
+	}
+	ln := nm.LocalNode()
+	if "a" != ln.Name {
+		t.Errorf("New node has name %q", ln.Name)
+	}
+	if want := net.ParseIP("192.0.2.2"); !want.Equal(ln.Addr) {
+		t.Errorf("New node advertises %s, expected %s", ln.Addr, want)
+	}
+	runningConfigL.Lock()
+	defer runningConfigL.Unlock()
+	if want := "192.0.2.2"; want != runningConfig.Advertise.String() {
+		t.Errorf(
+			"CONFIG has address %s, expected %s",
+			runningConfig.Advertise,
+			want,
+		)
+	}
+}
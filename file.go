@@ -0,0 +1,45 @@
+package main
+
+/*
+ * file.go
+ * Filesystem helpers
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/* writeFileAtomic writes b to a temporary file next to path and renames it
+into place, so readers never see a partially-written file. */
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(
+		filepath.Dir(path),
+		"."+filepath.Base(path)+".tmp",
+	)
+	if nil != err {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	tn := f.Name()
+	defer os.Remove(tn) /* Fails harmlessly after the rename */
+
+	if _, err := f.Write(b); nil != err {
+		f.Close()
+		return fmt.Errorf("writing to %s: %w", tn, err)
+	}
+	if err := f.Chmod(perm); nil != err {
+		f.Close()
+		return fmt.Errorf("setting permissions on %s: %w", tn, err)
+	}
+	if err := f.Close(); nil != err {
+		return fmt.Errorf("closing %s: %w", tn, err)
+	}
+	if err := os.Rename(tn, path); nil != err {
+		return fmt.Errorf("renaming %s to %s: %w", tn, path, err)
+	}
+	return nil
+}
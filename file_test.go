@@ -0,0 +1,72 @@
+package main
+
+/*
+ * file_test.go
+ * Tests for file.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* TestWriteFileAtomic makes sure files are written whole, with the right
+permissions, and that temporary files don't hang around. */
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	for _, want := range []string{"first\n", "second\n"} {
+		if err := writeFileAtomic(
+			path,
+			[]byte(want),
+			0600,
+		); nil != err {
+			t.Fatalf("Writing %q: %v", want, err)
+		}
+		b, err := os.ReadFile(path)
+		if nil != err {
+			t.Fatalf("Reading back %q: %v", want, err)
+		}
+		if got := string(b); want != got {
+			t.Fatalf("Read back %q, expected %q", got, want)
+		}
+	}
+	fi, err := os.Stat(path)
+	if nil != err {
+		t.Fatalf("Stat: %v", err)
+	}
+	if p := fi.Mode().Perm(); 0600 != p {
+		t.Fatalf("Permissions %o, expected 0600", p)
+	}
+	des, err := os.ReadDir(dir)
+	if nil != err {
+		t.Fatalf("Listing %s: %v", dir, err)
+	}
+	if 1 != len(des) {
+		t.Fatalf("Found %d files, expected 1", len(des))
+	}
+
+	/* Failures are errors and don't leave anything */
+	if err := writeFileAtomic(
+		filepath.Join(dir, "nonexistent", "f"),
+		nil,
+		0600,
+	); nil == err {
+		t.Fatalf("No error writing in a nonexistent directory")
+	}
+	if err := os.Mkdir(path+".d", 0700); nil != err {
+		t.Fatalf("Making directory: %v", err)
+	}
+	if err := writeFileAtomic(path+".d", nil, 0600); nil == err {
+		t.Fatalf("No error replacing a directory")
+	}
+	if des, err := os.ReadDir(dir); nil != err {
+		t.Fatalf("Listing %s again: %v", dir, err)
+	} else if 2 != len(des) {
+		t.Fatalf("Found %d files after failures, expected 2", len(des))
+	}
+}
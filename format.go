@@ -0,0 +1,209 @@
+package main
+
+/*
+ * format.go
+ * Formats in which clients receive events
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* eventSchemaVersion is the version of the JSON event schema.  It should be
+incremented whenever a change to jsonEvent would break existing clients. */
+const eventSchemaVersion = 1
+
+/* clientFormat is a format in which a client receives events */
+type clientFormat string
+
+/* Client formats */
+const (
+	formatText clientFormat = "" /* Same as what's logged */
+	formatJSON clientFormat = "json"
+	formatCEF  clientFormat = "cef" /* ArcSight Common Event Format */
+
+	/* Events as text, but a one-line member list */
+	formatCompact clientFormat = "compact"
+)
+
+/* eventFormat is the format in which clients are sent events unless they ask
+for another, and in which events are sent to stdout */
+var eventFormat = formatText
+
+/* cefSeverities maps event kinds to CEF severities, 0-10 */
+var cefSeverities = map[eventKind]int{
+	eventJoin:     3,
+	eventUpdate:   3,
+	eventLeave:    5,
+	eventConflict: 7,
+	eventNotice:   3,
+	eventOther:    3,
+}
+
+/* cefNames are the human-readable names for event kinds in CEF */
+var cefNames = map[eventKind]string{
+	eventJoin:     "Node joined",
+	eventUpdate:   "Node updated",
+	eventLeave:    "Node left",
+	eventConflict: "Node name conflict",
+	eventNotice:   "Notice",
+	eventOther:    "Other event",
+}
+
+/* String returns f's name */
+func (f clientFormat) String() string {
+	if formatText == f {
+		return "text"
+	}
+	return string(f)
+}
+
+/* append appends ev, formatted in f, to b.  Seq is the number of the event
+sent to the client. */
+func (f clientFormat) append(b []byte, ev *clientEvent, seq uint64) []byte {
+	switch f {
+	case formatJSON:
+		return appendJSON(b, ev, seq)
+	case formatCEF:
+		return appendCEF(b, ev)
+	default:
+		return append(b, ev.msg...)
+	}
+}
+
+/* appendJSON appends ev, as a line of JSON, to b. */
+func appendJSON(b []byte, ev *clientEvent, seq uint64) []byte {
+	je := jsonEvent{
+		Schema:  eventSchemaVersion,
+		Seq:     seq,
+		Time:    ev.when,
+		Kind:    ev.kind.String(),
+		Message: strings.TrimSuffix(string(ev.msg), "\n"),
+	}
+	if nil != ev.node {
+		nm := ParseMeta(ev.node.Meta)
+		je.Node = &jsonNode{
+			Name: ev.node.Name,
+			Addr: nodeAddr(ev.node),
+			ID:   nm.ID,
+			Role: nm.Role,
+		}
+	}
+	jb, err := json.Marshal(je)
+	if nil != err {
+		log.Printf("Error encoding event %q: %v", ev.msg, err)
+		return b
+	}
+	return append(append(b, jb...), '\n')
+}
+
+/* appendCEF appends ev, as a line of CEF, to b. */
+func appendCEF(b []byte, ev *clientEvent) []byte {
+	b = fmt.Appendf(
+		b,
+		"CEF:0|magisterquis|meshmembers|%d|%s|%s|%d|rt=%d",
+		eventSchemaVersion,
+		cefHeaderEscaper.Replace(ev.kind.String()),
+		cefHeaderEscaper.Replace(cefNames[ev.kind]),
+		cefSeverities[ev.kind],
+		ev.when.UnixMilli(),
+	)
+	if nil != ev.node {
+		nm := ParseMeta(ev.node.Meta)
+		/* src is only for IPv4 */
+		ip, ipk := normalizeIP(ev.node.Addr), "src"
+		if nil == ip.To4() {
+			ipk = "c6a2"
+		}
+		b = fmt.Appendf(
+			b,
+			" %s=%s spt=%d cs1Label=node cs1=%s",
+			ipk,
+			ip,
+			ev.node.Port,
+			cefExtensionEscaper.Replace(ev.node.Name),
+		)
+		if "" != nm.Role {
+			b = fmt.Appendf(
+				b,
+				" cs2Label=role cs2=%s",
+				cefExtensionEscaper.Replace(nm.Role),
+			)
+		}
+	}
+	return fmt.Appendf(
+		b,
+		" msg=%s\n",
+		cefExtensionEscaper.Replace(
+			strings.TrimSuffix(string(ev.msg), "\n"),
+		),
+	)
+}
+
+/* cefHeaderEscaper and cefExtensionEscaper escape CEF header fields and
+extension values, respectively. */
+var (
+	cefHeaderEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`|`, `\|`,
+		"\r", " ",
+		"\n", " ",
+	)
+	cefExtensionEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`=`, `\=`,
+		"\r", `\r`,
+		"\n", `\n`,
+	)
+)
+
+/* parseClientFormat parses the name of a format */
+func parseClientFormat(s string) (clientFormat, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return formatText, nil
+	case "json":
+		return formatJSON, nil
+	case "cef":
+		return formatCEF, nil
+	case "compact":
+		return formatCompact, nil
+	default:
+		return "", fmt.Errorf("unknown format %q", s)
+	}
+}
+
+/* clientEvent is an event to send to clients */
+type clientEvent struct {
+	kind eventKind
+	node *memberlist.Node /* May be nil */
+	msg  []byte           /* Text format, ending in a newline */
+	when time.Time
+}
+
+/* jsonEvent is an event sent to clients using the JSON format */
+type jsonEvent struct {
+	Schema  int       `json:"schema"`
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Node    *jsonNode `json:"node,omitempty"`
+}
+
+/* jsonNode is the node an event is about, in a jsonEvent */
+type jsonNode struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	ID   string `json:"id,omitempty"`
+	Role string `json:"role,omitempty"`
+}
@@ -0,0 +1,126 @@
+package main
+
+/*
+ * format_test.go
+ * Tests for format.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestJSONSeq makes sure JSON events have a schema and are numbered for each
+client. */
+func TestJSONSeq(t *testing.T) {
+	tcs := []*testClient{
+		newTestClient(t, nil, false),
+		newTestClient(t, nil, false),
+	}
+	for _, tc := range tcs {
+		tc.send("FORMAT json")
+		if l := tc.readLine(); "FORMAT json" != l {
+			t.Fatalf("Got %q", l)
+		}
+	}
+	check := func(tc *testClient, want uint64) {
+		t.Helper()
+		l := tc.readLine()
+		var je jsonEvent
+		if err := json.Unmarshal([]byte(l), &je); nil != err {
+			t.Fatalf("Unmarshalling %q: %v", l, err)
+		}
+		if eventSchemaVersion != je.Schema {
+			t.Fatalf("Got schema %d in %q", je.Schema, l)
+		}
+		if want != je.Seq {
+			t.Fatalf("Got seq %d, expected %d", je.Seq, want)
+		}
+		if m := fmt.Sprintf("event %d", want); m != je.Message {
+			t.Fatalf("Got message %q, expected %q", je.Message, m)
+		}
+	}
+
+	/* Both clients' numbers start at 1 */
+	for i := uint64(1); i <= 3; i++ {
+		Broadcastf("event %d", i)
+		for _, tc := range tcs {
+			check(tc, i)
+		}
+	}
+
+	/* A new client starts again */
+	tc := newTestClient(t, nil, false)
+	tc.send("FORMAT json")
+	tc.readLine()
+	Broadcastf("event 1")
+	check(tc, 1)
+}
+
+/* TestAppendCEF makes sure events are well-formed CEF, with awkward
+characters escaped. */
+func TestAppendCEF(t *testing.T) {
+	when := time.UnixMilli(1700000000123)
+	n := &memberlist.Node{
+		Name: "a=b|c",
+		Addr: net.ParseIP("::ffff:192.0.2.1"),
+		Port: 7946,
+		Meta: NewDelegate(NodeMeta{Role: `gate\way`}).NodeMeta(512),
+	}
+	for _, c := range []struct {
+		ev   clientEvent
+		want string
+	}{{
+		clientEvent{
+			kind: eventJoin,
+			node: n,
+			msg:  []byte("[Join] a=b|c\n"),
+			when: when,
+		},
+		"CEF:0|magisterquis|meshmembers|1|join|Node joined|3|" +
+			"rt=1700000000123 src=192.0.2.1 spt=7946 " +
+			`cs1Label=node cs1=a\=b|c ` +
+			`cs2Label=role cs2=gate\\way ` +
+			`msg=[Join] a\=b|c` + "\n",
+	}, {
+		clientEvent{
+			kind: eventLeave,
+			node: &memberlist.Node{
+				Name: "v6",
+				Addr: net.ParseIP("2001:db8::1"),
+				Port: 7946,
+			},
+			msg:  []byte("[Part] v6\n"),
+			when: when,
+		},
+		"CEF:0|magisterquis|meshmembers|1|leave|Node left|5|" +
+			"rt=1700000000123 c6a2=2001:db8::1 spt=7946 " +
+			"cs1Label=node cs1=v6 msg=[Part] v6\n",
+	}, {
+		clientEvent{
+			kind: eventNotice,
+			msg:  []byte("two\nlines\n"),
+			when: when,
+		},
+		"CEF:0|magisterquis|meshmembers|1|notice|Notice|3|" +
+			`rt=1700000000123 msg=two\nlines` + "\n",
+	}} {
+		if got := string(appendCEF(nil, &c.ev)); c.want != got {
+			t.Errorf("Got\n%s\nexpected\n%s", got, c.want)
+		}
+	}
+
+	/* Pipes in the header are escaped, too */
+	got := cefHeaderEscaper.Replace(`a|b\c`)
+	if want := `a\|b\\c`; want != got {
+		t.Errorf("Header escaped as %s, expected %s", got, want)
+	}
+}
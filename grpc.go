@@ -0,0 +1,130 @@
+//go:build grpc
+
+package main
+
+/*
+ * grpc.go
+ * Serve the member list and events via gRPC
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative meshmemberspb/meshmembers.proto
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/magisterquis/meshmembers/meshmemberspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListenGRPC serves the MeshMembers gRPC service on addr.  ListenGRPC
+// terminates the program on error.
+func ListenGRPC(addr string, m *memberlist.Memberlist) {
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		fatalf(exitSocket, "Unable to listen on %s: %s", addr, err)
+	}
+	log.Printf("Listening for gRPC clients on %s", l.Addr())
+	listenersL.Lock()
+	listeners = append(listeners, l)
+	listenersL.Unlock()
+
+	s := grpc.NewServer()
+	meshmemberspb.RegisterMeshMembersServer(s, grpcServer{m: m})
+	go func() {
+		if err := s.Serve(l); nil != err &&
+			!errors.Is(err, net.ErrClosed) {
+			log.Printf("Error serving gRPC: %v", err)
+		}
+	}()
+}
+
+/* grpcServer implements the MeshMembers gRPC service */
+type grpcServer struct {
+	meshmemberspb.UnimplementedMeshMembersServer
+	m *memberlist.Memberlist
+}
+
+/* ListMembers sends the current members of the mesh, sorted by name. */
+func (s grpcServer) ListMembers(
+	context.Context,
+	*meshmemberspb.ListMembersRequest,
+) (*meshmemberspb.ListMembersResponse, error) {
+	var res meshmemberspb.ListMembersResponse
+	for _, n := range sortedMembers(liveMesh(s.m)) {
+		nm := ParseMeta(n.Meta)
+		res.Nodes = append(res.Nodes, &meshmemberspb.Node{
+			Name: n.Name,
+			Addr: nodeAddr(n),
+			Id:   nm.ID,
+			Role: nm.Role,
+		})
+	}
+	return &res, nil
+}
+
+/* WatchEvents streams events to the client.  Under the hood, it's a JSON
+client on the other end of a pipe, so it gets events the same way as every
+other client. */
+func (s grpcServer) WatchEvents(
+	_ *meshmemberspb.WatchEventsRequest,
+	stream meshmemberspb.MeshMembers_WatchEventsServer,
+) error {
+	/* Pretend to be an events-only JSON client */
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go handleClient(theirs, clientOpts{format: formatJSON}, s.m)
+	go func() {
+		<-stream.Context().Done()
+		ours.Close()
+	}()
+
+	/* Skip the banner, then send events as they come in */
+	sc := bufio.NewScanner(ours)
+	sc.Scan()
+	for sc.Scan() {
+		var je jsonEvent
+		if err := json.Unmarshal(sc.Bytes(), &je); nil != err {
+			/* Probably a "too many clients" message */
+			return status.Errorf(codes.Unavailable, "%s", sc.Text())
+		}
+		if err := stream.Send(grpcEvent(je)); nil != err {
+			return err
+		}
+	}
+	if err := sc.Err(); nil != err && !errors.Is(err, io.ErrClosedPipe) {
+		return status.Errorf(codes.Internal, "reading events: %s", err)
+	}
+	return stream.Context().Err()
+}
+
+/* grpcEvent converts a jsonEvent to a gRPC Event */
+func grpcEvent(je jsonEvent) *meshmemberspb.Event {
+	ev := &meshmemberspb.Event{
+		Seq:     je.Seq,
+		Time:    je.Time.Format(time.RFC3339Nano),
+		Kind:    je.Kind,
+		Message: je.Message,
+	}
+	if nil != je.Node {
+		ev.Node = &meshmemberspb.Node{
+			Name: je.Node.Name,
+			Addr: je.Node.Addr,
+			Id:   je.Node.ID,
+			Role: je.Node.Role,
+		}
+	}
+	return ev
+}
@@ -0,0 +1,23 @@
+//go:build !grpc
+
+package main
+
+/*
+ * grpc_other.go
+ * Stub for builds without gRPC support
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import "github.com/hashicorp/memberlist"
+
+// ListenGRPC terminates the program, as gRPC support isn't built in.  Build
+// with -tags grpc to enable it.
+func ListenGRPC(addr string, m *memberlist.Memberlist) {
+	fatalf(
+		exitConfig,
+		"Not built with gRPC support, rebuild with -tags grpc "+
+			"to use -grpc-listen",
+	)
+}
@@ -0,0 +1,97 @@
+//go:build grpc
+
+package main
+
+/*
+ * grpc_test.go
+ * Tests for grpc.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/magisterquis/meshmembers/meshmemberspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+/* TestGRPC makes sure gRPC clients can list members and get events */
+func TestGRPC(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+
+	/* In-process server and client */
+	l := bufconn.Listen(1 << 16)
+	s := grpc.NewServer()
+	meshmemberspb.RegisterMeshMembersServer(s, grpcServer{m: ms[0]})
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	cc, err := grpc.NewClient(
+		"passthrough:///bufconn",
+		grpc.WithContextDialer(func(
+			ctx context.Context,
+			_ string,
+		) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if nil != err {
+		t.Fatalf("Making client: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	c := meshmemberspb.NewMeshMembersClient(cc)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	/* Who's there? */
+	res, err := c.ListMembers(ctx, &meshmemberspb.ListMembersRequest{})
+	if nil != err {
+		t.Fatalf("Listing members: %v", err)
+	}
+	if 2 != len(res.Nodes) {
+		t.Fatalf("Got %d members", len(res.Nodes))
+	}
+	for i, m := range ms {
+		n, want := res.Nodes[i], m.LocalNode()
+		if want.Name != n.Name ||
+			nodeAddr(want) != n.Addr ||
+			"id-"+want.Name != n.Id {
+			t.Errorf("Got %v, expected %s", n, FormatNode(want))
+		}
+	}
+
+	/* What's happening? */
+	before := countClients()
+	stream, err := c.WatchEvents(ctx, &meshmemberspb.WatchEventsRequest{})
+	if nil != err {
+		t.Fatalf("Watching events: %v", err)
+	}
+	waitFor(t, "gRPC client", func() bool {
+		return before+1 == countClients()
+	})
+	BroadcastNodef(ms[1].LocalNode(), "[Join] %s", FormatNode(
+		ms[1].LocalNode(),
+	))
+	ev, err := stream.Recv()
+	if nil != err {
+		t.Fatalf("Receiving event: %v", err)
+	}
+	if "[Join] "+FormatNode(ms[1].LocalNode()) != ev.Message ||
+		1 != ev.Seq ||
+		"b" != ev.Node.GetName() ||
+		"" == ev.Time {
+		t.Fatalf("Got event %v", ev)
+	}
+
+	/* Hanging up removes the client */
+	cancel()
+	waitFor(t, "gRPC client removal", func() bool {
+		return before == countClients()
+	})
+}
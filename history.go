@@ -0,0 +1,53 @@
+package main
+
+/*
+ * history.go
+ * Remember recent events for clients which connect late
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import "sync"
+
+/* defaultEventHistory is the default number of events to remember */
+const defaultEventHistory = 100
+
+var (
+	/* eventHistory is the number of recent events to remember, or 0 to
+	not remember any. */
+	eventHistory = defaultEventHistory
+
+	/* history is a ring buffer of the last eventHistory events sent to
+	clients.  historyNext is the index of the next slot to fill, which,
+	once history is full, is also the oldest event. */
+	history     []*clientEvent
+	historyNext int
+	historyL    sync.Mutex
+)
+
+/* recordEvent adds ev to the history, replacing the oldest event if the
+history is full. */
+func recordEvent(ev *clientEvent) {
+	if 0 >= eventHistory {
+		return
+	}
+	historyL.Lock()
+	defer historyL.Unlock()
+	if len(history) < eventHistory {
+		history = append(history, ev)
+		return
+	}
+	history[historyNext] = ev
+	historyNext = (historyNext + 1) % len(history)
+}
+
+/* recentEvents returns up to the last eventHistory events sent to clients,
+oldest first. */
+func recentEvents() []*clientEvent {
+	historyL.Lock()
+	defer historyL.Unlock()
+	evs := make([]*clientEvent, 0, len(history))
+	evs = append(evs, history[historyNext:]...)
+	return append(evs, history[:historyNext]...)
+}
@@ -0,0 +1,80 @@
+package main
+
+/*
+ * history_test.go
+ * Tests for history.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* resetHistory forgets the event history and sets it to hold n events, until
+t is finished. */
+func resetHistory(t *testing.T, n int) {
+	reset := func(n int) {
+		historyL.Lock()
+		defer historyL.Unlock()
+		eventHistory = n
+		history = nil
+		historyNext = 0
+	}
+	reset(n)
+	t.Cleanup(func() { reset(defaultEventHistory) })
+}
+
+/* TestHistoryCommand makes sure HISTORY sends the most recent events, oldest
+first. */
+func TestHistoryCommand(t *testing.T) {
+	const hist = 3
+	resetHistory(t, hist)
+	captureLog(t)
+	tc := newTestClient(t, nil, false)
+
+	/* Some joins and leaves, more than we remember */
+	var want []string
+	for i := range 5 {
+		n := &memberlist.Node{
+			Name: fmt.Sprintf("n%d", i),
+			Addr: net.ParseIP("192.0.2.1"),
+			Port: uint16(i),
+		}
+		t.Cleanup(func() { forgetNode(n.Name) })
+		ev := memberlist.NodeJoin
+		if 1 == i%2 {
+			ev = memberlist.NodeLeave
+		}
+		handleEvent("us", memberlist.NodeEvent{Event: ev, Node: n}, 0)
+		want = append(want, tc.readLine())
+	}
+	want = want[len(want)-hist:]
+
+	tc.send("HISTORY")
+	var got []string
+	for range hist {
+		got = append(got, tc.readLine())
+	}
+	if !slices.Equal(want, got) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+
+	/* No history, nothing to send */
+	resetHistory(t, 0)
+	Broadcastf("forgotten")
+	if l := tc.readLine(); "forgotten" != l {
+		t.Fatalf("Got %q", l)
+	}
+	tc.send("HISTORY")
+	tc.send("FORMAT")
+	if l := tc.readLine(); "FORMAT text" != l {
+		t.Fatalf("Got %q without a history", l)
+	}
+}
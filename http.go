@@ -0,0 +1,173 @@
+package main
+
+/*
+ * http.go
+ * Serve the member list and metrics over HTTP
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* httpReadTimeout is how long we'll wait for an HTTP client's request */
+const httpReadTimeout = 10 * time.Second
+
+/* httpMember is a member of the mesh, as served by /members */
+type httpMember struct {
+	Name      string     `json:"name"`
+	Addr      string     `json:"addr"`
+	ID        string     `json:"id,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+}
+
+// ListenHTTP serves the member list and metrics over HTTP.  If path isn't
+// empty, it's the path to a Unix socket on which to listen, which is removed
+// first if rm is true.  Otherwise, addr is a TCP address on which to listen.
+func ListenHTTP(addr, path string, rm bool, m *memberlist.Memberlist) {
+	l, err := httpListener(addr, path, rm)
+	if nil != err {
+		fatalf(exitSocket, "Unable to listen for HTTP: %v", err)
+	}
+	log.Printf("Listening for HTTP requests on %s", l.Addr())
+
+	/* Serve ALL the things */
+	mux := http.NewServeMux()
+	mux.HandleFunc("/members", withMesh(serveMembers, m))
+	mux.HandleFunc("/metrics", withMesh(serveMetrics, m))
+	srv := &http.Server{Handler: mux, ReadTimeout: httpReadTimeout}
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving HTTP: %v", err)
+		}
+	}()
+}
+
+/* httpListener listens on the Unix socket at path, if path isn't empty, or
+the TCP address addr otherwise.  Unix sockets are closed by CloseListeners. */
+func httpListener(addr, path string, rm bool) (net.Listener, error) {
+	if "" == path {
+		return net.Listen("tcp", addr)
+	}
+	if rm {
+		if err := os.RemoveAll(path); nil != err {
+			return nil, fmt.Errorf("removing %s: %w", path, err)
+		}
+	}
+	ul, err := ListenUnix(path)
+	if nil != err {
+		return nil, err
+	}
+	listenersL.Lock()
+	defer listenersL.Unlock()
+	listeners = append(listeners, ul)
+	return ul, nil
+}
+
+/* withMesh wraps f in an http.HandlerFunc which passes it m */
+func withMesh(
+	f func(w http.ResponseWriter, m *memberlist.Memberlist),
+	m *memberlist.Memberlist,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		f(w, liveMesh(m))
+	}
+}
+
+/* serveMembers sends the members of the mesh as a JSON array */
+func serveMembers(w http.ResponseWriter, m *memberlist.Memberlist) {
+	ns := sortedMembers(m)
+	hms := make([]httpMember, len(ns))
+	for i, n := range ns {
+		nm := ParseMeta(n.Meta)
+		hms[i] = httpMember{
+			Name: n.Name,
+			Addr: nodeAddr(n),
+			ID:   nm.ID,
+			Role: nm.Role,
+		}
+		if t, ok := FirstSeen(n.Name); ok {
+			hms[i].FirstSeen = &t
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hms); nil != err {
+		log.Printf("Error sending members via HTTP: %v", err)
+	}
+}
+
+/* serveMetrics sends a few metrics in Prometheus' text format */
+func serveMetrics(w http.ResponseWriter, m *memberlist.Memberlist) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(
+		w,
+		"# HELP meshmembers_members Number of members in the mesh.\n"+
+			"# TYPE meshmembers_members gauge\n"+
+			"meshmembers_members %d\n",
+		m.NumMembers(),
+	)
+	fmt.Fprintf(
+		w,
+		"# HELP meshmembers_clients Number of connected clients.\n"+
+			"# TYPE meshmembers_clients gauge\n"+
+			"meshmembers_clients %d\n",
+		countClients(),
+	)
+	fmt.Fprintf(
+		w,
+		"# HELP meshmembers_health_score Memberlist's awareness "+
+			"score, lower is better.\n"+
+			"# TYPE meshmembers_health_score gauge\n"+
+			"meshmembers_health_score %d\n",
+		m.GetHealthScore(),
+	)
+	fmt.Fprintf(
+		w,
+		"# HELP meshmembers_event_backlog Number of events from "+
+			"memberlist waiting to be handled.\n"+
+			"# TYPE meshmembers_event_backlog gauge\n"+
+			"meshmembers_event_backlog %d\n",
+		eventBacklog.Load(),
+	)
+	_, avg, max, _ := eventLag()
+	fmt.Fprintf(
+		w,
+		"# HELP meshmembers_event_lag_seconds Time between getting "+
+			"recent events from memberlist and handling them.\n"+
+			"# TYPE meshmembers_event_lag_seconds gauge\n"+
+			"meshmembers_event_lag_seconds{stat=\"avg\"} %g\n"+
+			"meshmembers_event_lag_seconds{stat=\"max\"} %g\n",
+		avg.Seconds(),
+		max.Seconds(),
+	)
+	names, sizes := extraMeshSizes()
+	if 0 == len(names) {
+		return
+	}
+	fmt.Fprintf(
+		w,
+		"# HELP meshmembers_extra_members Number of members in each "+
+			"extra mesh.\n"+
+			"# TYPE meshmembers_extra_members gauge\n",
+	)
+	for i, name := range names {
+		fmt.Fprintf(
+			w,
+			"meshmembers_extra_members{mesh=%q} %d\n",
+			name,
+			sizes[i],
+		)
+	}
+}
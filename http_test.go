@@ -0,0 +1,67 @@
+package main
+
+/*
+ * http_test.go
+ * Tests for http.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* TestHTTPSocket makes sure members and metrics are served on a Unix
+socket. */
+func TestHTTPSocket(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	path := filepath.Join(t.TempDir(), "http.sock")
+	captureLog(t) /* Serve complains when we close the listener */
+	ListenHTTP("", path, false, ms[0])
+	t.Cleanup(CloseListeners)
+	hc := &http.Client{Transport: &http.Transport{DialContext: func(
+		ctx context.Context,
+		_, _ string,
+	) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}}}
+	get := func(p string) []byte {
+		t.Helper()
+		res, err := hc.Get("http://meshmembers" + p)
+		if nil != err {
+			t.Fatalf("Requesting %s: %v", p, err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if nil != err {
+			t.Fatalf("Reading %s: %v", p, err)
+		}
+		if http.StatusOK != res.StatusCode {
+			t.Fatalf("Got %s for %s: %s", res.Status, p, b)
+		}
+		return b
+	}
+
+	var hms []httpMember
+	if b := get("/members"); nil != json.Unmarshal(b, &hms) {
+		t.Fatalf("Unparseable members %q", b)
+	}
+	if 2 != len(hms) || "a" != hms[0].Name || "b" != hms[1].Name {
+		t.Fatalf("Got members %+v", hms)
+	}
+	if b := get("/metrics"); !strings.Contains(
+		string(b),
+		"\nmeshmembers_members 2\n",
+	) {
+		t.Fatalf("Got metrics %q", b)
+	}
+}
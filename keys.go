@@ -0,0 +1,91 @@
+package main
+
+/*
+ * keys.go
+ * Gossip encryption keys
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* keyring holds the keys used to encrypt gossip.  It's set before the mesh
+is started. */
+var keyring *memberlist.Keyring
+
+// DeriveKey turns a secret into a key suitable for gossip encryption.
+func DeriveKey(secret string) []byte {
+	k := sha256.Sum256([]byte(secret))
+	return k[:]
+}
+
+/* newKeyring makes the keyring, with key as the primary key */
+func newKeyring(key []byte) (*memberlist.Keyring, error) {
+	kr, err := memberlist.NewKeyring(nil, key)
+	if nil != err {
+		return nil, err
+	}
+	keyring = kr
+	return kr, nil
+}
+
+// RotateKey adds the key derived from secret to the keyring if it's not
+// already there and makes it the primary key.  Older keys are still
+// accepted until they're removed with RemoveKey.
+func RotateKey(secret string) error {
+	key := DeriveKey(secret)
+	if err := keyring.AddKey(key); nil != err {
+		return fmt.Errorf("adding key: %w", err)
+	}
+	if err := keyring.UseKey(key); nil != err {
+		return fmt.Errorf("making key primary: %w", err)
+	}
+	log.Printf(
+		"Rotated to new primary key, %d keys in keyring",
+		len(keyring.GetKeys()),
+	)
+	return nil
+}
+
+// RemoveKey removes the key derived from secret from the keyring.  The
+// primary key can't be removed.
+func RemoveKey(secret string) error {
+	if err := keyring.RemoveKey(DeriveKey(secret)); nil != err {
+		return err
+	}
+	log.Printf(
+		"Removed key, %d keys in keyring",
+		len(keyring.GetKeys()),
+	)
+	return nil
+}
+
+// DropOldKeys removes every key but the primary key from the keyring, and
+// returns the number of keys removed.
+func DropOldKeys() (int, error) {
+	primary := keyring.GetPrimaryKey()
+	var n int
+	for _, k := range keyring.GetKeys() {
+		if bytes.Equal(k, primary) {
+			continue
+		}
+		if err := keyring.RemoveKey(k); nil != err {
+			return n, fmt.Errorf("removing key: %w", err)
+		}
+		n++
+	}
+	log.Printf(
+		"Removed %d old keys, %d keys in keyring",
+		n,
+		len(keyring.GetKeys()),
+	)
+	return n, nil
+}
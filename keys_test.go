@@ -0,0 +1,158 @@
+package main
+
+/*
+ * keys_test.go
+ * Tests for keys.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* withKeyrings gives each node made with newTestMesh its own keyring, with
+the same key, and returns the keyrings by node name.  The first keyring made
+is also used as our keyring. */
+func withKeyrings(
+	t testing.TB,
+	krs map[string]*memberlist.Keyring,
+) func(*memberlist.Config) {
+	old := keyring
+	t.Cleanup(func() { keyring = old })
+	return func(conf *memberlist.Config) {
+		kr, err := memberlist.NewKeyring(nil, conf.SecretKey)
+		if nil != err {
+			t.Fatalf("Making keyring: %v", err)
+		}
+		conf.Keyring = kr
+		krs[conf.Name] = kr
+		if 1 == len(krs) {
+			keyring = kr
+		}
+	}
+}
+
+/* TestRotateKey rotates a mesh to a new key and makes sure nodes with only
+the new key can join. */
+func TestRotateKey(t *testing.T) {
+	var (
+		krs = make(map[string]*memberlist.Keyring)
+		mn  = new(memberlist.MockNetwork)
+		ms  = newTestMeshOn(t, mn, withKeyrings(t, krs), "a", "b")
+	)
+	tc := newTestClient(t, ms[0], true)
+
+	/* Rotate a via the command, b by hand */
+	tc.send("ROTATE-KEY new")
+	if l := tc.readLine(); "Rotated to new primary key" != l {
+		t.Fatalf("ROTATE-KEY got %q", l)
+	}
+	if err := krs["b"].AddKey(DeriveKey("new")); nil != err {
+		t.Fatalf("Adding key to b: %v", err)
+	}
+	if err := krs["b"].UseKey(DeriveKey("new")); nil != err {
+		t.Fatalf("Using key on b: %v", err)
+	}
+	tc.send("REMOVE-KEY test-secret")
+	if l := tc.readLine(); "Removed key" != l {
+		t.Fatalf("REMOVE-KEY got %q", l)
+	}
+	if err := krs["b"].RemoveKey(DeriveKey("test-secret")); nil != err {
+		t.Fatalf("Removing key from b: %v", err)
+	}
+
+	/* The primary key can't go */
+	tc.send("REMOVE-KEY new")
+	if l := tc.readLine(); !strings.Contains(l, "primary key") {
+		t.Fatalf("Removing the primary key got %q", l)
+	}
+
+	/* A node with just the new key should be able to join */
+	c, err := memberlist.Create(newTestConfig(mn, "c", "new"))
+	if nil != err {
+		t.Fatalf("Creating c: %v", err)
+	}
+	t.Cleanup(func() { c.Shutdown() })
+	if _, err := c.Join(
+		[]string{ms[0].LocalNode().Address()},
+	); nil != err {
+		t.Fatalf("Joining with the new key: %v", err)
+	}
+	waitFor(t, "c to be seen", func() bool {
+		return 3 == ms[0].NumMembers() && 3 == ms[1].NumMembers()
+	})
+}
+
+/* TestSetSecret makes sure that after SET-SECRET gossip encrypted with either
+the new or old secret is accepted, and after DROP-OLD-SECRET only the new secret
+works. */
+func TestSetSecret(t *testing.T) {
+	var (
+		krs = make(map[string]*memberlist.Keyring)
+		mn  = new(memberlist.MockNetwork)
+		ms  = newTestMeshOn(t, mn, withKeyrings(t, krs), "a")
+	)
+	/* join makes a node which sends with the key from secret, and can
+	also read the new key, and joins it to a. */
+	join := func(name, secret string) error {
+		conf := newTestConfig(mn, name, secret)
+		kr, err := memberlist.NewKeyring(
+			[][]byte{DeriveKey("new")},
+			conf.SecretKey,
+		)
+		if nil != err {
+			t.Fatalf("Making keyring for %s: %v", name, err)
+		}
+		conf.Keyring = kr
+		m, err := memberlist.Create(conf)
+		if nil != err {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		_, err = m.Join([]string{ms[0].LocalNode().Address()})
+		return err
+	}
+
+	/* Only for admins */
+	tc := newTestClient(t, ms[0], false)
+	tc.send("SET-SECRET new")
+	want := "SET-SECRET is only available to admin clients"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Non-admin SET-SECRET got %q", l)
+	}
+
+	tc = newTestClient(t, ms[0], true)
+	tc.send("SET-SECRET")
+	if l := tc.readLine(); "Error: need a secret" != l {
+		t.Fatalf("SET-SECRET without a secret got %q", l)
+	}
+	tc.send("SET-SECRET new")
+	if l := tc.readLine(); "Rotated to new primary key" != l {
+		t.Fatalf("SET-SECRET got %q", l)
+	}
+	if err := join("b", "new"); nil != err {
+		t.Fatalf("Joining with the new secret: %v", err)
+	}
+	if err := join("c", "test-secret"); nil != err {
+		t.Fatalf("Joining with the old secret: %v", err)
+	}
+
+	/* After dropping the old one, only the new one's any good */
+	tc.send("DROP-OLD-SECRET")
+	if l := tc.readLine(); "Dropped 1 old secrets" != l {
+		t.Fatalf("DROP-OLD-SECRET got %q", l)
+	}
+	if ks := keyring.GetKeys(); 1 != len(ks) ||
+		!bytes.Equal(DeriveKey("new"), ks[0]) {
+		t.Fatalf("Keyring left with %d keys", len(ks))
+	}
+	if err := join("d", "test-secret"); nil == err {
+		t.Fatalf("Joined with the dropped secret")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * lag.go
+ * Measure how far behind we are handling events
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* lagSamples is the number of recent events whose lag is remembered */
+const lagSamples = 100
+
+var (
+	/* lags is a ring buffer of how long the last lagSamples events took
+	to handle, from when memberlist gave them to us.  lagsNext is the
+	index of the next slot to fill, and lagsLast is the most recent
+	lag. */
+	lags     []time.Duration
+	lagsNext int
+	lagsLast time.Duration
+	lagsL    sync.Mutex
+)
+
+/* timedEvent is an event from memberlist and when we got it */
+type timedEvent struct {
+	memberlist.NodeEvent
+	at time.Time
+}
+
+// TimedEventDelegate is like memberlist.ChannelEventDelegate, but notes when
+// each event was received, to measure how far behind we are handling them.
+type TimedEventDelegate struct {
+	Ch chan<- timedEvent
+}
+
+var _ memberlist.EventDelegate = TimedEventDelegate{}
+
+// NotifyJoin sends a NodeJoin event for n to d.Ch.
+func (d TimedEventDelegate) NotifyJoin(n *memberlist.Node) {
+	d.send(memberlist.NodeJoin, n)
+}
+
+// NotifyLeave sends a NodeLeave event for n to d.Ch.  The node is forgotten by
+// our JoinThrottle, if we have one, so it's throttled like any other new node
+// if it comes back.
+func (d TimedEventDelegate) NotifyLeave(n *memberlist.Node) {
+	localThrottle.forget(n.Name)
+	d.send(memberlist.NodeLeave, n)
+}
+
+// NotifyUpdate sends a NodeUpdate event for n to d.Ch.
+func (d TimedEventDelegate) NotifyUpdate(n *memberlist.Node) {
+	d.send(memberlist.NodeUpdate, n)
+}
+
+/* send sends an event of type et about a copy of n to d.Ch.  As with
+memberlist.ChannelEventDelegate, n is copied as memberlist may change it. */
+func (d TimedEventDelegate) send(
+	et memberlist.NodeEventType,
+	n *memberlist.Node,
+) {
+	node := *n
+	d.Ch <- timedEvent{
+		NodeEvent: memberlist.NodeEvent{Event: et, Node: &node},
+		at:        time.Now(),
+	}
+}
+
+/* recordLag notes that an event took d to handle, replacing the oldest lag
+if we've got lagSamples of them. */
+func recordLag(d time.Duration) {
+	lagsL.Lock()
+	defer lagsL.Unlock()
+	lagsLast = d
+	if len(lags) < lagSamples {
+		lags = append(lags, d)
+		return
+	}
+	lags[lagsNext] = d
+	lagsNext = (lagsNext + 1) % len(lags)
+}
+
+/* eventLag returns the lag of the most recently-handled event, and the
+average and maximum lag of the last n events, where n is at most
+lagSamples. */
+func eventLag() (last, avg, max time.Duration, n int) {
+	lagsL.Lock()
+	defer lagsL.Unlock()
+	if 0 == len(lags) {
+		return 0, 0, 0, 0
+	}
+	var total time.Duration
+	for _, d := range lags {
+		total += d
+		if d > max {
+			max = d
+		}
+	}
+	return lagsLast, total / time.Duration(len(lags)), max, len(lags)
+}
@@ -0,0 +1,59 @@
+package main
+
+/*
+ * lag_test.go
+ * Tests for lag.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestEventLag makes sure the time taken to send an event to clients counts
+towards its lag. */
+func TestEventLag(t *testing.T) {
+	const stuck = 100 * time.Millisecond
+	resetLags := func() {
+		lagsL.Lock()
+		defer lagsL.Unlock()
+		lags = nil
+		lagsNext = 0
+		lagsLast = 0
+	}
+	resetLags()
+	t.Cleanup(func() {
+		resetLags()
+		forgetNode("n")
+	})
+	captureLog(t)
+	nech := make(chan timedEvent)
+	defer close(nech)
+	go HandleEvents("us", nech)
+
+	/* Hold up broadcasting for a bit */
+	clientsL.Lock()
+	TimedEventDelegate{Ch: nech}.NotifyJoin(&memberlist.Node{Name: "n"})
+	time.Sleep(stuck)
+	clientsL.Unlock()
+
+	waitFor(t, "lag", func() bool {
+		_, _, _, n := eventLag()
+		return 1 == n
+	})
+	last, avg, max, _ := eventLag()
+	if last < stuck || avg != last || max != last {
+		t.Fatalf(
+			"Lag last=%s avg=%s max=%s, expected at least %s",
+			last,
+			avg,
+			max,
+			stuck,
+		)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+/*
+ * membersfile.go
+ * Keep a file listing the mesh's members
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* membersFileDebounce is how long to wait after a change before rewriting
+the members file, so a burst of changes only causes one write */
+const membersFileDebounce = time.Second
+
+/* membersChanged receives a value when the mesh's membership changes.  It's
+buffered so noting a change never blocks. */
+var membersChanged = make(chan struct{}, 1)
+
+// WatchMembers keeps the file at path up to date with the member list sent
+// to new clients.  The file is rewritten atomically after membership
+// changes, and every interval if interval isn't 0.
+func WatchMembers(
+	m *memberlist.Memberlist,
+	path string,
+	interval time.Duration,
+) {
+	var tick <-chan time.Time
+	if 0 != interval {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		var b bytes.Buffer
+		writeSnapshot(&b, liveMesh(m), formatText)
+		if err := writeFileAtomic(path, b.Bytes(), 0644); nil != err {
+			log.Printf("Error writing members file: %v", err)
+		}
+
+		/* Wait for something to happen, and for it to settle down */
+		select {
+		case <-membersChanged:
+			time.Sleep(membersFileDebounce)
+			select {
+			case <-membersChanged:
+			default:
+			}
+		case <-tick:
+		}
+	}
+}
+
+/* noteMembersChanged tells WatchMembers the mesh's membership has changed. */
+func noteMembersChanged() {
+	select {
+	case membersChanged <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+/*
+ * membersfile_test.go
+ * Tests for membersfile.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestWatchMembers makes sure the members file is rewritten, in one go, when
+a node joins. */
+func TestWatchMembers(t *testing.T) {
+	/* Two nodes which don't know about each other yet */
+	mn := new(memberlist.MockNetwork)
+	var ms []*memberlist.Memberlist
+	for _, name := range []string{"a", "b"} {
+		m, err := memberlist.Create(newTestConfig(mn, name, "s"))
+		if nil != err {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		ms = append(ms, m)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "members")
+	snapshot := func() string {
+		var b bytes.Buffer
+		writeSnapshot(&b, ms[0], formatText)
+		return b.String()
+	}
+	contents := func() string {
+		b, err := os.ReadFile(path)
+		if nil != err {
+			return ""
+		}
+		return string(b)
+	}
+
+	go WatchMembers(ms[0], path, 0)
+	want := snapshot()
+	waitFor(t, "members file", func() bool { return want == contents() })
+
+	/* Someone joins */
+	if _, err := ms[1].Join(
+		[]string{ms[0].LocalNode().Address()},
+	); nil != err {
+		t.Fatalf("Joining: %v", err)
+	}
+	waitFor(t, "join", func() bool { return 2 == ms[0].NumMembers() })
+	old := want
+	want = snapshot()
+	waitFor(t, "members file update", func() bool {
+		noteMembersChanged() /* Other tests' watchers may take it */
+		got := contents()
+		if old != got && want != got {
+			t.Fatalf("Members file partly written: %q", got)
+		}
+		return want == got
+	})
+
+	/* Nothing left lying about */
+	des, err := os.ReadDir(dir)
+	if nil != err {
+		t.Fatalf("Reading directory: %v", err)
+	}
+	if 1 != len(des) {
+		t.Fatalf("Directory has %d files, expected 1", len(des))
+	}
+}
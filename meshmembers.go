@@ -6,40 +6,96 @@ package main
  * Thin wrapper around HashiCorp's memberlist
  * By J. Stuart McMurray
  * Created 20200416
- * Last Modified 20200418
+ * Last Modified 20261014
  */
 
 import (
-	"crypto/sha256"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
-	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/memberlist"
 )
 
+/* githubSecret is the default secret, as found on GitHub */
+const githubSecret = "i_used_the_default_from_github"
+
 var (
 	/* SharedSecret is the secret shared amongst mesh members */
-	SharedSecret = "i_used_the_default_from_github"
+	SharedSecret = githubSecret
+
+	/* extAddrURL is the URL to query to get our external address.  Tests
+	point it somewhere local. */
+	extAddrURL = "https://icanhazip.com"
 )
 
 const (
-	/* udpBufferSize is the size of UDP packets we'll send.  This allows
-	for a much smaller MTU */
-	udpBufferSize = 1024
+	/* leaveTimeout is how long we'll wait for the rest of the mesh to
+	hear that we're leaving */
+	leaveTimeout = 10 * time.Second
 
-	/* extAddrURL is the URL to query to get our external address */
-	extAddrURL = "https://icanhazip.com"
+	/* hostLookupTimeout is how long we'll wait to resolve a hostname
+	given for our listen or external address */
+	hostLookupTimeout = 10 * time.Second
+
+	/* macLessEntropy is the number of random bytes added to the default
+	name for nodes without a MAC address */
+	macLessEntropy = 4
+
+	/* defaultDrainGrace is the default time between starting to drain
+	and leaving the mesh */
+	defaultDrainGrace = 5 * time.Second
+
+	/* lifetimeJitter is the largest fraction by which we'll randomly
+	lengthen or shorten -max-lifetime */
+	lifetimeJitter = 0.1
+)
+
+/* joinPeerTimeout is how long we'll wait for each peer when joining the mesh.
+Tests make it shorter. */
+var joinPeerTimeout = 15 * time.Second
+
+var (
+	/* drainGrace is how long we wait after starting to drain before
+	leaving the mesh */
+	drainGrace = defaultDrainGrace
+
+	/* draining is set once we've started draining */
+	draining atomic.Bool
+)
+
+/* configProfiles maps -profile values to the memberlist configs on which ours
+are based */
+var configProfiles = map[string]func() *memberlist.Config{
+	"wan":   memberlist.DefaultWANConfig,
+	"lan":   memberlist.DefaultLANConfig,
+	"local": memberlist.DefaultLocalConfig,
+}
+
+/* Exit codes, for telling supervisors why we died */
+const (
+	exitGeneral = 1 /* Something unexpected */
+	exitConfig  = 2 /* Invalid configuration, same as the flag package */
+	exitAddress = 3 /* Unable to work out our addresses */
+	exitMesh    = 4 /* Unable to start the mesh listeners */
+	exitSocket  = 5 /* Local client socket failure */
+	exitJoin    = 6 /* Unable to join the mesh with -require-join */
 )
 
 func main() {
@@ -47,12 +103,61 @@ func main() {
 		sockPath = flag.String(
 			"socket",
 			"",
-			"Unix socket `path` for listing members",
+			"Unix socket `path` for listing members, in which "+
+				"{name}, {pid}, and {port} will be expanded",
+		)
+		adminSockPath = flag.String(
+			"admin-socket",
+			"",
+			"Unix socket `path` for admin clients, expanded "+
+				"like -socket",
+		)
+		eventsSockPath = flag.String(
+			"events-socket",
+			"",
+			"Unix socket `path` for clients which only want "+
+				"events, expanded like -socket",
+		)
+		tcpClientAddr = flag.String(
+			"client-tcp",
+			"",
+			"Optional TCP `address` on which to listen for "+
+				"non-admin clients",
+		)
+		tcpAllow = flag.String(
+			"client-allow-cidr",
+			"",
+			"Comma-separated `list` of CIDR ranges from which "+
+				"TCP clients may connect (default any)",
+		)
+		tcpNegotiate = flag.Bool(
+			"client-tcp-negotiate",
+			false,
+			"Read an encoding byte from each TCP client before "+
+				"sending it anything",
+		)
+		httpAddr = flag.String(
+			"http-addr",
+			"",
+			"Optional TCP `address` on which to serve the member "+
+				"list and metrics via HTTP",
+		)
+		grpcAddr = flag.String(
+			"grpc-listen",
+			"",
+			"Optional `address` on which to serve gRPC clients, "+
+				"if built with -tags grpc",
+		)
+		httpSockPath = flag.String(
+			"http-socket",
+			"",
+			"Optional Unix socket `path` on which to serve HTTP "+
+				"instead of -http-addr, expanded like -socket",
 		)
 		removeSockFirst = flag.Bool(
 			"remove-existing-socket",
 			false,
-			"Remove the unix socket file before listening",
+			"Remove the unix socket files before listening",
 		)
 		nodeName = flag.String(
 			"name",
@@ -72,21 +177,456 @@ func main() {
 			"External IP `address` which will be found by "+
 				"querying icanhazip if unset",
 		)
+		extAddrCache = flag.String(
+			"extaddr-cache",
+			"",
+			"Optional `file` in which to cache the external "+
+				"address found by querying icanhazip",
+		)
+		extAddrCacheTTL = flag.Duration(
+			"extaddr-cache-ttl",
+			time.Hour,
+			"Maximum `age` of a cached external address",
+		)
+		extAddrRefresh = flag.Duration(
+			"extaddr-refresh",
+			0,
+			"Optional `interval` at which to check whether the "+
+				"external address found by querying icanhazip "+
+				"has changed, and rejoin advertising the new "+
+				"address if so",
+		)
+		requireExplicitBind = flag.Bool(
+			"require-explicit-bind",
+			false,
+			"Refuse to listen on all interfaces, requiring a "+
+				"specific address for -listen",
+		)
+		advertiseAddr = flag.String(
+			"advertise-addr",
+			"",
+			"Optional IP `address` to advertise to the mesh, "+
+				"overriding -external",
+		)
 		password = flag.String(
 			"secret",
 			SharedSecret,
 			"Mesh shared `secret`",
 		)
+		refuseDefaultSecret = flag.Bool(
+			"refuse-default-secret",
+			false,
+			"Refuse to start if the secret is the default from "+
+				"GitHub",
+		)
+		profile = flag.String(
+			"profile",
+			"wan",
+			"Base mesh timing `profile`, one of wan, lan, or local",
+		)
+		role = flag.String(
+			"role",
+			"",
+			"Optional `role` to advertise, e.g. gateway or worker",
+		)
+		observe = flag.Bool(
+			"observe",
+			false,
+			"Watch the mesh as unobtrusively as possible, "+
+				"without gossiping",
+		)
+		weight = flag.Int(
+			"weight",
+			0,
+			"Optional `weight` to advertise, for clients picking "+
+				"nodes by priority",
+		)
+		allowedRoles = flag.String(
+			"allowed-roles",
+			"",
+			"Optional comma-separated `list` of roles allowed "+
+				"for -role",
+		)
+		fullPolicy = flag.String(
+			"full-policy",
+			"reject",
+			"What to do with new clients when there's too "+
+				"many clients, reject or queue (wait a bit "+
+				"for room)",
+		)
+		socketFailurePolicy = flag.String(
+			"socket-failure-policy",
+			"exit",
+			"What to do when a client listener fails, exit (the "+
+				"mesh gracefully) or continue (without the "+
+				"listener)",
+		)
+		clientMemPolicy = flag.String(
+			"client-mem-policy",
+			"drop",
+			"What to do when over -client-mem-budget, drop "+
+				"(events) or disconnect (the slowest client)",
+		)
+		writeConcurrency = flag.Int(
+			"write-concurrency",
+			0,
+			"Write to clients with a fixed `number` of "+
+				"goroutines (0 for one per client)",
+		)
+		eventFormatName = flag.String(
+			"event-format",
+			"text",
+			"Default `format` for events sent to clients and "+
+				"stdout (text, json, cef), and for logged "+
+				"events if cef",
+		)
+		broadcastIncludeSize = flag.Bool(
+			"broadcast-include-size",
+			false,
+			"Add the number of members in the mesh to each "+
+				"event sent to clients",
+		)
+		reportRoles = flag.Bool(
+			"report-roles",
+			false,
+			"Include counts of nodes with each role in the mesh "+
+				"size report",
+		)
+		gossipCompression = flag.Bool(
+			"gossip-compression",
+			memberlist.DefaultLANConfig().EnableCompression,
+			"Compress gossip, which should be the same for all "+
+				"members of the mesh",
+		)
+		label = flag.String(
+			"label",
+			"",
+			"Optional mesh `label`, which must be the same for "+
+				"all members of the mesh",
+		)
 		peers = flag.String(
 			"peers",
 			"",
-			"Comma-separated `list` of known mesh members",
+			"Comma-separated `list` of known mesh members, or - "+
+				"to read the list from stdin",
+		)
+		peersSRV = flag.String(
+			"peers-srv",
+			"",
+			"DNS SRV `record` (e.g. _mesh._tcp.example.com) "+
+				"listing additional mesh members",
+		)
+		permanentPeers = flag.String(
+			"permanent-peers",
+			"",
+			"Comma-separated `list` of peers to keep trying to "+
+				"reach, even after they've left the mesh",
+		)
+		rejoinAfter = flag.Duration(
+			"rejoin-after",
+			5*time.Minute,
+			"Try to rejoin the mesh via the initial peers after "+
+				"having no peers for this `duration` (0 to "+
+				"disable)",
+		)
+		discoverLAN = flag.Bool(
+			"discover-lan",
+			false,
+			"Find peers via multicast announcements on the LAN",
+		)
+		discoverGroup = flag.String(
+			"discover-group",
+			"239.255.78.87:7887",
+			"Multicast `address` and port for LAN discovery",
 		)
 		reportInterval = flag.Duration(
 			"report-every",
 			time.Hour,
 			"Mesh size report `interval`",
 		)
+		initialReportDelay = flag.Duration(
+			"initial-report-delay",
+			30*time.Second,
+			"Report the mesh size once this `duration` after "+
+				"starting, before the first -report-every "+
+				"interval (0 to not)",
+		)
+		createRetries = flag.Uint(
+			"create-retries",
+			5,
+			"Number of `times` to retry starting the mesh "+
+				"listeners if the port is in use",
+		)
+		createRetryDelay = flag.Duration(
+			"create-retry-delay",
+			time.Second,
+			"Wait `duration` between attempts to start the mesh "+
+				"listeners",
+		)
+		readyFile = flag.String(
+			"ready-file",
+			"",
+			"Optional `file` which will exist only while this "+
+				"node has at least one peer",
+		)
+		membersFile = flag.String(
+			"members-file",
+			"",
+			"Optional `file` kept up to date with the mesh's "+
+				"members, as sent to new clients",
+		)
+		membersFileInterval = flag.Duration(
+			"members-file-interval",
+			0,
+			"Optional `interval` at which to rewrite "+
+				"-members-file even if nothing's changed",
+		)
+		debug = flag.Bool(
+			"debug",
+			false,
+			"Log memberlist's internal messages",
+		)
+		maxLifetime = flag.Duration(
+			"max-lifetime",
+			0,
+			"Leave the mesh and exit after roughly this "+
+				"`duration` (0 to run forever)",
+		)
+		reuseport = flag.Bool(
+			"reuseport",
+			false,
+			"Set SO_REUSEPORT on the mesh listeners, to allow "+
+				"quick restarts",
+		)
+		probePeers = flag.Bool(
+			"probe-peers",
+			false,
+			"After joining the mesh, check whether each peer's "+
+				"port is reachable via TCP and log the results",
+		)
+		selfTest = flag.Bool(
+			"selftest",
+			false,
+			"Start a throwaway mesh on loopback to make sure "+
+				"everything works, then exit",
+		)
+		idFile = flag.String(
+			"id-file",
+			"",
+			"Optional `file` in which to keep this node's ID "+
+				"across restarts",
+		)
+		joinRate = flag.Int(
+			"join-rate",
+			0,
+			"Maximum `number` of new nodes to let into the mesh "+
+				"every -join-rate-interval (0 for no limit)",
+		)
+		joinRateInterval = flag.Duration(
+			"join-rate-interval",
+			time.Second,
+			"Join rate limiting `interval`",
+		)
+		extraMeshesFile = flag.String(
+			"extra-meshes",
+			"",
+			"Optional `file` describing additional meshes to "+
+				"join, one per line",
+		)
+		bridgePeers = flag.String(
+			"bridge-peers",
+			"",
+			"Comma-separated `peers` in a second mesh to which to "+
+				"forward join and leave notices",
+		)
+		bridgeListen = flag.String(
+			"bridge-listen",
+			"0.0.0.0:0",
+			"Listen `address` and port for the bridged mesh",
+		)
+		bridgeSecret = flag.String(
+			"bridge-secret",
+			SharedSecret,
+			"Shared `secret` for the bridged mesh",
+		)
+		bridgeLabel = flag.String(
+			"bridge-label",
+			"",
+			"Optional `label` for the bridged mesh",
+		)
+		requireJoin = flag.Bool(
+			"require-join",
+			false,
+			"Exit if the initial peers can't be joined, rather "+
+				"than running alone",
+		)
+		suppressUpdates = flag.Bool(
+			"suppress-updates",
+			false,
+			"Neither log nor send clients update events, "+
+				"overriding -log-events and -broadcast-events",
+		)
+		stdoutEvents = flag.Bool(
+			"stdout-events",
+			false,
+			"Write events to stdout as they would be sent to "+
+				"clients",
+		)
+	)
+	flag.Var(
+		&logEvents,
+		"log-events",
+		"Comma-separated `kinds` of events to log (all, none, join, "+
+			"update, leave, conflict, notice, other)",
+	)
+	flag.Var(
+		&broadcastEvents,
+		"broadcast-events",
+		"Comma-separated `kinds` of events to send to clients, "+
+			"like -log-events",
+	)
+	flag.IntVar(
+		&maxCommandSize,
+		"max-command-size",
+		defaultMaxCommandSize,
+		"Maximum `length` of a command from a client, which will "+
+			"be disconnected if it sends a longer command",
+	)
+	flag.DurationVar(
+		&snapshotTimeout,
+		"client-snapshot-timeout",
+		defaultSnapshotTimeout,
+		"Maximum `duration` to spend sending a new client the "+
+			"member list",
+	)
+	flag.DurationVar(
+		&drainGrace,
+		"drain-grace",
+		defaultDrainGrace,
+		"Time to keep serving existing clients after DRAIN or "+
+			"SIGTERM before leaving the mesh",
+	)
+	flag.StringVar(
+		&peersCache,
+		"peers-cache",
+		"",
+		"Optional `file` in which to save the mesh's members when "+
+			"leaving or on SAVE-PEERS, to use as peers next time",
+	)
+	flag.IntVar(
+		&minJoinPeers,
+		"min-join-peers",
+		1,
+		"Minimum `number` of peers which must be contacted for "+
+			"joining the mesh to count as successful",
+	)
+	flag.Int64Var(
+		&clientMemBudget,
+		"client-mem-budget",
+		0,
+		"Maximum `bytes` of events waiting to be sent to all "+
+			"clients put together (0 for no limit)",
+	)
+	flag.IntVar(
+		&eventBuffer,
+		"event-buffer",
+		defaultEventBuffer,
+		"Number of `events` from memberlist to buffer while "+
+			"earlier events are handled",
+	)
+	flag.DurationVar(
+		&convergeQuiet,
+		"converge-quiet",
+		defaultConvergeQuiet,
+		"How long the mesh must go without joins, updates, or "+
+			"leaves to be considered converged",
+	)
+	flag.IntVar(
+		&eventHistory,
+		"event-history",
+		defaultEventHistory,
+		"Number of recent `events` to remember for HISTORY",
+	)
+	flag.BoolVar(
+		&broadcastIncludeSeq,
+		"broadcast-include-seq",
+		false,
+		"Number the events from the mesh sent to clients, so "+
+			"gaps can be spotted",
+	)
+	flag.StringVar(
+		&fullMessage,
+		"full-message",
+		defaultFullMessage,
+		"`Message` sent to clients when there's too many clients",
+	)
+	flag.IntVar(
+		&clientCoalesceMS,
+		"client-coalesce-ms",
+		0,
+		"Optional `milliseconds` for which to buffer events sent to "+
+			"clients, to send bursts with fewer writes",
+	)
+	flag.DurationVar(
+		&tombstoneTTL,
+		"tombstone-ttl",
+		0,
+		"Optional `duration` for which to list departed nodes in "+
+			"the member list sent to new clients",
+	)
+	flag.BoolVar(
+		&excludeSelfInSnapshot,
+		"exclude-self-in-snapshot",
+		false,
+		"Leave this node out of the member list sent to new clients",
+	)
+	flag.BoolVar(
+		&showNodeID,
+		"show-id",
+		false,
+		"Show the start of each node's ID when listing nodes",
+	)
+	flag.BoolVar(
+		&showProtocol,
+		"show-protocol",
+		false,
+		"Show each node's memberlist protocol versions when "+
+			"listing nodes",
+	)
+	flag.IntVar(
+		&udpBufferSize,
+		"udp-buffer",
+		defaultUDPBufferSize,
+		"Largest UDP packet to send, in `bytes`, which should "+
+			"fit in the network's MTU",
+	)
+	flag.IntVar(
+		&conflictRejoinAfter,
+		"conflict-rejoin-after",
+		0,
+		"Leave and rejoin with a new name after this `many` "+
+			"conflicts with our name within "+
+			"-conflict-rejoin-window",
+	)
+	flag.DurationVar(
+		&conflictRejoinWindow,
+		"conflict-rejoin-window",
+		defaultConflictRejoinWindow,
+		"Window in which to count conflicts for "+
+			"-conflict-rejoin-after",
+	)
+	flag.StringVar(
+		&conflictGuidance,
+		"conflict-guidance",
+		"",
+		"Optional `advice` added to name conflict messages, e.g. "+
+			"\"set -name to disambiguate\"",
+	)
+	flag.Var(
+		&bridgeEvents,
+		"bridge-events",
+		"Comma-separated `kinds` of events to forward to the "+
+			"bridged mesh (join, update, leave)",
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(
@@ -97,22 +637,241 @@ Joins a mesh network and sends a list of members to anything connecting to its
 socket.  By default the node's name will be composed of the platform, a MAC
 address, and the time.
 
+Exit codes:
+  %d - Unexpected error
+  %d - Invalid configuration
+  %d - Unable to work out addresses
+  %d - Unable to start the mesh listeners
+  %d - Local client socket failure
+  %d - Unable to join the mesh, with -require-join
+
 Options:
 `,
 			os.Args[0],
+			exitGeneral,
+			exitConfig,
+			exitAddress,
+			exitMesh,
+			exitSocket,
+			exitJoin,
 		)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	if *selfTest {
+		os.Exit(RunSelfTest())
+	}
+	if *suppressUpdates {
+		suppressUpdateEvents()
+	}
+	if 0 >= maxCommandSize {
+		fatalf(exitConfig, "Maximum command size must be positive")
+	}
+	if 1 > minJoinPeers {
+		fatalf(exitConfig, "Minimum join peers must be at least 1")
+	}
+	if 0 > *initialReportDelay {
+		fatalf(exitConfig, "Initial report delay must not be negative")
+	}
+	if 0 > *extAddrRefresh {
+		fatalf(
+			exitConfig,
+			"External address refresh interval must not be "+
+				"negative",
+		)
+	}
+	if 0 > *joinRate {
+		fatalf(exitConfig, "Join rate must not be negative")
+	}
+	if 0 >= *joinRateInterval {
+		fatalf(exitConfig, "Join rate interval must be positive")
+	}
+	if 0 >= eventBuffer {
+		fatalf(exitConfig, "Event buffer size must be positive")
+	}
+	if 0 >= convergeQuiet {
+		fatalf(exitConfig, "Convergence quiet period must be positive")
+	}
+	if 0 > eventHistory {
+		fatalf(exitConfig, "Event history size must not be negative")
+	}
+	if 0 > clientCoalesceMS {
+		fatalf(exitConfig, "Coalescing window must not be negative")
+	}
+	if 0 != eventKind(bridgeEvents)&^bridgeableEvents {
+		fatalf(
+			exitConfig,
+			"Only join, update, and leave events may be bridged",
+		)
+	}
+	switch *fullPolicy {
+	case "reject":
+	case "queue":
+		queueWhenFull = true
+	default:
+		fatalf(exitConfig, "Unknown full policy %q", *fullPolicy)
+	}
+	if 0 > clientMemBudget {
+		fatalf(exitConfig, "Client memory budget must not be negative")
+	}
+	if *observe && (*discoverLAN || "" != *permanentPeers || *probePeers) {
+		fatalf(
+			exitConfig,
+			"-observe can't be used with -discover-lan, "+
+				"-permanent-peers, or -probe-peers",
+		)
+	}
+	switch *socketFailurePolicy {
+	case "exit":
+	case "continue":
+		socketFailureContinue = true
+	default:
+		fatalf(
+			exitConfig,
+			"Unknown socket failure policy %q",
+			*socketFailurePolicy,
+		)
+	}
+	switch *clientMemPolicy {
+	case "drop":
+	case "disconnect":
+		clientMemDisconnect = true
+	default:
+		fatalf(
+			exitConfig,
+			"Unknown client memory policy %q",
+			*clientMemPolicy,
+		)
+	}
+	if 0 > *membersFileInterval {
+		fatalf(exitConfig, "Members file interval can't be negative")
+	}
+	if 0 > conflictRejoinAfter {
+		fatalf(
+			exitConfig,
+			"Conflicts before rejoining can't be negative",
+		)
+	}
+	if 0 >= conflictRejoinWindow {
+		fatalf(exitConfig, "Conflict rejoin window must be positive")
+	}
+	if minUDPBufferSize > udpBufferSize {
+		fatalf(
+			exitConfig,
+			"UDP buffer must be at least %d bytes",
+			minUDPBufferSize,
+		)
+	}
+	if 0 > *writeConcurrency {
+		fatalf(exitConfig, "Write concurrency must not be negative")
+	} else if 0 < *writeConcurrency {
+		LimitWriteConcurrency(*writeConcurrency)
+	}
+	allow, err := parseCIDRList(*tcpAllow)
+	if nil != err {
+		fatalf(exitConfig, "Invalid TCP client allowlist: %v", err)
+	}
+	ef, err := parseClientFormat(*eventFormatName)
+	if nil != err {
+		fatalf(exitConfig, "Invalid event format: %v", err)
+	}
+	eventFormat = ef
+	if *stdoutEvents {
+		StartStdoutEvents(os.Stdout)
+	}
+	if err := validateRole(*role, *allowedRoles); nil != err {
+		fatalf(exitConfig, "Invalid role: %v", err)
+	}
+	if "" != *advertiseAddr && nil == net.ParseIP(*advertiseAddr) {
+		fatalf(
+			exitConfig,
+			"Advertise address %q is not an IP address",
+			*advertiseAddr,
+		)
+	}
+	newConfig, ok := configProfiles[*profile]
+	if !ok {
+		fatalf(exitConfig, "Unknown profile %q", *profile)
+	}
+
+	/* Don't join random meshes if we're asked not to */
+	if *refuseDefaultSecret && githubSecret == *password {
+		fatalf(
+			exitConfig,
+			"Refusing to use the default secret from "+
+				"GitHub, please set one with -secret or at "+
+				"compile time",
+		)
+	}
+	if *refuseDefaultSecret &&
+		"" != *bridgePeers &&
+		githubSecret == *bridgeSecret {
+		fatalf(
+			exitConfig,
+			"Refusing to use the default secret from "+
+				"GitHub for the bridged mesh, please set one "+
+				"with -bridge-secret",
+		)
+	}
+
+	/* Maybe someone's piping us peers */
+	if "-" == *peers {
+		ps, err := readPeerList(os.Stdin)
+		if nil != err {
+			fatalf(
+				exitConfig,
+				"Error reading peers from stdin: %v",
+				err,
+			)
+		}
+		*peers = ps
+	}
+
+	/* Try the peers we knew about last time, too */
+	if "" != peersCache {
+		ps, err := readPeersCache()
+		if nil != err {
+			fatalf(
+				exitConfig,
+				"Error reading peers cache %s: %v",
+				peersCache,
+				err,
+			)
+		}
+		if "" == *peers {
+			*peers = ps
+		} else if "" != ps {
+			*peers += "," + ps
+		}
+	}
 
 	/* Log to stdout, not stderr */
 	log.SetOutput(os.Stdout)
 
-	/* Figure out our listen address and port */
-	ea, la, port, err := resolveAddresses(*listenAddr, *extAddr)
+	/* Figure out our listen address and port.  If we've been told what to
+	advertise, there's no need to ask the internet for our address. */
+	ext := *advertiseAddr
+	if "" == ext {
+		ext = *extAddr
+	}
+	ea, la, port, err := resolveAddresses(
+		*listenAddr,
+		ext,
+		*extAddrCache,
+		*extAddrCacheTTL,
+	)
 	if nil != err {
-		log.Fatalf("Error resolving addresses: %v", err)
+		fatalf(exitAddress, "Error resolving addresses: %v", err)
+	}
+	if *requireExplicitBind && isWildcardAddr(la) {
+		fatalf(
+			exitConfig,
+			"Refusing to listen on all interfaces with "+
+				"-require-explicit-bind, please give a "+
+				"specific address with -listen",
+		)
 	}
+	foundExt := ea /* Before it falls back to la */
 	if "" == ea {
 		ea = la
 	}
@@ -121,17 +880,32 @@ Options:
 	} else {
 		log.Printf("Listen address: %s", la)
 	}
-	log.Printf("External address: %s", ea)
+	if "" != *advertiseAddr {
+		log.Printf("Advertise address: %s", ea)
+	} else {
+		log.Printf("External address: %s", ea)
+	}
 	log.Printf("Port: %d", port)
 
 	/* Encryption key */
-	key := sha256.Sum256([]byte(*password))
+	key := DeriveKey(*password)
+	kr, err := newKeyring(key)
+	if nil != err {
+		fatalf(exitConfig, "Error setting up keyring: %v", err)
+	}
+
+	/* Work out who we are */
+	id, err := LoadOrCreateID(*idFile)
+	if nil != err {
+		fatalf(exitConfig, "Error getting node ID: %v", err)
+	}
+	log.Printf("Node ID: %s", id)
 
 	/* Mesh config */
-	nech := make(chan memberlist.NodeEvent)
-	conf := memberlist.DefaultWANConfig()
-	/* The above config's timings seem reasonable, but there's a few
-	defaults not suitable for us. */
+	nech := make(chan timedEvent, eventBuffer)
+	conf := newConfig()
+	/* The profile's timings seem reasonable, but there's a few defaults
+	not suitable for us. */
 	conf.Name = *nodeName
 	conf.BindAddr = la
 	conf.BindPort = port
@@ -140,32 +914,150 @@ Options:
 	conf.GossipVerifyIncoming = true
 	conf.GossipVerifyOutgoing = true
 	conf.ProtocolVersion = memberlist.ProtocolVersionMax
-	conf.SecretKey = key[:]
+	conf.Keyring = kr
+	conf.Label = *label
+	conf.EnableCompression = *gossipCompression
+	if conf.EnableCompression {
+		log.Printf("Gossip compression: enabled")
+	} else {
+		log.Printf("Gossip compression: disabled")
+	}
 	conf.UDPBufferSize = udpBufferSize
-	conf.Events = &memberlist.ChannelEventDelegate{Ch: nech}
-	conf.Conflict = ConflictHandler{}
-	conf.LogOutput = ioutil.Discard
+	conf.Events = TimedEventDelegate{Ch: nech}
+	conf.Conflict = ConflictHandler{ourName: conf.Name}
+	if 0 != *joinRate {
+		localThrottle = NewJoinThrottle(
+			conf.Name,
+			*joinRate,
+			*joinRateInterval,
+		)
+		conf.Alive = localThrottle
+	}
+	localDelegate = NewDelegate(NodeMeta{
+		ID:       id,
+		Role:     *role,
+		Weight:   *weight,
+		Observer: *observe,
+	})
+	conf.Delegate = localDelegate
+	CheckUDPBuffer(
+		conf.Name,
+		localDelegate.NodeMeta(memberlist.MetaMaxSize),
+		conf.Label,
+	)
+	if *observe {
+		log.Printf("Observing the mesh, not gossiping")
+		configureObserver(conf)
+	}
+	conf.Logger = log.New(memberlistLog{debug: *debug}, "", log.LstdFlags)
 
 	/* Handle events from the mesh */
 	go HandleEvents(conf.Name, nech)
 
 	/* Start our own node */
 	log.Printf("Starting mesh listeners")
-	m, err := memberlist.Create(conf)
+	create := createWithNetTransport
+	if *reuseport {
+		create = createWithReuseport
+	}
+	m, err := createMemberlist(
+		create,
+		conf,
+		*createRetries,
+		*createRetryDelay,
+	)
 	if nil != err {
-		log.Fatalf("Error creating local node: %v", err)
+		fatalf(exitMesh, "Error creating local node: %v", err)
 	}
 	log.Printf("This node: %s", FormatNode(m.LocalNode()))
+	noteConfig(m, conf, nodeConfig{
+		Profile:        *profile,
+		ReportInterval: *reportInterval,
+		DefaultSecret:  githubSecret == *password,
+	})
+	if *broadcastIncludeSize {
+		IncludeSizeInBroadcasts(m)
+	}
+	RejoinOnConflicts(m, conf, func(
+		c *memberlist.Config,
+	) (*memberlist.Memberlist, error) {
+		return createMemberlist(
+			create,
+			c,
+			*createRetries,
+			*createRetryDelay,
+		)
+	})
 
 	/* Listen for unix clients */
+	for _, p := range []*string{
+		sockPath,
+		adminSockPath,
+		eventsSockPath,
+		httpSockPath,
+	} {
+		if "" == *p {
+			continue
+		}
+		if *p, err = ExpandSocketPath(
+			*p,
+			conf.Name,
+			os.Getpid(),
+			port,
+		); nil != err {
+			fatalf(exitConfig, "Invalid socket path: %v", err)
+		}
+	}
 	if "" != *sockPath {
-		ListenForClients(*sockPath, *removeSockFirst, m)
+		ListenForClients(
+			*sockPath,
+			*removeSockFirst,
+			clientOpts{snapshot: true},
+			m,
+		)
 	}
+	if "" != *adminSockPath {
+		ListenForClients(
+			*adminSockPath,
+			*removeSockFirst,
+			clientOpts{admin: true, snapshot: true},
+			m,
+		)
+	}
+	if "" != *eventsSockPath {
+		ListenForClients(
+			*eventsSockPath,
+			*removeSockFirst,
+			clientOpts{},
+			m,
+		)
+	}
+	if "" != *tcpClientAddr {
+		ListenTCPClients(*tcpClientAddr, *tcpNegotiate, allow, m)
+	}
+	if "" != *grpcAddr {
+		ListenGRPC(*grpcAddr, m)
+	}
+	if "" != *httpSockPath || "" != *httpAddr {
+		ListenHTTP(*httpAddr, *httpSockPath, *removeSockFirst, m)
+	}
+
+	/* Leave gracefully when asked */
+	go drainOnSignal(m)
 
 	/* If we've peers to connect to, connect to them */
-	if "" != *peers {
-		n, err := connectToPeers(m, *peers)
-		if nil != err {
+	if csl := gatherPeers(*peers, *peersSRV); "" != csl {
+		n, err := connectToPeers(m, csl)
+		if nil != err && *requireJoin {
+			LeaveMeshAndExitWithError(
+				m,
+				exitJoin,
+				fmt.Errorf(
+					"connecting to initial peers: %w",
+					err,
+				),
+			)
+		} else if nil != err {
 			log.Printf(
 				"Error connecting to initial peers: %v",
 				err,
@@ -175,39 +1067,388 @@ Options:
 		} else {
 			log.Printf("Connected to %d initial peers", n)
 		}
+	} else if *requireJoin {
+		LeaveMeshAndExitWithError(
+			m,
+			exitJoin,
+			errors.New("no initial peers to join"),
+		)
 	}
 
-	/* Every so often print how many are in the mesh */
+	/* See if we can actually talk to our peers */
+	if *probePeers {
+		go ProbeMembers(m)
+	}
+
+	/* Tell another mesh what's going on in ours */
+	if "" != *bridgePeers {
+		if err := StartBridge(
+			newConfig,
+			conf.Name,
+			*bridgeListen,
+			*bridgeSecret,
+			*bridgeLabel,
+			*bridgePeers,
+			*debug,
+		); nil != err {
+			fatalf(exitMesh, "Error starting bridge: %v", err)
+		}
+	}
+
+	/* Be in a few more meshes, if we're meant to */
+	if "" != *extraMeshesFile {
+		if err := StartExtraMeshes(
+			newConfig,
+			conf.Name,
+			*extraMeshesFile,
+			*removeSockFirst,
+			*debug,
+		); nil != err {
+			fatalf(exitMesh, "Error starting extra meshes: %v", err)
+		}
+	}
+
+	/* If we get cut off, try to get back in */
+	if 0 != *rejoinAfter &&
+		("" != *peers || "" != *peersSRV || "" != *permanentPeers) {
+		go rejoinWhenIsolated(m, *rejoinAfter, func() string {
+			ps := gatherPeers(*peers, *peersSRV)
+			if "" == ps {
+				return *permanentPeers
+			} else if "" != *permanentPeers {
+				ps += "," + *permanentPeers
+			}
+			return ps
+		})
+	}
+
+	/* Never give up on the peers we must have */
+	if ps := parsePeerList(*permanentPeers); 0 != len(ps) {
+		go pursuePermanentPeers(m, ps)
+	}
+
+	/* Tell everybody when things settle down */
+	go announceConvergence(m)
+
+	/* Let orchestrators know when we're in the mesh */
+	if "" != *readyFile {
+		go WatchReadiness(m, *readyFile)
+	}
+
+	/* Keep a list of members for whoever wants one */
+	if "" != *membersFile {
+		go WatchMembers(m, *membersFile, *membersFileInterval)
+	}
+
+	/* Look for peers on the LAN */
+	if *discoverLAN {
+		if err := DiscoverLAN(m, *discoverGroup, kr); nil != err {
+			fatalf(
+				exitMesh,
+				"Error starting LAN discovery: %v",
+				err,
+			)
+		}
+	}
+
+	/* Notice if our external address changes under us */
+	if 0 != *extAddrRefresh && "" == ext {
+		go watchExternalAddr(*extAddrRefresh, *extAddrCache, foundExt)
+	}
+
+	/* Die young, if we're meant to */
+	if 0 != *maxLifetime {
+		go leaveAfterLifetime(m, *maxLifetime)
+	}
+
+	/* Every so often print how many are in the mesh, starting with an
+	early report to show we've converged. */
+	if 0 != *initialReportDelay {
+		time.Sleep(*initialReportDelay)
+		reportMeshSize(liveMesh(m), *reportRoles)
+	}
 	for range time.Tick(*reportInterval) {
-		log.Printf("Current mesh size: %d", m.NumMembers())
+		reportMeshSize(liveMesh(m), *reportRoles)
 	}
 }
 
-/* connectToPeers tries to connect m to the peers in the comma-separated list
-csl which should contain host:port pairs.  It only returns if no peers were
-contacted. */
-func connectToPeers(m *memberlist.Memberlist, csl string) (int, error) {
-	/* Clean up the list of peers */
-	ps := strings.Split(csl, ",")
-	last := 0
-	for _, p := range ps {
-		p = strings.TrimSpace(p)
-		if "" == p {
-			continue
+/* reportMeshSize logs the number of members in the mesh and, if roles is
+true, how many have each role. */
+func reportMeshSize(m *memberlist.Memberlist, roles bool) {
+	/* Extra meshes get their sizes tacked on the end */
+	var extra string
+	names, sizes := extraMeshSizes()
+	for i, name := range names {
+		extra += fmt.Sprintf(", %s: %d", name, sizes[i])
+	}
+
+	if !roles {
+		log.Printf("Current mesh size: %d%s", m.NumMembers(), extra)
+		return
+	}
+	log.Printf(
+		"Current mesh size: %d (%s)%s",
+		m.NumMembers(),
+		formatCounts(roleCounts(m)),
+		extra,
+	)
+}
+
+// Drain stops accepting new local clients, tells existing clients we're
+// leaving, marks us as draining in our metadata, waits for drainGrace, and
+// then leaves the mesh and exits with the given code.  Calls after the first
+// do nothing.
+func Drain(m *memberlist.Memberlist, why string, code int) {
+	if !draining.CompareAndSwap(false, true) {
+		return
+	}
+	CloseListeners()
+	broadcastAndLogf(
+		eventNotice,
+		nil,
+		"[Draining] %s, leaving the mesh in %s",
+		why,
+		drainGrace,
+	)
+	go markDraining(m)
+	time.Sleep(drainGrace)
+	LeaveMesh(m)
+	os.Exit(code)
+}
+
+/* markDraining sets the draining flag in our metadata and tells the mesh. */
+func markDraining(m *memberlist.Memberlist) {
+	if nil == localDelegate {
+		return
+	}
+	localDelegate.SetDraining(true)
+	if err := liveMesh(m).UpdateNode(gossipTimeout); nil != err {
+		log.Printf("Error telling the mesh we're draining: %v", err)
+	}
+}
+
+/* drainOnSignal drains when we get a SIGTERM.  A second SIGTERM causes an
+immediate exit. */
+func drainOnSignal(m *memberlist.Memberlist) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	<-ch
+	go Drain(m, "Caught SIGTERM", 0)
+	<-ch
+	fatalf(exitGeneral, "Caught second SIGTERM, exiting without leaving")
+}
+
+// LeaveMesh stops accepting local clients and gracefully leaves the mesh.
+func LeaveMesh(m *memberlist.Memberlist) {
+	m = liveMesh(m)
+	CloseListeners()
+	if n, err := SavePeers(m); nil == err {
+		log.Printf("Saved %d peers to %s", n, peersCache)
+	} else if !errors.Is(err, errNoPeersCache) {
+		log.Printf("Error saving peers: %v", err)
+	}
+	log.Printf("Leaving mesh")
+	if err := m.Leave(leaveTimeout); nil != err {
+		log.Printf("Error leaving mesh: %v", err)
+	}
+	if err := m.Shutdown(); nil != err {
+		log.Printf("Error shutting down mesh listeners: %v", err)
+	}
+	leaveBridge()
+	leaveExtraMeshes()
+}
+
+/* leaveAfterLifetime waits for roughly lifetime, randomly adjusted by up to
+lifetimeJitter so a fleet doesn't all leave at once, then leaves the mesh and
+exits. */
+func leaveAfterLifetime(m *memberlist.Memberlist, lifetime time.Duration) {
+	j := (2*rand.Float64() - 1) * lifetimeJitter * float64(lifetime)
+	lifetime += time.Duration(j)
+	log.Printf("Will leave the mesh in %s", lifetime.Round(time.Second))
+	time.Sleep(lifetime)
+
+	broadcastAndLogf(
+		eventNotice,
+		nil,
+		"[Leaving] Reached maximum lifetime",
+	)
+	LeaveMesh(m)
+	os.Exit(0)
+}
+
+/* fatalf logs the message and terminates the program with the given exit
+code */
+func fatalf(code int, f string, a ...interface{}) {
+	log.Printf(f, a...)
+	os.Exit(code)
+}
+
+/* meshTransport, if not nil, makes the transports for the nodes made by
+createMemberlist, instead of the transports made by the create functions it's
+given.  Tests use it to put the nodes main makes on a MockNetwork. */
+var meshTransport func(
+	conf *memberlist.Config,
+) (memberlist.NodeAwareTransport, error)
+
+/* createMemberlist calls create with conf, or createWithMeshTransport if
+meshTransport is set.  If the failure looks like our port is still in use, e.g.
+after a fast restart, it retries up to retries more times, waiting wait between
+attempts. */
+func createMemberlist(
+	create func(*memberlist.Config) (*memberlist.Memberlist, error),
+	conf *memberlist.Config,
+	retries uint,
+	wait time.Duration,
+) (*memberlist.Memberlist, error) {
+	if nil != meshTransport {
+		create = createWithMeshTransport
+	}
+	for i := uint(1); ; i++ {
+		m, err := create(conf)
+		if nil == err {
+			return m, nil
+		}
+		if i > retries || !isAddrInUse(err) {
+			return nil, err
 		}
-		ps[last] = p
-		last++
+		log.Printf(
+			"Port in use, retrying in %s (%d/%d): %v",
+			wait,
+			i,
+			retries,
+			err,
+		)
+		time.Sleep(wait)
 	}
-	ps = ps[:last]
+}
+
+/* createWithReuseport creates a memberlist with a ReuseportTransport, wrapped
+in a CountingTransport */
+func createWithReuseport(
+	conf *memberlist.Config,
+) (*memberlist.Memberlist, error) {
+	l := conf.Logger
+	if nil == l {
+		l = log.New(conf.LogOutput, "", log.LstdFlags)
+	}
+	t, err := NewReuseportTransport(conf.BindAddr, conf.BindPort, l)
+	if nil != err {
+		return nil, err
+	}
+	ct := NewCountingTransport(t)
+	conf.Transport = ct
+	m, err := memberlist.Create(conf)
+	if nil != err {
+		ct.Shutdown()
+		return nil, err
+	}
+	return m, nil
+}
+
+/* createWithMeshTransport creates a memberlist with a transport made by
+meshTransport, wrapped in a CountingTransport */
+func createWithMeshTransport(
+	conf *memberlist.Config,
+) (*memberlist.Memberlist, error) {
+	t, err := meshTransport(conf)
+	if nil != err {
+		return nil, err
+	}
+	ct := NewCountingTransport(t)
+	conf.Transport = ct
+	m, err := memberlist.Create(conf)
+	if nil != err {
+		ct.Shutdown()
+		return nil, err
+	}
+	return m, nil
+}
+
+/* isAddrInUse returns true if err indicates an address is already in use.
+As memberlist doesn't wrap the underlying errors, the message is checked as
+well. */
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) ||
+		strings.Contains(err.Error(), syscall.EADDRINUSE.Error())
+}
+
+/* connectToPeers tries to connect m to the peers in csl, which should contain
+host:port pairs separated by commas or whitespace.  Peers are tried in
+parallel, and peers which take longer than joinPeerTimeout are given up on, so
+a few dead peers don't hold up joining.  It returns an error if fewer than
+minJoinPeers peers were contacted. */
+func connectToPeers(m *memberlist.Memberlist, csl string) (int, error) {
+	ps := parsePeerList(csl)
 	if 0 == len(ps) {
 		return 0, errors.New("no usable peers in list")
 	}
 
-	/* Join with existing peers */
+	/* Join with existing peers, each on its own */
 	log.Printf("Initial peer list: %s", ps)
-	n, err := m.Join(ps)
-	if nil != err {
-		return 0, fmt.Errorf("error joining mesh: %w", err)
+	type result struct {
+		peer string
+		err  error
+	}
+	ch := make(chan result, len(ps))
+	for _, p := range ps {
+		go func(p string) {
+			_, err := m.Join([]string{p})
+			/* Skip memberlist's multi-line list of one error */
+			if u := errors.Unwrap(err); nil != u {
+				err = u
+			}
+			ch <- result{peer: p, err: err}
+		}(p)
+	}
+
+	/* See who we got */
+	var (
+		n    int
+		left = make(map[string]bool, len(ps))
+		t    = time.NewTimer(joinPeerTimeout)
+	)
+	defer t.Stop()
+	for _, p := range ps {
+		left[p] = true
+	}
+collect:
+	for 0 != len(left) {
+		select {
+		case r := <-ch:
+			delete(left, r.peer)
+			if nil != r.err {
+				log.Printf(
+					"Unable to join via %s: %v",
+					r.peer,
+					r.err,
+				)
+				continue
+			}
+			n++
+		case <-t.C:
+			for p := range left {
+				log.Printf(
+					"Unable to join via %s: timed out "+
+						"after %s",
+					p,
+					joinPeerTimeout,
+				)
+			}
+			break collect
+		}
+	}
+	if 0 == n {
+		return 0, fmt.Errorf(
+			"error joining mesh: unable to contact any of %d peers",
+			len(ps),
+		)
+	}
+	if n < minJoinPeers {
+		return n, fmt.Errorf(
+			"only contacted %d of the required %d peers",
+			n,
+			minJoinPeers,
+		)
 	}
 	return n, nil
 }
@@ -217,8 +1458,14 @@ time */
 func defaultNodeName() string {
 	nifs, err := net.Interfaces()
 	if nil != err {
-		log.Fatalf("Interfaces: %v", err)
+		fatalf(exitGeneral, "Interfaces: %v", err)
 	}
+	return nodeNameFor(nifs)
+}
+
+/* nodeNameFor returns a name composed of the platform, the first MAC address
+of nifs' non-loopback interfaces, and the time. */
+func nodeNameFor(nifs []net.Interface) string {
 	var hwaddrs []string
 	for _, nif := range nifs {
 		/* Don't want loopback interfaces */
@@ -236,9 +1483,18 @@ func defaultNodeName() string {
 	/* Get the first one */
 	sort.Strings(hwaddrs)
 
-	/* If we haven't a MAC address, it's a bit weird but not a problem */
+	/* If we haven't a MAC address, it's a bit weird but not a problem.
+	Containers often don't have them, though, so add a bit of randomness
+	to keep names from colliding. */
 	if 0 == len(hwaddrs) {
-		hwaddrs = append(hwaddrs, "unknown")
+		u := "unknown"
+		b := make([]byte, macLessEntropy)
+		if _, err := crand.Read(b); nil != err {
+			log.Printf("Error generating random name part: %v", err)
+		} else {
+			u += "-" + hex.EncodeToString(b)
+		}
+		hwaddrs = append(hwaddrs, u)
 	}
 
 	return fmt.Sprintf(
@@ -250,11 +1506,40 @@ func defaultNodeName() string {
 	)
 }
 
+/* configureObserver sets up conf for a node which lets everybody else do the
+talking, for -observe.  Probing stays on, as memberlist bases its suspicion
+timeouts on the probe interval. */
+func configureObserver(conf *memberlist.Config) {
+	conf.GossipNodes = 0
+	conf.PushPullInterval = 0
+}
+
+/* suppressUpdateEvents stops update events being logged or sent to clients,
+for -suppress-updates.  They're still otherwise handled as usual. */
+func suppressUpdateEvents() {
+	logEvents &^= eventMask(eventUpdate)
+	broadcastEvents &^= eventMask(eventUpdate)
+}
+
+/* isWildcardAddr returns true if a is empty or an address which listens on
+all interfaces, e.g. 0.0.0.0. */
+func isWildcardAddr(a string) bool {
+	if "" == a {
+		return true
+	}
+	ip := net.ParseIP(a)
+	return nil != ip && ip.IsUnspecified()
+}
+
 /* resolveAddresses makes sure we have a listen address and port and tries to
-get our external address */
+get our external address.  If cache isn't empty, the external address is
+cached in the file named by cache and reused for ttl.  Hostnames given for
+either address are resolved to an IP address. */
 func resolveAddresses(
 	la string,
 	ea string,
+	cache string,
+	ttl time.Duration,
 ) (extAddr, listenAddr string, port int, err error) {
 	/* Work out the listen address */
 	if "" == la {
@@ -269,34 +1554,68 @@ func resolveAddresses(
 	if nil != err {
 		return "", "", 0, fmt.Errorf("paring port %q: %w", p, err)
 	}
+	listenAddr, err = resolveHost(net.DefaultResolver, listenAddr)
+	if nil != err {
+		return "", "", 0, fmt.Errorf(
+			"resolving listen address: %w",
+			err,
+		)
+	}
 
 	/* If we have an external address already, use it */
 	if "" != ea {
-		extAddr = ea
+		extAddr, err = resolveHost(net.DefaultResolver, ea)
+		if nil != err {
+			err = fmt.Errorf("resolving external address: %w", err)
+		}
 		return
 	}
 
 	/* Try to get our external address */
-	res, err := http.Get(extAddrURL)
-	if nil != err {
-		/* We tried */
-		log.Printf("Error querying %q: %v", extAddrURL, err)
-		return
+	extAddr, err = lookupExternalAddr(cache, ttl)
+	return
+}
+
+/* hostResolver looks up hostnames.  It is satisfied by *net.Resolver. */
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+/* resolveHost returns h if it's empty or already an IP address, or else the
+first IPv4 address h resolves to via r, or the first IPv6 address if there's
+no IPv4 address. */
+func resolveHost(r hostResolver, h string) (string, error) {
+	if "" == h {
+		return h, nil
 	}
-	defer res.Body.Close()
-	b, err := ioutil.ReadAll(res.Body)
-	if nil != err {
-		log.Printf("Error reading reply from %q: %v", extAddrURL, err)
-		return
+	if _, err := netip.ParseAddr(h); nil == err {
+		return h, nil
 	}
 
-	/* Got an answer, maybe it's an address? */
-	ip := net.ParseIP(strings.TrimSpace(string(b)))
-	if nil == ip {
-		log.Printf("Unable to parse reply %q from %q", b, extAddrURL)
-		return
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		hostLookupTimeout,
+	)
+	defer cancel()
+	as, err := r.LookupHost(ctx, h)
+	if nil != err {
+		return "", fmt.Errorf("looking up %s: %w", h, err)
 	}
-	extAddr = ip.String()
-
-	return
+	var v6 string
+	for _, a := range as {
+		ip, err := netip.ParseAddr(a)
+		if nil != err {
+			continue
+		}
+		if ip.Unmap().Is4() {
+			return ip.Unmap().String(), nil
+		}
+		if "" == v6 {
+			v6 = a
+		}
+	}
+	if "" == v6 {
+		return "", fmt.Errorf("no addresses found for %s", h)
+	}
+	return v6, nil
 }
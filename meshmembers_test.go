@@ -0,0 +1,1104 @@
+package main
+
+/*
+ * meshmembers_test.go
+ * Helpers for tests
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* testTimeout is how long tests wait for something to happen */
+const testTimeout = 10 * time.Second
+
+/* mainArgsEnv is the environment variable which, if set, makes the test
+binary run main with the newline-separated arguments it contains. */
+const mainArgsEnv = "MESHMEMBERS_TEST_MAIN_ARGS"
+
+/* mainPeerEnv is the environment variable which, if set along with
+mainArgsEnv, puts main's nodes on a MockNetwork with a peer at mainPeerAddr
+using the secret it contains. */
+const mainPeerEnv = "MESHMEMBERS_TEST_MAIN_PEER"
+
+/* mainNodeAddr and mainPeerAddr are the addresses of main's node and its
+peer with mainPeerEnv, which get the first and second addresses on the
+MockNetwork. */
+const (
+	mainNodeAddr = "127.0.0.1:1"
+	mainPeerAddr = "127.0.0.1:2"
+)
+
+// TestMain runs main instead of the tests if mainArgsEnv is set, so tests can
+// check what main does.
+func TestMain(m *testing.M) {
+	args, ok := os.LookupEnv(mainArgsEnv)
+	if !ok {
+		os.Exit(m.Run())
+	}
+	os.Args = append([]string{"meshmembers"}, strings.Split(args, "\n")...)
+	if secret, ok := os.LookupEnv(mainPeerEnv); ok {
+		startMainPeer(secret)
+	}
+	main()
+	os.Exit(0)
+}
+
+/* runMain runs main in a child process with the given arguments and returns
+its exit code and output. */
+func runMain(t testing.TB, args ...string) (int, string) {
+	t.Helper()
+	out, err := mainCommand(args...).CombinedOutput()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode(), string(out)
+	} else if nil != err {
+		t.Fatalf("Running main: %v", err)
+	}
+	return 0, string(out)
+}
+
+/* startMainPeer makes main's nodes use the first transport on a MockNetwork
+and starts a peer using secret on the second. */
+func startMainPeer(secret string) {
+	var (
+		mn = new(memberlist.MockNetwork)
+		nt = mn.NewTransport("main") /* Can't add them once running */
+	)
+	if _, err := newThrowawayNode(
+		"peer",
+		secret,
+		"id-peer",
+		mn.NewTransport("peer"),
+		nil,
+	); nil != err {
+		log.Fatalf("Starting peer: %v", err)
+	}
+	meshTransport = func(
+		*memberlist.Config,
+	) (memberlist.NodeAwareTransport, error) {
+		return nt, nil
+	}
+}
+
+/* mainCommand returns a command which runs main with the given arguments */
+func mainCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	return cmd
+}
+
+/* TestExitCodes makes sure different failures exit with different codes */
+func TestExitCodes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts nodes")
+	}
+	for _, c := range []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"bad flag value", []string{"-udp-buffer", "1"}, exitConfig},
+		{"unknown profile", []string{"-profile", "moose"}, exitConfig},
+		{"no peers to join", []string{
+			"-profile", "local",
+			"-external", "127.0.0.1",
+			"-listen", "127.0.0.1:0",
+			"-socket", "",
+			"-require-join",
+		}, exitJoin},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, out := runMain(t, c.args...)
+			if c.want != got {
+				t.Fatalf(
+					"Exit code %d, expected %d\n%s",
+					got,
+					c.want,
+					out,
+				)
+			}
+		})
+	}
+}
+
+/* newTestConfig returns a throwawayConfig for a node called name on mn, with
+the given secret. */
+func newTestConfig(
+	mn *memberlist.MockNetwork,
+	name string,
+	secret string,
+) *memberlist.Config {
+	return throwawayConfig(name, secret, "id-"+name, mn.NewTransport(name))
+}
+
+/* newTestMesh starts a node for each of names on a new in-memory network,
+joins each to all of the ones before it, and waits for everybody to see
+everybody.  The nodes are shut down when the test finishes.  If confs is not
+nil, it's called with each node's config before the node's created. */
+func newTestMesh(
+	t testing.TB,
+	confs func(*memberlist.Config),
+	names ...string,
+) []*memberlist.Memberlist {
+	t.Helper()
+	return newTestMeshOn(t, new(memberlist.MockNetwork), confs, names...)
+}
+
+/* newTestMeshOn is like newTestMesh, but uses mn. */
+func newTestMeshOn(
+	t testing.TB,
+	mn *memberlist.MockNetwork,
+	confs func(*memberlist.Config),
+	names ...string,
+) []*memberlist.Memberlist {
+	t.Helper()
+	var ms []*memberlist.Memberlist
+	for _, name := range names {
+		m, err := newThrowawayNode(
+			name,
+			"test-secret",
+			"id-"+name,
+			mn.NewTransport(name),
+			confs,
+		)
+		if nil != err {
+			t.Fatalf("Starting node: %v", err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		ms = append(ms, m)
+	}
+	var addrs []string
+	for _, m := range ms {
+		if 0 != len(addrs) {
+			if _, err := m.Join(addrs); nil != err {
+				t.Fatalf(
+					"Joining %s: %v",
+					m.LocalNode().Name,
+					err,
+				)
+			}
+		}
+		addrs = append(addrs, m.LocalNode().Address())
+	}
+	waitFor(t, "nodes to converge", func() bool {
+		for _, m := range ms {
+			if len(ms) != m.NumMembers() {
+				return false
+			}
+		}
+		return true
+	})
+	return ms
+}
+
+/* waitFor waits for f to return true, failing the test if it takes longer
+than testTimeout.  what describes what's being waited for. */
+func waitFor(t testing.TB, what string, f func() bool) {
+	t.Helper()
+	for start := time.Now(); !f(); time.Sleep(10 * time.Millisecond) {
+		if testTimeout < time.Since(start) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+/* TestRefuseDefaultSecret makes sure -refuse-default-secret stops us
+starting with the default secret, and only the default secret. */
+func TestRefuseDefaultSecret(t *testing.T) {
+	code, out := runMain(t, "-refuse-default-secret")
+	if exitConfig != code || !strings.Contains(out, "Refusing") {
+		t.Fatalf("Exit code %d with the default secret\n%s", code, out)
+	}
+
+	/* A different secret is fine, up until an unreadable peers cache */
+	code, out = runMain(
+		t,
+		"-refuse-default-secret",
+		"-secret", "kittens",
+		"-peers-cache", t.TempDir(),
+	)
+	if exitConfig != code ||
+		!strings.Contains(out, "Error reading peers cache") {
+		t.Fatalf("Exit code %d with a different secret\n%s", code, out)
+	}
+}
+
+/* TestMaxLifetime makes sure we leave the mesh and exit happily after
+-max-lifetime. */
+func TestMaxLifetime(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts a node")
+	}
+	start := time.Now()
+	code, out := runMain(
+		t,
+		"-profile", "local",
+		"-external", "127.0.0.1",
+		"-listen", "127.0.0.1:0",
+		"-socket", "",
+		"-max-lifetime", "1s",
+	)
+	if 0 != code {
+		t.Fatalf("Exit code %d\n%s", code, out)
+	}
+	for _, want := range []string{
+		"Reached maximum lifetime",
+		"Leaving mesh",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("Output missing %q\n%s", want, out)
+		}
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || testTimeout < d {
+		t.Fatalf("Exited after %s", d)
+	}
+}
+
+/* TestAdvertiseAddr makes sure -advertise-addr is what we advertise */
+func TestAdvertiseAddr(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts a node")
+	}
+	code, out := runMain(
+		t,
+		"-profile", "local",
+		"-advertise-addr", "192.0.2.7",
+		"-listen", "127.0.0.1:0",
+		"-socket", "",
+		"-require-join",
+	)
+	if exitJoin != code {
+		t.Fatalf("Exit code %d\n%s", code, out)
+	}
+	if !regexp.MustCompile(
+		`This node: \S+ \(192\.0\.2\.7:\d+\)\n`,
+	).MatchString(out) {
+		t.Fatalf("Advertised address not 192.0.2.7\n%s", out)
+	}
+
+	/* Has to be an IP address */
+	code, out = runMain(t, "-advertise-addr", "moose")
+	if exitConfig != code {
+		t.Fatalf("Exit code %d with an invalid address\n%s", code, out)
+	}
+}
+
+/* TestCreateMemberlistRetries makes sure createMemberlist retries when the
+port's in use, and only then. */
+func TestCreateMemberlistRetries(t *testing.T) {
+	var (
+		inUse = fmt.Errorf(
+			"failed to start TCP listener: %w",
+			syscall.EADDRINUSE,
+		)
+		other = errors.New("invalid config")
+		mn    = new(memberlist.MockNetwork)
+	)
+	for _, c := range []struct {
+		name    string
+		fails   []error /* Errors to return before succeeding */
+		retries uint
+		tries   int
+		ok      bool
+	}{
+		{"immediate success", nil, 3, 1, true},
+		{"transient", []error{inUse, inUse}, 3, 3, true},
+		{"still in use", []error{inUse, inUse, inUse}, 2, 3, false},
+		{"config error", []error{other}, 3, 1, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var tries int
+			create := func(
+				conf *memberlist.Config,
+			) (*memberlist.Memberlist, error) {
+				tries++
+				if tries <= len(c.fails) {
+					return nil, c.fails[tries-1]
+				}
+				return memberlist.Create(conf)
+			}
+			m, err := createMemberlist(
+				create,
+				newTestConfig(mn, c.name, "test-secret"),
+				c.retries,
+				time.Millisecond,
+			)
+			if nil != m {
+				defer m.Shutdown()
+			}
+			if c.ok != (nil == err) {
+				t.Fatalf("Error: %v", err)
+			}
+			if c.tries != tries {
+				t.Fatalf(
+					"Tried %d times, expected %d",
+					tries,
+					c.tries,
+				)
+			}
+		})
+	}
+}
+
+/* TestLabelsIsolateMeshes makes sure nodes with different labels don't
+merge, even with the same secret. */
+func TestLabelsIsolateMeshes(t *testing.T) {
+	mn := new(memberlist.MockNetwork)
+	var ms []*memberlist.Memberlist
+	for _, name := range []string{"a", "b"} {
+		conf := newTestConfig(mn, name, "test-secret")
+		conf.Label = "mesh-" + name
+		m, err := memberlist.Create(conf)
+		if nil != err {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		ms = append(ms, m)
+	}
+	if _, err := ms[1].Join(
+		[]string{ms[0].LocalNode().Address()},
+	); nil == err {
+		t.Fatalf("Joined a node with a different label")
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, m := range ms {
+		if n := m.NumMembers(); 1 != n {
+			t.Fatalf(
+				"%s sees %d members",
+				m.LocalNode().Name,
+				n,
+			)
+		}
+	}
+}
+
+/* syncBuffer is a bytes.Buffer which is safe for concurrent use */
+type syncBuffer struct {
+	b bytes.Buffer
+	l sync.Mutex
+}
+
+/* Write writes p to sb's buffer */
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.l.Lock()
+	defer sb.l.Unlock()
+	return sb.b.Write(p)
+}
+
+/* String returns what's been written to sb */
+func (sb *syncBuffer) String() string {
+	sb.l.Lock()
+	defer sb.l.Unlock()
+	return sb.b.String()
+}
+
+/* captureLog sends the log to a buffer until the test finishes */
+func captureLog(t testing.TB) *syncBuffer {
+	var sb syncBuffer
+	w := log.Writer()
+	log.SetOutput(&sb)
+	t.Cleanup(func() { log.SetOutput(w) })
+	return &sb
+}
+
+/* testClients counts the clients made by newTestClient, for their tags */
+var testClients atomic.Uint64
+
+/* testClient is the far end of a client connection */
+type testClient struct {
+	t  testing.TB
+	lc *localClient
+	c  net.Conn
+	r  *bufio.Reader
+}
+
+/* newTestClient adds a client connected with net.Pipe, as if it connected to
+the admin socket if admin is true.  The client is disconnected and removed
+from the list of clients when the test finishes. */
+func newTestClient(
+	t testing.TB,
+	m *memberlist.Memberlist,
+	admin bool,
+) *testClient {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	lc := &localClient{
+		tag:    fmt.Sprintf("test-%d", testClients.Add(1)),
+		c:      ours,
+		admin:  admin,
+		proto:  defaultProtoVersion,
+		format: formatText,
+	}
+	if !addClient(lc, m) {
+		t.Fatalf("No room for client")
+	}
+	t.Cleanup(func() {
+		theirs.Close()
+		waitFor(t, "client removal", func() bool {
+			clientsL.Lock()
+			defer clientsL.Unlock()
+			return !slices.Contains(clients, lc)
+		})
+	})
+	return &testClient{t: t, lc: lc, c: theirs, r: bufio.NewReader(theirs)}
+}
+
+/* connectTestClient connects a client with net.Pipe as if it connected to a
+listener with the given options.  Unlike newTestClient, the client is handled
+by handleClient, so gets a banner and maybe the member list first.  The
+returned testClient's lc is nil. */
+func connectTestClient(
+	t testing.TB,
+	m *memberlist.Memberlist,
+	opts clientOpts,
+) *testClient {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	go handleClient(ours, opts, m)
+	t.Cleanup(func() {
+		theirs.Close()
+		waitFor(t, "client removal", func() bool {
+			return 0 == countClients()
+		})
+	})
+	return &testClient{t: t, c: theirs, r: bufio.NewReader(theirs)}
+}
+
+/* send sends a line to the client's command goroutine */
+func (tc *testClient) send(f string, a ...interface{}) {
+	tc.t.Helper()
+	tc.c.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := fmt.Fprintf(tc.c, f+"\n", a...); nil != err {
+		tc.t.Fatalf("Sending to client: %v", err)
+	}
+}
+
+/* readLine reads a line sent to the client, without the newline */
+func (tc *testClient) readLine() string {
+	tc.t.Helper()
+	tc.c.SetReadDeadline(time.Now().Add(testTimeout))
+	l, err := tc.r.ReadString('\n')
+	if nil != err {
+		tc.t.Fatalf("Reading from client: %v", err)
+	}
+	return strings.TrimSuffix(l, "\n")
+}
+
+/* readUntil reads lines sent to the client until one contains s, and returns
+the lines read, including the one containing s. */
+func (tc *testClient) readUntil(s string) []string {
+	tc.t.Helper()
+	var ls []string
+	for {
+		l := tc.readLine()
+		ls = append(ls, l)
+		if strings.Contains(l, s) {
+			return ls
+		}
+	}
+}
+
+/* TestConfigProfiles makes sure every profile makes a valid config with
+which nodes form a mesh. */
+func TestConfigProfiles(t *testing.T) {
+	for name, newConfig := range configProfiles {
+		t.Run(name, func(t *testing.T) {
+			newTestMesh(t, func(conf *memberlist.Config) {
+				base := newConfig()
+				base.Name = conf.Name
+				base.SecretKey = conf.SecretKey
+				base.Delegate = conf.Delegate
+				base.LogOutput = conf.LogOutput
+				base.Transport = conf.Transport
+				*conf = *base
+			}, "a", "b")
+		})
+	}
+}
+
+/* TestNodeNameFor makes sure default names use the MAC address if there is
+one, and are unique if there isn't. */
+func TestNodeNameFor(t *testing.T) {
+	mac, err := net.ParseMAC("02:fc:00:00:00:01")
+	if nil != err {
+		t.Fatalf("Parsing MAC: %v", err)
+	}
+	prefix := runtime.GOOS + "-" + runtime.GOARCH + "-"
+	withMAC := nodeNameFor([]net.Interface{
+		{Name: "lo", Flags: net.FlagLoopback},
+		{Name: "eth0", HardwareAddr: mac},
+	})
+	if !strings.HasPrefix(withMAC, prefix+"02:fc:00:00:00:01-") {
+		t.Fatalf("Name with a MAC is %q", withMAC)
+	}
+
+	/* No MAC, no problem */
+	lo := []net.Interface{{Name: "lo", Flags: net.FlagLoopback}}
+	a, b := nodeNameFor(lo), nodeNameFor(lo)
+	if !strings.HasPrefix(a, prefix+"unknown-") {
+		t.Fatalf("Name without a MAC is %q", a)
+	}
+	if a == b {
+		t.Fatalf("Got %q twice without a MAC", a)
+	}
+	/* Entropy's there, not just a different time */
+	if fs := strings.Split(a, "-"); 5 != len(fs) ||
+		2*macLessEntropy != len(fs[3]) {
+		t.Fatalf("Name without a MAC lacks entropy: %q", a)
+	}
+}
+
+/* TestMinJoinPeers makes sure joining via too few peers is a failure. */
+func TestMinJoinPeers(t *testing.T) {
+	mn := new(memberlist.MockNetwork)
+	ms := newTestMeshOn(t, mn, nil, "a", "b")
+	peers := ms[0].LocalNode().Address() + ", 127.0.0.1:1"
+	t.Cleanup(func() { minJoinPeers = 1 })
+
+	for _, c := range []struct {
+		min int
+		ok  bool
+	}{{2, false}, {1, true}} {
+		minJoinPeers = c.min
+		m, err := memberlist.Create(newTestConfig(
+			mn,
+			fmt.Sprintf("c%d", c.min),
+			"test-secret",
+		))
+		if nil != err {
+			t.Fatalf("Creating node: %v", err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		n, err := connectToPeers(m, peers)
+		if 1 != n {
+			t.Errorf("Minimum %d: contacted %d peers", c.min, n)
+		}
+		if c.ok != (nil == err) {
+			t.Errorf("Minimum %d: error %v", c.min, err)
+		}
+	}
+}
+
+/* TestRequireExplicitBind makes sure -require-explicit-bind refuses to listen
+on all interfaces, but not on a specific address. */
+func TestRequireExplicitBind(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		want bool
+	}{
+		{"", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+	} {
+		if got := isWildcardAddr(c.addr); c.want != got {
+			t.Errorf("%q: wildcard %t", c.addr, got)
+		}
+	}
+
+	if testing.Short() {
+		t.Skip("Starts a node")
+	}
+	for _, c := range []struct {
+		listen string
+		want   int
+	}{
+		{"0.0.0.0:0", exitConfig},
+		{":0", exitConfig},
+		{"127.0.0.1:0", 0},
+	} {
+		code, out := runMain(
+			t,
+			"-profile", "local",
+			"-external", "127.0.0.1",
+			"-listen", c.listen,
+			"-socket", "",
+			"-require-explicit-bind",
+			"-max-lifetime", "100ms",
+		)
+		if c.want != code {
+			t.Errorf(
+				"-listen %s: exit code %d, expected %d\n%s",
+				c.listen,
+				code,
+				c.want,
+				out,
+			)
+		}
+		if refused := strings.Contains(
+			out,
+			"Refusing to listen on all interfaces",
+		); refused != (0 != c.want) {
+			t.Errorf(
+				"-listen %s: refused %t\n%s",
+				c.listen,
+				refused,
+				out,
+			)
+		}
+	}
+}
+
+/* TestDrain makes sure DRAIN stops new clients connecting but keeps sending
+events to existing clients until we leave. */
+func TestDrain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts a node")
+	}
+
+	/* A peer to leave while we're draining */
+	conf := memberlist.DefaultLocalConfig()
+	conf.Name = "drain-peer"
+	conf.BindAddr = "127.0.0.1"
+	conf.BindPort = 0
+	conf.SecretKey = DeriveKey("test-secret")
+	conf.LogOutput = io.Discard
+	peer, err := memberlist.Create(conf)
+	if nil != err {
+		t.Fatalf("Creating peer: %v", err)
+	}
+	t.Cleanup(func() { peer.Shutdown() })
+
+	/* Start draining */
+	var (
+		dir   = t.TempDir()
+		sock  = dir + "/s"
+		asock = dir + "/a"
+		out   syncBuffer
+	)
+	cmd := mainCommand(
+		"-profile", "local",
+		"-secret", "test-secret",
+		"-external", "127.0.0.1",
+		"-listen", "127.0.0.1:0",
+		"-peers", peer.LocalNode().Address(),
+		"-socket", sock,
+		"-admin-socket", asock,
+		"-drain-grace", "2s",
+	)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); nil != err {
+		t.Fatalf("Starting main: %v", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+	dial := func(path string) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("unix", path)
+		if nil != err {
+			t.Fatalf("Connecting to %s: %v", path, err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(testTimeout))
+		return c, bufio.NewReader(c)
+	}
+	readUntil := func(r *bufio.Reader, s string) {
+		t.Helper()
+		for {
+			l, err := r.ReadString('\n')
+			if nil != err {
+				t.Fatalf("Waiting for %q: %v\n%s", s, err, &out)
+			}
+			if strings.Contains(l, s) {
+				return
+			}
+		}
+	}
+	waitFor(t, "listening", func() bool {
+		return strings.Contains(out.String(), asock)
+	})
+	_, existing := dial(sock)
+	readUntil(existing, "drain-peer")
+	ac, ar := dial(asock)
+	fmt.Fprintf(ac, "DRAIN\n")
+	readUntil(ar, "Draining")
+	readUntil(existing, "[Draining]")
+
+	/* Newcomers are turned away, but not the old guard */
+	if c, err := net.Dial("unix", sock); nil == err {
+		c.Close()
+		t.Fatalf("Connected while draining")
+	}
+	if err := peer.Leave(time.Second); nil != err {
+		t.Fatalf("Leaving: %v", err)
+	}
+	readUntil(existing, "drain-peer")
+	if err := cmd.Wait(); nil != err {
+		t.Fatalf("Main: %v\n%s", err, &out)
+	}
+	if !strings.Contains(out.String(), "Leaving mesh") {
+		t.Fatalf("Didn't leave\n%s", &out)
+	}
+}
+
+/* TestGossipCompression makes sure nodes join with compression on, off, and
+mixed, and that we log which it is. */
+func TestGossipCompression(t *testing.T) {
+	for _, on := range [][]bool{
+		{true, true},
+		{false, false},
+		{true, false, true},
+	} {
+		names := make([]string, len(on))
+		for i := range names {
+			names[i] = fmt.Sprintf("n%d", i)
+		}
+		newTestMesh(t, func(conf *memberlist.Config) {
+			var i int
+			fmt.Sscanf(conf.Name, "n%d", &i)
+			conf.EnableCompression = on[i]
+		}, names...)
+	}
+
+	if testing.Short() {
+		t.Skip("Starts a node")
+	}
+	for _, c := range []struct{ arg, want string }{
+		{"-gossip-compression=true", "Gossip compression: enabled"},
+		{"-gossip-compression=false", "Gossip compression: disabled"},
+	} {
+		code, out := runMain(
+			t,
+			"-profile", "local",
+			"-external", "127.0.0.1",
+			"-listen", "127.0.0.1:0",
+			"-socket", "",
+			"-max-lifetime", "100ms",
+			c.arg,
+		)
+		if 0 != code || !strings.Contains(out, c.want) {
+			t.Errorf("%s: exit code %d\n%s", c.arg, code, out)
+		}
+	}
+}
+
+/* TestInitialReportDelay makes sure the mesh size is reported early, long
+before -report-every, unless -initial-report-delay is 0. */
+func TestInitialReportDelay(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts a node")
+	}
+	for _, c := range []struct {
+		delay string
+		want  int
+	}{{"100ms", 1}, {"0", 0}} {
+		code, out := runMain(
+			t,
+			"-profile", "local",
+			"-external", "127.0.0.1",
+			"-listen", "127.0.0.1:0",
+			"-socket", "",
+			"-report-every", "1h",
+			"-initial-report-delay", c.delay,
+			"-max-lifetime", "1s",
+		)
+		if 0 != code {
+			t.Fatalf("Exit code %d\n%s", code, out)
+		}
+		if n := strings.Count(
+			out,
+			"Current mesh size: 1\n",
+		); c.want != n {
+			t.Errorf(
+				"Delay %s: %d reports, expected %d\n%s",
+				c.delay,
+				n,
+				c.want,
+				out,
+			)
+		}
+	}
+}
+
+/* stubHostResolver is a hostResolver which returns canned answers and notes
+what was looked up. */
+type stubHostResolver struct {
+	addrs  map[string][]string
+	lookup []string
+}
+
+/* LookupHost returns shr.addrs[host], or an error if there's none. */
+func (shr *stubHostResolver) LookupHost(
+	ctx context.Context,
+	host string,
+) ([]string, error) {
+	shr.lookup = append(shr.lookup, host)
+	as, ok := shr.addrs[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return as, nil
+}
+
+/* TestResolveHost makes sure hostnames resolve to one address, preferring
+IPv4, and that IP addresses aren't looked up. */
+func TestResolveHost(t *testing.T) {
+	shr := &stubHostResolver{addrs: map[string][]string{
+		"mixed":  {"2001:db8::1", "::ffff:192.0.2.1", "192.0.2.2"},
+		"v6":     {"garbage", "2001:db8::2", "2001:db8::3"},
+		"v4":     {"192.0.2.3"},
+		"nothin": {"garbage"},
+	}}
+	for _, c := range []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"192.0.2.9", "192.0.2.9", true},
+		{"2001:db8::9", "2001:db8::9", true},
+		{"mixed", "192.0.2.1", true},
+		{"v6", "2001:db8::2", true},
+		{"v4", "192.0.2.3", true},
+		{"nothin", "", false},
+		{"unknown", "", false},
+	} {
+		got, err := resolveHost(shr, c.host)
+		if c.ok != (nil == err) {
+			t.Errorf("%q: error %v", c.host, err)
+			continue
+		}
+		if c.want != got {
+			t.Errorf(
+				"%q: got %q, expected %q",
+				c.host,
+				got,
+				c.want,
+			)
+		}
+	}
+	want := []string{"mixed", "v6", "v4", "nothin", "unknown"}
+	if !slices.Equal(want, shr.lookup) {
+		t.Fatalf("Looked up %q, expected %q", shr.lookup, want)
+	}
+}
+
+/* TestObserve makes sure an observer still hears about and reports what
+active nodes do, and that the rest of the mesh knows it's an observer. */
+func TestObserve(t *testing.T) {
+	captureLog(t)
+	nech := make(chan timedEvent, 16)
+	t.Cleanup(func() {
+		close(nech)
+		for _, name := range []string{"a", "b", "obs"} {
+			forgetNode(name)
+		}
+	})
+	go HandleEvents("obs", nech)
+	mn := new(memberlist.MockNetwork)
+	ms := newTestMeshOn(t, mn, func(conf *memberlist.Config) {
+		if "obs" != conf.Name {
+			return
+		}
+		conf.Delegate = NewDelegate(NodeMeta{Observer: true})
+		conf.Events = TimedEventDelegate{Ch: nech}
+		configureObserver(conf)
+	}, "a", "obs")
+	tc := newTestClient(t, ms[1], false)
+
+	/* Everybody knows who's watching */
+	for _, n := range ms[0].Members() {
+		if "obs" != n.Name {
+			continue
+		}
+		if f := FormatNode(n); !strings.HasSuffix(f, " (observer)") {
+			t.Fatalf("Observer formatted as %q", f)
+		}
+	}
+
+	/* A node joining the active node is seen by the observer */
+	b, err := memberlist.Create(newTestConfig(mn, "b", "test-secret"))
+	if nil != err {
+		t.Fatalf("Creating b: %v", err)
+	}
+	t.Cleanup(func() { b.Shutdown() })
+	if _, err := b.Join(
+		[]string{ms[0].LocalNode().Address()},
+	); nil != err {
+		t.Fatalf("Joining b: %v", err)
+	}
+	want := "[Join] " + FormatNode(b.LocalNode())
+	tc.readUntil(want) /* After a's join */
+
+	/* As is it leaving */
+	if err := b.Leave(testTimeout); nil != err {
+		t.Fatalf("Leaving: %v", err)
+	}
+	want = "[Part] " + FormatNode(b.LocalNode())
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Observer got %q, expected %q", l, want)
+	}
+}
+
+/* TestJoinPeerTimeout makes sure a peer which never answers doesn't stop us
+joining via the others. */
+func TestJoinPeerTimeout(t *testing.T) {
+	joinPeerTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { joinPeerTimeout = 15 * time.Second })
+	sb := captureLog(t)
+	mn := new(memberlist.MockNetwork)
+	ms := newTestMeshOn(t, mn, nil, "a", "b")
+
+	/* A peer which accepts connections but never reads them */
+	ip, port, err := mn.NewTransport("dead").FinalAdvertiseAddr("", 0)
+	if nil != err {
+		t.Fatalf("Getting dead peer's address: %v", err)
+	}
+	dead := net.JoinHostPort(ip.String(), fmt.Sprint(port))
+	m, err := memberlist.Create(newTestConfig(mn, "c", "test-secret"))
+	if nil != err {
+		t.Fatalf("Creating node: %v", err)
+	}
+	t.Cleanup(func() { m.Shutdown() })
+
+	start := time.Now()
+	n, err := connectToPeers(m, strings.Join([]string{
+		dead,
+		ms[0].LocalNode().Address(),
+		ms[1].LocalNode().Address(),
+	}, ","))
+	if d := time.Since(start); testTimeout/2 < d {
+		t.Fatalf("Joining took %s", d)
+	}
+	if nil != err {
+		t.Fatalf("Error joining: %v", err)
+	}
+	if 2 != n {
+		t.Fatalf("Joined via %d peers, expected 2", n)
+	}
+	want := fmt.Sprintf(
+		"Unable to join via %s: timed out after %s",
+		dead,
+		joinPeerTimeout,
+	)
+	if !strings.Contains(sb.String(), want) {
+		t.Fatalf("Log missing %q: %q", want, sb.String())
+	}
+	waitFor(t, "c to join", func() bool { return 3 == ms[0].NumMembers() })
+}
+
+/* TestSuppressUpdates makes sure -suppress-updates stops update events being
+logged and sent, but not handled, and leaves joins alone. */
+func TestSuppressUpdates(t *testing.T) {
+	suppressUpdateEvents()
+	t.Cleanup(func() {
+		logEvents = eventMask(eventAll)
+		broadcastEvents = eventMask(eventAll)
+		forgetNode("n")
+	})
+	sb := captureLog(t)
+	tc := newTestClient(t, nil, false)
+	nech := make(chan timedEvent)
+	defer close(nech)
+	go HandleEvents("us", nech)
+	ed := TimedEventDelegate{Ch: nech}
+
+	/* Updates are handled, but not sent */
+	ed.NotifyUpdate(&memberlist.Node{Name: "n"})
+	waitFor(t, "update", func() bool {
+		ev, _ := LastEvent()
+		return memberlist.NodeUpdate == ev
+	})
+	ed.NotifyJoin(&memberlist.Node{Name: "n"})
+	if l := tc.readLine(); !strings.HasPrefix(l, "[Join] n ") {
+		t.Fatalf("Got %q, expected the join", l)
+	}
+	if strings.Contains(sb.String(), "[News]") {
+		t.Fatalf("Update logged: %s", sb)
+	}
+}
+
+/* TestRequireJoin makes sure -require-join exits when none of the initial
+peers can be reached, and that without it the node carries on alone. */
+func TestRequireJoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts nodes")
+	}
+	args := []string{
+		"-profile", "local",
+		"-external", "127.0.0.1",
+		"-listen", "127.0.0.1:0",
+		"-socket", "",
+		"-peers", "127.0.0.1:1", /* Nobody home */
+		"-max-lifetime", "100ms",
+	}
+
+	code, out := runMain(t, append(args, "-require-join")...)
+	if exitJoin != code {
+		t.Fatalf("Exit code %d, expected %d\n%s", code, exitJoin, out)
+	}
+	if !strings.Contains(out, "connecting to initial peers") {
+		t.Fatalf("Exited without saying why\n%s", out)
+	}
+
+	code, out = runMain(t, args...)
+	if 0 != code {
+		t.Fatalf("Exit code %d without -require-join\n%s", code, out)
+	}
+	if !strings.Contains(out, "Error connecting to initial peers") ||
+		!strings.Contains(out, "Reached maximum lifetime") {
+		t.Fatalf("Didn't carry on alone\n%s", out)
+	}
+}
+
+/* TestMainInMemory makes sure main's node can be put on a MockNetwork, and
+joins its peers there. */
+func TestMainInMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts nodes")
+	}
+	cmd := mainCommand(
+		"-profile", "local",
+		"-name", "main",
+		"-secret", "test-secret",
+		"-external", "127.0.0.1",
+		"-listen", "127.0.0.1:0",
+		"-socket", "",
+		"-peers", mainPeerAddr,
+		"-require-join",
+		"-max-lifetime", "500ms",
+	)
+	cmd.Env = append(cmd.Env, mainPeerEnv+"=test-secret")
+	b, err := cmd.CombinedOutput()
+	out := string(b)
+	if nil != err {
+		t.Fatalf("Error running main: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"This node: main (" + mainNodeAddr + ")",
+		"Connected to 1 initial peer\n",
+		"[Join] peer (" + mainPeerAddr + ")",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Output missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("Output:\n%s", out)
+	}
+}
@@ -0,0 +1,366 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: meshmemberspb/meshmembers.proto
+
+package meshmemberspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Node is a member of the mesh.
+type Node struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Addr          string                 `protobuf:"bytes,2,opt,name=addr,proto3" json:"addr,omitempty"` // host:port
+	Id            string                 `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	Role          string                 `protobuf:"bytes,4,opt,name=role,proto3" json:"role,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Node) Reset() {
+	*x = Node{}
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Node) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Node) ProtoMessage() {}
+
+func (x *Node) ProtoReflect() protoreflect.Message {
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Node.ProtoReflect.Descriptor instead.
+func (*Node) Descriptor() ([]byte, []int) {
+	return file_meshmemberspb_meshmembers_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Node) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Node) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+func (x *Node) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Node) GetRole() string {
+	if x != nil {
+		return x.Role
+	}
+	return ""
+}
+
+// Event is something which happened in the mesh, as sent to JSON clients.
+type Event struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Seq           uint64                 `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	Time          string                 `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`       // RFC3339, with nanoseconds
+	Kind          string                 `protobuf:"bytes,3,opt,name=kind,proto3" json:"kind,omitempty"`       // join, update, leave, conflict, notice, or other
+	Message       string                 `protobuf:"bytes,4,opt,name=message,proto3" json:"message,omitempty"` // The text sent to text clients
+	Node          *Node                  `protobuf:"bytes,5,opt,name=node,proto3" json:"node,omitempty"`       // Unset if the event isn't about a node
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_meshmemberspb_meshmembers_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Event) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Event) GetTime() string {
+	if x != nil {
+		return x.Time
+	}
+	return ""
+}
+
+func (x *Event) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *Event) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Event) GetNode() *Node {
+	if x != nil {
+		return x.Node
+	}
+	return nil
+}
+
+type ListMembersRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMembersRequest) Reset() {
+	*x = ListMembersRequest{}
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMembersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMembersRequest) ProtoMessage() {}
+
+func (x *ListMembersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMembersRequest.ProtoReflect.Descriptor instead.
+func (*ListMembersRequest) Descriptor() ([]byte, []int) {
+	return file_meshmemberspb_meshmembers_proto_rawDescGZIP(), []int{2}
+}
+
+type ListMembersResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Nodes         []*Node                `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMembersResponse) Reset() {
+	*x = ListMembersResponse{}
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMembersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMembersResponse) ProtoMessage() {}
+
+func (x *ListMembersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMembersResponse.ProtoReflect.Descriptor instead.
+func (*ListMembersResponse) Descriptor() ([]byte, []int) {
+	return file_meshmemberspb_meshmembers_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListMembersResponse) GetNodes() []*Node {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+type WatchEventsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchEventsRequest) Reset() {
+	*x = WatchEventsRequest{}
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchEventsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchEventsRequest) ProtoMessage() {}
+
+func (x *WatchEventsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_meshmemberspb_meshmembers_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchEventsRequest.ProtoReflect.Descriptor instead.
+func (*WatchEventsRequest) Descriptor() ([]byte, []int) {
+	return file_meshmemberspb_meshmembers_proto_rawDescGZIP(), []int{4}
+}
+
+var File_meshmemberspb_meshmembers_proto protoreflect.FileDescriptor
+
+const file_meshmemberspb_meshmembers_proto_rawDesc = "" +
+	"\n" +
+	"\x1fmeshmemberspb/meshmembers.proto\x12\vmeshmembers\"R\n" +
+	"\x04Node\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04addr\x18\x02 \x01(\tR\x04addr\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\tR\x02id\x12\x12\n" +
+	"\x04role\x18\x04 \x01(\tR\x04role\"\x82\x01\n" +
+	"\x05Event\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x04R\x03seq\x12\x12\n" +
+	"\x04time\x18\x02 \x01(\tR\x04time\x12\x12\n" +
+	"\x04kind\x18\x03 \x01(\tR\x04kind\x12\x18\n" +
+	"\amessage\x18\x04 \x01(\tR\amessage\x12%\n" +
+	"\x04node\x18\x05 \x01(\v2\x11.meshmembers.NodeR\x04node\"\x14\n" +
+	"\x12ListMembersRequest\">\n" +
+	"\x13ListMembersResponse\x12'\n" +
+	"\x05nodes\x18\x01 \x03(\v2\x11.meshmembers.NodeR\x05nodes\"\x14\n" +
+	"\x12WatchEventsRequest2\xa5\x01\n" +
+	"\vMeshMembers\x12P\n" +
+	"\vListMembers\x12\x1f.meshmembers.ListMembersRequest\x1a .meshmembers.ListMembersResponse\x12D\n" +
+	"\vWatchEvents\x12\x1f.meshmembers.WatchEventsRequest\x1a\x12.meshmembers.Event0\x01B3Z1github.com/magisterquis/meshmembers/meshmemberspbb\x06proto3"
+
+var (
+	file_meshmemberspb_meshmembers_proto_rawDescOnce sync.Once
+	file_meshmemberspb_meshmembers_proto_rawDescData []byte
+)
+
+func file_meshmemberspb_meshmembers_proto_rawDescGZIP() []byte {
+	file_meshmemberspb_meshmembers_proto_rawDescOnce.Do(func() {
+		file_meshmemberspb_meshmembers_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_meshmemberspb_meshmembers_proto_rawDesc), len(file_meshmemberspb_meshmembers_proto_rawDesc)))
+	})
+	return file_meshmemberspb_meshmembers_proto_rawDescData
+}
+
+var file_meshmemberspb_meshmembers_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_meshmemberspb_meshmembers_proto_goTypes = []any{
+	(*Node)(nil),                // 0: meshmembers.Node
+	(*Event)(nil),               // 1: meshmembers.Event
+	(*ListMembersRequest)(nil),  // 2: meshmembers.ListMembersRequest
+	(*ListMembersResponse)(nil), // 3: meshmembers.ListMembersResponse
+	(*WatchEventsRequest)(nil),  // 4: meshmembers.WatchEventsRequest
+}
+var file_meshmemberspb_meshmembers_proto_depIdxs = []int32{
+	0, // 0: meshmembers.Event.node:type_name -> meshmembers.Node
+	0, // 1: meshmembers.ListMembersResponse.nodes:type_name -> meshmembers.Node
+	2, // 2: meshmembers.MeshMembers.ListMembers:input_type -> meshmembers.ListMembersRequest
+	4, // 3: meshmembers.MeshMembers.WatchEvents:input_type -> meshmembers.WatchEventsRequest
+	3, // 4: meshmembers.MeshMembers.ListMembers:output_type -> meshmembers.ListMembersResponse
+	1, // 5: meshmembers.MeshMembers.WatchEvents:output_type -> meshmembers.Event
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_meshmemberspb_meshmembers_proto_init() }
+func file_meshmemberspb_meshmembers_proto_init() {
+	if File_meshmemberspb_meshmembers_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_meshmemberspb_meshmembers_proto_rawDesc), len(file_meshmemberspb_meshmembers_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_meshmemberspb_meshmembers_proto_goTypes,
+		DependencyIndexes: file_meshmemberspb_meshmembers_proto_depIdxs,
+		MessageInfos:      file_meshmemberspb_meshmembers_proto_msgTypes,
+	}.Build()
+	File_meshmemberspb_meshmembers_proto = out.File
+	file_meshmemberspb_meshmembers_proto_goTypes = nil
+	file_meshmemberspb_meshmembers_proto_depIdxs = nil
+}
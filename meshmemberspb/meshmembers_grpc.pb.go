@@ -0,0 +1,171 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: meshmemberspb/meshmembers.proto
+
+package meshmemberspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	MeshMembers_ListMembers_FullMethodName = "/meshmembers.MeshMembers/ListMembers"
+	MeshMembers_WatchEvents_FullMethodName = "/meshmembers.MeshMembers/WatchEvents"
+)
+
+// MeshMembersClient is the client API for MeshMembers service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// MeshMembers serves the same member list and events as the local sockets.
+type MeshMembersClient interface {
+	// ListMembers returns the current members of the mesh.
+	ListMembers(ctx context.Context, in *ListMembersRequest, opts ...grpc.CallOption) (*ListMembersResponse, error)
+	// WatchEvents streams events as they happen, like -events-socket.
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type meshMembersClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMeshMembersClient(cc grpc.ClientConnInterface) MeshMembersClient {
+	return &meshMembersClient{cc}
+}
+
+func (c *meshMembersClient) ListMembers(ctx context.Context, in *ListMembersRequest, opts ...grpc.CallOption) (*ListMembersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListMembersResponse)
+	err := c.cc.Invoke(ctx, MeshMembers_ListMembers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *meshMembersClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &MeshMembers_ServiceDesc.Streams[0], MeshMembers_WatchEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchEventsRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MeshMembers_WatchEventsClient = grpc.ServerStreamingClient[Event]
+
+// MeshMembersServer is the server API for MeshMembers service.
+// All implementations must embed UnimplementedMeshMembersServer
+// for forward compatibility.
+//
+// MeshMembers serves the same member list and events as the local sockets.
+type MeshMembersServer interface {
+	// ListMembers returns the current members of the mesh.
+	ListMembers(context.Context, *ListMembersRequest) (*ListMembersResponse, error)
+	// WatchEvents streams events as they happen, like -events-socket.
+	WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedMeshMembersServer()
+}
+
+// UnimplementedMeshMembersServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMeshMembersServer struct{}
+
+func (UnimplementedMeshMembersServer) ListMembers(context.Context, *ListMembersRequest) (*ListMembersResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListMembers not implemented")
+}
+func (UnimplementedMeshMembersServer) WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Error(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedMeshMembersServer) mustEmbedUnimplementedMeshMembersServer() {}
+func (UnimplementedMeshMembersServer) testEmbeddedByValue()                     {}
+
+// UnsafeMeshMembersServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MeshMembersServer will
+// result in compilation errors.
+type UnsafeMeshMembersServer interface {
+	mustEmbedUnimplementedMeshMembersServer()
+}
+
+func RegisterMeshMembersServer(s grpc.ServiceRegistrar, srv MeshMembersServer) {
+	// If the following call panics, it indicates UnimplementedMeshMembersServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&MeshMembers_ServiceDesc, srv)
+}
+
+func _MeshMembers_ListMembers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMembersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MeshMembersServer).ListMembers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MeshMembers_ListMembers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MeshMembersServer).ListMembers(ctx, req.(*ListMembersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MeshMembers_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MeshMembersServer).WatchEvents(m, &grpc.GenericServerStream[WatchEventsRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MeshMembers_WatchEventsServer = grpc.ServerStreamingServer[Event]
+
+// MeshMembers_ServiceDesc is the grpc.ServiceDesc for MeshMembers service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MeshMembers_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "meshmembers.MeshMembers",
+	HandlerType: (*MeshMembersServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListMembers",
+			Handler:    _MeshMembers_ListMembers_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _MeshMembers_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "meshmemberspb/meshmembers.proto",
+}
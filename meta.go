@@ -0,0 +1,225 @@
+package main
+
+/*
+ * meta.go
+ * Node metadata
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* shortIDLen is the number of characters of a node's ID shown by
+FormatNode */
+const shortIDLen = 8
+
+// NodeMeta is the metadata each node advertises to the rest of the mesh.
+type NodeMeta struct {
+	/* ID is a UUID which stays the same across restarts, unlike the
+	node's name */
+	ID string `json:"id,omitempty"`
+
+	/* Role is what the node does, e.g. gateway or worker */
+	Role string `json:"role,omitempty"`
+
+	/* Weight is the node's priority for weighted selection, higher
+	first.  Nodes without a weight have a weight of 0. */
+	Weight int `json:"weight,omitempty"`
+
+	/* Observer is set if the node's only watching the mesh, with
+	-observe */
+	Observer bool `json:"observer,omitempty"`
+
+	/* Draining is set once the node's started draining, before it
+	leaves the mesh */
+	Draining bool `json:"draining,omitempty"`
+}
+
+// ParseMeta parses a node's metadata.  Metadata which can't be parsed, e.g.
+// from an older version of meshmembers, yields an empty NodeMeta.
+func ParseMeta(b []byte) NodeMeta {
+	var nm NodeMeta
+	if 0 == len(b) {
+		return nm
+	}
+	if err := json.Unmarshal(b, &nm); nil != err {
+		return NodeMeta{}
+	}
+	return nm
+}
+
+/* noRole is what we call nodes which don't advertise a role */
+const noRole = "none"
+
+/* validateRole makes sure role is usable as a role.  If allowed isn't empty,
+role must be in the comma-separated list of allowed roles. */
+func validateRole(role, allowed string) error {
+	if "" == role {
+		return nil
+	}
+	if noRole == role {
+		return fmt.Errorf("%q is reserved for roleless nodes", role)
+	}
+	if strings.ContainsFunc(role, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) {
+		return fmt.Errorf("role %q contains unusable characters", role)
+	}
+	if "" == allowed {
+		return nil
+	}
+	for _, a := range parsePeerList(allowed) {
+		if a == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("role %q not in allowed roles %s", role, allowed)
+}
+
+/* nodeRole returns n's role, or noRole if it doesn't have one */
+func nodeRole(n *memberlist.Node) string {
+	if r := ParseMeta(n.Meta).Role; "" != r {
+		return r
+	}
+	return noRole
+}
+
+/* localDelegate is our own node's Delegate, or nil before the mesh is
+started. */
+var localDelegate *Delegate
+
+// Delegate supplies memberlist with our node's metadata.  It implements
+// memberlist.Delegate.
+type Delegate struct {
+	meta  NodeMeta
+	metaL sync.Mutex
+}
+
+// NewDelegate returns a Delegate which advertises the given metadata.
+func NewDelegate(nm NodeMeta) *Delegate {
+	return &Delegate{meta: nm}
+}
+
+// NodeMeta returns our node's metadata, encoded as JSON.
+func (d *Delegate) NodeMeta(limit int) []byte {
+	d.metaL.Lock()
+	defer d.metaL.Unlock()
+	b, err := json.Marshal(d.meta)
+	if nil != err {
+		log.Printf("Error encoding metadata: %v", err)
+		return nil
+	}
+	if len(b) > limit {
+		log.Printf(
+			"Metadata too large (%d > %d bytes), not sending",
+			len(b),
+			limit,
+		)
+		return nil
+	}
+	return b
+}
+
+// SetDraining sets whether our metadata says we're draining.  Call
+// memberlist.Memberlist.UpdateNode to tell the mesh.
+func (d *Delegate) SetDraining(draining bool) {
+	d.metaL.Lock()
+	defer d.metaL.Unlock()
+	d.meta.Draining = draining
+}
+
+// NotifyMsg handles notices forwarded from other meshes by bridges.
+func (d *Delegate) NotifyMsg(b []byte) { handleBridgeMsg(b) }
+
+// GetBroadcasts is a no-op.
+func (d *Delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+
+// LocalState is a no-op.
+func (d *Delegate) LocalState(join bool) []byte { return nil }
+
+// MergeRemoteState is a no-op.
+func (d *Delegate) MergeRemoteState(buf []byte, join bool) {}
+
+// LoadOrCreateID returns the UUID stored in the file at path.  If the file
+// doesn't exist, a new UUID is generated and written to it.  If path is the
+// empty string, a new UUID is returned without being saved.
+func LoadOrCreateID(path string) (string, error) {
+	if "" == path {
+		return newUUID()
+	}
+
+	/* If we already have an ID, use it */
+	b, err := os.ReadFile(path)
+	if nil == err {
+		id := strings.TrimSpace(string(b))
+		if !isUUID(id) {
+			return "", fmt.Errorf("invalid ID %q in %s", id, path)
+		}
+		return id, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	/* First run, make a new one */
+	id, err := newUUID()
+	if nil != err {
+		return "", err
+	}
+	if err := writeFileAtomic(path, []byte(id+"\n"), 0600); nil != err {
+		return "", fmt.Errorf("saving ID to %s: %w", path, err)
+	}
+	return id, nil
+}
+
+/* newUUID returns a random (version 4) UUID */
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); nil != err {
+		return "", fmt.Errorf("generating UUID: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 /* Version 4 */
+	b[8] = (b[8] & 0x3f) | 0x80 /* RFC 4122 variant */
+	h := hex.EncodeToString(b[:])
+	return fmt.Sprintf(
+		"%s-%s-%s-%s-%s",
+		h[:8],
+		h[8:12],
+		h[12:16],
+		h[16:20],
+		h[20:],
+	), nil
+}
+
+/* isUUID returns true if s looks like a UUID */
+func isUUID(s string) bool {
+	if 36 != len(s) {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if '-' != c {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
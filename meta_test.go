@@ -0,0 +1,134 @@
+package main
+
+/*
+ * meta_test.go
+ * Tests for meta.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestLoadOrCreateID makes sure a node's ID survives restarts */
+func TestLoadOrCreateID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "id")
+	id, err := LoadOrCreateID(path)
+	if nil != err {
+		t.Fatalf("Creating ID: %v", err)
+	}
+	if !isUUID(id) {
+		t.Fatalf("New ID %q isn't a UUID", id)
+	}
+	again, err := LoadOrCreateID(path)
+	if nil != err {
+		t.Fatalf("Loading ID: %v", err)
+	}
+	if again != id {
+		t.Fatalf("Loaded ID %q, expected %q", again, id)
+	}
+
+	/* Garbage in the file is an error, not a new ID */
+	if err := os.WriteFile(path, []byte("moose\n"), 0600); nil != err {
+		t.Fatalf("Writing bad ID: %v", err)
+	}
+	if _, err := LoadOrCreateID(path); nil == err {
+		t.Fatalf("Loaded invalid ID without error")
+	}
+
+	/* No path, no saving */
+	a, err := LoadOrCreateID("")
+	if nil != err {
+		t.Fatalf("Creating unsaved ID: %v", err)
+	}
+	b, err := LoadOrCreateID("")
+	if nil != err {
+		t.Fatalf("Creating second unsaved ID: %v", err)
+	}
+	if a == b {
+		t.Fatalf("Got the same unsaved ID twice: %s", a)
+	}
+}
+
+/* TestNodeMetaRoundTrip makes sure metadata advertised by a Delegate parses
+back into the same NodeMeta. */
+func TestNodeMetaRoundTrip(t *testing.T) {
+	want := NodeMeta{
+		ID:     "2b0c9c4e-4a8e-4c8a-93a4-61f1e0c3f8f1",
+		Role:   "gateway",
+		Weight: 3,
+	}
+	d := NewDelegate(want)
+	if got := ParseMeta(d.NodeMeta(512)); got != want {
+		t.Fatalf("Got %+v, expected %+v", got, want)
+	}
+
+	/* Too-big metadata isn't sent */
+	if b := d.NodeMeta(10); nil != b {
+		t.Fatalf("Sent %d bytes of metadata with a limit of 10", len(b))
+	}
+
+	/* Unparseable metadata is empty */
+	if got := ParseMeta([]byte("not json")); (NodeMeta{}) != got {
+		t.Fatalf("Parsed garbage as %+v", got)
+	}
+}
+
+/* TestValidateRole makes sure only usable roles are allowed */
+func TestValidateRole(t *testing.T) {
+	for _, c := range []struct {
+		role    string
+		allowed string
+		ok      bool
+	}{
+		{"", "", true},
+		{"gateway", "", true},
+		{"gateway", "worker, gateway", true},
+		{"db", "worker,gateway", false},
+		{noRole, "", false},
+		{"two words", "", false},
+		{"bell\a", "", false},
+	} {
+		err := validateRole(c.role, c.allowed)
+		if c.ok != (nil == err) {
+			t.Errorf("%q in %q: error %v", c.role, c.allowed, err)
+		}
+	}
+}
+
+/* TestMarkDraining makes sure other nodes see a draining node as draining. */
+func TestMarkDraining(t *testing.T) {
+	t.Cleanup(func() { localDelegate = nil })
+	ms := newTestMesh(t, func(conf *memberlist.Config) {
+		if "a" == conf.Name {
+			localDelegate = NewDelegate(NodeMeta{ID: "id-a"})
+			conf.Delegate = localDelegate
+		}
+	}, "a", "b")
+	viewOfA := func() string {
+		for _, n := range ms[1].Members() {
+			if "a" == n.Name {
+				return FormatNode(n)
+			}
+		}
+		return ""
+	}
+	if v := viewOfA(); strings.Contains(v, "(draining)") {
+		t.Fatalf("Draining before DRAIN: %q", v)
+	}
+
+	markDraining(ms[0])
+	if !ParseMeta(ms[0].LocalNode().Meta).Draining {
+		t.Fatalf("Not draining in our own metadata")
+	}
+	waitFor(t, "b to see a draining", func() bool {
+		return strings.HasSuffix(viewOfA(), " (draining)")
+	})
+}
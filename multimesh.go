@@ -0,0 +1,363 @@
+package main
+
+/*
+ * multimesh.go
+ * Run extra, independent meshes in the same process
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* extraMesh is an additional mesh, configured with -extra-meshes */
+type extraMesh struct {
+	name string
+	m    *memberlist.Memberlist
+}
+
+var (
+	/* extraMeshes are the additional meshes we're in, in the order in
+	which they were configured. */
+	extraMeshes  []extraMesh
+	extraMeshesL sync.Mutex
+)
+
+// StartExtraMeshes starts the additional meshes described in the file at
+// path, one per line.  Each line holds whitespace-separated key=value pairs:
+//
+//	name     Name for the mesh in logs and metrics, required
+//	listen   Address and port on which to listen, required
+//	secret   Secret shared by the mesh's nodes, required
+//	label    Optional memberlist label
+//	peers    Optional comma-separated list of peers to join
+//	socket   Unix socket on which to send the mesh's member list, required
+//
+// As with -socket, {name}, {pid}, and {port} in socket paths are replaced
+// with our node's name in the mesh, the process ID, and the mesh's port.
+// Blank lines and lines starting with # are ignored.  Our node in each mesh
+// is named nodeName with a hyphen and the mesh's name appended.  Clients
+// connecting to an extra mesh's socket are sent its member list and
+// disconnected; events and commands are only available for our own mesh.
+func StartExtraMeshes(
+	newConfig func() *memberlist.Config,
+	nodeName string,
+	path string,
+	rm bool,
+	debug bool,
+) error {
+	mcs, err := readExtraMeshes(path)
+	if nil != err {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	for _, mc := range mcs {
+		if err := startExtraMesh(
+			newConfig,
+			nodeName,
+			mc,
+			rm,
+			debug,
+		); nil != err {
+			return fmt.Errorf(
+				"starting mesh %s: %w",
+				mc["name"],
+				err,
+			)
+		}
+	}
+	return nil
+}
+
+/* readExtraMeshes reads the extra mesh configs from the file at path. */
+func readExtraMeshes(path string) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		mcs   []map[string]string
+		names = make(map[string]bool)
+		sc    = bufio.NewScanner(f)
+		ln    int
+	)
+	for sc.Scan() {
+		ln++
+		l := strings.TrimSpace(sc.Text())
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		mc := make(map[string]string)
+		for _, kv := range strings.Fields(l) {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf(
+					"line %d: expected key=value, got %q",
+					ln,
+					kv,
+				)
+			}
+			switch k {
+			case "name", "listen", "secret", "label", "peers",
+				"socket":
+			default:
+				return nil, fmt.Errorf(
+					"line %d: unknown key %q",
+					ln,
+					k,
+				)
+			}
+			mc[k] = v
+		}
+		for _, k := range []string{
+			"name",
+			"listen",
+			"secret",
+			"socket",
+		} {
+			if "" == mc[k] {
+				return nil, fmt.Errorf(
+					"line %d: need %s",
+					ln,
+					k,
+				)
+			}
+		}
+		if names[mc["name"]] {
+			return nil, fmt.Errorf(
+				"line %d: duplicate name %q",
+				ln,
+				mc["name"],
+			)
+		}
+		names[mc["name"]] = true
+		mcs = append(mcs, mc)
+	}
+	if err := sc.Err(); nil != err {
+		return nil, err
+	}
+	if 0 == len(mcs) {
+		return nil, errors.New("no meshes configured")
+	}
+	return mcs, nil
+}
+
+/* startExtraMesh joins the mesh described by mc and listens on its socket. */
+func startExtraMesh(
+	newConfig func() *memberlist.Config,
+	nodeName string,
+	mc map[string]string,
+	rm bool,
+	debug bool,
+) error {
+	/* Join the mesh */
+	m, err := newSideMesh(
+		newConfig,
+		nodeName+"-"+mc["name"],
+		"",
+		mc["listen"],
+		mc["secret"],
+		mc["label"],
+		debug,
+	)
+	if nil != err {
+		return fmt.Errorf("creating node: %w", err)
+	}
+	log.Printf(
+		"Node in mesh %s: %s",
+		mc["name"],
+		FormatNode(m.LocalNode()),
+	)
+	if "" != mc["peers"] {
+		n, err := connectToPeers(m, mc["peers"])
+		if nil != err {
+			log.Printf(
+				"Error connecting to initial peers for mesh "+
+					"%s: %v",
+				mc["name"],
+				err,
+			)
+		} else {
+			log.Printf(
+				"Connected to %d initial peers for mesh %s",
+				n,
+				mc["name"],
+			)
+		}
+	}
+
+	/* Serve the member list */
+	path, err := ExpandSocketPath(
+		mc["socket"],
+		m.LocalNode().Name,
+		os.Getpid(),
+		int(m.LocalNode().Port),
+	)
+	if nil != err {
+		m.Shutdown()
+		return fmt.Errorf("invalid socket path: %w", err)
+	}
+	if rm {
+		if err := os.RemoveAll(path); nil != err {
+			m.Shutdown()
+			return fmt.Errorf("removing %s: %w", path, err)
+		}
+	}
+	ul, err := ListenUnix(path)
+	if nil != err {
+		m.Shutdown()
+		return fmt.Errorf("listening on %s: %w", path, err)
+	}
+	log.Printf(
+		"Listening for mesh %s clients on %s",
+		mc["name"],
+		ul.Addr(),
+	)
+	listenersL.Lock()
+	listeners = append(listeners, ul)
+	listenersL.Unlock()
+	go serveExtraMesh(ul, mc["name"], m)
+
+	extraMeshesL.Lock()
+	defer extraMeshesL.Unlock()
+	extraMeshes = append(extraMeshes, extraMesh{name: mc["name"], m: m})
+	return nil
+}
+
+/* serveExtraMesh sends m's member list to each client which connects to l,
+then disconnects it. */
+func serveExtraMesh(l net.Listener, name string, m *memberlist.Memberlist) {
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if IsTemporary(err) {
+			time.Sleep(acceptWait)
+			continue
+		} else if nil != err {
+			log.Printf(
+				"Error accepting mesh %s client: %v",
+				name,
+				err,
+			)
+			return
+		}
+		go sendExtraMembers(c, name, m)
+	}
+}
+
+/* sendExtraMembers sends m's member list to c and closes c. */
+func sendExtraMembers(c net.Conn, name string, m *memberlist.Memberlist) {
+	defer c.Close()
+	ns := sortedMembers(m)
+	b := fmt.Appendf(nil, "Current nodes in mesh: %d\n", len(ns))
+	for _, n := range ns {
+		b = fmt.Appendf(b, "%s\n", FormatNode(n))
+	}
+	if err := writeWithTimeout(c, b, snapshotTimeout); nil != err {
+		log.Printf("Error sending mesh %s members: %v", name, err)
+	}
+}
+
+/* extraMeshSizes returns the names and sizes of the extra meshes, in the
+order in which they were configured. */
+func extraMeshSizes() ([]string, []int) {
+	extraMeshesL.Lock()
+	defer extraMeshesL.Unlock()
+	names := make([]string, len(extraMeshes))
+	sizes := make([]int, len(extraMeshes))
+	for i, em := range extraMeshes {
+		names[i] = em.name
+		sizes[i] = em.m.NumMembers()
+	}
+	return names, sizes
+}
+
+/* leaveExtraMeshes gracefully leaves the extra meshes. */
+func leaveExtraMeshes() {
+	extraMeshesL.Lock()
+	defer extraMeshesL.Unlock()
+	for _, em := range extraMeshes {
+		if err := em.m.Leave(leaveTimeout); nil != err {
+			log.Printf("Error leaving mesh %s: %v", em.name, err)
+		}
+		if err := em.m.Shutdown(); nil != err {
+			log.Printf(
+				"Error shutting down mesh %s listeners: %v",
+				em.name,
+				err,
+			)
+		}
+	}
+	extraMeshes = nil
+}
+
+/* newSideMesh creates a node named name, with the given role, in a mesh
+other than our own, e.g. for bridging.  The mesh's config is made with
+newConfig and otherwise set up like our own. */
+func newSideMesh(
+	newConfig func() *memberlist.Config,
+	name string,
+	role string,
+	listen string,
+	secret string,
+	label string,
+	debug bool,
+) (*memberlist.Memberlist, error) {
+	/* Work out where to listen */
+	h, p, err := net.SplitHostPort(listen)
+	if nil != err {
+		return nil, fmt.Errorf(
+			"parsing listen address %q: %w",
+			listen,
+			err,
+		)
+	}
+	port, err := strconv.Atoi(p)
+	if nil != err {
+		return nil, fmt.Errorf("parsing listen port %q: %w", p, err)
+	}
+	/* Not newKeyring, which would replace our own mesh's keyring */
+	kr, err := memberlist.NewKeyring(nil, DeriveKey(secret))
+	if nil != err {
+		return nil, fmt.Errorf("setting up keyring: %w", err)
+	}
+
+	/* Mesh config, which is mostly the same as for our own mesh */
+	conf := newConfig()
+	conf.Name = name
+	conf.BindAddr = h
+	conf.BindPort = port
+	if !isWildcardAddr(h) {
+		conf.AdvertiseAddr = h
+	}
+	conf.AdvertisePort = port
+	conf.GossipVerifyIncoming = true
+	conf.GossipVerifyOutgoing = true
+	conf.ProtocolVersion = memberlist.ProtocolVersionMax
+	conf.Keyring = kr
+	conf.Label = label
+	conf.UDPBufferSize = udpBufferSize
+	conf.Delegate = NewDelegate(NodeMeta{Role: role})
+	if debug {
+		conf.Logger = log.Default()
+	} else {
+		conf.LogOutput = ioutil.Discard
+	}
+	return memberlist.Create(conf)
+}
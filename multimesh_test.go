@@ -0,0 +1,157 @@
+package main
+
+/*
+ * multimesh_test.go
+ * Tests for multimesh.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestReadExtraMeshes makes sure extra mesh configs parse, and that bad ones
+don't. */
+func TestReadExtraMeshes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meshes")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0600); nil != err {
+			t.Fatalf("Writing config: %v", err)
+		}
+	}
+	write("# Comment\n\n" +
+		"name=a listen=127.0.0.1:1 secret=s socket=/a label=l\n" +
+		"  name=b listen=127.0.0.1:2 secret=t socket=/b " +
+		"peers=x:1,y:2\n")
+	mcs, err := readExtraMeshes(path)
+	if nil != err {
+		t.Fatalf("Reading config: %v", err)
+	}
+	if 2 != len(mcs) || "l" != mcs[0]["label"] ||
+		"x:1,y:2" != mcs[1]["peers"] {
+		t.Fatalf("Read %q", mcs)
+	}
+
+	for _, c := range []struct {
+		conf string
+		want string
+	}{
+		{"", "no meshes configured"},
+		{"name=a listen", "expected key=value"},
+		{"name=a moose=b", "unknown key"},
+		{"name=a listen=x:1 secret=s", "need socket"},
+		{
+			"name=a listen=x:1 secret=s socket=/a\n" +
+				"name=a listen=x:2 secret=s socket=/b",
+			"duplicate name",
+		},
+	} {
+		write(c.conf)
+		if _, err := readExtraMeshes(path); nil == err ||
+			!strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got error %v", c.conf, err)
+		}
+	}
+}
+
+/* TestExtraMeshes runs two extra meshes in the same process and makes sure
+each serves its own member list on its own socket. */
+func TestExtraMeshes(t *testing.T) {
+	captureLog(t)
+	newConfig := func() *memberlist.Config {
+		return memberlist.DefaultLocalConfig()
+	}
+	t.Cleanup(func() {
+		leaveExtraMeshes()
+		CloseListeners()
+	})
+
+	/* A peer for the first mesh */
+	conf := newConfig()
+	conf.Name = "peer"
+	conf.BindAddr = "127.0.0.1"
+	conf.BindPort = 0
+	conf.SecretKey = DeriveKey("s1")
+	conf.LogOutput = io.Discard
+	peer, err := memberlist.Create(conf)
+	if nil != err {
+		t.Fatalf("Creating peer: %v", err)
+	}
+	t.Cleanup(func() { peer.Shutdown() })
+
+	dir := t.TempDir()
+	for _, mc := range []map[string]string{{
+		"name":   "one",
+		"listen": "127.0.0.1:0",
+		"secret": "s1",
+		"peers":  peer.LocalNode().Address(),
+		"socket": filepath.Join(dir, "{name}.sock"),
+	}, {
+		"name":   "two",
+		"listen": "127.0.0.1:0",
+		"secret": "s2",
+		"socket": filepath.Join(dir, "{name}.sock"),
+	}} {
+		if err := startExtraMesh(
+			newConfig,
+			"us",
+			mc,
+			false,
+			false,
+		); nil != err {
+			t.Fatalf("Starting mesh %s: %v", mc["name"], err)
+		}
+	}
+	waitFor(t, "peer to join", func() bool {
+		return 2 == peer.NumMembers()
+	})
+	names, sizes := extraMeshSizes()
+	if !slices.Equal([]string{"one", "two"}, names) ||
+		!slices.Equal([]int{2, 1}, sizes) {
+		t.Fatalf("Got meshes %q with sizes %d", names, sizes)
+	}
+
+	/* Each socket has its own mesh */
+	for _, c := range []struct {
+		name string
+		want []string
+	}{
+		{
+			"us-one",
+			[]string{"Current nodes in mesh: 2", "peer", "us-one"},
+		},
+		{
+			"us-two",
+			[]string{"Current nodes in mesh: 1", "us-two"},
+		},
+	} {
+		sc, err := net.Dial("unix", filepath.Join(dir, c.name+".sock"))
+		if nil != err {
+			t.Fatalf("Connecting to %s's socket: %v", c.name, err)
+		}
+		sc.SetReadDeadline(time.Now().Add(testTimeout))
+		b, err := io.ReadAll(sc)
+		sc.Close()
+		if nil != err {
+			t.Fatalf("Reading from %s's socket: %v", c.name, err)
+		}
+		got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		for i, l := range got[1:] {
+			got[i+1], _, _ = strings.Cut(l, " ")
+		}
+		if !slices.Equal(c.want, got) {
+			t.Errorf("%s: got %q, expected %q", c.name, got, c.want)
+		}
+	}
+}
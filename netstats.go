@@ -0,0 +1,195 @@
+package main
+
+/*
+ * netstats.go
+ * Count the mesh traffic we send and receive
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* netStats counts the mesh traffic sent and received via CountingTransports.
+Bytes include both packets and streams, as they are on the wire, i.e. after
+encryption and compression. */
+var netStats struct {
+	txBytes, rxBytes     atomic.Uint64
+	txPackets, rxPackets atomic.Uint64
+}
+
+// CountingTransport wraps another memberlist.NodeAwareTransport and counts
+// the bytes and packets sent and received.
+type CountingTransport struct {
+	memberlist.NodeAwareTransport
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+	done     chan struct{}
+	doneO    sync.Once
+}
+
+var _ memberlist.NodeAwareTransport = (*CountingTransport)(nil)
+
+// NewCountingTransport returns a CountingTransport which wraps t.
+func NewCountingTransport(t memberlist.NodeAwareTransport) *CountingTransport {
+	ct := &CountingTransport{
+		NodeAwareTransport: t,
+		packetCh:           make(chan *memberlist.Packet),
+		streamCh:           make(chan net.Conn),
+		done:               make(chan struct{}),
+	}
+	go ct.relayPackets()
+	go ct.relayStreams()
+	return ct
+}
+
+// WriteTo sends the packet b to addr.
+func (t *CountingTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.WriteToAddress(b, memberlist.Address{Addr: addr})
+}
+
+// WriteToAddress sends the packet b to a.
+func (t *CountingTransport) WriteToAddress(
+	b []byte,
+	a memberlist.Address,
+) (time.Time, error) {
+	ts, err := t.NodeAwareTransport.WriteToAddress(b, a)
+	if nil == err {
+		netStats.txPackets.Add(1)
+		netStats.txBytes.Add(uint64(len(b)))
+	}
+	return ts, err
+}
+
+// PacketCh returns a channel on which received packets are sent.
+func (t *CountingTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// DialTimeout makes a stream connection to addr.
+func (t *CountingTransport) DialTimeout(
+	addr string,
+	timeout time.Duration,
+) (net.Conn, error) {
+	return t.DialAddressTimeout(memberlist.Address{Addr: addr}, timeout)
+}
+
+// DialAddressTimeout makes a stream connection to a.
+func (t *CountingTransport) DialAddressTimeout(
+	a memberlist.Address,
+	timeout time.Duration,
+) (net.Conn, error) {
+	c, err := t.NodeAwareTransport.DialAddressTimeout(a, timeout)
+	if nil != err {
+		return nil, err
+	}
+	return countingConn{Conn: c}, nil
+}
+
+// StreamCh returns a channel on which accepted streams are sent.
+func (t *CountingTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown stops counting and shuts down the wrapped transport.
+func (t *CountingTransport) Shutdown() error {
+	t.doneO.Do(func() { close(t.done) })
+	return t.NodeAwareTransport.Shutdown()
+}
+
+/* relayPackets counts packets from the wrapped transport and sends them to
+t.packetCh. */
+func (t *CountingTransport) relayPackets() {
+	in := t.NodeAwareTransport.PacketCh()
+	for {
+		select {
+		case p := <-in:
+			netStats.rxPackets.Add(1)
+			netStats.rxBytes.Add(uint64(len(p.Buf)))
+			select {
+			case t.packetCh <- p:
+			case <-t.done:
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+/* relayStreams wraps streams from the wrapped transport in countingConns
+and sends them to t.streamCh. */
+func (t *CountingTransport) relayStreams() {
+	in := t.NodeAwareTransport.StreamCh()
+	for {
+		select {
+		case c := <-in:
+			select {
+			case t.streamCh <- countingConn{Conn: c}:
+			case <-t.done:
+				c.Close()
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+/* countingConn is a net.Conn which counts the bytes read and written */
+type countingConn struct {
+	net.Conn
+}
+
+/* Read reads from the underlying Conn and counts what's read. */
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	netStats.rxBytes.Add(uint64(n))
+	return n, err
+}
+
+/* Write writes to the underlying Conn and counts what's written. */
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	netStats.txBytes.Add(uint64(n))
+	return n, err
+}
+
+/* createWithNetTransport creates a memberlist with memberlist's usual
+NetTransport, wrapped in a CountingTransport. */
+func createWithNetTransport(
+	conf *memberlist.Config,
+) (*memberlist.Memberlist, error) {
+	l := conf.Logger
+	if nil == l {
+		l = log.New(conf.LogOutput, "", log.LstdFlags)
+	}
+	nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{conf.BindAddr},
+		BindPort:  conf.BindPort,
+		Logger:    l,
+	})
+	if nil != err {
+		return nil, err
+	}
+	if 0 == conf.BindPort {
+		conf.BindPort = nt.GetAutoBindPort()
+		conf.AdvertisePort = conf.BindPort
+	}
+	ct := NewCountingTransport(nt)
+	conf.Transport = ct
+	m, err := memberlist.Create(conf)
+	if nil != err {
+		ct.Shutdown()
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+/*
+ * netstats_test.go
+ * Tests for netstats.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestCountingTransport makes sure gossip via CountingTransports is counted
+and sent to clients with NETSTATS. */
+func TestCountingTransport(t *testing.T) {
+	counts := func() [4]uint64 {
+		return [4]uint64{
+			netStats.txBytes.Load(),
+			netStats.rxBytes.Load(),
+			netStats.txPackets.Load(),
+			netStats.rxPackets.Load(),
+		}
+	}
+	before := counts()
+	ms := newTestMesh(t, func(conf *memberlist.Config) {
+		conf.Transport = NewCountingTransport(
+			conf.Transport.(memberlist.NodeAwareTransport),
+		)
+	}, "a", "b")
+
+	/* Joining's a stream, probes are packets */
+	waitFor(t, "traffic to be counted", func() bool {
+		after := counts()
+		for i := range after {
+			if after[i] <= before[i] {
+				return false
+			}
+		}
+		return true
+	})
+
+	/* Clients get the counters */
+	tc := newTestClient(t, ms[0], false)
+	tc.send("NETSTATS")
+	for i, k := range []string{
+		"tx_bytes",
+		"rx_bytes",
+		"tx_packets",
+		"rx_packets",
+	} {
+		l := tc.readLine()
+		v, ok := strings.CutPrefix(l, k+"=")
+		if !ok {
+			t.Fatalf("Expected %s, got %q", k, l)
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if nil != err {
+			t.Fatalf("Parsing %q: %v", l, err)
+		}
+		if n <= before[i] {
+			t.Errorf("%s not counted: %d", k, n)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+/*
+ * peers.go
+ * Find peers to join
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* srvTimeout is how long we'll wait for an SRV lookup */
+const srvTimeout = 10 * time.Second
+
+/* rejoinCheckInterval is how often we check if we're isolated.  Tests make it
+shorter. */
+var rejoinCheckInterval = 10 * time.Second
+
+/* minJoinPeers is the number of peers we need to have contacted when joining
+the mesh for the join to be a success.  We're considered isolated if we have
+fewer peers. */
+var minJoinPeers = 1
+
+/* peersCache is the file in which the addresses of the other members of the
+mesh are saved, to use as peers next time, or the empty string to not save
+them. */
+var peersCache string
+
+/* errNoPeersCache is returned by SavePeers if there's no peers cache */
+var errNoPeersCache = errors.New("no peers cache configured")
+
+/* srvResolver looks up SRV records.  It is satisfied by *net.Resolver. */
+type srvResolver interface {
+	LookupSRV(
+		ctx context.Context,
+		service, proto, name string,
+	) (string, []*net.SRV, error)
+}
+
+/* parsePeerList splits s on commas and whitespace, ignoring empty entries */
+func parsePeerList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return ',' == r || unicode.IsSpace(r)
+	})
+}
+
+/* readPeerList reads a comma- or whitespace-separated list of peers from r.  An
+empty list isn't an error. */
+func readPeerList(r io.Reader) (string, error) {
+	b, err := io.ReadAll(r)
+	if nil != err {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+/* gatherPeers combines the comma-separated list of static peers with the
+targets of the SRV record srv, if srv isn't the empty string.  SRV lookup
+failures are logged and otherwise ignored, leaving just the static peers. */
+func gatherPeers(static, srv string) string {
+	if "" == srv {
+		return static
+	}
+	ps, err := lookupSRVPeers(net.DefaultResolver, srv)
+	if nil != err {
+		log.Printf("Error looking up peers in %s: %v", srv, err)
+		return static
+	}
+	if "" == static {
+		return strings.Join(ps, ",")
+	}
+	return static + "," + strings.Join(ps, ",")
+}
+
+/* lookupSRVPeers resolves the SRV record name, e.g. _mesh._tcp.example.com,
+to a list of host:port pairs. */
+func lookupSRVPeers(r srvResolver, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), srvTimeout)
+	defer cancel()
+	_, srvs, err := r.LookupSRV(ctx, "", "", name)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(srvs) {
+		return nil, fmt.Errorf("no targets found")
+	}
+	ps := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		ps = append(ps, net.JoinHostPort(
+			strings.TrimSuffix(srv.Target, "."),
+			strconv.Itoa(int(srv.Port)),
+		))
+	}
+	return ps, nil
+}
+
+/* rejoinWhenIsolated tries to rejoin the mesh using the peers returned by
+seeds if we've had fewer than minJoinPeers peers for at least after.  Seeds
+should return a comma-separated list of peers. */
+func rejoinWhenIsolated(
+	m *memberlist.Memberlist,
+	after time.Duration,
+	seeds func() string,
+) {
+	var isolatedSince time.Time
+	for range time.Tick(rejoinCheckInterval) {
+		m := liveMesh(m)
+
+		/* If we're not isolated, life's good */
+		if minJoinPeers < m.NumMembers() {
+			isolatedSince = time.Time{}
+			continue
+		}
+		if isolatedSince.IsZero() {
+			isolatedSince = time.Now()
+		}
+		if time.Since(isolatedSince) < after {
+			continue
+		}
+
+		/* Been alone too long, try to find friends */
+		csl := seeds()
+		if "" == csl {
+			continue
+		}
+		broadcastAndLogf(
+			eventNotice,
+			nil,
+			"[Reconnecting] Fewer than %d peers for %s, "+
+				"rejoining mesh",
+			minJoinPeers,
+			time.Since(isolatedSince).Round(time.Second),
+		)
+		if n, err := connectToPeers(m, csl); nil != err {
+			log.Printf("Error rejoining mesh: %v", err)
+		} else {
+			log.Printf("Rejoined mesh via %d peers", n)
+		}
+
+		/* Give it a while before trying again */
+		isolatedSince = time.Now()
+	}
+}
+
+// SavePeers writes the addresses of the other members of m to the peers
+// cache, one per line, and returns the number written.
+func SavePeers(m *memberlist.Memberlist) (int, error) {
+	if "" == peersCache {
+		return 0, errNoPeersCache
+	}
+	var b strings.Builder
+	n := 0
+	for _, p := range sortedMembers(m) {
+		if p.Name == m.LocalNode().Name {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\n", nodeAddr(p))
+		n++
+	}
+	if err := writeFileAtomic(
+		peersCache,
+		[]byte(b.String()),
+		0644,
+	); nil != err {
+		return 0, err
+	}
+	return n, nil
+}
+
+/* readPeersCache returns the peers saved in the peers cache by SavePeers.  A
+missing cache isn't an error, as there's nothing to read on the first run. */
+func readPeersCache() (string, error) {
+	f, err := os.Open(peersCache)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if nil != err {
+		return "", err
+	}
+	defer f.Close()
+	return readPeerList(f)
+}
+
+/* pursuePermanentPeers tries every rejoinCheckInterval to join whichever of
+the peers in ps aren't in the mesh, no matter how long they've been gone.
+Clients are told when a permanent peer we didn't have is reached. */
+func pursuePermanentPeers(m *memberlist.Memberlist, ps []string) {
+	/* reached notes which peers were in the mesh last we checked, so we
+	only tell clients when one comes back. */
+	reached := make(map[string]bool)
+	t := time.NewTicker(rejoinCheckInterval)
+	defer t.Stop()
+	for ; ; <-t.C {
+		m := liveMesh(m)
+
+		/* Work out who we have */
+		have := make(map[string]bool)
+		for _, n := range m.Members() {
+			have[nodeAddr(n)] = true
+		}
+
+		for _, p := range ps {
+			/* Names may resolve differently as time goes on */
+			ta, err := net.ResolveTCPAddr("tcp", p)
+			if nil != err {
+				log.Printf(
+					"Error resolving permanent peer %s: %v",
+					p,
+					err,
+				)
+				reached[p] = false
+				continue
+			}
+			a := net.JoinHostPort(
+				normalizeIP(ta.IP).String(),
+				strconv.Itoa(ta.Port),
+			)
+
+			/* If we already have it, life's good */
+			if have[a] {
+				reached[p] = true
+				continue
+			}
+
+			/* Try to get it back */
+			if _, err := m.Join([]string{a}); nil != err {
+				if reached[p] {
+					log.Printf(
+						"Lost permanent peer %s: %v",
+						p,
+						err,
+					)
+				}
+				reached[p] = false
+				continue
+			}
+			if !reached[p] {
+				broadcastAndLogf(
+					eventNotice,
+					nil,
+					"[Permanent] Reached permanent peer %s",
+					p,
+				)
+			}
+			reached[p] = true
+		}
+	}
+}
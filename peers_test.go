@@ -0,0 +1,259 @@
+package main
+
+/*
+ * peers_test.go
+ * Tests for peers.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* stubResolver is an srvResolver which returns canned answers */
+type stubResolver struct {
+	srvs []*net.SRV
+	err  error
+	name string /* Name looked up */
+}
+
+/* LookupSRV returns sr.srvs and sr.err */
+func (sr *stubResolver) LookupSRV(
+	ctx context.Context,
+	service, proto, name string,
+) (string, []*net.SRV, error) {
+	sr.name = name
+	return name, sr.srvs, sr.err
+}
+
+/* TestLookupSRVPeers makes sure SRV targets turn into peers */
+func TestLookupSRVPeers(t *testing.T) {
+	sr := stubResolver{srvs: []*net.SRV{
+		{Target: "a.example.com.", Port: 7946},
+		{Target: "b.example.com", Port: 1234},
+		{Target: "2001:db8::1", Port: 80},
+	}}
+	ps, err := lookupSRVPeers(&sr, "_mesh._tcp.example.com")
+	if nil != err {
+		t.Fatalf("Error: %v", err)
+	}
+	if "_mesh._tcp.example.com" != sr.name {
+		t.Fatalf("Looked up %q", sr.name)
+	}
+	want := []string{
+		"a.example.com:7946",
+		"b.example.com:1234",
+		"[2001:db8::1]:80",
+	}
+	if !slices.Equal(want, ps) {
+		t.Fatalf("Got %q, expected %q", ps, want)
+	}
+
+	/* Lookup failures and empty answers are errors */
+	if _, err := lookupSRVPeers(
+		&stubResolver{err: errors.New("oops")},
+		"x",
+	); nil == err {
+		t.Fatalf("Failed lookup didn't return an error")
+	}
+	if _, err := lookupSRVPeers(&stubResolver{}, "x"); nil == err {
+		t.Fatalf("Empty answer didn't return an error")
+	}
+}
+
+/* TestRejoinWhenIsolated makes sure an isolated node rejoins the mesh via its
+seeds. */
+func TestRejoinWhenIsolated(t *testing.T) {
+	rejoinCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { rejoinCheckInterval = 10 * time.Second })
+
+	/* Two nodes which don't know about each other */
+	mn := new(memberlist.MockNetwork)
+	var ms []*memberlist.Memberlist
+	for _, name := range []string{"a", "b"} {
+		m, err := memberlist.Create(newTestConfig(mn, name, "s"))
+		if nil != err {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		ms = append(ms, m)
+	}
+	tc := newTestClient(t, ms[0], false)
+
+	go rejoinWhenIsolated(ms[0], 50*time.Millisecond, func() string {
+		return ms[1].LocalNode().Address()
+	})
+	if l := tc.readLine(); !strings.Contains(l, "[Reconnecting]") {
+		t.Fatalf("Got %q", l)
+	}
+	waitFor(t, "rejoin", func() bool {
+		return 2 == ms[0].NumMembers() && 2 == ms[1].NumMembers()
+	})
+}
+
+/* TestReadPeerList makes sure peers can be read from stdin */
+func TestReadPeerList(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []string
+	}{
+		{"a:1,b:2\nc:3\n", []string{"a:1", "b:2", "c:3"}},
+		{"", nil},
+		{"\n\n", nil},
+	} {
+		s, err := readPeerList(strings.NewReader(c.in))
+		if nil != err {
+			t.Fatalf("Error reading %q: %v", c.in, err)
+		}
+		if got := parsePeerList(s); !slices.Equal(c.want, got) {
+			t.Errorf(
+				"Read %q as %q, expected %q",
+				c.in,
+				got,
+				c.want,
+			)
+		}
+	}
+
+	/* Read errors are errors */
+	if _, err := readPeerList(iotest.ErrReader(
+		errors.New("oops"),
+	)); nil == err {
+		t.Fatalf("Read error not returned")
+	}
+}
+
+/* TestParsePeerList makes sure peers may be separated by all sorts of
+things */
+func TestParsePeerList(t *testing.T) {
+	got := parsePeerList(" a:1,b:2\n\tc:3 ,, d:4\r\n\ne:5,\n")
+	want := []string{"a:1", "b:2", "c:3", "d:4", "e:5"}
+	if !slices.Equal(want, got) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+	if got := parsePeerList(" ,\n, "); 0 != len(got) {
+		t.Fatalf("Empty list parsed as %q", got)
+	}
+}
+
+/* TestSavePeers makes sure SAVE-PEERS writes the other members' addresses to
+the peers cache, ready to be read on the next run. */
+func TestSavePeers(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b", "c")
+	tc := newTestClient(t, ms[0], true)
+	t.Cleanup(func() { peersCache = "" })
+
+	/* Nowhere to save */
+	tc.send("SAVE-PEERS")
+	if l := tc.readLine(); "Error: "+errNoPeersCache.Error() != l {
+		t.Fatalf("Got %q without a peers cache", l)
+	}
+
+	/* Nothing to read yet */
+	peersCache = filepath.Join(t.TempDir(), "peers")
+	if s, err := readPeersCache(); nil != err || "" != s {
+		t.Fatalf("Missing peers cache read %q, error %v", s, err)
+	}
+
+	tc.send("SAVE-PEERS")
+	if l, want := tc.readLine(), fmt.Sprintf(
+		"Saved 2 peers to %s",
+		peersCache,
+	); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+	want := []string{ /* Sorted by name */
+		nodeAddr(ms[1].LocalNode()),
+		nodeAddr(ms[2].LocalNode()),
+	}
+	b, err := os.ReadFile(peersCache)
+	if nil != err {
+		t.Fatalf("Reading peers cache: %v", err)
+	}
+	if got := strings.Join(want, "\n") + "\n"; got != string(b) {
+		t.Fatalf("Peers cache has %q, expected %q", b, got)
+	}
+	s, err := readPeersCache()
+	if nil != err {
+		t.Fatalf("Reading peers cache: %v", err)
+	}
+	if got := parsePeerList(s); !slices.Equal(want, got) {
+		t.Fatalf("Read peers %q, expected %q", got, want)
+	}
+}
+
+/* TestPursuePermanentPeers makes sure a permanent peer is retried after it
+drops out of the mesh, and that clients are told when it's back. */
+func TestPursuePermanentPeers(t *testing.T) {
+	rejoinCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { rejoinCheckInterval = 10 * time.Second })
+
+	/* Real networking, so the permanent peer can come back on the same
+	address */
+	newNode := func(name string, port int) *memberlist.Memberlist {
+		conf := memberlist.DefaultLocalConfig()
+		conf.Name = name
+		conf.BindAddr = "127.0.0.1"
+		conf.BindPort = port
+		conf.SecretKey = DeriveKey("s")
+		conf.LogOutput = io.Discard
+		conf.ProbeInterval = 20 * time.Millisecond
+		conf.ProbeTimeout = 10 * time.Millisecond
+		conf.SuspicionMult = 1
+		m, err := memberlist.Create(conf)
+		if nil != err {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		t.Cleanup(func() { m.Shutdown() })
+		return m
+	}
+	has := func(m *memberlist.Memberlist, name string) bool {
+		for _, n := range m.Members() {
+			if name == n.Name {
+				return true
+			}
+		}
+		return false
+	}
+	a := newNode("a", 0)
+	b := newNode("b", 0)
+	p := b.LocalNode().Address()
+	sb := captureLog(t)
+	tc := newTestClient(t, a, false)
+	want := "[Permanent] Reached permanent peer " + p
+
+	go pursuePermanentPeers(a, []string{p})
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+	waitFor(t, "b to join", func() bool { return has(a, "b") })
+
+	/* Lose it, and get it back */
+	b.Shutdown()
+	waitFor(t, "b to be lost", func() bool {
+		return strings.Contains(sb.String(), "Lost permanent peer "+p)
+	})
+	if has(a, "b") {
+		t.Fatalf("Lost b, but it's still a member")
+	}
+	newNode("b", int(b.LocalNode().Port))
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q after b came back, expected %q", l, want)
+	}
+	waitFor(t, "b to rejoin", func() bool { return has(a, "b") })
+}
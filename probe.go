@@ -0,0 +1,92 @@
+package main
+
+/*
+ * probe.go
+ * Check whether we can reach peers directly
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* probeTimeout is how long we'll wait for a probe to connect */
+const probeTimeout = 5 * time.Second
+
+/* probe is a TCP connection attempt to a peer */
+type probe struct {
+	name string /* Node name, if known */
+	addr string
+	rtt  time.Duration
+	err  error
+}
+
+/* String describes the probe's result */
+func (p probe) String() string {
+	who := p.addr
+	if "" != p.name {
+		who = fmt.Sprintf("%s (%s)", p.name, p.addr)
+	}
+	if nil != p.err {
+		return fmt.Sprintf("%s: unreachable: %v", who, p.err)
+	}
+	return fmt.Sprintf(
+		"%s: reachable in %s",
+		who,
+		p.rtt.Round(time.Microsecond),
+	)
+}
+
+/* runProbes tries to make a TCP connection to each of ps' addresses in
+parallel, independent of memberlist, and fills in the results. */
+func runProbes(ps []probe) {
+	var wg sync.WaitGroup
+	for i := range ps {
+		wg.Add(1)
+		go func(p *probe) {
+			defer wg.Done()
+			start := time.Now()
+			c, err := net.DialTimeout("tcp", p.addr, probeTimeout)
+			p.rtt = time.Since(start)
+			if nil != err {
+				p.err = err
+				return
+			}
+			c.Close()
+		}(&ps[i])
+	}
+	wg.Wait()
+}
+
+/* memberProbes returns probes for all of the members of the mesh but us */
+func memberProbes(m *memberlist.Memberlist) []probe {
+	var (
+		ps = make([]probe, 0, m.NumMembers())
+		me = m.LocalNode().Name
+	)
+	for _, n := range sortedMembers(m) {
+		if me == n.Name {
+			continue
+		}
+		ps = append(ps, probe{name: n.Name, addr: nodeAddr(n)})
+	}
+	return ps
+}
+
+// ProbeMembers probes all of the other members of the mesh and logs the
+// results.
+func ProbeMembers(m *memberlist.Memberlist) {
+	ps := memberProbes(m)
+	runProbes(ps)
+	for _, p := range ps {
+		log.Printf("Probe: %s", p)
+	}
+}
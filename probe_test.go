@@ -0,0 +1,53 @@
+package main
+
+/*
+ * probe_test.go
+ * Tests for probe.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+/* TestProbeCommand makes sure PROBE tells reachable and unreachable
+addresses apart. */
+func TestProbeCommand(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listening: %v", err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listening: %v", err)
+	}
+	down.Close()
+	sb := captureLog(t)
+	ms := newTestMesh(t, nil, "a")
+	tc := newTestClient(t, ms[0], true)
+
+	for _, c := range []struct{ addr, want string }{
+		{up.Addr().String(), ": reachable in "},
+		{down.Addr().String(), ": unreachable: "},
+	} {
+		tc.send("PROBE %s", c.addr)
+		l := tc.readLine()
+		if !strings.HasPrefix(l, c.addr+c.want) {
+			t.Errorf("Got %q, expected %q...", l, c.addr+c.want)
+		}
+		if !strings.Contains(sb.String(), "Probe: "+l) {
+			t.Errorf("Probe of %s not logged", c.addr)
+		}
+	}
+
+	/* Only addresses and members are probed */
+	tc.send("PROBE moose")
+	if l := tc.readLine(); !strings.Contains(l, "not a member or") {
+		t.Fatalf("Got %q", l)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+/*
+ * ready.go
+ * Tell orchestrators when we're ready
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* readyCheckInterval is how often we check whether we're ready */
+const readyCheckInterval = time.Second
+
+// IsReady returns true if we have at least one peer.
+func IsReady(m *memberlist.Memberlist) bool {
+	return 1 < m.NumMembers()
+}
+
+// WatchReadiness makes sure the file at path exists while we're ready and
+// doesn't exist while we're not.
+func WatchReadiness(m *memberlist.Memberlist, path string) {
+	/* Don't trust a leftover file */
+	if err := os.Remove(path); nil != err &&
+		!errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing ready file %s: %v", path, err)
+	}
+
+	var ready bool
+	for {
+		if r := IsReady(liveMesh(m)); r != ready {
+			if err := setReadyFile(path, r); nil != err {
+				log.Printf("Error updating ready file: %v", err)
+			} else if r {
+				log.Printf("Ready")
+				ready = r
+			} else {
+				log.Printf("No longer ready")
+				ready = r
+			}
+		}
+		time.Sleep(readyCheckInterval)
+	}
+}
+
+/* setReadyFile creates the file at path if ready is true, or removes it if
+ready is false. */
+func setReadyFile(path string, ready bool) error {
+	if !ready {
+		return os.Remove(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if nil != err {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,46 @@
+package main
+
+/*
+ * ready_test.go
+ * Tests for ready.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/* TestWatchReadiness makes sure the ready file comes and goes with our
+peers. */
+func TestWatchReadiness(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	path := filepath.Join(t.TempDir(), "ready")
+	if err := os.WriteFile(path, nil, 0644); nil != err {
+		t.Fatalf("Making leftover ready file: %v", err)
+	}
+	exists := func() bool {
+		_, err := os.Stat(path)
+		return nil == err
+	}
+
+	go WatchReadiness(ms[0], path)
+	waitFor(t, "ready file", exists)
+	if !IsReady(ms[0]) {
+		t.Fatalf("Not ready with a peer")
+	}
+
+	/* Lose our peer */
+	if err := ms[1].Leave(time.Second); nil != err {
+		t.Fatalf("Leaving: %v", err)
+	}
+	ms[1].Shutdown()
+	waitFor(t, "ready file removal", func() bool { return !exists() })
+	if IsReady(ms[0]) {
+		t.Fatalf("Ready without a peer")
+	}
+}
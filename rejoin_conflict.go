@@ -0,0 +1,249 @@
+package main
+
+/*
+ * rejoin_conflict.go
+ * Rejoin with a new name after repeated name conflicts
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	/* defaultConflictRejoinWindow is the default window in which
+	conflicts with our name are counted */
+	defaultConflictRejoinWindow = time.Minute
+
+	/* renameEntropy is the number of random bytes added to our name when
+	we rejoin after conflicts */
+	renameEntropy = 4
+)
+
+/* meshCreator makes a node from a config. */
+type meshCreator func(*memberlist.Config) (*memberlist.Memberlist, error)
+
+var (
+	/* conflictRejoinAfter is the number of conflicts with our name within
+	conflictRejoinWindow after which we leave and rejoin with a new name,
+	or 0 to never do so. */
+	conflictRejoinAfter  int
+	conflictRejoinWindow = defaultConflictRejoinWindow
+
+	/* conflictTimes are when the conflicts with our name within the last
+	conflictRejoinWindow happened, oldest first.  conflictMesh is the
+	mesh to leave, set with RejoinOnConflicts along with conflictConf and
+	conflictCreate, which are used by replaceMesh to make its
+	replacement.
+	conflictBaseName is the name we had before any renaming and
+	conflictRenamed the name we've most recently taken, if any.
+	conflictRejoining is set while we're rejoining.  All of them are
+	protected by conflictL. */
+	conflictTimes     []time.Time
+	conflictMesh      *memberlist.Memberlist
+	conflictConf      *memberlist.Config
+	conflictCreate    meshCreator
+	conflictBaseName  string
+	conflictRenamed   string
+	conflictRejoining bool
+	conflictL         sync.Mutex
+
+	/* replacedMeshes maps meshes we've left to the meshes we rejoined
+	as, for liveMesh. */
+	replacedMeshes = make(
+		map[*memberlist.Memberlist]*memberlist.Memberlist,
+	)
+	replacedMeshesL sync.Mutex
+
+	/* replaceL makes replaceMesh replace one node at a time */
+	replaceL sync.Mutex
+)
+
+// RejoinOnConflicts causes us to leave m and rejoin with a new name after
+// conflictRejoinAfter conflicts with our name within conflictRejoinWindow.
+// The new node is made by calling create with a copy of m's config, conf,
+// with the new name.  m, conf, and create are also used to replace m when it
+// needs to advertise a new address.
+func RejoinOnConflicts(
+	m *memberlist.Memberlist,
+	conf *memberlist.Config,
+	create meshCreator,
+) {
+	conflictL.Lock()
+	defer conflictL.Unlock()
+	conflictMesh = m
+	conflictConf = conf
+	conflictCreate = create
+}
+
+/* liveMesh returns the mesh we rejoined as after leaving m, e.g. because of
+name conflicts, or m if we haven't left it.  Anything which holds on to a mesh
+for a while should use liveMesh to get the one to use. */
+func liveMesh(m *memberlist.Memberlist) *memberlist.Memberlist {
+	replacedMeshesL.Lock()
+	defer replacedMeshesL.Unlock()
+	for {
+		r, ok := replacedMeshes[m]
+		if !ok {
+			return m
+		}
+		m = r
+	}
+}
+
+/* renamedName returns the name we've most recently taken after name
+conflicts, or the empty string if we've not been renamed. */
+func renamedName() string {
+	conflictL.Lock()
+	defer conflictL.Unlock()
+	return conflictRenamed
+}
+
+/* noteSelfConflict notes that another node's tried to use our name and, if
+that's happened often enough recently, starts a rejoin with a new name. */
+func noteSelfConflict(name string) {
+	conflictL.Lock()
+	defer conflictL.Unlock()
+	if 0 == conflictRejoinAfter ||
+		nil == conflictMesh ||
+		conflictRejoining {
+		return
+	}
+
+	/* Forget about conflicts outside of the window */
+	now := time.Now()
+	var i int
+	for ; i < len(conflictTimes); i++ {
+		if now.Sub(conflictTimes[i]) <= conflictRejoinWindow {
+			break
+		}
+	}
+	conflictTimes = append(conflictTimes[i:], now)
+	if len(conflictTimes) < conflictRejoinAfter {
+		return
+	}
+
+	/* Too many, time for a new name.  This is called by memberlist with
+	locks held, so we can't leave from here. */
+	conflictRejoining = true
+	if "" == conflictBaseName {
+		conflictBaseName = name
+	}
+	go rejoinWithNewName(conflictBaseName, len(conflictTimes))
+}
+
+/* rejoinWithNewName replaces our node with one with a new name, made from
+base and a random suffix.  n is the number of conflicts which led to the new
+name. */
+func rejoinWithNewName(base string, n int) {
+	/* Work out the new name */
+	b := make([]byte, renameEntropy)
+	if _, err := crand.Read(b); nil != err {
+		log.Printf("Error generating new name: %v", err)
+		conflictL.Lock()
+		conflictRejoining = false
+		conflictL.Unlock()
+		return
+	}
+	newName := base + "-" + hex.EncodeToString(b)
+
+	/* Leave and come back */
+	broadcastAndLogf(
+		eventNotice,
+		nil,
+		"[Renaming] %d name conflicts within %s, rejoining as %s",
+		n,
+		conflictRejoinWindow,
+		newName,
+	)
+	replaceMesh(func(nc *memberlist.Config) {
+		nc.Name = newName
+		nc.Conflict = ConflictHandler{ourName: newName}
+		if jt, ok := nc.Alive.(*JoinThrottle); ok {
+			jt.setOurName(newName)
+		}
+		conflictL.Lock()
+		conflictRenamed = newName
+		conflictL.Unlock()
+	})
+	conflictL.Lock()
+	conflictTimes = nil
+	conflictRejoining = false
+	conflictL.Unlock()
+}
+
+/* replaceMesh leaves the mesh set with RejoinOnConflicts and, without
+stopping anything else, makes a new node from a copy of its config, changed by
+change, and rejoins the peers the old node knew about.  Anything using the old
+node should get the new one via liveMesh.  If the new node can't be made, we
+exit. */
+func replaceMesh(change func(*memberlist.Config)) {
+	replaceL.Lock()
+	defer replaceL.Unlock()
+	conflictL.Lock()
+	m, conf, create := conflictMesh, conflictConf, conflictCreate
+	conflictL.Unlock()
+	if nil == m {
+		log.Printf("No node to replace")
+		return
+	}
+
+	/* Note who to rejoin */
+	var peers []string
+	for _, p := range m.Members() {
+		if p.Name != m.LocalNode().Name {
+			peers = append(peers, nodeAddr(p))
+		}
+	}
+
+	/* Leave and come back */
+	log.Printf("Leaving mesh")
+	if err := m.Leave(leaveTimeout); nil != err {
+		log.Printf("Error leaving mesh: %v", err)
+	}
+	if err := m.Shutdown(); nil != err {
+		log.Printf("Error shutting down mesh listeners: %v", err)
+	}
+	nc := *conf
+	nc.Transport = nil /* Shut down with m */
+	change(&nc)
+	nm, err := create(&nc)
+	if nil != err {
+		fatalf(exitMesh, "Error rejoining as %s: %v", nc.Name, err)
+	}
+	log.Printf("This node: %s", FormatNode(nm.LocalNode()))
+
+	/* Everything using m should now use nm */
+	replacedMeshesL.Lock()
+	replacedMeshes[m] = nm
+	replacedMeshesL.Unlock()
+	sizeMeshL.Lock()
+	if m == sizeMesh {
+		sizeMesh = nm
+	}
+	sizeMeshL.Unlock()
+	noteNewNode(nm.LocalNode())
+	conflictL.Lock()
+	conflictMesh = nm
+	conflictConf = &nc
+	conflictL.Unlock()
+
+	/* Find our friends again */
+	if 0 == len(peers) {
+		return
+	}
+	if n, err := connectToPeers(nm, strings.Join(peers, ",")); nil != err {
+		log.Printf("Error rejoining mesh: %v", err)
+	} else {
+		log.Printf("Rejoined mesh via %d peers", n)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+/*
+ * rejoin_conflict_test.go
+ * Tests for rejoin_conflict.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestRejoinWithNewName makes sure repeated conflicts with our name cause us
+to rejoin the mesh under a new name, without losing our clients. */
+func TestRejoinWithNewName(t *testing.T) {
+	const after = 3
+	rc := runningConfig
+	t.Cleanup(func() {
+		conflictL.Lock()
+		defer conflictL.Unlock()
+		conflictRejoinAfter = 0
+		conflictTimes = nil
+		conflictMesh = nil
+		conflictConf = nil
+		conflictCreate = nil
+		conflictBaseName = ""
+		conflictRenamed = ""
+		conflictRejoining = false
+		runningConfig = rc
+	})
+	captureLog(t)
+
+	/* Two nodes, one of which will have a name conflict */
+	mn := new(memberlist.MockNetwork)
+	nt := mn.NewTransport("renamed") /* Can't add them once running */
+	var aConf *memberlist.Config
+	ms := newTestMeshOn(t, mn, func(conf *memberlist.Config) {
+		if "a" == conf.Name {
+			conf.Conflict = ConflictHandler{ourName: conf.Name}
+			aConf = conf
+		}
+	}, "a", "b")
+	conflictRejoinAfter = after
+	RejoinOnConflicts(ms[0], aConf, func(
+		conf *memberlist.Config,
+	) (*memberlist.Memberlist, error) {
+		conf.Transport = nt
+		m, err := memberlist.Create(conf)
+		if nil == err {
+			t.Cleanup(func() { m.Shutdown() })
+		}
+		return m, err
+	})
+	tc := newTestClient(t, ms[0], false)
+
+	/* Not quite enough conflicts */
+	existing := ms[0].LocalNode()
+	other := &memberlist.Node{Name: "a", Addr: existing.Addr, Port: 1}
+	for range after - 1 {
+		aConf.Conflict.NotifyConflict(existing, other)
+	}
+	if m := liveMesh(ms[0]); ms[0] != m {
+		t.Fatalf("Rejoined after %d conflicts", after-1)
+	}
+
+	/* One more should do it */
+	aConf.Conflict.NotifyConflict(existing, other)
+	tc.readUntil("[Renaming] 3 name conflicts")
+	var nm *memberlist.Memberlist
+	waitFor(t, "new node", func() bool {
+		nm = liveMesh(ms[0])
+		return ms[0] != nm
+	})
+	name := nm.LocalNode().Name
+	if !strings.HasPrefix(name, "a-") || len("a-") == len(name) {
+		t.Fatalf("Rejoined as %q", name)
+	}
+	waitFor(t, "b to see the new name", func() bool {
+		var got []string
+		for _, n := range ms[1].Members() {
+			got = append(got, n.Name)
+		}
+		return 2 == len(got) && strings.Contains(
+			strings.Join(got, " "),
+			name,
+		)
+	})
+
+	/* Our client should now be talking to the new node */
+	tc.send("CSV")
+	tc.readUntil("name,addr,port,meta")
+	if l := tc.readLine(); !strings.HasPrefix(l, name+",") {
+		t.Fatalf("Got %q, expected the new name %s", l, name)
+	}
+	runningConfigL.Lock()
+	defer runningConfigL.Unlock()
+	if name != runningConfig.Name {
+		t.Fatalf("CONFIG has name %q", runningConfig.Name)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+/*
+ * reuseport_other.go
+ * Stub for platforms without SO_REUSEPORT
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"errors"
+	"syscall"
+)
+
+/* setReuseport returns an error, as SO_REUSEPORT isn't supported on this
+platform. */
+func setReuseport(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
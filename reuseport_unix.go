@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+/*
+ * reuseport_unix.go
+ * Set SO_REUSEPORT on Unixy platforms
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+/* setReuseport sets SO_REUSEPORT on c.  It is a net.ListenConfig Control
+function. */
+func setReuseport(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(
+			int(fd),
+			unix.SOL_SOCKET,
+			unix.SO_REUSEPORT,
+			1,
+		)
+	}); nil != err {
+		return err
+	}
+	return serr
+}
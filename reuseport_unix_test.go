@@ -0,0 +1,44 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+/*
+ * reuseport_unix_test.go
+ * Tests for reuseport_unix.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+)
+
+/* TestReuseportTransport makes sure two transports may bind the same port */
+func TestReuseportTransport(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	a, err := NewReuseportTransport("127.0.0.1", 0, l)
+	if nil != err {
+		t.Fatalf("First bind: %v", err)
+	}
+	defer a.Shutdown()
+	port := a.tcpL.Addr().(*net.TCPAddr).Port
+	b, err := NewReuseportTransport("127.0.0.1", port, l)
+	if nil != err {
+		t.Fatalf("Second bind to port %d: %v", port, err)
+	}
+	defer b.Shutdown()
+
+	/* Without SO_REUSEPORT, it shouldn't work */
+	if l, err := net.Listen(
+		"tcp",
+		net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+	); nil == err {
+		l.Close()
+		t.Fatalf("Bound port %d without SO_REUSEPORT", port)
+	}
+}
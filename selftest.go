@@ -0,0 +1,215 @@
+package main
+
+/*
+ * selftest.go
+ * Make sure we work on this host
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* selfTestTimeout is how long we'll wait for each self-test step */
+const selfTestTimeout = 10 * time.Second
+
+/* selfTest holds the state of a self-test */
+type selfTest struct {
+	a, b *memberlist.Memberlist
+	dir  string /* Temporary directory, for the socket */
+	sock string
+}
+
+// RunSelfTest starts a throwaway two-node mesh on loopback, makes sure the
+// nodes can see each other and that a client can connect, and prints the
+// results.  No real peers or external services are contacted.  RunSelfTest
+// returns the exit code to use.
+func RunSelfTest() int {
+	/* Only the summary is interesting */
+	log.SetOutput(io.Discard)
+
+	var st selfTest
+	defer st.cleanup()
+	for _, step := range []struct {
+		name string
+		f    func() error
+	}{
+		{"Start two nodes on loopback", st.startNodes},
+		{"Join the nodes", st.join},
+		{"Wait for the nodes to see each other", st.converge},
+		{"Listen for local clients", st.listen},
+		{"Connect a client", st.connect},
+	} {
+		if err := step.f(); nil != err {
+			fmt.Printf("FAIL: %s: %v\n", step.name, err)
+			return exitGeneral
+		}
+		fmt.Printf("PASS: %s\n", step.name)
+	}
+	fmt.Printf("Self-test passed\n")
+	return 0
+}
+
+/* startNodes starts st.a and st.b, sharing a random secret */
+func (st *selfTest) startNodes() error {
+	secret, err := newUUID()
+	if nil != err {
+		return fmt.Errorf("generating secret: %w", err)
+	}
+	if st.a, err = st.newNode("selftest-a", secret); nil != err {
+		return err
+	}
+	st.b, err = st.newNode("selftest-b", secret)
+	return err
+}
+
+/* newNode starts a node listening on a random loopback port. */
+func (st *selfTest) newNode(
+	name string,
+	secret string,
+) (*memberlist.Memberlist, error) {
+	id, err := newUUID()
+	if nil != err {
+		return nil, fmt.Errorf("generating ID: %w", err)
+	}
+	return newThrowawayNode(name, secret, id, nil, nil)
+}
+
+/* throwawayConfig returns the config for a throwaway node, e.g. for the
+self-test, named name with the node ID id, which encrypts with secret and
+doesn't log.  If tr is nil, the node listens on a random loopback port. */
+func throwawayConfig(
+	name string,
+	secret string,
+	id string,
+	tr memberlist.Transport,
+) *memberlist.Config {
+	conf := memberlist.DefaultLocalConfig()
+	conf.Name = name
+	conf.BindAddr = "127.0.0.1"
+	conf.BindPort = 0
+	conf.AdvertisePort = 0
+	conf.SecretKey = DeriveKey(secret)
+	conf.Delegate = NewDelegate(NodeMeta{ID: id})
+	conf.LogOutput = io.Discard
+	conf.Transport = tr
+	return conf
+}
+
+/* newThrowawayNode creates a node with the config from throwawayConfig.  If
+confs isn't nil, it's called with the config before the node's created. */
+func newThrowawayNode(
+	name string,
+	secret string,
+	id string,
+	tr memberlist.Transport,
+	confs func(*memberlist.Config),
+) (*memberlist.Memberlist, error) {
+	conf := throwawayConfig(name, secret, id, tr)
+	if nil != confs {
+		confs(conf)
+	}
+	m, err := memberlist.Create(conf)
+	if nil != err {
+		return nil, fmt.Errorf("creating %s: %w", name, err)
+	}
+	return m, nil
+}
+
+/* join joins st.b to st.a */
+func (st *selfTest) join() error {
+	_, err := st.b.Join([]string{st.a.LocalNode().Address()})
+	return err
+}
+
+/* converge waits for both nodes to see both nodes */
+func (st *selfTest) converge() error {
+	for start := time.Now(); time.Since(start) < selfTestTimeout; {
+		if 2 == st.a.NumMembers() && 2 == st.b.NumMembers() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf(
+		"nodes see %d and %d members after %s",
+		st.a.NumMembers(),
+		st.b.NumMembers(),
+		selfTestTimeout,
+	)
+}
+
+/* listen listens for clients on a socket in a temporary directory */
+func (st *selfTest) listen() error {
+	var err error
+	if st.dir, err = os.MkdirTemp("", "meshmembers-selftest"); nil != err {
+		return fmt.Errorf("making temporary directory: %w", err)
+	}
+	st.sock = filepath.Join(st.dir, "sock")
+	ul, err := ListenUnix(st.sock)
+	if nil != err {
+		return err
+	}
+	serveClients(ul, clientOpts{snapshot: true}, st.a)
+	return nil
+}
+
+/* connect connects to the socket and checks the banner, member list, and a
+command. */
+func (st *selfTest) connect() error {
+	c, err := net.DialTimeout("unix", st.sock, selfTestTimeout)
+	if nil != err {
+		return err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(selfTestTimeout)); nil != err {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+	if _, err := fmt.Fprintf(c, "PROTO\n"); nil != err {
+		return fmt.Errorf("sending command: %w", err)
+	}
+
+	/* Make sure we get what we expect */
+	br := bufio.NewReader(c)
+	for _, want := range []string{
+		fmt.Sprintf("MESHMEMBERS %d", maxProtoVersion),
+		"Current nodes in mesh: 2",
+		"", /* Member */
+		"", /* Member */
+		fmt.Sprintf("PROTO %d", defaultProtoVersion),
+	} {
+		l, err := br.ReadString('\n')
+		if nil != err {
+			return fmt.Errorf("reading from socket: %w", err)
+		}
+		l = strings.TrimSpace(l)
+		if "" != want && want != l {
+			return fmt.Errorf("got %q, expected %q", l, want)
+		}
+	}
+	return nil
+}
+
+/* cleanup stops everything started by the self-test */
+func (st *selfTest) cleanup() {
+	CloseListeners()
+	for _, m := range []*memberlist.Memberlist{st.b, st.a} {
+		if nil != m {
+			m.Shutdown()
+		}
+	}
+	if "" != st.dir {
+		os.RemoveAll(st.dir)
+	}
+}
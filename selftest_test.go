@@ -0,0 +1,109 @@
+package main
+
+/*
+ * selftest_test.go
+ * Tests for selftest.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestSelfTest makes sure the self-test passes. */
+func TestSelfTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts nodes")
+	}
+	code, out := runMain(t, "-selftest")
+	if 0 != code {
+		t.Errorf("Exit code %d\n%s", code, out)
+	}
+	if strings.Contains(out, "FAIL") ||
+		5 != strings.Count(out, "PASS: ") ||
+		!strings.HasSuffix(out, "Self-test passed\n") {
+		t.Errorf("Unexpected output\n%s", out)
+	}
+}
+
+/* Example_inMemoryMesh starts two nodes connected by memberlist's in-memory
+transport, no sockets required, and watches them see each other come and go. */
+func Example_inMemoryMesh() {
+	mn := new(memberlist.MockNetwork)
+	var (
+		ms  []*memberlist.Memberlist
+		chs []chan timedEvent
+	)
+	for _, name := range []string{"a", "b"} {
+		ch := make(chan timedEvent, 16)
+		conf := newTestConfig(mn, name, "example")
+		conf.Events = TimedEventDelegate{Ch: ch}
+		m, err := memberlist.Create(conf)
+		if nil != err {
+			fmt.Printf("Error creating %s: %v\n", name, err)
+			return
+		}
+		defer m.Shutdown()
+		ms = append(ms, m)
+		chs = append(chs, ch)
+	}
+
+	/* Wait for an event about a node */
+	waitForEvent := func(
+		i int,
+		et memberlist.NodeEventType,
+		name string,
+	) {
+		what := map[memberlist.NodeEventType]string{
+			memberlist.NodeJoin:  "join",
+			memberlist.NodeLeave: "leave",
+		}[et]
+		for {
+			select {
+			case te := <-chs[i]:
+				if et != te.Event || name != te.Node.Name {
+					continue
+				}
+				fmt.Printf(
+					"%s saw %s %s\n",
+					ms[i].LocalNode().Name,
+					name,
+					what,
+				)
+				return
+			case <-time.After(testTimeout):
+				fmt.Printf("Timed out waiting for %s\n", what)
+				return
+			}
+		}
+	}
+
+	/* Say hello */
+	if _, err := ms[1].Join(
+		[]string{ms[0].LocalNode().Address()},
+	); nil != err {
+		fmt.Printf("Error joining: %v\n", err)
+		return
+	}
+	waitForEvent(0, memberlist.NodeJoin, "b")
+	waitForEvent(1, memberlist.NodeJoin, "a")
+
+	/* Say goodbye */
+	if err := ms[1].Leave(time.Second); nil != err {
+		fmt.Printf("Error leaving: %v\n", err)
+		return
+	}
+	waitForEvent(0, memberlist.NodeLeave, "b")
+
+	// Output:
+	// a saw b join
+	// b saw a join
+	// a saw b leave
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+ * tcpclient.go
+ * Handle clients connecting via TCP
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* negotiateTimeout is how long we'll wait for a TCP client's encoding byte */
+const negotiateTimeout = 10 * time.Second
+
+/* Encoding bytes sent by TCP clients when negotiating */
+const (
+	encodingText byte = 0
+	encodingGzip byte = 1
+	encodingJSON byte = 2
+)
+
+// ListenTCPClients listens for and handles clients connecting to addr via
+// TCP.  TCP clients may not use admin commands.  If negotiate is true, each
+// client's first byte sets how it'll be sent data.  If allow isn't empty,
+// clients from addresses outside of allow are disconnected right away.
+func ListenTCPClients(
+	addr string,
+	negotiate bool,
+	allow []netip.Prefix,
+	m *memberlist.Memberlist,
+) {
+	l, err := net.Listen("tcp", addr)
+	if nil != err {
+		fatalf(exitSocket, "Unable to listen on %s: %s", addr, err)
+	}
+	log.Printf("Listening for TCP clients on %s", l.Addr())
+	serveClients(l, clientOpts{
+		snapshot:  true,
+		negotiate: negotiate,
+		allow:     allow,
+	}, m)
+}
+
+/* parseCIDRList parses the CIDR ranges in s, which should be separated by
+commas or whitespace. */
+func parseCIDRList(s string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, r := range parsePeerList(s) {
+		p, err := netip.ParsePrefix(r)
+		if nil != err {
+			return nil, fmt.Errorf("invalid CIDR range %q", r)
+		}
+		ps = append(ps, p.Masked())
+	}
+	return ps, nil
+}
+
+/* clientAllowed returns true if allow is empty or c's remote address is in
+one of the ranges in allow.  Clients without an IP address, e.g. on Unix
+sockets, are only allowed if allow is empty. */
+func clientAllowed(c net.Conn, allow []netip.Prefix) bool {
+	if 0 == len(allow) {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if nil != err {
+		return false
+	}
+	a := ap.Addr().Unmap()
+	for _, p := range allow {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+/* negotiateEncoding reads a single byte from c which indicates how the client
+wants to be sent data.  It returns c, possibly wrapped, and the format in which
+the client should be sent events. */
+func negotiateEncoding(c net.Conn) (net.Conn, clientFormat, error) {
+	/* Get the byte */
+	if err := c.SetReadDeadline(
+		time.Now().Add(negotiateTimeout),
+	); nil != err {
+		return nil, "", fmt.Errorf("setting deadline: %w", err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(c, b[:]); nil != err {
+		return nil, "", fmt.Errorf("reading encoding byte: %w", err)
+	}
+	if err := c.SetReadDeadline(time.Time{}); nil != err {
+		return nil, "", fmt.Errorf("clearing deadline: %w", err)
+	}
+
+	/* Work out what it means */
+	switch b[0] {
+	case encodingText:
+		return c, formatText, nil
+	case encodingGzip:
+		gc := &gzipConn{Conn: c, gz: gzip.NewWriter(c)}
+		return gc, formatText, nil
+	case encodingJSON:
+		return c, formatJSON, nil
+	default:
+		fmt.Fprintf(c, "Unknown encoding byte 0x%02x\n", b[0])
+		return nil, "", fmt.Errorf("unknown encoding byte 0x%02x", b[0])
+	}
+}
+
+/* gzipConn is a net.Conn which gzips everything written to it.  Reads aren't
+decompressed.  Each write is flushed, so the client gets it right away. */
+type gzipConn struct {
+	net.Conn
+	gz  *gzip.Writer
+	gzL sync.Mutex
+}
+
+/* Write compresses b, writes it to the underlying Conn, and flushes. */
+func (g *gzipConn) Write(b []byte) (int, error) {
+	g.gzL.Lock()
+	defer g.gzL.Unlock()
+	n, err := g.gz.Write(b)
+	if nil != err {
+		return n, err
+	}
+	return n, g.gz.Flush()
+}
+
+/* Close finishes the gzip stream, if nothing's being written, and closes the
+underlying Conn. */
+func (g *gzipConn) Close() error {
+	if g.gzL.TryLock() {
+		g.gz.Close()
+		g.gzL.Unlock()
+	}
+	return g.Conn.Close()
+}
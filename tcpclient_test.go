@@ -0,0 +1,153 @@
+package main
+
+/*
+ * tcpclient_test.go
+ * Tests for tcpclient.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+/* TestNegotiateEncoding makes sure each encoding byte gets the right
+encoding. */
+func TestNegotiateEncoding(t *testing.T) {
+	for _, c := range []struct {
+		b     byte
+		gzip  bool
+		wantF clientFormat
+	}{
+		{encodingText, false, formatText},
+		{encodingGzip, true, formatText},
+		{encodingJSON, false, formatJSON},
+	} {
+		ours, theirs := net.Pipe()
+		defer theirs.Close()
+		go theirs.Write([]byte{c.b})
+		nc, f, err := negotiateEncoding(ours)
+		if nil != err {
+			t.Fatalf("Byte %d: %v", c.b, err)
+		}
+		if c.wantF != f {
+			t.Errorf("Byte %d: format %s", c.b, f)
+		}
+
+		/* Make sure it's encoded as it should be */
+		go func() {
+			nc.Write([]byte("kittens\n"))
+			nc.Close()
+		}()
+		var r io.Reader = theirs
+		if c.gzip {
+			gr, err := gzip.NewReader(theirs)
+			if nil != err {
+				t.Fatalf("Byte %d: starting gzip: %v", c.b, err)
+			}
+			r = gr
+		}
+		l, err := bufio.NewReader(r).ReadString('\n')
+		if nil != err {
+			t.Fatalf("Byte %d: reading: %v", c.b, err)
+		}
+		if "kittens\n" != l {
+			t.Errorf("Byte %d: got %q", c.b, l)
+		}
+	}
+
+	/* Unknown bytes get an error */
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	go theirs.Write([]byte{3})
+	go io.Copy(io.Discard, theirs)
+	if _, _, err := negotiateEncoding(ours); nil == err {
+		t.Fatalf("Unknown byte accepted")
+	}
+}
+
+/* remoteAddrConn is a net.Conn with a settable remote address */
+type remoteAddrConn struct {
+	net.Conn
+	raddr net.Addr
+}
+
+/* RemoteAddr returns rac.raddr */
+func (rac remoteAddrConn) RemoteAddr() net.Addr { return rac.raddr }
+
+/* TestClientAllowCIDR makes sure -client-allow-cidr lets in clients from
+allowed addresses and disconnects everybody else before sending anything. */
+func TestClientAllowCIDR(t *testing.T) {
+	allow, err := parseCIDRList(
+		"192.0.2.0/24, 2001:db8::/32\n127.0.0.1/32",
+	)
+	if nil != err {
+		t.Fatalf("Parsing ranges: %v", err)
+	}
+	if _, err := parseCIDRList("192.0.2.0/24,moose"); nil == err {
+		t.Fatalf("Parsed an invalid range")
+	}
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1}
+	}
+	for _, c := range []struct {
+		addr net.Addr
+		want bool
+	}{
+		{tcp("192.0.2.7"), true},
+		{tcp("::ffff:192.0.2.7"), true},
+		{tcp("2001:db8::7"), true},
+		{tcp("198.51.100.7"), false},
+		{tcp("127.0.0.2"), false},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+	} {
+		rac := remoteAddrConn{raddr: c.addr}
+		if got := clientAllowed(rac, allow); c.want != got {
+			t.Errorf("%s: allowed %t", c.addr, got)
+		}
+		if !clientAllowed(rac, nil) {
+			t.Errorf("%s: not allowed without ranges", c.addr)
+		}
+	}
+
+	/* Real clients get a greeting if they're allowed and nothing if
+	they're not */
+	greeting := func(allow []netip.Prefix) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			t.Fatalf("Listening: %v", err)
+		}
+		defer closeListener(l)
+		serveClients(l, clientOpts{allow: allow}, nil)
+		c, err := net.Dial("tcp", l.Addr().String())
+		if nil != err {
+			t.Fatalf("Connecting: %v", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(testTimeout))
+		b, err := io.ReadAll(io.LimitReader(c, 14))
+		if nil != err {
+			t.Fatalf("Reading: %v", err)
+		}
+		return string(b)
+	}
+	captureLog(t)
+	ok, err := parseCIDRList("127.0.0.0/8")
+	if nil != err {
+		t.Fatalf("Parsing loopback range: %v", err)
+	}
+	if g := greeting(ok); "MESHMEMBERS 1\n" != g {
+		t.Fatalf("Allowed client got %q", g)
+	}
+	waitFor(t, "client removal", func() bool { return 0 == countClients() })
+	if g := greeting(allow[:1]); "" != g {
+		t.Fatalf("Disallowed client got %q", g)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+/*
+ * throttle.go
+ * Limit the rate at which new nodes join
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* errThrottled is returned by JoinThrottle.NotifyAlive when there's been too
+many joins lately */
+var errThrottled = errors.New("too many recent joins")
+
+/* localThrottle is our own node's JoinThrottle, or nil if we're not
+throttling joins.  Nodes are forgotten by it when they leave or are
+FORGOTten. */
+var localThrottle *JoinThrottle
+
+// JoinThrottle limits how quickly new nodes may join the mesh, using a token
+// bucket which holds up to n tokens and gains n more every per.  Alive
+// messages for nodes we don't yet know about are ignored when the bucket is
+// empty; as memberlist keeps gossiping about them, they'll be let in once
+// the rate drops.  It implements memberlist.AliveDelegate.
+type JoinThrottle struct {
+	n       int
+	per     time.Duration
+	tokens  float64
+	last    time.Time
+	ourName string
+
+	/* known holds the nodes we've let in, which aren't throttled, and
+	throttled the ones we've told clients have been throttled */
+	known     map[string]bool
+	throttled map[string]bool
+
+	l sync.Mutex
+}
+
+// NewJoinThrottle returns a JoinThrottle which lets in up to n new nodes
+// every per.  Alive messages about ourName are never throttled.
+func NewJoinThrottle(ourName string, n int, per time.Duration) *JoinThrottle {
+	return &JoinThrottle{
+		n:         n,
+		per:       per,
+		tokens:    float64(n),
+		last:      time.Now(),
+		ourName:   ourName,
+		known:     make(map[string]bool),
+		throttled: make(map[string]bool),
+	}
+}
+
+/* setOurName changes the name of the node whose alive messages are never
+throttled, after we've been renamed. */
+func (t *JoinThrottle) setOurName(name string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.ourName = name
+}
+
+/* forget removes what t knows about the named node, so it counts as new if
+it comes back.  It's a no-op if t is nil. */
+func (t *JoinThrottle) forget(name string) {
+	if nil == t {
+		return
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	delete(t.known, name)
+	delete(t.throttled, name)
+}
+
+// NotifyAlive returns an error if peer is new to us and we've let in too many
+// new nodes recently.  This is called by memberlist with its node lock held,
+// so it mustn't call back into memberlist.
+func (t *JoinThrottle) NotifyAlive(peer *memberlist.Node) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	/* Nodes we already know about can do what they like */
+	if t.ourName == peer.Name || t.known[peer.Name] {
+		return nil
+	}
+
+	/* Top up the bucket */
+	now := time.Now()
+	t.tokens += float64(t.n) * float64(now.Sub(t.last)) / float64(t.per)
+	if float64(t.n) < t.tokens {
+		t.tokens = float64(t.n)
+	}
+	t.last = now
+
+	/* If we've room, let it in */
+	if 1 <= t.tokens {
+		t.tokens--
+		t.known[peer.Name] = true
+		delete(t.throttled, peer.Name)
+		return nil
+	}
+
+	/* Only tell clients the first time, as memberlist will keep trying */
+	if !t.throttled[peer.Name] {
+		t.throttled[peer.Name] = true
+		go broadcastAndLogf(
+			eventNotice,
+			peer,
+			"[Throttled] %s",
+			FormatNode(peer),
+		)
+	}
+	return errThrottled
+}
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * throttle_test.go
+ * Tests for throttle.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestJoinThrottle makes sure only so many new nodes are let in, that known
+nodes are always let in, and that clients are told about throttling once. */
+func TestJoinThrottle(t *testing.T) {
+	jt := NewJoinThrottle("us", 2, time.Hour)
+	tc := newTestClient(t, nil, false)
+	alive := func(name string) error {
+		return jt.NotifyAlive(&memberlist.Node{Name: name})
+	}
+
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{
+		{"us", true},
+		{"a", true},
+		{"b", true},
+		{"c", false},
+		{"a", true},
+		{"c", false},
+		{"d", false},
+		{"us", true},
+	} {
+		if err := alive(c.name); c.ok != (nil == err) {
+			t.Fatalf("%s: error %v", c.name, err)
+		}
+	}
+	got := sortedLines(tc, 2)
+	for i, want := range []string{"[Throttled] c (", "[Throttled] d ("} {
+		if !strings.HasPrefix(got[i], want) {
+			t.Fatalf("Got %q, expected %q...", got[i], want)
+		}
+	}
+
+	/* Tokens come back with time */
+	jt = NewJoinThrottle("us", 1, 100*time.Millisecond)
+	if err := alive("a"); nil != err {
+		t.Fatalf("First join throttled: %v", err)
+	}
+	if err := alive("b"); nil == err {
+		t.Fatalf("Second join not throttled")
+	}
+	tc.readLine()
+	time.Sleep(150 * time.Millisecond)
+	if err := alive("b"); nil != err {
+		t.Fatalf("Join throttled after waiting: %v", err)
+	}
+}
+
+/* TestJoinThrottleForget makes sure nodes which leave or are forgotten are
+forgotten by the throttle, but we're never throttled. */
+func TestJoinThrottleForget(t *testing.T) {
+	localThrottle = NewJoinThrottle("us", 1, time.Hour)
+	t.Cleanup(func() { localThrottle = nil })
+	captureLog(t)
+	alive := func(name string) error {
+		return localThrottle.NotifyAlive(&memberlist.Node{Name: name})
+	}
+	sizes := func() (int, int) {
+		localThrottle.l.Lock()
+		defer localThrottle.l.Unlock()
+		return len(localThrottle.known), len(localThrottle.throttled)
+	}
+
+	if err := alive("a"); nil != err {
+		t.Fatalf("First join throttled: %v", err)
+	}
+	if err := alive("b"); nil == err {
+		t.Fatalf("Second join not throttled")
+	}
+	if k, th := sizes(); 1 != k || 1 != th {
+		t.Fatalf("Knows %d and throttled %d, expected 1 and 1", k, th)
+	}
+
+	/* Leaving and forgetting clear things out */
+	nech := make(chan timedEvent, 1)
+	TimedEventDelegate{Ch: nech}.NotifyLeave(&memberlist.Node{Name: "b"})
+	forgetNode("a")
+	if k, th := sizes(); 0 != k || 0 != th {
+		t.Fatalf("Still knows %d and throttled %d", k, th)
+	}
+
+	/* Forgotten nodes are new again, but we're not */
+	if err := alive("a"); nil == err {
+		t.Fatalf("Forgotten node not throttled")
+	}
+	forgetNode("us")
+	if err := alive("us"); nil != err {
+		t.Fatalf("We were throttled: %v", err)
+	}
+}
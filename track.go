@@ -0,0 +1,198 @@
+package main
+
+/*
+ * track.go
+ * Keep track of what we've seen happen to nodes
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* defaultConvergeQuiet is the default for convergeQuiet */
+const defaultConvergeQuiet = 30 * time.Second
+
+var (
+	/* convergeQuiet is how long the mesh needs to have gone without
+	membership changes for us to call it converged. */
+	convergeQuiet = defaultConvergeQuiet
+
+	/* firstSeen holds when we first saw each current member join, by
+	name.  This is only what this node's seen; other nodes may well have
+	seen nodes join at different times. */
+	firstSeen  = make(map[string]time.Time)
+	firstSeenL sync.Mutex
+
+	/* lastChanged holds when each current member last joined or was
+	updated, by name.  It's protected by firstSeenL. */
+	lastChanged = make(map[string]time.Time)
+
+	/* lastEvent and lastEventAt are the most recent event we got from
+	memberlist and when we got it */
+	lastEvent   memberlist.NodeEventType
+	lastEventAt time.Time
+	lastEventL  sync.Mutex
+
+	/* tombstoneTTL is how long we remember nodes which have left the
+	mesh, or 0 to forget them immediately. */
+	tombstoneTTL time.Duration
+
+	/* tombstones holds recently-departed nodes, by name */
+	tombstones  = make(map[string]Tombstone)
+	tombstonesL sync.Mutex
+)
+
+// Tombstone is a node which left the mesh recently.
+type Tombstone struct {
+	Node *memberlist.Node
+	Left time.Time
+}
+
+/* trackEvent updates our records of what's happened in the mesh.  Events
+should be tracked in the order memberlist sends them. */
+func trackEvent(ne memberlist.NodeEvent) {
+	lastEventL.Lock()
+	lastEvent, lastEventAt = ne.Event, time.Now()
+	lastEventL.Unlock()
+
+	firstSeenL.Lock()
+	defer firstSeenL.Unlock()
+	switch ne.Event {
+	case memberlist.NodeJoin:
+		if _, ok := firstSeen[ne.Node.Name]; !ok {
+			firstSeen[ne.Node.Name] = time.Now()
+		}
+		lastChanged[ne.Node.Name] = time.Now()
+	case memberlist.NodeUpdate:
+		lastChanged[ne.Node.Name] = time.Now()
+	case memberlist.NodeLeave:
+		delete(firstSeen, ne.Node.Name)
+		delete(lastChanged, ne.Node.Name)
+	}
+	trackTombstone(ne)
+}
+
+/* trackTombstone updates the list of tombstones with ne.  Tombstones are
+removed when they're older than tombstoneTTL or the node rejoins. */
+func trackTombstone(ne memberlist.NodeEvent) {
+	if 0 >= tombstoneTTL {
+		return
+	}
+	tombstonesL.Lock()
+	defer tombstonesL.Unlock()
+	switch ne.Event {
+	case memberlist.NodeJoin:
+		delete(tombstones, ne.Node.Name)
+	case memberlist.NodeLeave:
+		/* Copy the node, as memberlist may change it */
+		n := *ne.Node
+		ts := Tombstone{Node: &n, Left: time.Now()}
+		tombstones[n.Name] = ts
+		time.AfterFunc(tombstoneTTL, func() {
+			tombstonesL.Lock()
+			defer tombstonesL.Unlock()
+			/* Don't remove a newer tombstone */
+			t, ok := tombstones[n.Name]
+			if ok && t.Left.Equal(ts.Left) {
+				delete(tombstones, n.Name)
+			}
+		})
+	}
+}
+
+/* forgetNode removes what we've noted about the node with the given name,
+including any tombstone and what localThrottle knows about it.  It returns
+false if there was nothing to forget. */
+func forgetNode(name string) bool {
+	firstSeenL.Lock()
+	_, seen := firstSeen[name]
+	_, changed := lastChanged[name]
+	delete(firstSeen, name)
+	delete(lastChanged, name)
+	firstSeenL.Unlock()
+
+	tombstonesL.Lock()
+	_, dead := tombstones[name]
+	delete(tombstones, name)
+	tombstonesL.Unlock()
+
+	localThrottle.forget(name)
+
+	return seen || changed || dead
+}
+
+// Tombstones returns the nodes which have left the mesh within the last
+// -tombstone-ttl, most recent first.
+func Tombstones() []Tombstone {
+	tombstonesL.Lock()
+	defer tombstonesL.Unlock()
+	ts := make([]Tombstone, 0, len(tombstones))
+	for _, t := range tombstones {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Left.After(ts[j].Left)
+	})
+	return ts
+}
+
+// LastEvent returns the type of the most recent event we got from
+// memberlist, and when we got it.  The returned time is the zero time if we've
+// not had any events.
+func LastEvent() (memberlist.NodeEventType, time.Time) {
+	lastEventL.Lock()
+	defer lastEventL.Unlock()
+	return lastEvent, lastEventAt
+}
+
+// FirstSeen returns when we first saw the named node join the mesh.  The
+// returned bool is false if we've not seen the node join.
+func FirstSeen(name string) (time.Time, bool) {
+	firstSeenL.Lock()
+	defer firstSeenL.Unlock()
+	t, ok := firstSeen[name]
+	return t, ok
+}
+
+// LastChanged returns when the named node last joined the mesh or was
+// updated.  The returned bool is false if we've not seen the node join.
+func LastChanged(name string) (time.Time, bool) {
+	firstSeenL.Lock()
+	defer firstSeenL.Unlock()
+	t, ok := lastChanged[name]
+	return t, ok
+}
+
+/* announceConvergence waits until there's been no joins, updates, or leaves
+for convergeQuiet, and then tells clients the mesh has converged.  It only
+does so once; later quiet periods aren't announced. */
+func announceConvergence(m *memberlist.Memberlist) {
+	start := time.Now()
+	for {
+		/* Work out when things last changed */
+		_, at := LastEvent()
+		if at.Before(start) {
+			at = start
+		}
+
+		/* If it's been long enough, we're converged */
+		if wait := convergeQuiet - time.Since(at); 0 < wait {
+			time.Sleep(wait)
+			continue
+		}
+		broadcastAndLogf(
+			eventNotice,
+			nil,
+			"[Converged] Mesh converged: %d members",
+			liveMesh(m).NumMembers(),
+		)
+		return
+	}
+}
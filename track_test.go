@@ -0,0 +1,263 @@
+package main
+
+/*
+ * track_test.go
+ * Tests for track.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestAges makes sure we remember when we first saw nodes, and that AGES
+tells clients. */
+func TestAges(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	t.Cleanup(func() { forgetNode("b") })
+	b := ms[1].LocalNode()
+
+	/* First join counts, later ones don't */
+	trackEvent(memberlist.NodeEvent{Event: memberlist.NodeJoin, Node: b})
+	first, ok := FirstSeen("b")
+	if !ok {
+		t.Fatalf("Join not noted")
+	}
+	time.Sleep(10 * time.Millisecond)
+	trackEvent(memberlist.NodeEvent{Event: memberlist.NodeJoin, Node: b})
+	if again, _ := FirstSeen("b"); !again.Equal(first) {
+		t.Fatalf("Second join changed first seen to %s", again)
+	}
+
+	tc := newTestClient(t, ms[0], false)
+	tc.send("AGES")
+	if l := tc.readLine(); "a unknown unknown" != l {
+		t.Fatalf("Got %q for a", l)
+	}
+	fs := strings.Fields(tc.readLine())
+	if 3 != len(fs) ||
+		"b" != fs[0] ||
+		first.Format(time.RFC3339) != fs[1] ||
+		"0s" != fs[2] {
+		t.Fatalf("Got %q for b", fs)
+	}
+
+	/* Leaving is forgetting */
+	trackEvent(memberlist.NodeEvent{Event: memberlist.NodeLeave, Node: b})
+	if _, ok := FirstSeen("b"); ok {
+		t.Fatalf("First seen still known after leaving")
+	}
+}
+
+/* TestTombstones makes sure departed nodes show up in snapshots until
+-tombstone-ttl passes. */
+func TestTombstones(t *testing.T) {
+	tombstoneTTL = 500 * time.Millisecond
+	t.Cleanup(func() {
+		tombstoneTTL = 0
+		forgetNode("b")
+	})
+	ms := newTestMesh(t, nil, "a", "b")
+	b := *ms[1].LocalNode()
+	ms[1].Leave(time.Second)
+	ms[1].Shutdown()
+	waitFor(t, "b to leave", func() bool { return 1 == ms[0].NumMembers() })
+	trackEvent(memberlist.NodeEvent{Event: memberlist.NodeLeave, Node: &b})
+
+	/* Fresh snapshot, fresh tombstone */
+	snapshot := func() []string {
+		tc := connectTestClient(t, ms[0], clientOpts{snapshot: true})
+		defer tc.c.Close()
+		return tc.readUntil("Recently departed nodes:")
+	}
+	tc := connectTestClient(t, ms[0], clientOpts{snapshot: true})
+	ls := tc.readUntil("Recently departed nodes: 1")
+	if l := tc.readLine(); !strings.HasPrefix(l, "b (") ||
+		!strings.HasSuffix(l, " (left 0s ago)") {
+		t.Fatalf("Got tombstone %q", l)
+	}
+	if 4 != len(ls) {
+		t.Fatalf("Unexpected snapshot %q", ls)
+	}
+	tc.c.Close()
+
+	/* And after a bit, nothing */
+	waitFor(t, "tombstone to expire", func() bool {
+		return 0 == len(Tombstones())
+	})
+	ls = snapshot()
+	if l := ls[len(ls)-1]; "Recently departed nodes: 0" != l {
+		t.Fatalf("Got %q after the TTL", l)
+	}
+}
+
+/* TestLastEvent makes sure tracking an event updates the last event and that
+LASTEVENT tells clients. */
+func TestLastEvent(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b")
+	t.Cleanup(func() { forgetNode("b") })
+	b := ms[1].LocalNode()
+	tc := newTestClient(t, ms[0], false)
+
+	for _, c := range []struct {
+		et   memberlist.NodeEventType
+		name string
+	}{
+		{memberlist.NodeUpdate, "UPDATE"},
+		{memberlist.NodeLeave, "LEAVE"},
+		{memberlist.NodeJoin, "JOIN"},
+	} {
+		before := time.Now()
+		trackEvent(memberlist.NodeEvent{Event: c.et, Node: b})
+		et, at := LastEvent()
+		if c.et != et || at.Before(before) {
+			t.Fatalf(
+				"Last event %d at %s, expected %d",
+				et,
+				at,
+				c.et,
+			)
+		}
+		tc.send("LASTEVENT")
+		want := "last_event=" + c.name + " at " +
+			at.UTC().Format(time.RFC3339) + " (0s ago)"
+		if l := tc.readLine(); want != l {
+			t.Fatalf("Got %q, expected %q", l, want)
+		}
+	}
+}
+
+/* TestSinceCommand makes sure SINCE only sends nodes which changed after the
+given time, and complains about unusable times. */
+func TestSinceCommand(t *testing.T) {
+	ms := newTestMesh(t, nil, "a", "b", "c")
+	for _, m := range ms {
+		name := m.LocalNode().Name
+		t.Cleanup(func() { forgetNode(name) })
+		trackEvent(memberlist.NodeEvent{
+			Event: memberlist.NodeJoin,
+			Node:  m.LocalNode(),
+		})
+	}
+	/* a and b joined a while ago, c's new */
+	firstSeenL.Lock()
+	for _, name := range []string{"a", "b"} {
+		lastChanged[name] = time.Now().Add(-time.Hour)
+	}
+	firstSeenL.Unlock()
+	changed, _ := LastChanged("c")
+
+	tc := newTestClient(t, ms[0], false)
+	since := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	tc.send("SINCE %s", since)
+	want := FormatNode(ms[2].LocalNode()) + " " +
+		changed.UTC().Format(time.RFC3339)
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for _, c := range [][2]string{
+		{"SINCE moose", `Error: invalid RFC3339 time "moose"`},
+		{"SINCE " + future, "Error: " + future + " is in the future"},
+	} {
+		tc.send("%s", c[0])
+		if l := tc.readLine(); c[1] != l {
+			t.Errorf("%s: got %q, expected %q", c[0], l, c[1])
+		}
+	}
+}
+
+/* TestConvergence makes sure CONVERGENCE and the converged notice reflect how
+long it's been since a burst of joins. */
+func TestConvergence(t *testing.T) {
+	convergeQuiet = 200 * time.Millisecond
+	t.Cleanup(func() { convergeQuiet = defaultConvergeQuiet })
+	ms := newTestMesh(t, nil, "a", "b", "c")
+	tc := newTestClient(t, ms[0], false)
+
+	/* A burst of joins, spread over a couple of seconds */
+	start := time.Now()
+	for i, m := range ms {
+		name := m.LocalNode().Name
+		t.Cleanup(func() { forgetNode(name) })
+		trackEvent(memberlist.NodeEvent{
+			Event: memberlist.NodeJoin,
+			Node:  m.LocalNode(),
+		})
+		firstSeenL.Lock()
+		firstSeen[name] = start.Add(time.Duration(i) * time.Second)
+		firstSeenL.Unlock()
+	}
+	_, burst := LastEvent()
+	go announceConvergence(ms[0])
+	tc.send("CONVERGENCE")
+	want := "last_change=0s converged=false formation=2s members=3"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q during the burst, expected %q", l, want)
+	}
+
+	/* Then quiet */
+	want = "[Converged] Mesh converged: 3 members"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+	if d := time.Since(burst); d < convergeQuiet {
+		t.Fatalf("Converged after only %s", d)
+	}
+	tc.send("CONVERGENCE")
+	want = "last_change=0s converged=true formation=2s members=3"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q after the burst, expected %q", l, want)
+	}
+}
+
+/* TestAnnounceConvergence makes sure the mesh is only announced as converged
+after it's been quiet for -converge-quiet, and only once. */
+func TestAnnounceConvergence(t *testing.T) {
+	convergeQuiet = 100 * time.Millisecond
+	t.Cleanup(func() {
+		convergeQuiet = defaultConvergeQuiet
+		forgetNode("b")
+	})
+	ms := newTestMesh(t, nil, "a", "b")
+	sb := captureLog(t)
+	tc := newTestClient(t, ms[0], false)
+	b := ms[1].LocalNode()
+
+	/* Keep things busy for a while */
+	go announceConvergence(ms[0])
+	var last time.Time
+	for start := time.Now(); time.Since(start) < 3*convergeQuiet; {
+		trackEvent(memberlist.NodeEvent{
+			Event: memberlist.NodeUpdate,
+			Node:  b,
+		})
+		_, last = LastEvent()
+		time.Sleep(convergeQuiet / 4)
+	}
+	want := "[Converged] Mesh converged: 2 members"
+	if l := tc.readLine(); want != l {
+		t.Fatalf("Got %q, expected %q", l, want)
+	}
+	if d := time.Since(last); d < convergeQuiet {
+		t.Fatalf("Converged %s after the last event", d)
+	}
+	if !strings.Contains(sb.String(), want) {
+		t.Fatalf("Convergence not logged: %q", sb.String())
+	}
+
+	/* Another quiet period isn't announced */
+	trackEvent(memberlist.NodeEvent{Event: memberlist.NodeUpdate, Node: b})
+	time.Sleep(3 * convergeQuiet)
+	Broadcastf("marker")
+	if l := tc.readLine(); "marker" != l {
+		t.Fatalf("Got %q after converging", l)
+	}
+}
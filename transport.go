@@ -0,0 +1,242 @@
+package main
+
+/*
+ * transport.go
+ * Memberlist transport which allows port reuse
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sockaddr "github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	/* udpPacketBufSize is the size of the buffer into which we read
+	packets, which is the same as memberlist's NetTransport */
+	udpPacketBufSize = 65536
+
+	/* maxAcceptDelay is the longest we'll wait after failing to accept a
+	stream */
+	maxAcceptDelay = time.Second
+)
+
+// ReuseportTransport is a memberlist.Transport similar to memberlist's
+// NetTransport, but which sets SO_REUSEPORT on its sockets.  This allows a
+// new instance to start listening before an old one has stopped.
+type ReuseportTransport struct {
+	tcpL     *net.TCPListener
+	udpL     *net.UDPConn
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+	logger   *log.Logger
+	shutdown atomic.Bool
+	wg       sync.WaitGroup
+}
+
+var _ memberlist.NodeAwareTransport = (*ReuseportTransport)(nil)
+
+// NewReuseportTransport listens on the given address and port with
+// SO_REUSEPORT set.  If port is 0, a random port is chosen.
+func NewReuseportTransport(
+	addr string,
+	port int,
+	logger *log.Logger,
+) (*ReuseportTransport, error) {
+	t := &ReuseportTransport{
+		packetCh: make(chan *memberlist.Packet),
+		streamCh: make(chan net.Conn),
+		logger:   logger,
+	}
+	lc := net.ListenConfig{Control: setReuseport}
+
+	/* Listen for streams */
+	l, err := lc.Listen(
+		context.Background(),
+		"tcp",
+		net.JoinHostPort(addr, strconv.Itoa(port)),
+	)
+	if nil != err {
+		return nil, fmt.Errorf(
+			"listening on TCP port %d: %w",
+			port,
+			err,
+		)
+	}
+	t.tcpL = l.(*net.TCPListener)
+	port = t.tcpL.Addr().(*net.TCPAddr).Port
+
+	/* Listen for packets */
+	pc, err := lc.ListenPacket(
+		context.Background(),
+		"udp",
+		net.JoinHostPort(addr, strconv.Itoa(port)),
+	)
+	if nil != err {
+		t.tcpL.Close()
+		return nil, fmt.Errorf(
+			"listening on UDP port %d: %w",
+			port,
+			err,
+		)
+	}
+	t.udpL = pc.(*net.UDPConn)
+
+	t.wg.Add(2)
+	go t.acceptStreams()
+	go t.readPackets()
+
+	return t, nil
+}
+
+// FinalAdvertiseAddr returns the address and port to advertise.  If ip is
+// empty, our private IP address is used if we're listening on all interfaces
+// or our listen address otherwise.
+func (t *ReuseportTransport) FinalAdvertiseAddr(
+	ip string,
+	port int,
+) (net.IP, int, error) {
+	/* Easy case: we've been told an address */
+	if "" != ip {
+		a := net.ParseIP(ip)
+		if nil == a {
+			return nil, 0, fmt.Errorf("invalid address %q", ip)
+		}
+		return normalizeIP(a), port, nil
+	}
+
+	/* Work out an address ourselves */
+	la := t.tcpL.Addr().(*net.TCPAddr)
+	if !la.IP.IsUnspecified() {
+		return normalizeIP(la.IP), la.Port, nil
+	}
+	pip, err := sockaddr.GetPrivateIP()
+	if nil != err {
+		return nil, 0, fmt.Errorf("getting private IP address: %w", err)
+	}
+	a := net.ParseIP(pip)
+	if nil == a {
+		return nil, 0, fmt.Errorf("no private IP address found")
+	}
+	return normalizeIP(a), la.Port, nil
+}
+
+// WriteTo sends the packet b to addr.
+func (t *ReuseportTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.WriteToAddress(b, memberlist.Address{Addr: addr})
+}
+
+// WriteToAddress sends the packet b to a.
+func (t *ReuseportTransport) WriteToAddress(
+	b []byte,
+	a memberlist.Address,
+) (time.Time, error) {
+	ua, err := net.ResolveUDPAddr("udp", a.Addr)
+	if nil != err {
+		return time.Time{}, err
+	}
+	_, err = t.udpL.WriteTo(b, ua)
+	return time.Now(), err
+}
+
+// PacketCh returns a channel on which received packets are sent.
+func (t *ReuseportTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// DialTimeout makes a stream connection to addr.
+func (t *ReuseportTransport) DialTimeout(
+	addr string,
+	timeout time.Duration,
+) (net.Conn, error) {
+	return t.DialAddressTimeout(memberlist.Address{Addr: addr}, timeout)
+}
+
+// DialAddressTimeout makes a stream connection to a.
+func (t *ReuseportTransport) DialAddressTimeout(
+	a memberlist.Address,
+	timeout time.Duration,
+) (net.Conn, error) {
+	return net.DialTimeout("tcp", a.Addr, timeout)
+}
+
+// StreamCh returns a channel on which accepted streams are sent.
+func (t *ReuseportTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown stops listening.
+func (t *ReuseportTransport) Shutdown() error {
+	t.shutdown.Store(true)
+	t.tcpL.Close()
+	t.udpL.Close()
+	t.wg.Wait()
+	return nil
+}
+
+/* acceptStreams accepts streams and sends them to t.streamCh */
+func (t *ReuseportTransport) acceptStreams() {
+	defer t.wg.Done()
+	var delay time.Duration
+	for {
+		c, err := t.tcpL.AcceptTCP()
+		if nil != err {
+			if t.shutdown.Load() {
+				return
+			}
+			/* Back off a bit before trying again */
+			if 0 == delay {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; maxAcceptDelay < delay {
+				delay = maxAcceptDelay
+			}
+			t.logger.Printf(
+				"[ERR] meshmembers: Error accepting stream: %v",
+				err,
+			)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		t.streamCh <- c
+	}
+}
+
+/* readPackets reads packets and sends them to t.packetCh */
+func (t *ReuseportTransport) readPackets() {
+	defer t.wg.Done()
+	for {
+		buf := make([]byte, udpPacketBufSize)
+		n, addr, err := t.udpL.ReadFrom(buf)
+		ts := time.Now()
+		if nil != err {
+			if t.shutdown.Load() {
+				return
+			}
+			t.logger.Printf(
+				"[ERR] meshmembers: Error reading packet: %v",
+				err,
+			)
+			continue
+		}
+		if 0 == n {
+			continue
+		}
+		t.packetCh <- &memberlist.Packet{
+			Buf:       buf[:n],
+			From:      addr,
+			Timestamp: ts,
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+/*
+ * udpbuffer.go
+ * Warn when the UDP buffer is too small for the mesh
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bytes"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	/* defaultUDPBufferSize is the default size of UDP packets we'll
+	send.  This allows for a much smaller MTU than memberlist's
+	default. */
+	defaultUDPBufferSize = 1024
+
+	/* minUDPBufferSize is the smallest UDP buffer we'll allow, which
+	is enough for a node with a short name and no metadata */
+	minUDPBufferSize = 256
+
+	/* aliveOverhead is roughly how many bytes a node's state takes to
+	gossip, on top of its name and metadata */
+	aliveOverhead = 96
+
+	/* udpWarnInterval is the least time between warnings that memberlist
+	has reported truncated packets */
+	udpWarnInterval = time.Minute
+)
+
+var (
+	/* udpBufferSize is the size of UDP packets we'll send */
+	udpBufferSize = defaultUDPBufferSize
+
+	/* udpLabelOverhead is the number of bytes the mesh's label adds to
+	every packet */
+	udpLabelOverhead int
+
+	/* udpBiggestNode is the size of the biggest node state we've warned
+	about not fitting in udpBufferSize, so we only warn when it grows */
+	udpBiggestNode atomic.Int64
+
+	/* udpLastTruncWarn is when we last warned about truncated packets,
+	in Unix seconds */
+	udpLastTruncWarn atomic.Int64
+)
+
+// CheckUDPBuffer warns if our own node's state, with the given name and
+// metadata, is too big to gossip in a single udpBufferSize packet in a mesh
+// with the given label.  Other nodes' states are checked as they join and
+// are updated.
+func CheckUDPBuffer(name string, meta []byte, label string) {
+	if "" != label {
+		udpLabelOverhead = 2 + len(label)
+	}
+	checkStateSize(name, meta)
+}
+
+/* checkNodeSize warns if n's state is too big to gossip in a single
+udpBufferSize packet. */
+func checkNodeSize(n *memberlist.Node) {
+	checkStateSize(n.Name, n.Meta)
+}
+
+/* checkStateSize warns if a node's state, with the given name and metadata,
+is likely too big to gossip in a single udpBufferSize packet and is bigger
+than any we've warned about before. */
+func checkStateSize(name string, meta []byte) {
+	sz := int64(len(name) + len(meta) + aliveOverhead + udpLabelOverhead)
+	if sz <= int64(udpBufferSize) {
+		return
+	}
+	for {
+		if prev := udpBiggestNode.Load(); sz <= prev {
+			return
+		} else if udpBiggestNode.CompareAndSwap(prev, sz) {
+			break
+		}
+	}
+	log.Printf(
+		"State for %s is about %d bytes, more than the %d byte "+
+			"UDP buffer; gossip about it will be slow or fail, "+
+			"consider a larger -udp-buffer",
+		name,
+		sz,
+		udpBufferSize,
+	)
+}
+
+/* memberlistLog receives memberlist's logs.  It watches for signs the UDP
+buffer is too small and, if debug is set, passes the logs on to our own
+log. */
+type memberlistLog struct {
+	debug bool
+}
+
+/* Write notes if b reports truncated packets and writes it to our log if
+ml.debug is set. */
+func (ml memberlistLog) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("truncated")) {
+		warnTruncation()
+	}
+	if !ml.debug {
+		return len(b), nil
+	}
+	return log.Writer().Write(b)
+}
+
+/* warnTruncation warns that memberlist has reported truncated packets, at
+most every udpWarnInterval. */
+func warnTruncation() {
+	now := time.Now().Unix()
+	last := udpLastTruncWarn.Load()
+	if now-last < int64(udpWarnInterval/time.Second) ||
+		!udpLastTruncWarn.CompareAndSwap(last, now) {
+		return
+	}
+	log.Printf(
+		"Memberlist reported truncated packets with a %d byte UDP "+
+			"buffer, consider a larger -udp-buffer",
+		udpBufferSize,
+	)
+}
@@ -0,0 +1,93 @@
+package main
+
+/*
+ * udpbuffer_test.go
+ * Tests for udpbuffer.go
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/* TestCheckUDPBuffer makes sure we warn about nodes too big for the UDP
+buffer, but only when there's a new biggest one. */
+func TestCheckUDPBuffer(t *testing.T) {
+	udpBufferSize = minUDPBufferSize
+	t.Cleanup(func() {
+		udpBufferSize = defaultUDPBufferSize
+		udpLabelOverhead = 0
+		udpBiggestNode.Store(0)
+		forgetNode("big")
+	})
+	sb := captureLog(t)
+	warnings := func() int {
+		return strings.Count(
+			sb.String(),
+			"consider a larger -udp-buffer",
+		)
+	}
+
+	/* Small enough */
+	CheckUDPBuffer("small", []byte(`{"id":"x"}`), "")
+	if 0 != warnings() {
+		t.Fatalf("Warned about a small node: %s", sb)
+	}
+
+	/* Too big, but only once */
+	big := bytes.Repeat([]byte("x"), minUDPBufferSize)
+	CheckUDPBuffer("us", big, "")
+	if 1 != warnings() {
+		t.Fatalf("Didn't warn about our own big node: %s", sb)
+	}
+	CheckUDPBuffer("us", big, "")
+	if 1 != warnings() {
+		t.Fatalf("Warned twice about the same size: %s", sb)
+	}
+
+	/* A bigger node joining is worth another warning */
+	handleEvent("us", memberlist.NodeEvent{
+		Event: memberlist.NodeJoin,
+		Node:  &memberlist.Node{Name: "big", Meta: append(big, 'x')},
+	}, 0)
+	waitFor(t, "warning about joined node", func() bool {
+		return 2 == warnings()
+	})
+	if !strings.Contains(sb.String(), "State for big is about") {
+		t.Fatalf("Warning doesn't name the big node: %s", sb)
+	}
+}
+
+/* TestMemberlistLogTruncation makes sure we warn when memberlist reports
+truncated packets, and only pass memberlist's logs on when debugging. */
+func TestMemberlistLogTruncation(t *testing.T) {
+	t.Cleanup(func() { udpLastTruncWarn.Store(0) })
+	sb := captureLog(t)
+
+	ml := memberlistLog{}
+	ml.Write([]byte("[DEBUG] memberlist: moose\n"))
+	if "" != sb.String() {
+		t.Fatalf("Non-debug log passed on: %s", sb)
+	}
+	for range 2 {
+		ml.Write([]byte("[WARN] memberlist: packet truncated\n"))
+	}
+	if n := strings.Count(
+		sb.String(),
+		"reported truncated packets",
+	); 1 != n {
+		t.Fatalf("Warned %d times about truncation: %s", n, sb)
+	}
+
+	ml.debug = true
+	ml.Write([]byte("[DEBUG] memberlist: moose\n"))
+	if !strings.Contains(sb.String(), "moose") {
+		t.Fatalf("Debug log not passed on: %s", sb)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+/*
+ * writepool.go
+ * Write to clients with a fixed number of goroutines
+ * By J. Stuart McMurray
+ * Created 20261014
+ * Last Modified 20261014
+ */
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* clientWritePool writes events and command output to clients with a fixed
+number of goroutines, for -write-concurrency.  A client is only written to by
+one goroutine at a time, so its events stay in order. */
+type clientWritePool struct {
+	ready   []*pooledWriter /* Clients with something to write */
+	stopped bool
+	l       sync.Mutex
+	c       *sync.Cond /* Signalled when ready or stopped change */
+}
+
+/* pooledWriter is a client's state in a clientWritePool */
+type pooledWriter struct {
+	lc      *localClient
+	pool    *clientWritePool
+	q       <-chan *clientEvent
+	replies <-chan clientReply
+	done    chan<- struct{} /* Closed once q is closed and drained */
+
+	/* scheduled is set while the client is in pool's list of ready
+	clients, or is about to be, or is being written to. */
+	scheduled atomic.Bool
+
+	/* closing is set once q's been closed */
+	closing atomic.Bool
+
+	/* The rest are only used by whichever goroutine's writing */
+	buf      []byte
+	seq      uint64
+	finished bool
+}
+
+// LimitWriteConcurrency starts n goroutines which write events and command
+// output to clients, instead of each client getting a goroutine of its own.
+// Each client's events are still written in order.  It must be called before
+// any clients connect.  The returned function stops the goroutines once
+// they've finished their current writes; clients which connect afterwards get
+// their own goroutines again.
+func LimitWriteConcurrency(n int) (stop func()) {
+	p := new(clientWritePool)
+	p.c = sync.NewCond(&p.l)
+	for range n {
+		go p.work()
+	}
+	clientsL.Lock()
+	defer clientsL.Unlock()
+	writePool = p
+	return func() {
+		clientsL.Lock()
+		writePool = nil
+		clientsL.Unlock()
+		p.l.Lock()
+		p.stopped = true
+		p.l.Unlock()
+		p.c.Broadcast()
+	}
+}
+
+/* work writes to clients made ready with add until p is stopped. */
+func (p *clientWritePool) work() {
+	for {
+		p.l.Lock()
+		for 0 == len(p.ready) && !p.stopped {
+			p.c.Wait()
+		}
+		if p.stopped {
+			p.l.Unlock()
+			return
+		}
+		pw := p.ready[0]
+		p.ready = p.ready[1:]
+		p.l.Unlock()
+
+		pw.write()
+
+		/* Anything sent, or closing, while we were writing needs
+		another go.  Once scheduled is unset, another goroutine may
+		be writing to pw. */
+		finished := pw.finished
+		pw.scheduled.Store(false)
+		if 0 != len(pw.q) ||
+			0 != len(pw.replies) ||
+			(pw.closing.Load() && !finished) {
+			pw.wake(0)
+		}
+	}
+}
+
+/* add adds pw to the list of clients with something to write. */
+func (p *clientWritePool) add(pw *pooledWriter) {
+	p.l.Lock()
+	p.ready = append(p.ready, pw)
+	p.l.Unlock()
+	p.c.Signal()
+}
+
+/* wake adds pw to its pool's list of clients with something to write after
+delay, unless it's already there. */
+func (pw *pooledWriter) wake(delay time.Duration) {
+	if !pw.scheduled.CompareAndSwap(false, true) {
+		return
+	}
+	if 0 == delay {
+		pw.pool.add(pw)
+		return
+	}
+	time.AfterFunc(delay, func() { pw.pool.add(pw) })
+}
+
+/* write writes pw's waiting command output, if it has any, and as many of its
+waiting events as fit in maxCoalesced.  Once pw.q's closed and drained,
+pw.done is closed. */
+func (pw *pooledWriter) write() {
+	select {
+	case r := <-pw.replies:
+		r.sent <- sendReply(pw.lc, r.b)
+	default:
+	}
+
+	var (
+		n      int /* Bytes to give back to the memory budget */
+		closed bool
+	)
+	pw.buf = pw.buf[:0]
+collect:
+	for len(pw.buf) < maxCoalesced {
+		select {
+		case ev, ok := <-pw.q:
+			if !ok {
+				closed = true
+				break collect
+			}
+			pw.seq++
+			pw.buf = formatEvent(pw.lc, pw.buf, ev, pw.seq)
+			n += len(ev.msg)
+		default:
+			break collect
+		}
+	}
+	if 0 != len(pw.buf) {
+		sendEvent(pw.lc, pw.buf)
+		releaseClientMem(pw.lc, n)
+	}
+	if closed && !pw.finished {
+		pw.finished = true
+		close(pw.done)
+	}
+}